@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/pierrchen/avs/images"
 	"github.com/urfave/cli"
@@ -23,24 +27,43 @@ func main() {
 		{
 			Name:    "bootimg",
 			Aliases: []string{"b"},
-			Usage:   "parse and extract android bootimg",
+			Usage:   "parse, extract and repack android bootimg and vendor_boot",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "image", Value: "", Usage: "boot image file"},
 				cli.BoolFlag{Name: "extract", Usage: "extract bootimage"},
+				cli.BoolFlag{Name: "repack", Usage: "build a boot image, the defaults are from --image if any"},
+				cli.StringFlag{Name: "out", Value: "boot-repacked.img", Usage: "the repacked boot image"},
+				cli.StringFlag{Name: "kernel", Value: "", Usage: "kernel to repack"},
+				cli.StringFlag{Name: "ramdisk", Value: "", Usage: "ramdisk to repack"},
+				cli.StringFlag{Name: "second", Value: "", Usage: "second stage bootloader to repack"},
+				cli.StringFlag{Name: "cmdline", Value: "", Usage: "kernel command line"},
+				cli.StringFlag{Name: "board", Value: "", Usage: "board (product) name"},
+				cli.StringFlag{Name: "base", Value: "", Usage: "base address"},
+				cli.StringFlag{Name: "kernel_offset", Value: "", Usage: "kernel offset from base"},
+				cli.StringFlag{Name: "ramdisk_offset", Value: "", Usage: "ramdisk offset from base"},
+				cli.StringFlag{Name: "second_offset", Value: "", Usage: "second offset from base"},
+				cli.StringFlag{Name: "tags_offset", Value: "", Usage: "tags offset from base"},
+				cli.StringFlag{Name: "pagesize", Value: "", Usage: "page size"},
+				cli.StringFlag{Name: "os_version", Value: "", Usage: "os version, e.g 9.0.0"},
+				cli.StringFlag{Name: "os_patch_level", Value: "", Usage: "os patch level, e.g 2018-06"},
+				cli.StringFlag{Name: "header_version", Value: "", Usage: "boot image header version, 0 to 4"},
+				cli.StringFlag{Name: "recovery_dtbo", Value: "", Usage: "recovery dtbo to repack, v1 and v2"},
+				cli.StringFlag{Name: "dtb", Value: "", Usage: "dtb to repack, v2 and vendor_boot"},
+				cli.StringFlag{Name: "dtb_offset", Value: "", Usage: "dtb offset from base"},
+				cli.BoolFlag{Name: "vendor_boot", Usage: "repack a vendor_boot image, implied if --image is one"},
+				cli.StringSliceFlag{Name: "vendor_ramdisk", Usage: "vendor ramdisk to repack, [name=]file, the name is for the v4 fragments"},
+				cli.StringFlag{Name: "vendor_bootconfig", Value: "", Usage: "bootconfig to repack, v4 vendor_boot"},
 			},
 			Action: func(c *cli.Context) error {
-				b := images.Bootimg{ImagePath: c.String("image")}
-
-				// dump the header
-				v, err := b.Hdr()
-				if err != nil {
-					log.Fatalln(err)
+				if c.Bool("repack") {
+					if err := repackBootimg(c); err != nil {
+						log.Fatalln(err)
+					}
+					return nil
 				}
 
-				fmt.Println(v)
-
-				if c.Bool("extract") {
-					b.Unpack()
+				if err := dumpBootimg(c.String("image"), c.Bool("extract")); err != nil {
+					log.Fatalln(err)
 				}
 				return nil
 			},
@@ -49,19 +72,47 @@ func main() {
 		{
 			Name:    "ramdisk",
 			Aliases: []string{"r"},
-			Usage:   "extract the ramdisk",
+			Usage:   "extract or pack the ramdisk",
 			Flags: []cli.Flag{
-				cli.StringFlag{Name: "image", Value: "", Usage: "ramdisk.img image for unpack"},
+				cli.StringFlag{Name: "image", Value: "", Usage: "ramdisk.img image for unpack, or the one to create for pack"},
 				cli.StringFlag{Name: "extract", Value: "avs_ramdisk", Usage: "extracted out dir"},
+				cli.StringFlag{Name: "pack", Value: "", Usage: "dir to pack into --image"},
+				cli.StringFlag{Name: "compress", Value: images.RamdiskGzip, Usage: "compression for pack: gzip, lz4 or none"},
 			},
 			Action: func(c *cli.Context) error {
 				r := images.Ramdisk{ImagePath: c.String("image")}
+				if c.String("pack") != "" {
+					if err := r.Pack(c.String("pack"), c.String("compress")); err != nil {
+						log.Fatalln(err)
+					}
+					fmt.Printf("%s is packed to %s\n", c.String("pack"), r.ImagePath)
+					return nil
+				}
 				err := r.Unpack(c.String("extract"))
 				if err != nil {
 					log.Fatalln(err)
 				}
 				return nil
 			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "edit",
+					Usage: "edit the files in the ramdisk, or the ramdisk in the boot image, without extracting it",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "image", Value: "", Usage: "ramdisk.img or boot.img to edit"},
+						cli.StringFlag{Name: "out", Value: "", Usage: "write the result to the file, default is to edit the image in place"},
+						cli.StringSliceFlag{Name: "add", Usage: "src:dst, add or replace the file dst in the ramdisk with the local file src"},
+						cli.StringSliceFlag{Name: "remove", Usage: "path, remove the file or the dir in the ramdisk"},
+						cli.StringSliceFlag{Name: "chmod", Usage: "mode:path, change the mode of the file in the ramdisk, e.g 0750:init.rc"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := editRamdisk(c); err != nil {
+							log.Fatalln(err)
+						}
+						return nil
+					},
+				},
+			},
 		},
 
 		{
@@ -71,44 +122,41 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "image", Value: "", Usage: "kernel image file"},
 				cli.BoolFlag{Name: "configs", Usage: "enable kernel config dump"},
+				cli.StringFlag{Name: "split", Value: "", Usage: "prefix of the kernel and the appended dtbs split, default to the image"},
+				cli.BoolFlag{Name: "check", Usage: "check the kernel configs against the requirements"},
+				cli.StringFlag{Name: "android", Value: "", Usage: "Android version for --check, e.g O or 8.1"},
+				cli.StringSliceFlag{Name: "hal", Usage: "HAL name for --check, or usb_gadget, to check the configs it needs"},
+				cli.StringSliceFlag{Name: "fragment", Usage: "config fragment for --check, e.g android-base.config of kernel/configs"},
 			},
 			Action: func(c *cli.Context) error {
+				if c.Bool("check") {
+					if err := checkKernelConfigs(c); err != nil {
+						log.Fatalln(err)
+					}
+					return nil
+				}
+
 				r := images.Kernel{ImagePath: c.String("image")}
 				v, err := r.Version()
 				if err != nil {
-					log.Fatalln(err)
-				}
-
-				fmt.Println(v)
-				// check if it is arm64 image
-				arm64 := images.Arm64Image{ImagePath: c.String("image")}
-				hdr, err := arm64.Hdr()
-
-				if err == nil {
-					fmt.Println("Arm 64 Linux Kernel Image, info")
-					fmt.Println(hdr)
+					fmt.Println(err)
+				} else {
+					fmt.Println(v)
+					fmt.Printf("Release %s, Compiler %s, Built by %s@%s, SMP %v, PREEMPT %v\n",
+						v.Release, v.Compiler, v.BuildUser, v.BuildHost, v.SMP, v.Preempt)
 				}
 
-				// check if it has something appended
-				if arm64.IsSomethingAppended() {
-					fmt.Println("something is appended after the kernel")
-					ks, _ := arm64.ActualKernelSize()
-					fmt.Println("Actualy Kernel Size", ks)
-
-					arm64.Split()
-
-				} else {
-					fmt.Println("Pure and simple kernel image")
+				if err := dumpKernelImage(c.String("image"), c.String("split")); err != nil {
+					log.Fatalln(err)
 				}
 
 				// dump kernel build configs
 				if c.Bool("configs") {
 					configs, err := r.Configs()
 					if err != nil {
-						fmt.Println(configs)
-					} else {
-						fmt.Println(configs)
+						log.Fatalln(err)
 					}
+					fmt.Println(configs)
 				}
 				return nil
 			},
@@ -121,7 +169,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "image", Value: "", Usage: "dtb image file"},
 				cli.BoolFlag{Name: "hdr", Usage: "dump hdr info"},
-				cli.BoolFlag{Name: "dump", Usage: "dump dtb"},
+				cli.BoolFlag{Name: "dump", Usage: "print the dtb as dts"},
 			},
 			Action: func(c *cli.Context) error {
 				dtb := images.Dtb{ImagePath: c.String("image")}
@@ -139,12 +187,758 @@ func main() {
 				}
 
 				if c.Bool("dump") {
-					dtb.ToDts()
+					dts, err := dtb.ToDts()
+					if err != nil {
+						log.Fatalln(err)
+					}
+					fmt.Print(dts)
 				}
 				return nil
 			},
 		},
+
+		{
+			Name:  "dtbo",
+			Usage: "list, extract and pack dtbo.img, and apply the overlay to the dtb",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list the entries in the dtbo.img",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "image", Value: "", Usage: "dtbo.img"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := listDtbo(c.String("image")); err != nil {
+							log.Fatalln(err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "extract",
+					Usage: "extract the overlays in the dtbo.img to prefix.N",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "image", Value: "", Usage: "dtbo.img"},
+						cli.StringFlag{Name: "out", Value: "avs_dtbo", Usage: "prefix of the extracted files"},
+					},
+					Action: func(c *cli.Context) error {
+						d := images.Dtbo{ImagePath: c.String("image")}
+						if err := d.Extract(c.String("out")); err != nil {
+							log.Fatalln(err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "pack",
+					Usage: "pack the overlays into the dtbo.img",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "image", Value: "dtbo.img", Usage: "dtbo.img to create"},
+						cli.StringFlag{Name: "pagesize", Value: "2048", Usage: "page size"},
+						cli.StringSliceFlag{Name: "dt", Usage: "file[:id=N,rev=N,custom0=N..custom3=N], the overlay and the fields of the entry"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := packDtbo(c); err != nil {
+							log.Fatalln(err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "apply",
+					Usage: "apply the overlay to the dtb, and print the merged device tree",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "base", Value: "", Usage: "base dtb, compiled with dtc -@"},
+						cli.StringFlag{Name: "overlay", Value: "", Usage: "overlay dtb, or dtbo.img"},
+						cli.StringFlag{Name: "entry", Value: "0", Usage: "the entry to apply if --overlay is a dtbo.img"},
+						cli.StringFlag{Name: "out", Value: "", Usage: "write the merged dtb to the file"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := applyOverlay(c); err != nil {
+							log.Fatalln(err)
+						}
+						return nil
+					},
+				},
+			},
+		},
+
+		{
+			Name:  "sparse",
+			Usage: "inspect, unsparse, sparse and resparse the android sparse image",
+			Subcommands: []cli.Command{
+				{
+					Name:  "info",
+					Usage: "print the header and the chunks of the sparse image",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "image", Value: "", Usage: "sparse image"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := sparseInfo(c.String("image")); err != nil {
+							log.Fatalln(err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "unsparse",
+					Usage: "convert the sparse image to the raw image, the same as simg2img",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "image", Value: "", Usage: "sparse image"},
+						cli.StringFlag{Name: "out", Value: "", Usage: "raw image to create"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := unsparseImage(c.String("image"), c.String("out")); err != nil {
+							log.Fatalln(err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "sparse",
+					Usage: "convert the raw image to the sparse image, the same as img2simg",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "image", Value: "", Usage: "raw image"},
+						cli.StringFlag{Name: "out", Value: "", Usage: "sparse image to create"},
+						cli.StringFlag{Name: "blocksize", Value: "4096", Usage: "block size"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := sparseImage(c.String("image"), c.String("out"), c.String("blocksize")); err != nil {
+							log.Fatalln(err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "resparse",
+					Usage: "split the sparse image into prefix.N no larger than --max-size, the same as simg2simg",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "image", Value: "", Usage: "sparse image"},
+						cli.StringFlag{Name: "out", Value: "", Usage: "prefix of the sparse images to create, default to the image"},
+						cli.StringFlag{Name: "max-size", Value: "", Usage: "max size of the sparse images in bytes"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := resparseImage(c.String("image"), c.String("out"), c.String("max-size")); err != nil {
+							log.Fatalln(err)
+						}
+						return nil
+					},
+				},
+			},
+		},
 	}
 
 	app.Run(os.Args)
 }
+
+// dumpBootimg prints the header of boot or vendor_boot image of any version, and extracts
+// the content if extract is true
+func dumpBootimg(image string, extract bool) error {
+	vb := images.VendorBootimg{ImagePath: image}
+	if vb.IsVendorBoot() {
+		hdr, err := vb.Hdr()
+		if err != nil {
+			return err
+		}
+		fmt.Println(hdr)
+		entries, err := vb.RamdiskTable()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Println(&e)
+		}
+		if extract {
+			return vb.Unpack()
+		}
+		return nil
+	}
+
+	b := images.Bootimg{ImagePath: image}
+	version, err := b.Version()
+	if err != nil {
+		return err
+	}
+	if version >= 3 {
+		hdr, err := b.HdrV3()
+		if err != nil {
+			return err
+		}
+		fmt.Println(hdr)
+	} else {
+		hdr, err := b.Hdr()
+		if err != nil {
+			return err
+		}
+		fmt.Println(hdr)
+	}
+
+	if extract {
+		return b.Unpack()
+	}
+	return nil
+}
+
+// readFlagFiles reads the files in the flags into the data, for the flags set only
+func readFlagFiles(c *cli.Context, files map[string]*[]byte) error {
+	for name, data := range files {
+		if c.String(name) == "" {
+			continue
+		}
+		d, err := ioutil.ReadFile(c.String(name))
+		if err != nil {
+			return err
+		}
+		*data = d
+	}
+	return nil
+}
+
+// parseFlagNums parses the numbers in the flags, for the flags set only, hex is 0x prefixed
+func parseFlagNums(c *cli.Context, nums map[string]*uint32) error {
+	for name, v := range nums {
+		if c.String(name) == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(c.String(name), 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid --%s %s", name, c.String(name))
+		}
+		*v = uint32(n)
+	}
+	return nil
+}
+
+// setFlagStrings sets the strings in the flags, for the flags set only
+func setFlagStrings(c *cli.Context, strs map[string]*string) {
+	for name, v := range strs {
+		if c.IsSet(name) {
+			*v = c.String(name)
+		}
+	}
+}
+
+// repackBootimg builds a boot image with the args from the flags, the ones not set are
+// from the --image if any, or the defaults of mkbootimg.
+func repackBootimg(c *cli.Context) error {
+	vb := images.VendorBootimg{ImagePath: c.String("image")}
+	if c.Bool("vendor_boot") || (c.String("image") != "" && vb.IsVendorBoot()) {
+		return repackVendorBootimg(c)
+	}
+
+	args := images.DefaultBootImgArgs()
+	if c.String("image") != "" {
+		b := images.Bootimg{ImagePath: c.String("image")}
+		a, err := b.Args()
+		if err != nil {
+			return err
+		}
+		args = a
+	}
+
+	err := readFlagFiles(c, map[string]*[]byte{
+		"kernel":        &args.Kernel,
+		"ramdisk":       &args.Ramdisk,
+		"second":        &args.Second,
+		"recovery_dtbo": &args.RecoveryDtbo,
+		"dtb":           &args.Dtb,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = parseFlagNums(c, map[string]*uint32{
+		"header_version": &args.HeaderVersion,
+		"base":           &args.Base,
+		"kernel_offset":  &args.KernelOffset,
+		"ramdisk_offset": &args.RamdiskOffset,
+		"second_offset":  &args.SecondOffset,
+		"tags_offset":    &args.TagsOffset,
+		"dtb_offset":     &args.DtbOffset,
+		"pagesize":       &args.PageSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	setFlagStrings(c, map[string]*string{
+		"cmdline":        &args.CmdLine,
+		"board":          &args.Board,
+		"os_version":     &args.OsVersion,
+		"os_patch_level": &args.OsPatchLevel,
+	})
+
+	if len(args.Kernel) == 0 {
+		return fmt.Errorf("no kernel, use --kernel or --image")
+	}
+
+	out := images.Bootimg{ImagePath: c.String("out")}
+	if err := out.Pack(args); err != nil {
+		return err
+	}
+	fmt.Printf("%s is created\n", out.ImagePath)
+	return dumpBootimg(out.ImagePath, false)
+}
+
+// repackVendorBootimg builds a vendor_boot image, as repackBootimg does. A --vendor_ramdisk
+// with name replaces the fragment of the name, or adds one if there isn't, the one without
+// name replaces all the fragments.
+func repackVendorBootimg(c *cli.Context) error {
+	args := images.DefaultVendorBootImgArgs()
+	if c.String("image") != "" {
+		vb := images.VendorBootimg{ImagePath: c.String("image")}
+		a, err := vb.Args()
+		if err != nil {
+			return err
+		}
+		args = a
+	}
+
+	err := readFlagFiles(c, map[string]*[]byte{
+		"dtb":               &args.Dtb,
+		"vendor_bootconfig": &args.Bootconfig,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range c.StringSlice("vendor_ramdisk") {
+		name, file := "", r
+		if i := strings.Index(r, "="); i >= 0 {
+			name, file = r[:i], r[i+1:]
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			args.Ramdisks = []images.VendorRamdisk{{Type: images.VendorRamdiskTypePlatform, Data: data}}
+			continue
+		}
+		found := false
+		for i := range args.Ramdisks {
+			if args.Ramdisks[i].Name == name {
+				args.Ramdisks[i].Data = data
+				found = true
+			}
+		}
+		if !found {
+			args.Ramdisks = append(args.Ramdisks, images.VendorRamdisk{
+				Name: name, Type: images.VendorRamdiskTypePlatform, Data: data})
+		}
+	}
+
+	err = parseFlagNums(c, map[string]*uint32{
+		"header_version": &args.HeaderVersion,
+		"base":           &args.Base,
+		"kernel_offset":  &args.KernelOffset,
+		"ramdisk_offset": &args.RamdiskOffset,
+		"tags_offset":    &args.TagsOffset,
+		"dtb_offset":     &args.DtbOffset,
+		"pagesize":       &args.PageSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	setFlagStrings(c, map[string]*string{
+		"cmdline": &args.CmdLine,
+		"board":   &args.Board,
+	})
+
+	out := images.VendorBootimg{ImagePath: c.String("out")}
+	if err := out.Pack(args); err != nil {
+		return err
+	}
+	fmt.Printf("%s is created\n", out.ImagePath)
+	return dumpBootimg(out.ImagePath, false)
+}
+
+// editRamdisk removes, adds and chmods the files in the ramdisk as the flags, in that order
+func editRamdisk(c *cli.Context) error {
+	image := c.String("image")
+	if image == "" {
+		return fmt.Errorf("no image, use --image")
+	}
+	out := c.String("out")
+	if out == "" {
+		out = image
+	}
+
+	edit := func(cpio *images.Cpio) error {
+		for _, path := range c.StringSlice("remove") {
+			if err := cpio.Remove(path); err != nil {
+				return err
+			}
+		}
+		for _, add := range c.StringSlice("add") {
+			i := strings.LastIndex(add, ":")
+			if i <= 0 || i == len(add)-1 {
+				return fmt.Errorf("invalid --add %s, expect src:dst", add)
+			}
+			if err := cpio.AddFile(add[:i], add[i+1:]); err != nil {
+				return err
+			}
+		}
+		for _, chmod := range c.StringSlice("chmod") {
+			i := strings.Index(chmod, ":")
+			if i <= 0 {
+				return fmt.Errorf("invalid --chmod %s, expect mode:path", chmod)
+			}
+			mode, err := strconv.ParseUint(chmod[:i], 8, 32)
+			if err != nil {
+				return fmt.Errorf("invalid --chmod %s, the mode is octal", chmod)
+			}
+			if err := cpio.Chmod(chmod[i+1:], uint32(mode)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	b := images.Bootimg{ImagePath: image}
+	if _, err := b.Version(); err == nil {
+		if err := b.EditRamdisk(out, edit); err != nil {
+			return err
+		}
+	} else {
+		r := images.Ramdisk{ImagePath: image}
+		if err := r.Edit(out, edit); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s is edited to %s\n", image, out)
+	return nil
+}
+
+// listDtbo prints the header and the entries of the dtbo.img
+func listDtbo(image string) error {
+	d := images.Dtbo{ImagePath: image}
+	hdr, err := d.Hdr()
+	if err != nil {
+		return err
+	}
+	entries, err := d.Entries()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("version %d, page size %d, total size %d, %d entries\n",
+		hdr.Version, hdr.PageSize, hdr.TotalSize, hdr.DtEntryCount)
+	for i := range entries {
+		fmt.Printf("[%d] %s\n", i, entries[i].String())
+	}
+	return nil
+}
+
+// packDtbo builds the dtbo.img with the --dt overlays, the fields of the entry are hex with
+// 0x prefix or decimal
+func packDtbo(c *cli.Context) error {
+	var dts []images.DtboDt
+	for _, arg := range c.StringSlice("dt") {
+		fields := strings.SplitN(arg, ":", 2)
+		data, err := ioutil.ReadFile(fields[0])
+		if err != nil {
+			return err
+		}
+		dt := images.DtboDt{Dt: data}
+		if len(fields) == 2 {
+			for _, kv := range strings.Split(fields[1], ",") {
+				i := strings.Index(kv, "=")
+				if i <= 0 {
+					return fmt.Errorf("invalid --dt %s, expect key=value", arg)
+				}
+				v, err := strconv.ParseUint(kv[i+1:], 0, 32)
+				if err != nil {
+					return fmt.Errorf("invalid --dt %s, %s is not a number", arg, kv[i+1:])
+				}
+				switch key := kv[:i]; key {
+				case "id":
+					dt.ID = uint32(v)
+				case "rev":
+					dt.Rev = uint32(v)
+				case "custom0", "custom1", "custom2", "custom3":
+					dt.Custom[key[len(key)-1]-'0'] = uint32(v)
+				default:
+					return fmt.Errorf("invalid --dt %s, unknown %s", arg, key)
+				}
+			}
+		}
+		dts = append(dts, dt)
+	}
+	if len(dts) == 0 {
+		return fmt.Errorf("no overlay, use --dt")
+	}
+
+	pageSize, err := strconv.ParseUint(c.String("pagesize"), 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid --pagesize %s", c.String("pagesize"))
+	}
+	d := images.Dtbo{ImagePath: c.String("image")}
+	if err := d.Pack(dts, uint32(pageSize)); err != nil {
+		return err
+	}
+	fmt.Printf("%s is created\n", d.ImagePath)
+	return listDtbo(d.ImagePath)
+}
+
+// applyOverlay applies the --overlay, or the --entry of it if it is a dtbo.img, to the --base
+// and prints the merged device tree
+func applyOverlay(c *cli.Context) error {
+	base := images.Dtb{ImagePath: c.String("base")}
+	fdt, err := base.Fdt()
+	if err != nil {
+		return err
+	}
+
+	var overlay *images.Fdt
+	d := images.Dtbo{ImagePath: c.String("overlay")}
+	if d.IsDtbo() {
+		entry, err := strconv.Atoi(c.String("entry"))
+		if err != nil {
+			return fmt.Errorf("invalid --entry %s", c.String("entry"))
+		}
+		dts, err := d.Dts()
+		if err != nil {
+			return err
+		}
+		if entry < 0 || entry >= len(dts) {
+			return fmt.Errorf("%s has no entry %d", d.ImagePath, entry)
+		}
+		if overlay, err = images.ParseFdt(dts[entry].Dt); err != nil {
+			return fmt.Errorf("%s entry %d: %s", d.ImagePath, entry, err)
+		}
+	} else {
+		o := images.Dtb{ImagePath: c.String("overlay")}
+		if overlay, err = o.Fdt(); err != nil {
+			return err
+		}
+	}
+
+	if err := fdt.ApplyOverlay(overlay); err != nil {
+		return err
+	}
+	if out := c.String("out"); out != "" {
+		if err := ioutil.WriteFile(out, fdt.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Print(fdt.Dts())
+	return nil
+}
+
+// checkKernelConfigs checks the configs of the kernel against the requirements of the
+// --android, --hal and --fragment, it is error if any mismatch
+func checkKernelConfigs(c *cli.Context) error {
+	var fragments []images.KconfigFragment
+	if c.String("android") != "" {
+		f, err := images.AndroidKconfigFragment(c.String("android"))
+		if err != nil {
+			return err
+		}
+		fragments = append(fragments, f)
+	}
+	for _, hal := range c.StringSlice("hal") {
+		f, ok := images.FeatureKconfigFragment(hal)
+		if !ok {
+			return fmt.Errorf("no kernel config requirements for %s", hal)
+		}
+		fragments = append(fragments, f)
+	}
+	for _, file := range c.StringSlice("fragment") {
+		f, err := images.LoadKconfigFragment(file)
+		if err != nil {
+			return err
+		}
+		fragments = append(fragments, f)
+	}
+	if len(fragments) == 0 {
+		return fmt.Errorf("nothing to check, use --android, --hal or --fragment")
+	}
+
+	k := images.Kernel{ImagePath: c.String("image")}
+	configs, err := k.ConfigMap()
+	if err != nil {
+		return err
+	}
+	mismatches := images.CheckKconfig(configs, fragments...)
+	for _, m := range mismatches {
+		fmt.Println(m)
+	}
+	if len(mismatches) != 0 {
+		return fmt.Errorf("%d kernel config(s) not as required", len(mismatches))
+	}
+	fmt.Println("kernel configs are as required")
+	return nil
+}
+
+// dumpKernelImage prints the format and the header of the kernel image, and if there is
+// anything appended after the kernel, splits the kernel and the dtbs to prefix.kernel and
+// prefix.dtb.N, prefix is the image if it is empty
+func dumpKernelImage(image string, prefix string) error {
+	k, err := images.DetectKernelImage(image)
+	if err != nil {
+		return err
+	}
+	info, err := k.Describe()
+	if err != nil {
+		return err
+	}
+	fmt.Println(info)
+
+	size, err := k.KernelSize()
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+	if size >= fi.Size() {
+		fmt.Println("Pure and simple kernel image")
+		return nil
+	}
+
+	fmt.Println("something is appended after the kernel")
+	fmt.Println("Actualy Kernel Size", size)
+	if prefix == "" {
+		prefix = image
+	}
+	dtbs, err := images.SplitKernelImage(image, k, prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("split kernel to %s.kernel\n", prefix)
+	for i, dtb := range dtbs {
+		fmt.Printf("split %s to %s.dtb.%d\n", dtb, prefix, i)
+	}
+	return nil
+}
+
+// sparseInfo prints the header and the chunks of the sparse image
+func sparseInfo(image string) error {
+	s := images.Sparse{ImagePath: image}
+	hdr, err := s.Hdr()
+	if err != nil {
+		return err
+	}
+	img, err := s.Image()
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	fmt.Printf("version %d.%d, block size %d, %d blocks, %d chunks, raw size %d\n",
+		hdr.MajorVersion, hdr.MinorVersion, hdr.BlkSz, hdr.TotalBlks, hdr.TotalChunks, img.Size())
+	var block uint32
+	for i, c := range img.Chunks {
+		fmt.Printf("[%d] %s, blocks %d-%d (%d)", i, images.SparseChunkType(c.Type), block, block+c.Blocks, c.Blocks)
+		switch c.Type {
+		case images.SparseChunkFill:
+			fmt.Printf(", fill 0x%08x", c.Fill)
+		case images.SparseChunkCRC32:
+			fmt.Printf(", crc32 0x%08x", c.CRC32)
+		}
+		fmt.Println()
+		block += c.Blocks
+	}
+	return nil
+}
+
+// unsparseImage writes the raw image of the sparse image to out
+func unsparseImage(image, out string) error {
+	if out == "" {
+		return fmt.Errorf("no raw image, use --out")
+	}
+	s := images.Sparse{ImagePath: image}
+	img, err := s.Image()
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if err := createFile(out, img.Unsparse); err != nil {
+		return err
+	}
+	fmt.Printf("unsparse %s to %s, %d bytes\n", image, out, img.Size())
+	return nil
+}
+
+// sparseImage writes the sparse image of the raw image to out
+func sparseImage(image, out, blockSize string) error {
+	if out == "" {
+		return fmt.Errorf("no sparse image, use --out")
+	}
+	bs, err := strconv.ParseUint(blockSize, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid --blocksize %s", blockSize)
+	}
+	raw, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	fi, err := raw.Stat()
+	if err != nil {
+		return err
+	}
+	img, err := images.ReadRawImage(raw, fi.Size(), uint32(bs))
+	if err != nil {
+		return fmt.Errorf("%s: %s", image, err)
+	}
+	if err := createFile(out, func(w io.Writer) error {
+		_, err := img.WriteTo(w)
+		return err
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("sparse %s to %s, %d chunks\n", image, out, len(img.Chunks))
+	return nil
+}
+
+// resparseImage splits the sparse image into prefix.N no larger than maxSize
+func resparseImage(image, prefix, maxSize string) error {
+	size, err := strconv.ParseInt(maxSize, 0, 64)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid --max-size %s", maxSize)
+	}
+	if prefix == "" {
+		prefix = image
+	}
+	s := images.Sparse{ImagePath: image}
+	img, err := s.Image()
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	parts, err := img.Resparse(size)
+	if err != nil {
+		return err
+	}
+	for i, p := range parts {
+		out := fmt.Sprintf("%s.%d", prefix, i)
+		var n int64
+		if err := createFile(out, func(w io.Writer) (err error) {
+			n, err = p.WriteTo(w)
+			return err
+		}); err != nil {
+			return err
+		}
+		fmt.Printf("resparse %s, %d bytes\n", out, n)
+	}
+	return nil
+}
+
+// createFile creates the file and writes it with write, the file is removed if any error,
+// not to leave what is partially written
+func createFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
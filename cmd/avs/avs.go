@@ -1,12 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"text/tabwriter"
 
+	"github.com/pierrchen/avs/spec"
 	"github.com/pierrchen/avs/specconv"
+	"github.com/pierrchen/avs/vdts"
 	"github.com/urfave/cli"
 )
 
@@ -49,16 +54,151 @@ func main() {
 			Usage:   "validate device config",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "dir", Value: "", Usage: " dir for validation, default is current dir"},
+				cli.StringFlag{Name: "format", Value: vdts.FormatText, Usage: "report format: text, json or sarif"},
 			},
 			Action: func(c *cli.Context) error {
 				absGenDir := checkDir(c, true)
-				err := specconv.ValdiateDeviceConfig(absGenDir)
+				report, err := specconv.ValdiateDeviceConfig(absGenDir)
+				if werr := report.Write(os.Stdout, c.String("format")); werr != nil {
+					log.Fatalln("[avs v]", werr)
+				}
 				if err != nil {
-					fmt.Println("[avs v] spec validation failed, please fix the errors!")
-				} else {
+					// non-zero exit code so that the CI can gate on it
+					return cli.NewExitError("[avs v] spec validation failed, please fix the errors!", 1)
+				}
+				// keep the machine readable output clean
+				if c.String("format") == vdts.FormatText {
 					fmt.Println("[avs v] OK")
 				}
-				return err
+				return nil
+			},
+		},
+		{
+			Name:  "check-images",
+			Usage: "check the built images against the device config",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "dir", Value: "", Usage: "device dir, default is current dir"},
+				cli.StringFlag{Name: "out", Value: os.Getenv("ANDROID_PRODUCT_OUT"), Usage: "product out dir, e.g out/target/product/poplar, default is ${ANDROID_PRODUCT_OUT}"},
+				cli.StringFlag{Name: "format", Value: vdts.FormatText, Usage: "report format: text, json or sarif"},
+			},
+			Action: func(c *cli.Context) error {
+				absGenDir := checkDir(c, true)
+				if c.String("out") == "" {
+					log.Fatalln("must specify --out for avs check-images")
+				}
+				report, err := specconv.CheckImages(absGenDir, c.String("out"))
+				if werr := report.Write(os.Stdout, c.String("format")); werr != nil {
+					log.Fatalln("[avs check-images]", werr)
+				}
+				if err != nil {
+					return cli.NewExitError("[avs check-images] "+err.Error(), 1)
+				}
+				if c.String("format") == vdts.FormatText {
+					fmt.Println("[avs check-images] OK")
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "partition-table",
+			Usage: "generate the partition table image, partition.xml and the parted script",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "dir", Value: "", Usage: "device dir, default is current dir"},
+				cli.StringFlag{Name: "out", Value: ".", Usage: "dir to write the files to"},
+			},
+			Action: func(c *cli.Context) error {
+				absGenDir := checkDir(c, true)
+				if err := specconv.GeneratePartitionTable(absGenDir, c.String("out")); err != nil {
+					log.Fatalln("[avs partition-table]", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "migrate",
+			Usage: "migrate config.json, the specs it extends and the overlays to the current schema version",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "dir", Value: "", Usage: "dir for migration, default is current dir"},
+				cli.BoolFlag{Name: "dry-run", Usage: "print the changes only"},
+			},
+			Action: func(c *cli.Context) error {
+				absGenDir := checkDir(c, true)
+				results, err := specconv.MigrateDeviceConfigs(absGenDir, c.Bool("dry-run"))
+				if err != nil {
+					log.Fatalln("[avs migrate]", err)
+				}
+				for _, r := range results {
+					if len(r.Changes) == 0 {
+						fmt.Printf("[avs migrate] %s: up to date\n", r.File)
+						continue
+					}
+					fmt.Printf("[avs migrate] %s: schema %s -> %s\n", r.File, r.From, r.To)
+					for _, change := range r.Changes {
+						fmt.Println("    " + change)
+					}
+					if r.Backup != "" {
+						fmt.Printf("    original saved to %s\n", r.Backup)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "overlay",
+			Usage: "work with the overlays of config.json",
+			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "print the effective spec, with where each field comes from",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "dir", Value: "", Usage: "device dir, default is current dir"},
+						cli.BoolFlag{Name: "json", Usage: "print the merged config.json instead"},
+					},
+					Action: func(c *cli.Context) error {
+						absGenDir := checkDir(c, true)
+						data, fields, err := specconv.EffectiveSpec(absGenDir)
+						if err != nil {
+							log.Fatalln("[avs overlay]", err)
+						}
+						if c.Bool("json") {
+							fmt.Println(string(data))
+							return nil
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+						for _, f := range fields {
+							fmt.Fprintf(w, "%s\t%s\t%s\n", f.Path, f.Value, f.Source)
+						}
+						return w.Flush()
+					},
+				},
+			},
+		},
+		{
+			Name:  "schema",
+			Usage: "print the JSON Schema of config.json",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "out", Value: "", Usage: "write the schema to file instead of stdout"},
+			},
+			Action: func(c *cli.Context) error {
+				data, err := json.MarshalIndent(spec.Schema(), "", "    ")
+				if err != nil {
+					log.Fatalln("[avs schema]", err)
+				}
+				if c.String("out") == "" {
+					fmt.Println(string(data))
+					return nil
+				}
+				return ioutil.WriteFile(c.String("out"), append(data, '\n'), 0644)
+			},
+		},
+		{
+			Name:  "rules",
+			Usage: "list the validation rules",
+			Action: func(c *cli.Context) error {
+				for _, r := range vdts.Rules() {
+					fmt.Printf("%-24s %-8s %-8s %s\n", r.ID, r.Stage, r.Severity, r.Description)
+				}
+				return nil
 			},
 		},
 		{
@@ -67,13 +207,18 @@ func main() {
 			Usage:   "re-generate Android mk with updated device config",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "dir", Value: "", Usage: "dir for update, default is current dir"},
+				cli.BoolFlag{Name: "dry-run", Usage: "print the files that would change and the diff"},
+				cli.BoolFlag{Name: "force", Usage: "overwrite the generated files edited by hand"},
 			},
 			Action: func(c *cli.Context) error {
 				absGenDir := checkDir(c, true)
-				if err := specconv.UpdateDeviceConfigs(absGenDir); err != nil {
+				opts := specconv.UpdateOptions{DryRun: c.Bool("dry-run"), Force: c.Bool("force")}
+				if err := specconv.UpdateDeviceConfigs(absGenDir, opts); err != nil {
 					log.Fatalln("[avs s] Error updating the config file", err)
 				}
-				fmt.Println("[avs u] OK")
+				if !opts.DryRun {
+					fmt.Println("[avs u] OK")
+				}
 				return nil
 			},
 		},
@@ -83,10 +228,11 @@ func main() {
 			Usage:   "delete all the generated files",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "dir", Value: "", Usage: "dir for cleanup, default is current dir"},
+				cli.BoolFlag{Name: "force", Usage: "delete the generated files edited by hand as well"},
 			},
 			Action: func(c *cli.Context) error {
 				absGenDir := checkDir(c, true)
-				if err := specconv.CleanDeviceConfigs(absGenDir); err != nil {
+				if err := specconv.CleanDeviceConfigs(absGenDir, c.Bool("force")); err != nil {
 					log.Fatalln("[avs s] Error updating the config file", err)
 				}
 				fmt.Println("[avs u] OK")
@@ -45,74 +45,81 @@ type Arm64Image struct {
 func (i *Arm64Image) Hdr() (*Arm64ImageHeader, error) {
 	var hdr Arm64ImageHeader
 	f, err := os.Open(i.ImagePath)
-
-	defer f.Close()
-
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
 	r := bufio.NewReader(f)
 	binary.Read(r, binary.LittleEndian, &hdr)
 
 	if string(hdr.Magic[:]) != linuxARM64ImageMagic {
-		fmt.Printf("Not valid arm64 image %s\n", hdr.Magic)
 		return nil, fmt.Errorf("Not ARM64 Linux Image")
 	}
 
 	return &hdr, nil
 }
 
+// Arch is arm64
+func (i *Arm64Image) Arch() string {
+	return "arm64"
+}
+
+// Describe return the header info
+func (i *Arm64Image) Describe() (string, error) {
+	hdr, err := i.Hdr()
+	if err != nil {
+		return "", err
+	}
+	return "arm64 Image\n" + hdr.String(), nil
+}
+
+// KernelSize is ActualKernelSize
+func (i *Arm64Image) KernelSize() (int64, error) {
+	if _, err := i.Hdr(); err != nil {
+		return 0, err
+	}
+	return i.ActualKernelSize()
+}
+
 // ActualKernelSize return the actual kernel size
 func (i *Arm64Image) ActualKernelSize() (int64, error) {
 	f, err := os.Open(i.ImagePath)
-	defer f.Close()
-
 	if err != nil {
 		return 0, err
 	}
+	defer f.Close()
 
-	// kernel real-size, reset and seek to the off
-	f.Seek(KERNEL_IMAGE_STEXT_OFFSET, os.SEEK_SET)
+	// kernel real-size is the _stext plus the raw size
 	t := make([]byte, 4)
-	f.Read(t)
+	if _, err := f.ReadAt(t, KERNEL_IMAGE_STEXT_OFFSET); err != nil {
+		return 0, err
+	}
 	stext := binary.LittleEndian.Uint32(t)
 
-	f.Seek(KERNEL_IMAGE_RAW_SIZE_OFFSET, os.SEEK_SET)
-	f.Read(t)
+	if _, err := f.ReadAt(t, KERNEL_IMAGE_RAW_SIZE_OFFSET); err != nil {
+		return 0, err
+	}
 	rawSize := binary.LittleEndian.Uint32(t)
 
 	return int64(stext + rawSize), nil
 }
 
 // IsSomethingAppended return true if file size > ActualKernelSize
-func (i *Arm64Image) IsSomethingAppended() bool {
-
-	info, _ := os.Stat(i.ImagePath)
-	s, _ := i.ActualKernelSize()
-
-	if info.Size() > s {
-		return true
+func (i *Arm64Image) IsSomethingAppended() (bool, error) {
+	info, err := os.Stat(i.ImagePath)
+	if err != nil {
+		return false, err
 	}
-
-	return false
-}
-
-// Split will split the kernel and the stuff appended, usually dtb
-func (i *Arm64Image) Split() {
-
-	if !i.IsSomethingAppended() {
-		return
+	s, err := i.ActualKernelSize()
+	if err != nil {
+		return false, err
 	}
+	return info.Size() > s, nil
+}
 
-	imageFile, _ := os.Open(i.ImagePath)
-	info, _ := imageFile.Stat()
-	s, _ := i.ActualKernelSize()
-	kernel := fmt.Sprintf("%s.kernel", i.ImagePath)
-	fkernel, _ := os.Create(kernel)
-	extract(imageFile, 0, uint32(s), fkernel)
-
-	dtb := fmt.Sprintf("%s.dtb", i.ImagePath)
-	fdtb, _ := os.Create(dtb)
-	extract(imageFile, s, uint32(info.Size()-s), fdtb)
+// Split will split the kernel and the stuff appended, usually dtbs, to prefix.kernel and
+// prefix.dtb.N. See SplitKernelImage.
+func (i *Arm64Image) Split(prefix string) ([]AppendedDtb, error) {
+	return SplitKernelImage(i.ImagePath, i, prefix)
 }
@@ -2,8 +2,10 @@ package images
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -30,7 +32,20 @@ type Bootimg struct {
 // [1] https://android.googlesource.com/platform/system/core/+/master/mkbootimg/include/bootimg/bootimg.h
 // [2] https://android.googlesource.com/platform/system/core/+/master/mkbootimg/mkbootimg
 
-// BootImgHdr is the Android Boot Image header
+// the header size of each version, as in the HeaderSize field of v1 and later
+const (
+	bootImgHdrV0Size = 1632
+	bootImgHdrV1Size = 1648
+	bootImgHdrV2Size = 1660
+	bootImgHdrV3Size = 1580
+	bootImgHdrV4Size = 1584
+
+	// v3 and later have a fixed page size
+	bootImgV3PageSize = 4096
+)
+
+// BootImgHdr is the Android Boot Image header of version 0, 1 and 2.
+// The fields of a later version are 0 for an earlier version.
 type BootImgHdr struct {
 	Magic      [8]byte
 	KernelSize uint32
@@ -47,26 +62,43 @@ type BootImgHdr struct {
 	OsVersion         uint32
 	ProductName       [16]byte
 	CmdLine           [512]byte
-	ID                [8]byte
-	ExtraCmdline      [1024]byte
+	// ID is the SHA-1 of the kernel, ramdisk and second, in the first 20 bytes
+	ID           [32]byte
+	ExtraCmdline [1024]byte
+	// v1
+	RecoveryDtboSize   uint32
+	RecoveryDtboOffset uint64
+	HeaderSize         uint32
+	// v2
+	DtbSize uint32
+	DtbAddr uint64
+}
+
+// BootImgHdrV3 is the Android Boot Image header of version 3 and 4.
+// The load addresses, the page size and the dtb are moved to the vendor_boot image.
+type BootImgHdrV3 struct {
+	Magic         [8]byte
+	KernelSize    uint32
+	RamdiskSize   uint32
+	OsVersion     uint32
+	HeaderSize    uint32
+	Reserved      [4]uint32
+	HeaderVersion uint32
+	CmdLine       [1536]byte
+	// v4, the size of the boot signature after the ramdisk
+	SignatureSize uint32
 }
 
 // ToString print hdr info
 func (h *BootImgHdr) String() string {
 	var s = ""
-	/* os_version = ver << 11 | lvl */
-	osVer := h.OsVersion >> 11
-	osLvl := h.OsVersion & ((1 << 11) - 1)
+	s += fmt.Sprintf("HeaderVersion:%d\n", h.BootImgHdrVersion)
+	version, patchLevel := osVersionString(h.OsVersion)
+	s += fmt.Sprintf("OsVersion   :0x%x (Android Version: %s, Patch Level: %s)\n",
+		h.OsVersion, version, patchLevel)
 
-	/* ver = A << 14 | B << 7 | C         (7 bits for each of A, B, C)
-	 * lvl = ((Y - 2000) & 127) << 4 | M  (7 bits for Y, 4 bits for M) */
-	s += fmt.Sprintf("OsVersion   :0x%x (Android Version: %d.%d.%d, Patch Level: %d.%d)\n",
-		h.OsVersion,
-		(osVer>>7)&0x7F, (osVer>>14)&0x7F, osVer&0x7F,
-		(osLvl>>4)+2000, osLvl&0x0F)
-
-	s += fmt.Sprintf("Product:%s\n", h.ProductName)
-	s += fmt.Sprintf("CmdLine:%s\n", h.CmdLine)
+	s += fmt.Sprintf("Product:%s\n", cString(h.ProductName[:]))
+	s += fmt.Sprintf("CmdLine:%s%s\n", cString(h.CmdLine[:]), cString(h.ExtraCmdline[:]))
 
 	s += fmt.Sprintf("KernelAddr  :0x%x", h.KernelAddr)
 	if h.KernelAddr == DefaultKernelLoadAddr {
@@ -89,6 +121,35 @@ func (h *BootImgHdr) String() string {
 		s += fmt.Sprintf("SecondAddr  :0x%x\n", h.SecondAddr)
 	}
 
+	if h.BootImgHdrVersion > 0 {
+		s += fmt.Sprintf("HeaderSize  :%d\n", h.HeaderSize)
+		s += fmt.Sprintf("RecoveryDtboSize  :0x%x(%d)\n", h.RecoveryDtboSize, h.RecoveryDtboSize)
+		s += fmt.Sprintf("RecoveryDtboOffset:0x%x\n", h.RecoveryDtboOffset)
+	}
+
+	if h.BootImgHdrVersion > 1 {
+		s += fmt.Sprintf("DtbSize     :0x%x(%d)\n", h.DtbSize, h.DtbSize)
+		s += fmt.Sprintf("DtbAddr     :0x%x\n", h.DtbAddr)
+	}
+
+	return s
+}
+
+// String print the v3 hdr info
+func (h *BootImgHdrV3) String() string {
+	var s = ""
+	s += fmt.Sprintf("HeaderVersion:%d\n", h.HeaderVersion)
+	s += fmt.Sprintf("HeaderSize  :%d\n", h.HeaderSize)
+	version, patchLevel := osVersionString(h.OsVersion)
+	s += fmt.Sprintf("OsVersion   :0x%x (Android Version: %s, Patch Level: %s)\n",
+		h.OsVersion, version, patchLevel)
+	s += fmt.Sprintf("CmdLine:%s\n", cString(h.CmdLine[:]))
+	s += fmt.Sprintf("PageSize    :0x%x(%d)\n", bootImgV3PageSize, bootImgV3PageSize)
+	s += fmt.Sprintf("KernelSize  :0x%x(%d)\n", h.KernelSize, h.KernelSize)
+	s += fmt.Sprintf("RamdiskSize :0x%x(%d)\n", h.RamdiskSize, h.RamdiskSize)
+	if h.HeaderVersion > 3 {
+		s += fmt.Sprintf("SignatureSize:0x%x(%d)\n", h.SignatureSize, h.SignatureSize)
+	}
 	return s
 }
 
@@ -97,45 +158,159 @@ func align(size uint32, pageSize uint32) uint32 {
 	return (size + pageSize - 1) / pageSize * pageSize
 }
 
-// Hdr return the Hdr of the boot image
-func (b *Bootimg) Hdr() (*BootImgHdr, error) {
-	f, err := os.Open(b.ImagePath)
+// imgSection is a section in the boot image, e.g the kernel
+type imgSection struct {
+	// name is also the file it is unpacked to, with .out
+	name  string
+	start uint32
+	size  uint32
+}
+
+// layout sets the start of the sections, they follow the header one after another and
+// each one is page aligned
+func layout(hdrSize, pageSize uint32, sections []imgSection) []imgSection {
+	off := align(hdrSize, pageSize)
+	for i := range sections {
+		sections[i].start = off
+		off += align(sections[i].size, pageSize)
+	}
+	return sections
+}
+
+// readHdr reads the header at the beginning of the file into hdr, and checks the magic
+func readHdr(path string, magic string, hdr interface{}) error {
+	f, err := os.Open(path)
 	if err != nil {
-		fmt.Println(err)
-		return nil, err
+		return err
 	}
+	defer f.Close()
 
-	r := bufio.NewReader(f)
+	var m [8]byte
+	if err := binary.Read(bufio.NewReader(f), binary.LittleEndian, &m); err != nil {
+		return fmt.Errorf("Fail to read %s, err %s", path, err)
+	}
+	if string(m[:]) != magic {
+		return fmt.Errorf("%s is not a %s image", path, magic)
+	}
+
+	// the header of an earlier version can be shorter than hdr, the rest is 0 if the
+	// image is truncated there
+	data := make([]byte, binary.Size(hdr))
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return err
+	}
+	return binary.Read(bytes.NewReader(data), binary.LittleEndian, hdr)
+}
+
+// Version return the header version of the boot image
+func (b *Bootimg) Version() (uint32, error) {
+	var hdr struct {
+		Magic   [8]byte
+		_       [8]uint32
+		Version uint32
+	}
+	if err := readHdr(b.ImagePath, bootMagic, &hdr); err != nil {
+		return 0, err
+	}
+	return hdr.Version, nil
+}
+
+// Hdr return the Hdr of the boot image, of version 0, 1 or 2
+func (b *Bootimg) Hdr() (*BootImgHdr, error) {
 	var hdr BootImgHdr
-	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
-		fmt.Printf("Fail to read the bootimg %s, err %s", b.ImagePath, err)
+	if err := readHdr(b.ImagePath, bootMagic, &hdr); err != nil {
+		fmt.Println(err)
 		return nil, err
 	}
 
-	if string(hdr.Magic[:]) != "ANDROID!" {
-		err := fmt.Errorf("Not An ANdroid Boot Image")
+	switch hdr.BootImgHdrVersion {
+	case 0:
+		hdr.RecoveryDtboSize, hdr.RecoveryDtboOffset, hdr.HeaderSize = 0, 0, 0
+		fallthrough
+	case 1:
+		hdr.DtbSize, hdr.DtbAddr = 0, 0
+	case 2:
+	default:
+		return nil, fmt.Errorf("%s is a v%d boot image, use HdrV3", b.ImagePath, hdr.BootImgHdrVersion)
+	}
+
+	return &hdr, nil
+}
+
+// HdrV3 return the Hdr of the boot image, of version 3 or 4
+func (b *Bootimg) HdrV3() (*BootImgHdrV3, error) {
+	var hdr BootImgHdrV3
+	if err := readHdr(b.ImagePath, bootMagic, &hdr); err != nil {
 		return nil, err
 	}
 
+	switch hdr.HeaderVersion {
+	case 3:
+		hdr.SignatureSize = 0
+	case 4:
+	default:
+		return nil, fmt.Errorf("%s is a v%d boot image, use Hdr", b.ImagePath, hdr.HeaderVersion)
+	}
+
 	return &hdr, nil
 }
 
+// sections return the sections in the boot image of any version
+func (b *Bootimg) sections() ([]imgSection, error) {
+	version, err := b.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	if version >= 3 {
+		hdr, err := b.HdrV3()
+		if err != nil {
+			return nil, err
+		}
+		return layout(bootImgHdrV4Size, bootImgV3PageSize, []imgSection{
+			{name: "kernel", size: hdr.KernelSize},
+			{name: "ramdisk", size: hdr.RamdiskSize},
+			{name: "signature", size: hdr.SignatureSize},
+		}), nil
+	}
+
+	hdr, err := b.Hdr()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.PageSize == 0 {
+		return nil, fmt.Errorf("%s: invalid page size 0", b.ImagePath)
+	}
+	sections := []imgSection{
+		{name: "kernel", size: hdr.KernelSize},
+		{name: "ramdisk", size: hdr.RamdiskSize},
+		{name: "second", size: hdr.SecondSize},
+	}
+	if hdr.BootImgHdrVersion > 0 {
+		sections = append(sections, imgSection{name: "recovery_dtbo", size: hdr.RecoveryDtboSize})
+	}
+	if hdr.BootImgHdrVersion > 1 {
+		sections = append(sections, imgSection{name: "dtb", size: hdr.DtbSize})
+	}
+	return layout(bootImgHdrV0Size, hdr.PageSize, sections), nil
+}
+
 func extract(file *os.File, start int64, size uint32, outFile *os.File) error {
 	_, err := file.Seek(int64(start), os.SEEK_SET)
 
 	if err != nil {
-		return fmt.Errorf("Err seek", err)
+		return fmt.Errorf("Err seek %s", err)
 	}
 
 	buf := make([]byte, size)
 	n, err := file.Read(buf)
 	if err != nil || n < int(size) {
-		return fmt.Errorf("Err read", err)
+		return fmt.Errorf("Err read %s", err)
 	}
 
 	n, err = outFile.Write(buf)
 	if err != nil || n < int(size) {
-		return fmt.Errorf("Err write", err)
+		return fmt.Errorf("Err write %s", err)
 	}
 
 	return nil
@@ -143,59 +318,36 @@ func extract(file *os.File, start int64, size uint32, outFile *os.File) error {
 
 // Unpack dump the bootimage header infor and extact all the stuff within (kernel, ramdisk, dtb)
 func (b *Bootimg) Unpack() error {
-	hdr, err := b.Hdr()
-	f, err := os.Open(b.ImagePath)
-
+	sections, err := b.sections()
 	if err != nil {
 		return err
 	}
+	return unpackSections(b.ImagePath, sections)
+}
 
-	type dump struct {
-		In    *os.File
-		Start uint32
-		Size  uint32
-		Out   *os.File
-	}
-
-	var dumps []dump
-
-	if hdr.KernelSize != 0 {
-		// kernel
-		var d dump
-		d.In = f
-		d.Start = 1 * hdr.PageSize
-		d.Size = hdr.KernelSize
-		d.Out, _ = os.Create("kernel.out")
-		dumps = append(dumps, d)
-	}
-
-	if hdr.RamdiskSize != 0 {
-		// ramdisk
-		var d dump
-		d.In = f
-		d.Start = 1*hdr.PageSize + align(hdr.KernelSize, hdr.PageSize)
-		d.Size = hdr.RamdiskSize
-		d.Out, _ = os.Create("ramdisk.out")
-		dumps = append(dumps, d)
-	}
-
-	if hdr.SecondSize != 0 {
-		// second
-		var d dump
-		d.In = f
-		d.Start = 1*hdr.PageSize + align(hdr.KernelSize, hdr.PageSize) + align(hdr.RamdiskSize, hdr.PageSize)
-		d.Size = hdr.SecondSize
-		d.Out, _ = os.Create("second.out")
-		dumps = append(dumps, d)
+// unpackSections extracts each non empty section in the image to <name>.out
+func unpackSections(image string, sections []imgSection) error {
+	f, err := os.Open(image)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	for _, d := range dumps {
-		err = extract(d.In, int64(d.Start), d.Size, d.Out)
+	for _, s := range sections {
+		if s.size == 0 {
+			continue
+		}
+		out, cerr := os.Create(s.name + ".out")
+		if cerr != nil {
+			return cerr
+		}
+		err = extract(f, int64(s.start), s.size, out)
+		out.Close()
 
 		if err != nil {
-			fmt.Print("unpack %s failed, %s\n", err)
+			fmt.Printf("unpack %s failed, %s\n", out.Name(), err)
 		} else {
-			fmt.Printf("unpack %s OK\n", d.Out.Name())
+			fmt.Printf("unpack %s OK\n", out.Name())
 		}
 	}
 
@@ -0,0 +1,170 @@
+package images
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackBootimg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootimg")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	args := DefaultBootImgArgs()
+	args.Kernel = []byte("kernel")
+	args.Ramdisk = []byte("ramdisk")
+	args.CmdLine = "console=ttyS0 " + strings.Repeat("x", bootArgsSize)
+	args.Board = "hikey"
+	args.OsVersion = "9.0.0"
+	args.OsPatchLevel = "2018-06"
+
+	b := Bootimg{ImagePath: filepath.Join(dir, "boot.img")}
+	assert.Nil(t, b.Pack(args))
+
+	data, err := ioutil.ReadFile(b.ImagePath)
+	assert.Nil(t, err)
+	// header, kernel and ramdisk, each in a page
+	assert.Equal(t, 3*DefaultPageSize, len(data))
+	assert.Equal(t, bootImgHdrV2Size, binary.Size(BootImgHdr{}))
+	assert.Equal(t, bootImgHdrV4Size, binary.Size(BootImgHdrV3{}))
+
+	hdr, err := b.Hdr()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(DefaultKernelLoadAddr), hdr.KernelAddr)
+	assert.Equal(t, uint32(DefaultRamdiskLoadAddr), hdr.RamdiskAddr)
+	assert.Equal(t, uint32(0x12000126), hdr.OsVersion)
+	// the same as mkbootimg, sha1 of each section followed by its size
+	assert.Equal(t, "5d017bf93d2f03723918ab9e296e37f6f72c2b5f", fmt.Sprintf("%x", hdr.ID[:20]))
+	assert.Nil(t, b.Verify())
+
+	// repack with the args from the image gives the same image
+	got, err := b.Args()
+	assert.Nil(t, err)
+	assert.Equal(t, args, got)
+	repacked, err := got.Build()
+	assert.Nil(t, err)
+	assert.Equal(t, data, repacked)
+
+	args.OsPatchLevel = "2018-13"
+	_, err = args.Build()
+	assert.NotNil(t, err)
+}
+
+func TestPackBootimgVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootimg")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// v2, with the recovery dtbo and dtb after the second
+	args := DefaultBootImgArgs()
+	args.HeaderVersion = 2
+	args.Kernel = []byte("kernel")
+	args.Ramdisk = []byte("ramdisk")
+	args.RecoveryDtbo = []byte("dtbo")
+	args.Dtb = []byte("dtb")
+
+	b := Bootimg{ImagePath: filepath.Join(dir, "boot-v2.img")}
+	assert.Nil(t, b.Pack(args))
+	hdr, err := b.Hdr()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(bootImgHdrV2Size), hdr.HeaderSize)
+	assert.Equal(t, uint64(3*DefaultPageSize), hdr.RecoveryDtboOffset)
+	assert.Equal(t, uint64(DefaultLoadBaseAddr+DefaultDtbOffset), hdr.DtbAddr)
+	assert.Equal(t, "304bf382a18db2a3700525a1bca5af16ee63ed2c", fmt.Sprintf("%x", hdr.ID[:20]))
+	got, err := b.Args()
+	assert.Nil(t, err)
+	assert.Equal(t, args, got)
+
+	args.HeaderVersion = 1
+	_, err = args.Build()
+	assert.NotNil(t, err, "dtb needs v2")
+
+	// v4, the page size is fixed and the rest are in vendor_boot
+	args = &BootImgArgs{
+		HeaderVersion: 4,
+		Kernel:        []byte("kernel"),
+		Ramdisk:       []byte("ramdisk"),
+		Signature:     []byte("signature"),
+		CmdLine:       "console=ttyS0",
+		OsVersion:     "12.0.0",
+		OsPatchLevel:  "2021-10",
+	}
+	b = Bootimg{ImagePath: filepath.Join(dir, "boot-v4.img")}
+	assert.Nil(t, b.Pack(args))
+	data, err := ioutil.ReadFile(b.ImagePath)
+	assert.Nil(t, err)
+	assert.Equal(t, 4*bootImgV3PageSize, len(data))
+	assert.Equal(t, "signature", string(data[3*bootImgV3PageSize:3*bootImgV3PageSize+9]))
+
+	_, err = b.Hdr()
+	assert.NotNil(t, err)
+	hdrV3, err := b.HdrV3()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(bootImgHdrV4Size), hdrV3.HeaderSize)
+	assert.Equal(t, uint32(9), hdrV3.SignatureSize)
+	got, err = b.Args()
+	assert.Nil(t, err)
+	assert.Equal(t, args, got)
+	assert.Nil(t, b.Verify())
+}
+
+func TestPackVendorBootimg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootimg")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	args := DefaultVendorBootImgArgs()
+	args.Board = "hikey960"
+	args.CmdLine = "androidboot.hardware=hikey960"
+	args.Dtb = []byte("dtb")
+	args.Bootconfig = []byte("androidboot.serialno=123\n")
+	args.Ramdisks = []VendorRamdisk{
+		{Name: "", Type: VendorRamdiskTypePlatform, Data: []byte("platform")},
+		{Name: "dlkm", Type: VendorRamdiskTypeDlkm, Data: []byte("modules")},
+	}
+	args.Ramdisks[1].BoardID[0] = 0x960
+
+	v := VendorBootimg{ImagePath: filepath.Join(dir, "vendor_boot.img")}
+	assert.Nil(t, v.Pack(args))
+	assert.True(t, v.IsVendorBoot())
+	assert.Equal(t, vendorBootImgHdrV4Size, binary.Size(VendorBootImgHdr{}))
+	assert.Equal(t, vendorRamdiskEntrySize, binary.Size(VendorRamdiskEntry{}))
+
+	hdr, err := v.Hdr()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(15), hdr.VendorRamdiskSize)
+	assert.Equal(t, uint32(2), hdr.VendorRamdiskTableEntryNum)
+
+	entries, err := v.RamdiskTable()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, uint32(8), entries[1].RamdiskOffset)
+	assert.Equal(t, "dlkm", cString(entries[1].RamdiskName[:]))
+
+	got, err := v.Args()
+	assert.Nil(t, err)
+	assert.Equal(t, args, got)
+
+	// v3 has only one ramdisk
+	args.HeaderVersion = 3
+	args.Bootconfig = nil
+	_, err = args.Build()
+	assert.NotNil(t, err)
+	args.Ramdisks = args.Ramdisks[:1]
+	args.Ramdisks[0].Type = VendorRamdiskTypeNone
+	assert.Nil(t, v.Pack(args))
+	got, err = v.Args()
+	assert.Nil(t, err)
+	assert.Equal(t, args, got)
+
+	b := Bootimg{ImagePath: v.ImagePath}
+	_, err = b.Version()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,210 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The ramdisk is a cpio archive of the newc format [1], the same as the kernel initramfs.
+// [1] https://www.kernel.org/doc/Documentation/early-userspace/buffer-format.txt
+
+const (
+	cpioNewcMagic   = "070701"
+	cpioHeaderSize  = 110
+	cpioTrailerName = "TRAILER!!!"
+
+	// the inode number of the first entry, same as mkbootfs
+	cpioFirstIno = 300000
+)
+
+// the file types in CpioEntry.Mode, same as st_mode
+const (
+	CpioModeTypeMask = 0170000
+	CpioModeSocket   = 0140000
+	CpioModeSymlink  = 0120000
+	CpioModeRegular  = 0100000
+	CpioModeBlock    = 0060000
+	CpioModeDir      = 0040000
+	CpioModeChar     = 0020000
+	CpioModeFifo     = 0010000
+)
+
+// CpioEntry is a file in the cpio archive
+type CpioEntry struct {
+	// Name is the path, e.g system/bin, mkbootfs writes it without the leading "./" but
+	// other tools may not
+	Name string
+	// Mode is the file type and the permission bits
+	Mode  uint32
+	UID   uint32
+	GID   uint32
+	Mtime uint32
+	// RdevMajor and RdevMinor are for the device nodes
+	RdevMajor uint32
+	RdevMinor uint32
+	// Data is the content of the regular file, or the target of the symlink
+	Data []byte
+}
+
+// Type return the file type of the entry, e.g CpioModeDir
+func (e *CpioEntry) Type() uint32 {
+	return e.Mode & CpioModeTypeMask
+}
+
+// cpioHeader is the newc header, the fields are 8 hex digits
+type cpioHeader struct {
+	ino, mode, uid, gid, nlink, mtime, fileSize uint32
+	devMajor, devMinor, rdevMajor, rdevMinor    uint32
+	nameSize, check                             uint32
+}
+
+func (h *cpioHeader) fields() []*uint32 {
+	return []*uint32{&h.ino, &h.mode, &h.uid, &h.gid, &h.nlink, &h.mtime, &h.fileSize,
+		&h.devMajor, &h.devMinor, &h.rdevMajor, &h.rdevMinor, &h.nameSize, &h.check}
+}
+
+// cpioPad return the padding to align n to 4
+func cpioPad(n int) int {
+	return (4 - n%4) % 4
+}
+
+// ReadCpio reads all the entries in the cpio archive, the archives concatenated one after
+// another, as the kernel accepts, are read as well.
+// The hard links are read as regular files with the same content.
+func ReadCpio(r io.Reader) ([]CpioEntry, error) {
+	br := bufio.NewReader(r)
+	var entries []CpioEntry
+
+	// the hard links, by inode, the content is only in the last one of them
+	type link struct {
+		ino, devMajor, devMinor uint32
+	}
+	links := map[link][]int{}
+
+	for {
+		// skip the padding between the archives
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == 0 {
+			br.ReadByte()
+			continue
+		}
+
+		hdr := make([]byte, cpioHeaderSize)
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return nil, fmt.Errorf("cpio header: %s", err)
+		}
+		if string(hdr[:6]) != cpioNewcMagic {
+			return nil, fmt.Errorf("not a newc cpio archive, magic %q", hdr[:6])
+		}
+		var h cpioHeader
+		for i, f := range h.fields() {
+			v, err := strconv.ParseUint(string(hdr[6+i*8:6+(i+1)*8]), 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("cpio header: invalid field %q", hdr[6+i*8:6+(i+1)*8])
+			}
+			*f = uint32(v)
+		}
+		if h.nameSize == 0 {
+			return nil, fmt.Errorf("cpio header: empty name")
+		}
+
+		name := make([]byte, int(h.nameSize)+cpioPad(cpioHeaderSize+int(h.nameSize)))
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, fmt.Errorf("cpio name: %s", err)
+		}
+		data := make([]byte, int(h.fileSize)+cpioPad(int(h.fileSize)))
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("cpio data: %s", err)
+		}
+
+		e := CpioEntry{
+			Name:      string(bytes.TrimRight(name[:h.nameSize], "\x00")),
+			Mode:      h.mode,
+			UID:       h.uid,
+			GID:       h.gid,
+			Mtime:     h.mtime,
+			RdevMajor: h.rdevMajor,
+			RdevMinor: h.rdevMinor,
+			Data:      data[:h.fileSize],
+		}
+		if e.Name == cpioTrailerName {
+			// a new archive can follow, the inodes start over
+			links = map[link][]int{}
+			continue
+		}
+
+		entries = append(entries, e)
+		if e.Type() == CpioModeRegular && h.nlink > 1 {
+			l := link{h.ino, h.devMajor, h.devMinor}
+			links[l] = append(links[l], len(entries)-1)
+			if len(e.Data) != 0 {
+				for _, i := range links[l] {
+					entries[i].Data = e.Data
+				}
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// WriteCpio writes the entries as a newc cpio archive, in the order given, followed by the
+// trailer. The inode numbers are assigned in order, so the same entries give the same archive.
+func WriteCpio(w io.Writer, entries []CpioEntry) error {
+	bw := bufio.NewWriter(w)
+
+	write := func(h cpioHeader, name string, data []byte) error {
+		h.nameSize = uint32(len(name) + 1)
+		h.fileSize = uint32(len(data))
+
+		var buf bytes.Buffer
+		buf.WriteString(cpioNewcMagic)
+		for _, f := range h.fields() {
+			fmt.Fprintf(&buf, "%08x", *f)
+		}
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		buf.Write(make([]byte, cpioPad(buf.Len())))
+		buf.Write(data)
+		buf.Write(make([]byte, cpioPad(len(data))))
+
+		_, err := bw.Write(buf.Bytes())
+		return err
+	}
+
+	for i, e := range entries {
+		if e.Name == "" || e.Name == cpioTrailerName {
+			return fmt.Errorf("invalid cpio entry name %q", e.Name)
+		}
+		h := cpioHeader{
+			ino:       cpioFirstIno + uint32(i),
+			mode:      e.Mode,
+			uid:       e.UID,
+			gid:       e.GID,
+			nlink:     1,
+			mtime:     e.Mtime,
+			rdevMajor: e.RdevMajor,
+			rdevMinor: e.RdevMinor,
+		}
+		if e.Type() == CpioModeDir {
+			h.nlink = 2
+		}
+		if err := write(h, e.Name, e.Data); err != nil {
+			return err
+		}
+	}
+
+	if err := write(cpioHeader{nlink: 1}, cpioTrailerName, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
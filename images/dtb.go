@@ -3,9 +3,7 @@ package images
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
 	"os"
-	"os/exec"
 )
 
 const (
@@ -69,17 +67,11 @@ func (d *Dtb) Hdr() *DtbHeader {
 	return &hdr
 }
 
-// ToDts dump to dts, two options
-// 1. dtc -I dtb -O dts -o d.ImagePath.dts d.ImagePath
-// 2. fdtdump d.ImagePath
-// choose 1
-func (d *Dtb) ToDts() error {
-	// dtc -I dtb -O dts -o d.ImagePath.dts d.ImagePath
-	cmdline := "dtc " + " -I dtb -O dts -o " + d.ImagePath + ".dts " + d.ImagePath
-	cmd := exec.Command("bash", "-c", cmdline)
-	err := cmd.Run()
+// ToDts return the dts decompiled from the dtb
+func (d *Dtb) ToDts() (string, error) {
+	fdt, err := d.Fdt()
 	if err != nil {
-		fmt.Println("dts dumped to ", d.ImagePath+".dts")
+		return "", err
 	}
-	return err
+	return fdt.Dts(), nil
 }
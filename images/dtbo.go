@@ -0,0 +1,228 @@
+package images
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+// The dtbo.img is the DT table [1] of the device tree overlays, the bootloader picks the
+// entries by the id, rev and custom fields and applies them to the base dtb.
+// [1] https://source.android.com/devices/architecture/dto/partitions
+
+const (
+	dtTableMagic      = 0xd7b7ab1e
+	dtTableHeaderSize = 32
+	dtTableEntrySize  = 32
+
+	// the compression of the entry of version 1, in the low 4 bits of the flags
+	dtCompressionNone = 0
+	dtCompressionZlib = 1
+	dtCompressionGzip = 2
+)
+
+// DtboHeader is the dt_table_header, big endian
+type DtboHeader struct {
+	Magic           uint32
+	TotalSize       uint32
+	HeaderSize      uint32
+	DtEntrySize     uint32
+	DtEntryCount    uint32
+	DtEntriesOffset uint32
+	PageSize        uint32
+	Version         uint32
+}
+
+// DtboEntry is the dt_table_entry, big endian.
+// For version 1, the low 4 bits of Custom[0] are the compression, the flags of v1.
+type DtboEntry struct {
+	DtSize   uint32
+	DtOffset uint32
+	ID       uint32
+	Rev      uint32
+	Custom   [4]uint32
+}
+
+// Dtbo is the dtbo.img
+type Dtbo struct {
+	// absolution path or the relative to current dir where the command is calling
+	ImagePath string
+}
+
+// DtboDt is a device tree in the dtbo.img, and the fields to pick it
+type DtboDt struct {
+	ID     uint32
+	Rev    uint32
+	Custom [4]uint32
+	// Dt is the dtb, uncompressed
+	Dt []byte
+}
+
+// String print the entry info
+func (e *DtboEntry) String() string {
+	return fmt.Sprintf("id 0x%x, rev 0x%x, custom [0x%x 0x%x 0x%x 0x%x], offset 0x%x, size 0x%x(%d)",
+		e.ID, e.Rev, e.Custom[0], e.Custom[1], e.Custom[2], e.Custom[3], e.DtOffset, e.DtSize, e.DtSize)
+}
+
+// IsDtbo is dtbo.img or not
+func (d *Dtbo) IsDtbo() bool {
+	_, err := d.Hdr()
+	return err == nil
+}
+
+// read return the header, entries and the content of the image
+func (d *Dtbo) read() (*DtboHeader, []DtboEntry, []byte, error) {
+	data, err := ioutil.ReadFile(d.ImagePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var hdr DtboHeader
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil || hdr.Magic != dtTableMagic {
+		return nil, nil, nil, fmt.Errorf("%s is not a dtbo image", d.ImagePath)
+	}
+	if hdr.DtEntrySize < dtTableEntrySize {
+		return nil, nil, nil, fmt.Errorf("%s: invalid dt entry size %d", d.ImagePath, hdr.DtEntrySize)
+	}
+
+	var entries []DtboEntry
+	for i := uint32(0); i < hdr.DtEntryCount; i++ {
+		off := uint64(hdr.DtEntriesOffset) + uint64(i)*uint64(hdr.DtEntrySize)
+		if off+dtTableEntrySize > uint64(len(data)) {
+			return nil, nil, nil, fmt.Errorf("%s is truncated", d.ImagePath)
+		}
+		var e DtboEntry
+		binary.Read(bytes.NewReader(data[off:]), binary.BigEndian, &e)
+		if uint64(e.DtOffset)+uint64(e.DtSize) > uint64(len(data)) {
+			return nil, nil, nil, fmt.Errorf("%s: entry %d is out of the image", d.ImagePath, i)
+		}
+		entries = append(entries, e)
+	}
+	return &hdr, entries, data, nil
+}
+
+// Hdr return the header of the dtbo.img
+func (d *Dtbo) Hdr() (*DtboHeader, error) {
+	hdr, _, _, err := d.read()
+	return hdr, err
+}
+
+// Entries return the entries of the dtbo.img
+func (d *Dtbo) Entries() ([]DtboEntry, error) {
+	_, entries, _, err := d.read()
+	return entries, err
+}
+
+// Dts return the device trees in the dtbo.img, decompressed
+func (d *Dtbo) Dts() ([]DtboDt, error) {
+	hdr, entries, data, err := d.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var dts []DtboDt
+	for i, e := range entries {
+		dt := DtboDt{ID: e.ID, Rev: e.Rev, Custom: e.Custom, Dt: data[e.DtOffset : e.DtOffset+e.DtSize]}
+		if hdr.Version == 1 {
+			if dt.Dt, err = dtDecompress(dt.Dt, e.Custom[0]&0xf); err != nil {
+				return nil, fmt.Errorf("%s: entry %d: %s", d.ImagePath, i, err)
+			}
+			dt.Custom[0] &^= 0xf
+		}
+		dts = append(dts, dt)
+	}
+	return dts, nil
+}
+
+// dtDecompress return the dt decompressed
+func dtDecompress(dt []byte, compression uint32) ([]byte, error) {
+	switch compression {
+	case dtCompressionNone:
+		return dt, nil
+	case dtCompressionZlib:
+		r, err := zlib.NewReader(bytes.NewReader(dt))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case dtCompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(dt))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("unknown compression %d", compression)
+}
+
+// Extract writes each device tree in the dtbo.img to prefix.N, N is the index from 0, as
+// mkdtboimg dump does
+func (d *Dtbo) Extract(prefix string) error {
+	dts, err := d.Dts()
+	if err != nil {
+		return err
+	}
+	for i, dt := range dts {
+		out := fmt.Sprintf("%s.%d", prefix, i)
+		if err := ioutil.WriteFile(out, dt.Dt, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("extract %s OK\n", out)
+	}
+	return nil
+}
+
+// BuildDtbo return the dtbo.img of version 0 with the device trees, the same as mkdtboimg
+// create. The device trees of the same content are stored once.
+func BuildDtbo(dts []DtboDt, pageSize uint32) []byte {
+	hdr := DtboHeader{
+		Magic:           dtTableMagic,
+		HeaderSize:      dtTableHeaderSize,
+		DtEntrySize:     dtTableEntrySize,
+		DtEntryCount:    uint32(len(dts)),
+		DtEntriesOffset: dtTableHeaderSize,
+		PageSize:        pageSize,
+	}
+
+	var blobs bytes.Buffer
+	offsets := map[string]uint32{}
+	start := uint32(dtTableHeaderSize + dtTableEntrySize*len(dts))
+	var entries []DtboEntry
+	for _, dt := range dts {
+		off, ok := offsets[string(dt.Dt)]
+		if !ok {
+			off = start + uint32(blobs.Len())
+			offsets[string(dt.Dt)] = off
+			blobs.Write(dt.Dt)
+		}
+		entries = append(entries, DtboEntry{
+			DtSize:   uint32(len(dt.Dt)),
+			DtOffset: off,
+			ID:       dt.ID,
+			Rev:      dt.Rev,
+			Custom:   dt.Custom,
+		})
+	}
+	hdr.TotalSize = start + uint32(blobs.Len())
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &hdr)
+	for i := range entries {
+		binary.Write(&buf, binary.BigEndian, &entries[i])
+	}
+	buf.Write(blobs.Bytes())
+	return buf.Bytes()
+}
+
+// Pack builds the dtbo.img with the device trees and writes it to ImagePath
+func (d *Dtbo) Pack(dts []DtboDt, pageSize uint32) error {
+	for i, dt := range dts {
+		if _, err := ParseFdt(dt.Dt); err != nil {
+			return fmt.Errorf("entry %d: %s", i, err)
+		}
+	}
+	return ioutil.WriteFile(d.ImagePath, BuildDtbo(dts, pageSize), 0644)
+}
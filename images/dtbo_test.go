@@ -0,0 +1,112 @@
+package images
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testOverlay return an overlay for testFdt, as dtc -@ compiles
+func testOverlay() *Fdt {
+	root := &FdtNode{}
+	frag0 := root.AddChild("fragment@0", FdtProperty{"target", CellsValue(0xffffffff)})
+	frag0.AddChild("__overlay__", FdtProperty{"assigned-clocks", CellsValue(0xffffffff, 3)})
+	frag1 := root.AddChild("fragment@1", FdtProperty{"target-path", []byte("/soc\x00")})
+	o := frag1.AddChild("__overlay__")
+	o.AddChild("led@0", FdtProperty{"phandle", CellsValue(1)})
+	o.AddChild("gpio-leds", FdtProperty{"leds", CellsValue(1)})
+	o.AddChild("serial@8b00000", FdtProperty{"status", []byte("disabled\x00")})
+	root.AddChild("__symbols__", FdtProperty{"led", []byte("/fragment@1/__overlay__/led@0\x00")})
+	root.AddChild("__fixups__",
+		FdtProperty{"crg", []byte("/fragment@0:target:0\x00/fragment@0/__overlay__:assigned-clocks:0\x00")})
+	lf := root.AddChild("__local_fixups__")
+	lf = lf.AddChild("fragment@1").AddChild("__overlay__")
+	lf.AddChild("gpio-leds", FdtProperty{"leds", CellsValue(0)})
+	return &Fdt{Root: root}
+}
+
+func TestApplyOverlay(t *testing.T) {
+	fdt := testFdt()
+	overlay := testOverlay()
+	data := overlay.Bytes()
+	assert.Nil(t, fdt.ApplyOverlay(overlay))
+	// the overlay is not changed
+	assert.Equal(t, data, overlay.Bytes())
+
+	assert.Equal(t, CellsValue(2, 3), fdt.Find("/soc/crg").Property("assigned-clocks").Value)
+	// the phandles of the overlay follow the ones of the base
+	assert.Equal(t, CellsValue(3), fdt.Find("/soc/led@0").Property("phandle").Value)
+	assert.Equal(t, CellsValue(3), fdt.Find("/soc/gpio-leds").Property("leds").Value)
+	serial := fdt.Find("serial0")
+	assert.Equal(t, "disabled", string(bytes.TrimRight(serial.Property("status").Value, "\x00")))
+	assert.Equal(t, 4, len(serial.Properties))
+	assert.Equal(t, []string{"led"}, fdt.Labels()["/soc/led@0"])
+	_, err := ParseFdt(fdt.Bytes())
+	assert.Nil(t, err)
+
+	// the label is not in the base
+	fdt = testFdt()
+	fdt.Root.Child("__symbols__").Properties = nil
+	data = fdt.Bytes()
+	assert.NotNil(t, fdt.ApplyOverlay(overlay))
+	// the tree is not changed
+	assert.Equal(t, data, fdt.Bytes())
+}
+
+func TestDtbo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dtbo")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	overlay := testOverlay().Bytes()
+	other := testFdt().Bytes()
+	dts := []DtboDt{
+		{ID: 0x1, Rev: 0x2, Dt: overlay},
+		{ID: 0x3, Custom: [4]uint32{1, 2, 3, 4}, Dt: other},
+		{ID: 0x4, Dt: overlay},
+	}
+	d := Dtbo{ImagePath: filepath.Join(dir, "dtbo.img")}
+	assert.Nil(t, d.Pack(dts, 4096))
+	assert.True(t, d.IsDtbo())
+
+	hdr, err := d.Hdr()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), hdr.DtEntryCount)
+	assert.Equal(t, uint32(4096), hdr.PageSize)
+	// the same overlay is stored once
+	assert.Equal(t, uint32(32+3*32+len(overlay)+len(other)), hdr.TotalSize)
+	entries, err := d.Entries()
+	assert.Nil(t, err)
+	assert.Equal(t, entries[0].DtOffset, entries[2].DtOffset)
+
+	read, err := d.Dts()
+	assert.Nil(t, err)
+	assert.Equal(t, dts, read)
+
+	assert.Nil(t, d.Extract(filepath.Join(dir, "dt")))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dt.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, other, data)
+
+	// version 1 with the entry compressed
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(overlay)
+	w.Close()
+	img := BuildDtbo([]DtboDt{{ID: 0x5, Custom: [4]uint32{dtCompressionZlib}, Dt: z.Bytes()}}, 2048)
+	binary.BigEndian.PutUint32(img[28:], 1)
+	assert.Nil(t, ioutil.WriteFile(d.ImagePath, img, 0644))
+	read, err = d.Dts()
+	assert.Nil(t, err)
+	assert.Equal(t, []DtboDt{{ID: 0x5, Dt: overlay}}, read)
+
+	d.ImagePath = filepath.Join(dir, "dt.1")
+	assert.False(t, d.IsDtbo())
+	assert.NotNil(t, d.Pack([]DtboDt{{Dt: []byte("not a dtb")}}, 2048))
+}
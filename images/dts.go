@@ -0,0 +1,180 @@
+package images
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fdtPhandleProps are the properties with phandles, each is followed by the arguments of the
+// number in the #cells property of the node it refers to, "" for no arguments.
+// The *-gpios properties are the same as gpios, and pinctrl-N are phandles.
+var fdtPhandleProps = map[string]string{
+	"interrupt-parent":    "",
+	"memory-region":       "",
+	"operating-points-v2": "",
+	"cpu-idle-states":     "",
+	"next-level-cache":    "",
+	"remote-endpoint":     "",
+	"nvmem-cells":         "",
+	"cpu":                 "",
+	"trip":                "",
+	"clocks":              "#clock-cells",
+	"assigned-clocks":     "#clock-cells",
+	"resets":              "#reset-cells",
+	"phys":                "#phy-cells",
+	"dmas":                "#dma-cells",
+	"power-domains":       "#power-domain-cells",
+	"iommus":              "#iommu-cells",
+	"mboxes":              "#mbox-cells",
+	"thermal-sensors":     "#thermal-sensor-cells",
+	"interrupts-extended": "#interrupt-cells",
+	"hwlocks":             "#hwlock-cells",
+	"io-channels":         "#io-channel-cells",
+	"sound-dai":           "#sound-dai-cells",
+	"cooling-device":      "#cooling-cells",
+	"gpios":               "#gpio-cells",
+}
+
+// phandleCells return the #cells property for the property with phandles, and if it is one
+func phandleCells(name string) (string, bool) {
+	if cells, ok := fdtPhandleProps[name]; ok {
+		return cells, true
+	}
+	if strings.HasSuffix(name, "-gpios") || strings.HasSuffix(name, "-gpio") {
+		return "#gpio-cells", true
+	}
+	if strings.HasPrefix(name, "pinctrl-") && strings.Trim(name[len("pinctrl-"):], "0123456789") == "" {
+		return "", true
+	}
+	return "", false
+}
+
+// dtsWriter writes the device tree as dts, the same as `dtc -O dts` but with the phandles
+// resolved to the labels, or the paths of the nodes if they have no label
+type dtsWriter struct {
+	sb       strings.Builder
+	phandles map[uint32]*FdtNode
+	labels   map[string][]string
+}
+
+// Dts return the device tree source
+func (f *Fdt) Dts() string {
+	w := dtsWriter{phandles: f.Phandles(), labels: f.Labels()}
+	w.sb.WriteString("/dts-v1/;\n\n")
+	for _, r := range f.Reserved {
+		fmt.Fprintf(&w.sb, "/memreserve/ 0x%016x 0x%016x;\n", r.Address, r.Size)
+	}
+	w.node(f.Root, 0)
+	return w.sb.String()
+}
+
+func (w *dtsWriter) node(n *FdtNode, depth int) {
+	indent := strings.Repeat("\t", depth)
+	name := n.Name
+	if n.Parent == nil {
+		name = "/"
+	}
+	w.sb.WriteString(indent)
+	for _, l := range w.labels[n.Path()] {
+		w.sb.WriteString(l + ": ")
+	}
+	w.sb.WriteString(name + " {\n")
+
+	for i := range n.Properties {
+		p := &n.Properties[i]
+		w.sb.WriteString(indent + "\t" + p.Name)
+		if len(p.Value) != 0 {
+			w.sb.WriteString(" = " + w.value(p))
+		}
+		w.sb.WriteString(";\n")
+	}
+	for _, c := range n.Children {
+		w.sb.WriteString("\n")
+		w.node(c, depth+1)
+	}
+	w.sb.WriteString(indent + "};\n")
+}
+
+// ref return the reference to the node
+func (w *dtsWriter) ref(n *FdtNode) string {
+	if l := w.labels[n.Path()]; len(l) != 0 {
+		return "&" + l[0]
+	}
+	return "&{" + n.Path() + "}"
+}
+
+// value return the property value in dts, the type is guessed from the name and the value,
+// as dtc does
+func (w *dtsWriter) value(p *FdtProperty) string {
+	if strs, ok := p.Strings(); ok {
+		quoted := make([]string, len(strs))
+		for i, s := range strs {
+			quoted[i] = dtsQuote(s)
+		}
+		return strings.Join(quoted, ", ")
+	}
+
+	cells, err := p.Cells()
+	if err != nil {
+		bytes := make([]string, len(p.Value))
+		for i, b := range p.Value {
+			bytes[i] = fmt.Sprintf("%02x", b)
+		}
+		return "[" + strings.Join(bytes, " ") + "]"
+	}
+
+	if refs, ok := w.phandleCells(p.Name, cells); ok {
+		return "<" + strings.Join(refs, " ") + ">"
+	}
+	strs := make([]string, len(cells))
+	for i, c := range cells {
+		strs[i] = fmt.Sprintf("0x%02x", c)
+	}
+	return "<" + strings.Join(strs, " ") + ">"
+}
+
+// phandleCells return the cells with the phandles resolved, false if it is not a property of
+// phandles, or any phandle can't be resolved
+func (w *dtsWriter) phandleCells(name string, cells []uint32) ([]string, bool) {
+	argsProp, ok := phandleCells(name)
+	if !ok || len(cells) == 0 {
+		return nil, false
+	}
+
+	var strs []string
+	for i := 0; i < len(cells); {
+		n := w.phandles[cells[i]]
+		if n == nil {
+			return nil, false
+		}
+		strs = append(strs, w.ref(n))
+		i++
+
+		args := 0
+		if argsProp != "" {
+			p := n.Property(argsProp)
+			if p == nil {
+				return nil, false
+			}
+			v, err := p.U32()
+			if err != nil {
+				return nil, false
+			}
+			args = int(v)
+		}
+		if i+args > len(cells) {
+			return nil, false
+		}
+		for _, c := range cells[i : i+args] {
+			strs = append(strs, fmt.Sprintf("0x%02x", c))
+		}
+		i += args
+	}
+	return strs, true
+}
+
+// dtsQuote return the string quoted as in dts
+func dtsQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`
+}
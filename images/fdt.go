@@ -0,0 +1,462 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// The flattened device tree (FDT), aka the dtb, follows the devicetree specification [1].
+// [1] https://github.com/devicetree-org/devicetree-specification/releases, chapter 5
+
+// the tokens in the structure block
+const (
+	fdtBeginNode = 0x1
+	fdtEndNode   = 0x2
+	fdtProp      = 0x3
+	fdtNop       = 0x4
+	fdtEnd       = 0x9
+
+	// the earliest version we can parse
+	fdtFirstVersion = 16
+)
+
+// FdtReserve is an entry of the memory reservation map
+type FdtReserve struct {
+	Address uint64
+	Size    uint64
+}
+
+// FdtProperty is a property of the node, the value is as it is in the dtb, big endian for
+// the cells
+type FdtProperty struct {
+	Name  string
+	Value []byte
+}
+
+// FdtNode is a node in the device tree
+type FdtNode struct {
+	// Name is with the unit address, e.g uart@f8b00000, it is "" for the root
+	Name       string
+	Properties []FdtProperty
+	Children   []*FdtNode
+	// Parent is nil for the root
+	Parent *FdtNode
+}
+
+// Fdt is the device tree in the dtb
+type Fdt struct {
+	Header   DtbHeader
+	Reserved []FdtReserve
+	Root     *FdtNode
+}
+
+// Fdt parses the dtb
+func (d *Dtb) Fdt() (*Fdt, error) {
+	data, err := ioutil.ReadFile(d.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	fdt, err := ParseFdt(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", d.ImagePath, err)
+	}
+	return fdt, nil
+}
+
+// ParseFdt parses the dtb in data, the data after the totalsize in the header is ignored
+func ParseFdt(data []byte) (*Fdt, error) {
+	var fdt Fdt
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &fdt.Header); err != nil {
+		return nil, fmt.Errorf("not a dtb, %s", err)
+	}
+	h := &fdt.Header
+	if h.Magic != dtbHeaderMagic {
+		return nil, fmt.Errorf("not a dtb, magic 0x%x", h.Magic)
+	}
+	if uint64(h.TotalSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("dtb truncated, %d bytes of %d", len(data), h.TotalSize)
+	}
+	if h.Version < fdtFirstVersion {
+		return nil, fmt.Errorf("dtb version %d is not supported", h.Version)
+	}
+	data = data[:h.TotalSize]
+
+	// the memory reservation map ends with an entry of 0s
+	for off := uint64(h.OffMemRsvmap); ; off += 16 {
+		if off+16 > uint64(len(data)) {
+			return nil, fmt.Errorf("memory reservation map truncated")
+		}
+		r := FdtReserve{
+			Address: binary.BigEndian.Uint64(data[off:]),
+			Size:    binary.BigEndian.Uint64(data[off+8:]),
+		}
+		if r.Address == 0 && r.Size == 0 {
+			break
+		}
+		fdt.Reserved = append(fdt.Reserved, r)
+	}
+
+	if uint64(h.OffDtStrings)+uint64(h.SizeDtStrings) > uint64(len(data)) {
+		return nil, fmt.Errorf("strings block out of the dtb")
+	}
+	strs := data[h.OffDtStrings : h.OffDtStrings+h.SizeDtStrings]
+	// v16 has no size of the structure block
+	end := uint64(len(data))
+	if h.SizeDtStruct != 0 {
+		end = uint64(h.OffDtStruct) + uint64(h.SizeDtStruct)
+	}
+	if uint64(h.OffDtStruct) > end || end > uint64(len(data)) {
+		return nil, fmt.Errorf("structure block out of the dtb")
+	}
+
+	p := fdtParser{data: data[h.OffDtStruct:end], strs: strs}
+	root, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("structure block at 0x%x: %s", uint64(h.OffDtStruct)+uint64(p.off), err)
+	}
+	fdt.Root = root
+	return &fdt, nil
+}
+
+type fdtParser struct {
+	data []byte
+	strs []byte
+	off  int
+}
+
+func (p *fdtParser) u32() (uint32, error) {
+	if p.off+4 > len(p.data) {
+		return 0, fmt.Errorf("truncated")
+	}
+	v := binary.BigEndian.Uint32(p.data[p.off:])
+	p.off += 4
+	return v, nil
+}
+
+// fdtString return the null terminated string at off in b
+func fdtString(b []byte, off int) (string, error) {
+	if off < 0 || off >= len(b) {
+		return "", fmt.Errorf("string offset %d out of range", off)
+	}
+	i := bytes.IndexByte(b[off:], 0)
+	if i < 0 {
+		return "", fmt.Errorf("string at %d not terminated", off)
+	}
+	return string(b[off : off+i]), nil
+}
+
+// align4 return n aligned to 4
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// parse return the root node, the nodes are nested between the begin and end node tokens
+func (p *fdtParser) parse() (*FdtNode, error) {
+	var root, node *FdtNode
+	for {
+		token, err := p.u32()
+		if err != nil {
+			return nil, err
+		}
+
+		switch token {
+		case fdtBeginNode:
+			name, err := fdtString(p.data, p.off)
+			if err != nil {
+				return nil, err
+			}
+			p.off = align4(p.off + len(name) + 1)
+			n := &FdtNode{Name: name, Parent: node}
+			if node == nil {
+				if root != nil {
+					return nil, fmt.Errorf("more than one root node")
+				}
+				root = n
+			} else {
+				node.Children = append(node.Children, n)
+			}
+			node = n
+		case fdtEndNode:
+			if node == nil {
+				return nil, fmt.Errorf("unexpected end of node")
+			}
+			node = node.Parent
+		case fdtProp:
+			if node == nil {
+				return nil, fmt.Errorf("property out of node")
+			}
+			size, err := p.u32()
+			if err != nil {
+				return nil, err
+			}
+			nameOff, err := p.u32()
+			if err != nil {
+				return nil, err
+			}
+			name, err := fdtString(p.strs, int(nameOff))
+			if err != nil {
+				return nil, err
+			}
+			if uint64(p.off)+uint64(size) > uint64(len(p.data)) {
+				return nil, fmt.Errorf("property %s truncated", name)
+			}
+			value := p.data[p.off : p.off+int(size)]
+			p.off = align4(p.off + int(size))
+			node.Properties = append(node.Properties, FdtProperty{Name: name, Value: value})
+		case fdtNop:
+		case fdtEnd:
+			if node != nil || root == nil {
+				return nil, fmt.Errorf("unexpected end of the structure block")
+			}
+			return root, nil
+		default:
+			return nil, fmt.Errorf("unknown token 0x%x", token)
+		}
+	}
+}
+
+// Path return the full path of the node, e.g /soc/uart@f8b00000
+func (n *FdtNode) Path() string {
+	if n.Parent == nil {
+		return "/"
+	}
+	if n.Parent.Parent == nil {
+		return "/" + n.Name
+	}
+	return n.Parent.Path() + "/" + n.Name
+}
+
+// Property return the property of the name, or nil
+func (n *FdtNode) Property(name string) *FdtProperty {
+	for i := range n.Properties {
+		if n.Properties[i].Name == name {
+			return &n.Properties[i]
+		}
+	}
+	return nil
+}
+
+// Child return the child of the name, or nil. The unit address can be omitted if there is
+// only one child of the name, as in the device tree path.
+func (n *FdtNode) Child(name string) *FdtNode {
+	var found *FdtNode
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	if strings.Contains(name, "@") {
+		return nil
+	}
+	for _, c := range n.Children {
+		if strings.SplitN(c.Name, "@", 2)[0] == name {
+			if found != nil {
+				return nil
+			}
+			found = c
+		}
+	}
+	return found
+}
+
+// AddChild adds the node of the name with the properties as the last child, and return it
+func (n *FdtNode) AddChild(name string, props ...FdtProperty) *FdtNode {
+	c := &FdtNode{Name: name, Parent: n, Properties: props}
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// Walk calls fn for the node and all its descendants, parents first
+func (n *FdtNode) Walk(fn func(*FdtNode)) {
+	fn(n)
+	for _, c := range n.Children {
+		c.Walk(fn)
+	}
+}
+
+// Find return the node of the path, or nil. The path can start with an alias, e.g serial0.
+func (f *Fdt) Find(path string) *FdtNode {
+	if !strings.HasPrefix(path, "/") {
+		alias := strings.SplitN(path, "/", 2)
+		aliases := f.Root.Child("aliases")
+		if aliases == nil {
+			return nil
+		}
+		p := aliases.Property(alias[0])
+		if p == nil {
+			return nil
+		}
+		target, ok := p.StringValue()
+		if !ok || !strings.HasPrefix(target, "/") {
+			return nil
+		}
+		if len(alias) > 1 {
+			target += "/" + alias[1]
+		}
+		return f.Find(target)
+	}
+
+	n := f.Root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if n = n.Child(name); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// Phandles return the nodes by phandle
+func (f *Fdt) Phandles() map[uint32]*FdtNode {
+	phandles := map[uint32]*FdtNode{}
+	f.Root.Walk(func(n *FdtNode) {
+		for _, name := range []string{"phandle", "linux,phandle"} {
+			if p := n.Property(name); p != nil {
+				if v, err := p.U32(); err == nil {
+					phandles[v] = n
+				}
+			}
+		}
+	})
+	return phandles
+}
+
+// Labels return the labels of the nodes by path, from the /__symbols__ node, which is in
+// the dtb compiled with dtc -@
+func (f *Fdt) Labels() map[string][]string {
+	labels := map[string][]string{}
+	symbols := f.Root.Child("__symbols__")
+	if symbols == nil {
+		return labels
+	}
+	for _, p := range symbols.Properties {
+		if path, ok := p.StringValue(); ok {
+			labels[path] = append(labels[path], p.Name)
+		}
+	}
+	for _, l := range labels {
+		sort.Strings(l)
+	}
+	return labels
+}
+
+// CellsValue return the value of the property of the cells, big endian
+func CellsValue(cells ...uint32) []byte {
+	b := make([]byte, 4*len(cells))
+	for i, c := range cells {
+		binary.BigEndian.PutUint32(b[i*4:], c)
+	}
+	return b
+}
+
+// U32 return the value as one cell
+func (p *FdtProperty) U32() (uint32, error) {
+	if len(p.Value) != 4 {
+		return 0, fmt.Errorf("%s is not one cell", p.Name)
+	}
+	return binary.BigEndian.Uint32(p.Value), nil
+}
+
+// Cells return the value as cells, it is error if the size is not multiple of 4
+func (p *FdtProperty) Cells() ([]uint32, error) {
+	if len(p.Value)%4 != 0 {
+		return nil, fmt.Errorf("%s is not cells", p.Name)
+	}
+	cells := make([]uint32, len(p.Value)/4)
+	for i := range cells {
+		cells[i] = binary.BigEndian.Uint32(p.Value[i*4:])
+	}
+	return cells, nil
+}
+
+// Strings return the value as a string list, false if it is not
+func (p *FdtProperty) Strings() ([]string, bool) {
+	v := p.Value
+	if len(v) == 0 || v[len(v)-1] != 0 {
+		return nil, false
+	}
+	strs := strings.Split(string(v[:len(v)-1]), "\x00")
+	for _, s := range strs {
+		if s == "" {
+			return nil, false
+		}
+		for _, c := range []byte(s) {
+			if (c < 0x20 || c > 0x7e) && c != '\t' && c != '\n' && c != '\r' {
+				return nil, false
+			}
+		}
+	}
+	return strs, true
+}
+
+// StringValue return the value as a string, false if it is not
+func (p *FdtProperty) StringValue() (string, bool) {
+	strs, ok := p.Strings()
+	if !ok || len(strs) != 1 {
+		return "", false
+	}
+	return strs[0], true
+}
+
+// Bytes return the dtb of the device tree, in version 17 and the same layout as dtc: the
+// header, the memory reservation map, the structure block and then the strings block
+func (f *Fdt) Bytes() []byte {
+	var strs []byte
+	strOffs := map[string]int{}
+	var st []byte
+	u32 := func(v uint32) {
+		st = append(st, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+
+	var node func(n *FdtNode)
+	node = func(n *FdtNode) {
+		u32(fdtBeginNode)
+		st = append(st, n.Name...)
+		st = append(st, make([]byte, align4(len(n.Name)+1)-len(n.Name))...)
+		for _, p := range n.Properties {
+			off, ok := strOffs[p.Name]
+			if !ok {
+				off = len(strs)
+				strOffs[p.Name] = off
+				strs = append(append(strs, p.Name...), 0)
+			}
+			u32(fdtProp)
+			u32(uint32(len(p.Value)))
+			u32(uint32(off))
+			st = append(st, p.Value...)
+			st = append(st, make([]byte, align4(len(p.Value))-len(p.Value))...)
+		}
+		for _, c := range n.Children {
+			node(c)
+		}
+		u32(fdtEndNode)
+	}
+	node(f.Root)
+	u32(fdtEnd)
+
+	h := f.Header
+	h.Magic = dtbHeaderMagic
+	h.Version = 17
+	h.LastCompVersion = 16
+	h.OffMemRsvmap = uint32(binary.Size(h))
+	h.OffDtStruct = h.OffMemRsvmap + uint32(16*(len(f.Reserved)+1))
+	h.SizeDtStruct = uint32(len(st))
+	h.OffDtStrings = h.OffDtStruct + h.SizeDtStruct
+	h.SizeDtStrings = uint32(len(strs))
+	h.TotalSize = h.OffDtStrings + h.SizeDtStrings
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &h)
+	for _, r := range append(f.Reserved, FdtReserve{}) {
+		binary.Write(&buf, binary.BigEndian, &r)
+	}
+	buf.Write(st)
+	buf.Write(strs)
+	return buf.Bytes()
+}
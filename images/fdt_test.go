@@ -0,0 +1,107 @@
+package images
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testFdt return a device tree like the poplar one
+func testFdt() *Fdt {
+	root := &FdtNode{Properties: []FdtProperty{
+		{"compatible", []byte("hisilicon,hi3798cv200-poplar\x00hisilicon,hi3798cv200\x00")},
+		{"#address-cells", CellsValue(2)},
+		{"interrupt-parent", CellsValue(1)},
+	}}
+	root.AddChild("aliases", FdtProperty{"serial0", []byte("/soc/serial@8b00000\x00")})
+	soc := root.AddChild("soc", FdtProperty{"ranges", nil})
+	soc.AddChild("interrupt-controller@f1001000",
+		FdtProperty{"#interrupt-cells", CellsValue(3)}, FdtProperty{"phandle", CellsValue(1)})
+	soc.AddChild("crg@8a22000", FdtProperty{"#clock-cells", CellsValue(1)}, FdtProperty{"phandle", CellsValue(2)})
+	soc.AddChild("serial@8b00000",
+		FdtProperty{"clocks", CellsValue(2, 5, 2, 6)},
+		FdtProperty{"clock-names", []byte("uartclk\x00apb_pclk\x00")},
+		FdtProperty{"status", []byte("okay\x00")},
+		FdtProperty{"local-mac-address", []byte{1, 2, 3, 4, 5, 6}})
+	root.AddChild("__symbols__", FdtProperty{"crg", []byte("/soc/crg@8a22000\x00")})
+	return &Fdt{Root: root, Reserved: []FdtReserve{{Address: 0x80000000, Size: 0x100000}}}
+}
+
+func TestFdt(t *testing.T) {
+	data := testFdt().Bytes()
+	fdt, err := ParseFdt(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(17), fdt.Header.Version)
+	assert.Equal(t, uint32(len(data)), fdt.Header.TotalSize)
+	assert.Equal(t, []FdtReserve{{Address: 0x80000000, Size: 0x100000}}, fdt.Reserved)
+	// encode what is parsed gives the same dtb
+	assert.Equal(t, data, fdt.Bytes())
+
+	serial := fdt.Find("/soc/serial@8b00000")
+	assert.NotNil(t, serial)
+	assert.Equal(t, serial, fdt.Find("serial0"))
+	assert.Equal(t, serial, fdt.Find("/soc/serial"))
+	assert.Equal(t, "/soc/serial@8b00000", serial.Path())
+	assert.Nil(t, fdt.Find("/soc/gpio"))
+
+	names, ok := serial.Property("clock-names").Strings()
+	assert.True(t, ok)
+	assert.Equal(t, []string{"uartclk", "apb_pclk"}, names)
+	_, ok = serial.Property("clocks").Strings()
+	assert.False(t, ok)
+	c, err := serial.Property("clocks").Cells()
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{2, 5, 2, 6}, c)
+	assert.Equal(t, "crg@8a22000", fdt.Phandles()[2].Name)
+
+	_, err = ParseFdt(data[:len(data)-1])
+	assert.NotNil(t, err)
+	_, err = ParseFdt(data[4:])
+	assert.NotNil(t, err)
+}
+
+func TestDts(t *testing.T) {
+	assert.Equal(t, `/dts-v1/;
+
+/memreserve/ 0x0000000080000000 0x0000000000100000;
+/ {
+	compatible = "hisilicon,hi3798cv200-poplar", "hisilicon,hi3798cv200";
+	#address-cells = <0x02>;
+	interrupt-parent = <&{/soc/interrupt-controller@f1001000}>;
+
+	aliases {
+		serial0 = "/soc/serial@8b00000";
+	};
+
+	soc {
+		ranges;
+
+		interrupt-controller@f1001000 {
+			#interrupt-cells = <0x03>;
+			phandle = <0x01>;
+		};
+
+		crg: crg@8a22000 {
+			#clock-cells = <0x01>;
+			phandle = <0x02>;
+		};
+
+		serial@8b00000 {
+			clocks = <&crg 0x05 &crg 0x06>;
+			clock-names = "uartclk", "apb_pclk";
+			status = "okay";
+			local-mac-address = [01 02 03 04 05 06];
+		};
+	};
+
+	__symbols__ {
+		crg = "/soc/crg@8a22000";
+	};
+};
+`, testFdt().Dts())
+
+	// the phandle not found is kept as it is
+	fdt := testFdt()
+	fdt.Find("serial0").Property("clocks").Value = CellsValue(9, 5)
+	assert.Contains(t, fdt.Dts(), "clocks = <0x09 0x05>;")
+}
@@ -0,0 +1,252 @@
+package images
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The kernel configs Android requires are in the fragments of kernel/configs [1], the
+// android-base.config ones are mandatory and checked by VTS.
+// [1] https://android.googlesource.com/kernel/configs/
+
+// androidReleases are the Android releases by the letter, oldest first
+var androidReleases = []struct {
+	letter, name, version string
+}{
+	{"o", "oreo", "8"},
+	{"p", "pie", "9"},
+	{"q", "10", "10"},
+	{"r", "11", "11"},
+	{"s", "12", "12"},
+	{"t", "13", "13"},
+	{"u", "14", "14"},
+}
+
+// AndroidRelease return the letter of the Android release, e.g o for "Android O", "Oreo",
+// "8" or "8.1.0"
+func AndroidRelease(android string) (string, error) {
+	v := strings.ToLower(strings.TrimSpace(android))
+	v = strings.TrimSpace(strings.TrimPrefix(v, "android"))
+	for _, r := range androidReleases {
+		if v == r.letter || v == r.name || v == r.version || strings.HasPrefix(v, r.version+".") {
+			return r.letter, nil
+		}
+	}
+	return "", fmt.Errorf("unknown Android release %q", android)
+}
+
+// androidKconfigs are the android-base requirements, each applies to the releases listed by
+// the letters. It is the common part of the fragments of all kernel versions, the full ones
+// can be loaded with LoadKconfigFragment.
+var androidKconfigs = []struct {
+	releases string
+	fragment string
+}{
+	{"opqrstu", `
+# CONFIG_DEVKMEM is not set
+# CONFIG_DEVMEM is not set
+# CONFIG_FHANDLE is not set
+# CONFIG_NFSD is not set
+# CONFIG_NFS_FS is not set
+# CONFIG_SYSVIPC is not set
+# CONFIG_USELIB is not set
+CONFIG_ANDROID=y
+CONFIG_ANDROID_BINDER_IPC=y
+CONFIG_AUDIT=y
+CONFIG_BLK_DEV_INITRD=y
+CONFIG_CGROUPS=y
+CONFIG_CGROUP_CPUACCT=y
+CONFIG_CGROUP_FREEZER=y
+CONFIG_CGROUP_SCHED=y
+CONFIG_DEFAULT_SECURITY_SELINUX=y
+CONFIG_EMBEDDED=y
+CONFIG_HIGH_RES_TIMERS=y
+CONFIG_IKCONFIG=y
+CONFIG_IKCONFIG_PROC=y
+CONFIG_INOTIFY_USER=y
+CONFIG_IPV6=y
+CONFIG_MODULES=y
+CONFIG_NET=y
+CONFIG_NETFILTER=y
+CONFIG_PM_WAKELOCKS=y
+CONFIG_PREEMPT=y
+CONFIG_PROFILING=y
+CONFIG_QUOTA=y
+CONFIG_RTC_CLASS=y
+CONFIG_SECCOMP=y
+CONFIG_SECURITY=y
+CONFIG_SECURITY_NETWORK=y
+CONFIG_SECURITY_SELINUX=y
+CONFIG_STAGING=y
+CONFIG_TUN=y
+CONFIG_UNIX=y
+CONFIG_XFRM_USER=y
+`},
+	{"op", `
+CONFIG_ANDROID_LOW_MEMORY_KILLER=y
+`},
+	{"opqr", `
+CONFIG_ASHMEM=y
+`},
+	{"opq", `
+CONFIG_ANDROID_BINDER_DEVICES="binder,hwbinder,vndbinder"
+`},
+	{"pqrstu", `
+CONFIG_BPF_SYSCALL=y
+CONFIG_CGROUP_BPF=y
+CONFIG_SECCOMP_FILTER=y
+`},
+	{"rstu", `
+CONFIG_PSI=y
+`},
+}
+
+// featureKconfigs are the kernel configs the HALs need, by the HAL name, and usb_gadget for
+// adb. m is for the ones can be modules, which are satisfied by y as well.
+var featureKconfigs = map[string]string{
+	"audio":      "CONFIG_SND=m",
+	"bluetooth":  "CONFIG_BT=m",
+	"camera":     "CONFIG_MEDIA_SUPPORT=m",
+	"nfc":        "CONFIG_NFC=m",
+	"wifi":       "CONFIG_CFG80211=m",
+	"usb_gadget": "CONFIG_USB_GADGET=y\nCONFIG_USB_CONFIGFS=y\nCONFIG_USB_CONFIGFS_F_FS=y",
+}
+
+// KconfigFragment is the kernel configs required, in the .config format, see ParseConfigs
+type KconfigFragment struct {
+	// Source is where the requirements are from, e.g the file
+	Source  string
+	Configs map[string]string
+}
+
+// parseFragment return the fragment, the built in ones are always valid
+func parseFragment(source, fragment string) KconfigFragment {
+	configs, err := ParseConfigs(strings.NewReader(fragment))
+	if err != nil {
+		panic(err)
+	}
+	return KconfigFragment{Source: source, Configs: configs}
+}
+
+// AndroidKconfigFragment return the android-base requirements of the Android release, see
+// AndroidRelease
+func AndroidKconfigFragment(android string) (KconfigFragment, error) {
+	release, err := AndroidRelease(android)
+	if err != nil {
+		return KconfigFragment{}, err
+	}
+	var fragment []string
+	for _, k := range androidKconfigs {
+		if strings.Contains(k.releases, release) {
+			fragment = append(fragment, k.fragment)
+		}
+	}
+	return parseFragment("android-base ("+release+")", strings.Join(fragment, "\n")), nil
+}
+
+// FeatureKconfigFragment return the requirements of the HAL or usb_gadget, false if there
+// is none
+func FeatureKconfigFragment(feature string) (KconfigFragment, bool) {
+	fragment, ok := featureKconfigs[feature]
+	if !ok {
+		return KconfigFragment{}, false
+	}
+	return parseFragment(feature, fragment), true
+}
+
+// LoadKconfigFragment loads the requirements from the fragment file, e.g the
+// android-base.config in kernel/configs
+func LoadKconfigFragment(path string) (KconfigFragment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return KconfigFragment{}, err
+	}
+	defer f.Close()
+	configs, err := ParseConfigs(f)
+	if err != nil {
+		return KconfigFragment{}, fmt.Errorf("%s: %s", path, err)
+	}
+	return KconfigFragment{Source: path, Configs: configs}, nil
+}
+
+// KconfigMismatch is a kernel config not as required
+type KconfigMismatch struct {
+	Option string
+	// Want is the value required, Got is the one of the kernel, n if it is not set
+	Want   string
+	Got    string
+	Source string
+	// Conflict is the other fragment requiring a value that can't be met with Want, it is
+	// reported whatever the kernel has
+	Conflict     string
+	ConflictWant string
+}
+
+func (m KconfigMismatch) String() string {
+	if m.Conflict != "" {
+		return fmt.Sprintf("%s, %s requires %s but %s requires %s",
+			m.Option, m.Source, m.Want, m.Conflict, m.ConflictWant)
+	}
+	got := m.Option + "=" + m.Got
+	if m.Got == "n" {
+		got = m.Option + " is not set"
+	}
+	return fmt.Sprintf("%s, %s requires %s", got, m.Source, m.Want)
+}
+
+// kconfigStricter return the value that meets both a and b, y for y and m, false if none does
+func kconfigStricter(a, b string) (string, bool) {
+	if a == b {
+		return a, true
+	}
+	if (a == "y" && b == "m") || (a == "m" && b == "y") {
+		return "y", true
+	}
+	return "", false
+}
+
+// CheckKconfig return the configs not as the fragments require, sorted by the option.
+// If the fragments require the same option differently, the strictest one is kept, e.g
+// y over m, and the ones can't be met together are reported as a conflict. The options not
+// in the configs are n, and m is satisfied by y.
+func CheckKconfig(configs map[string]string, fragments ...KconfigFragment) []KconfigMismatch {
+	required := map[string]KconfigMismatch{}
+	for _, f := range fragments {
+		for option, want := range f.Configs {
+			m, ok := required[option]
+			if !ok {
+				required[option] = KconfigMismatch{Option: option, Want: want, Source: f.Source}
+				continue
+			}
+			if m.Conflict != "" {
+				continue
+			}
+			v, ok := kconfigStricter(m.Want, want)
+			if !ok {
+				m.Conflict, m.ConflictWant = f.Source, want
+			} else if v != m.Want {
+				m.Want, m.Source = v, f.Source
+			}
+			required[option] = m
+		}
+	}
+
+	var mismatches []KconfigMismatch
+	for option, m := range required {
+		got, ok := configs[option]
+		if !ok {
+			got = "n"
+		}
+		if m.Conflict == "" && (got == m.Want || (m.Want == "m" && got == "y")) {
+			continue
+		}
+		m.Got = got
+		mismatches = append(mismatches, m)
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Option < mismatches[j].Option
+	})
+	return mismatches
+}
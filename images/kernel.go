@@ -1,12 +1,15 @@
 package images
 
 import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os/exec"
-	"path/filepath"
 	"strings"
-
-	"github.com/pierrchen/avs/utils"
 )
 
 // Kernel image
@@ -15,64 +18,319 @@ type Kernel struct {
 	ImagePath string
 }
 
+const (
+	// the kernel config built in with CONFIG_IKCONFIG, gzip compressed between the markers,
+	// see kernel/configs.c
+	ikconfigStart = "IKCFG_ST"
+	ikconfigEnd   = "IKCFG_ED"
+
+	linuxBanner = "Linux version "
+)
+
+// kernelCompression is a compression the kernel can be in, the Image.gz as a whole or the
+// payload of the self decompressing zImage and bzImage
+type kernelCompression struct {
+	name  string
+	magic []byte
+	// decompress return what is decompressed, which may be partial if the data is followed
+	// by something else
+	decompress func(data []byte) ([]byte, error)
+}
+
+var kernelCompressions = []kernelCompression{
+	{"gzip", []byte{0x1f, 0x8b, 0x08}, gunzip},
+	{"lz4", []byte{0x02, 0x21, 0x4c, 0x18}, lz4LegacyDecompress},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, func(data []byte) ([]byte, error) {
+		return decompressCommand("xz", data)
+	}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, func(data []byte) ([]byte, error) {
+		return decompressCommand("zstd", data)
+	}},
+	{"bzip2", []byte("BZh"), func(data []byte) ([]byte, error) {
+		return ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	}},
+}
+
+// gunzip decompresses the first gzip member in data, the data after it is ignored
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	r.Multistream(false)
+	return ioutil.ReadAll(r)
+}
+
 func commandInstalled(cmd string) bool {
-	cmdLine := "which " + cmd
-	c := exec.Command("bash", "-c", cmdLine)
-	o, _ := c.Output()
-	if string(o) == "" {
-		return false
+	_, err := exec.LookPath(cmd)
+	return err == nil
+}
+
+// decompressCommand decompresses the data with the command, xz or zstd, there is no
+// decompressor of them in the go standard library
+func decompressCommand(cmd string, data []byte) ([]byte, error) {
+	if !commandInstalled(cmd) {
+		return nil, fmt.Errorf("command %s isn't installed, it is needed for the %s compressed kernel", cmd, cmd)
 	}
-	return true
+	c := exec.Command(cmd, "-dc")
+	c.Stdin = bytes.NewReader(data)
+	var out bytes.Buffer
+	c.Stdout = &out
+	// the trailing data is an error, but what is before it is good
+	err := c.Run()
+	return out.Bytes(), err
 }
 
-// Configs return the configs file of the Kernel
-// https://github.com/torvalds/linux/blob/master/scripts/extract-ikconfig
-// It assume extract-ikconfig is inside of the $PATH
-func (k *Kernel) Configs() (string, error) {
-	img, err := filepath.Abs(k.ImagePath)
+// Data return the kernel uncompressed. The uncompressed arm64 and RISC-V Image are told by the
+// header, the Image.gz and the like are decompressed as a whole, the bzImage has the payload
+// in the header, and the zImage is searched for the compressed kernel in it, the same as the
+// extract-vmlinux and extract-ikconfig scripts in the kernel. The first decompression with the
+// banner is the kernel.
+func (k *Kernel) Data() ([]byte, error) {
+	data, err := ioutil.ReadFile(k.ImagePath)
 	if err != nil {
-		return "", fmt.Errorf("can't find image %s", img)
+		return nil, err
+	}
+	if arch, _ := kernelArch(data); arch != "" {
+		return data, nil
 	}
 
-	if r, _ := utils.FileExists(img); r == false {
-		return "", fmt.Errorf("can't find image %s", img)
+	var errs []string
+	tried := map[int64]bool{}
+	decompress := func(c kernelCompression, off int64) []byte {
+		if tried[off] {
+			return nil
+		}
+		tried[off] = true
+		out, err := c.decompress(data[off:])
+		if bytes.Contains(out, []byte(linuxBanner)) {
+			return out
+		}
+		if err != nil && off == 0 {
+			errs = append(errs, fmt.Sprintf("%s: %s", c.name, err))
+		}
+		return nil
+	}
+	// the payload is since boot protocol 2.08
+	offsets := []int64{0}
+	var hdr BzImageHeader
+	if decodeHeader(data, bzImageHeaderStart, &hdr) && hdr.BootFlag == bzImageBootFlag &&
+		string(hdr.Header[:]) == bzImageHeaderMagic && hdr.Version >= 0x208 {
+		offsets = append(offsets, hdr.setupSize()+int64(hdr.PayloadOffset))
+	}
+	for _, off := range offsets {
+		for _, c := range kernelCompressions {
+			if off < int64(len(data)) && bytes.HasPrefix(data[off:], c.magic) {
+				if out := decompress(c, off); out != nil {
+					return out, nil
+				}
+			}
+		}
 	}
 
-	extractTool := "extract-ikconfig"
+	// the banner can be in the compressed data, as the literals of lz4, so the raw data is
+	// the last to try
+	for _, c := range kernelCompressions {
+		for off := 0; ; off++ {
+			i := bytes.Index(data[off:], c.magic)
+			if i < 0 {
+				break
+			}
+			off += i
+			if out := decompress(c, int64(off)); out != nil {
+				return out, nil
+			}
+		}
+	}
+	if bytes.Contains(data, []byte(linuxBanner)) {
+		return data, nil
+	}
+	if len(errs) != 0 {
+		return nil, fmt.Errorf("%s: can't find the kernel, %s", k.ImagePath, strings.Join(errs, ", "))
+	}
+	return nil, fmt.Errorf("%s: can't find the kernel, it is not a kernel or in an unknown compression", k.ImagePath)
+}
 
-	if !commandInstalled(extractTool) {
-		return "", fmt.Errorf("command %s ins't installed, get it from %s and install it to $PATH",
-			extractTool, "https://github.com/torvalds/linux/blob/master/scripts/extract-ikconfig")
+// Configs return the configs file of the Kernel, built in with CONFIG_IKCONFIG, as the
+// extract-ikconfig script does
+func (k *Kernel) Configs() (string, error) {
+	data, err := k.Data()
+	if err != nil {
+		return "", err
+	}
+	i := bytes.Index(data, []byte(ikconfigStart))
+	if i < 0 {
+		return "", fmt.Errorf("%s: no kernel config, is it built with CONFIG_IKCONFIG?", k.ImagePath)
+	}
+	data = data[i+len(ikconfigStart):]
+	if i := bytes.Index(data, []byte(ikconfigEnd)); i >= 0 {
+		data = data[:i]
 	}
+	config, err := gunzip(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: kernel config: %s", k.ImagePath, err)
+	}
+	return string(config), nil
+}
 
-	cmdLine := "extract-ikconfig " + img
-	cmd := exec.Command("bash", "-c", cmdLine)
+// ConfigMap return the configs of the Kernel, see ParseConfigs
+func (k *Kernel) ConfigMap() (map[string]string, error) {
+	configs, err := k.Configs()
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfigs(strings.NewReader(configs))
+}
 
-	config, err := cmd.Output()
-	return string(config), nil
+// ParseConfigs parses the kernel .config, or the fragment of it, the key is the option
+// e.g CONFIG_USB, the value is as it is in the file, e.g y, m, 0x1000 or "quoted string",
+// and n for "# CONFIG_USB is not set".
+func ParseConfigs(r io.Reader) (map[string]string, error) {
+	configs := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "# CONFIG_") && strings.HasSuffix(line, " is not set") {
+			configs[strings.TrimSuffix(line[2:], " is not set")] = "n"
+			continue
+		}
+		if !strings.HasPrefix(line, "CONFIG_") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid config %q", line)
+		}
+		configs[kv[0]] = kv[1]
+	}
+	return configs, scanner.Err()
 }
 
-// Version returns the version of the Kernel
-func (k *Kernel) Version() (string, error) {
+// KernelVersion is the version banner of the kernel, e.g
+// Linux version 4.9.37 (user@host) (gcc version 6.3.1 20170404 (Linaro GCC 6.3-2017.05) ) #1 SMP PREEMPT Thu Jan 4 10:11:12 CST 2018
+type KernelVersion struct {
+	// Banner is the whole line
+	Banner string
+	// Release is the uname -r, e.g 4.9.37
+	Release   string
+	BuildUser string
+	BuildHost string
+	// Compiler is in the second brackets, e.g gcc version 6.3.1 20170404 (Linaro GCC 6.3-2017.05)
+	Compiler string
+	// Build is the build number after "#", e.g 1
+	Build   string
+	SMP     bool
+	Preempt bool
+	// PreemptRT is true for the PREEMPT_RT kernel, Preempt is true as well
+	PreemptRT bool
+	// BuildTime is the rest, e.g Thu Jan 4 10:11:12 CST 2018
+	BuildTime string
+}
+
+func (v *KernelVersion) String() string {
+	return v.Banner
+}
 
-	img, err := filepath.Abs(k.ImagePath)
+// Version returns the version of the Kernel
+func (k *Kernel) Version() (*KernelVersion, error) {
+	data, err := k.Data()
 	if err != nil {
-		return "", fmt.Errorf("can't find image %s", img)
+		return nil, err
+	}
+	// the banner is followed by \n, and the format string of it, which is skipped, has %s
+	for off := 0; ; {
+		i := bytes.Index(data[off:], []byte(linuxBanner))
+		if i < 0 {
+			break
+		}
+		off += i
+		end := bytes.IndexAny(data[off:], "\n\x00")
+		if end < 0 {
+			end = len(data) - off
+		}
+		banner := string(data[off : off+end])
+		off += end
+		if strings.Contains(banner, "%") {
+			continue
+		}
+		return ParseKernelVersion(banner)
 	}
+	return nil, fmt.Errorf("%s: no linux version banner", k.ImagePath)
+}
 
-	if r, _ := utils.FileExists(img); r == false {
-		return "", fmt.Errorf("can't find image %s", img)
+// bracketed return the text in the brackets at the beginning of s, the nested ones are
+// included, and the rest
+func bracketed(s string) (string, string, bool) {
+	if !strings.HasPrefix(s, "(") {
+		return "", s, false
+	}
+	depth := 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s[1:i], strings.TrimSpace(s[i+1:]), true
+			}
+		}
 	}
+	return "", s, false
+}
 
-	cmdLine := "strings " + img + ` | grep "Linux version" `
-	cmd := exec.Command("bash", "-c", cmdLine)
+// ParseKernelVersion parses the linux version banner
+func ParseKernelVersion(banner string) (*KernelVersion, error) {
+	banner = strings.TrimSpace(banner)
+	v := &KernelVersion{Banner: banner}
+	if !strings.HasPrefix(banner, linuxBanner) {
+		return nil, fmt.Errorf("invalid linux version banner %q", banner)
+	}
+	s := banner[len(linuxBanner):]
+	fields := strings.SplitN(s, " ", 2)
+	v.Release = fields[0]
+	if len(fields) == 1 {
+		return v, nil
+	}
+	s = strings.TrimSpace(fields[1])
 
-	version, err := cmd.Output()
+	var ok bool
+	var who string
+	if who, s, ok = bracketed(s); ok {
+		userHost := strings.SplitN(who, "@", 2)
+		v.BuildUser = userHost[0]
+		if len(userHost) == 2 {
+			v.BuildHost = userHost[1]
+		}
+	}
+	if v.Compiler, s, ok = bracketed(s); ok {
+		v.Compiler = strings.TrimSpace(v.Compiler)
+	}
 
-	if err != nil {
-		return "", err
+	if !strings.HasPrefix(s, "#") {
+		return v, nil
+	}
+	fields = strings.Fields(s[1:])
+	if len(fields) == 0 {
+		return v, nil
+	}
+	v.Build = fields[0]
+	fields = fields[1:]
+	for len(fields) != 0 {
+		switch fields[0] {
+		case "SMP":
+			v.SMP = true
+		case "PREEMPT", "PREEMPT_DYNAMIC":
+			v.Preempt = true
+		case "PREEMPT_RT":
+			v.Preempt = true
+			v.PreemptRT = true
+		default:
+			v.BuildTime = strings.Join(fields, " ")
+			return v, nil
+		}
+		fields = fields[1:]
 	}
-	// the 2nd line is garbage, contains Linux version %s (%s)
-	v := strings.Split(string(version), "\n")[0]
 	return v, nil
 }
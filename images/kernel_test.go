@@ -0,0 +1,216 @@
+package images
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testBanner = "Linux version 4.19.157-g0e2a1c (builder@build-host) (Android (6443078 based on r383902) clang version 11.0.1, LLD 11.0.1) #1 SMP PREEMPT Mon Jan 11 10:11:12 UTC 2021"
+	testConfig = "#\n# Linux/arm64 4.19.157 Kernel Configuration\n#\nCONFIG_64BIT=y\nCONFIG_LOCALVERSION=\"-g0e2a1c\"\n" +
+		"CONFIG_HZ=250\n# CONFIG_USB is not set\nCONFIG_EXT4_FS=m\n"
+)
+
+func gzipData(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// testKernel return the uncompressed kernel with the banner and the config
+func testKernel() []byte {
+	var k bytes.Buffer
+	k.Write(make([]byte, 64))
+	k.WriteString("Linux version %s (%s)\n\x00")
+	k.WriteString(testBanner + "\n\x00")
+	k.WriteString(ikconfigStart)
+	k.Write(gzipData([]byte(testConfig)))
+	k.WriteString(ikconfigEnd)
+	k.Write(make([]byte, 64))
+	return k.Bytes()
+}
+
+func TestKernel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kernel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	kernel := testKernel()
+	// the zImage has the compressed kernel after the decompressor, and something after it
+	zImage := func(compressed []byte) []byte {
+		return append(append([]byte("decompressor\x1f\x8b\x08"), compressed...), "trailer"...)
+	}
+	// the arm64 Image is told by the header, what looks like a compressed stream in it isn't
+	// tried
+	arm64 := append(testArm64Image(0x200), kernel...)
+	arm64 = append(arm64, kernelCompressions[2].magic...)
+	// the bzImage has the payload where the header says
+	bzImage := make([]byte, 0x400)
+	hdr := BzImageHeader{SetupSects: 1, BootFlag: bzImageBootFlag, Version: 0x20f, PayloadOffset: 0x10}
+	copy(hdr.Header[:], bzImageHeaderMagic)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &hdr)
+	copy(bzImage[bzImageHeaderStart:], buf.Bytes())
+	bzImage = append(bzImage, gzipData(kernel)...)
+	images := map[string][]byte{
+		"Image":       kernel,
+		"Image-arm64": arm64,
+		"bzImage":     bzImage,
+		"Image.gz":    gzipData(kernel),
+		"Image.lz4":   lz4LegacyCompress(kernel),
+		"zImage-gzip": zImage(gzipData(kernel)),
+		"zImage-lz4":  zImage(lz4LegacyCompress(kernel)),
+	}
+	// there is no go compressor of them
+	for _, cmd := range []string{"xz", "zstd", "bzip2"} {
+		if commandInstalled(cmd) {
+			images["zImage-"+cmd] = zImage(compressCommand(t, cmd, kernel))
+		}
+	}
+
+	for name, data := range images {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+		k := Kernel{ImagePath: path}
+
+		v, err := k.Version()
+		assert.Nil(t, err, name)
+		assert.Equal(t, testBanner, v.String(), name)
+
+		configs, err := k.ConfigMap()
+		assert.Nil(t, err, name)
+		assert.Equal(t, map[string]string{
+			"CONFIG_64BIT":        "y",
+			"CONFIG_LOCALVERSION": `"-g0e2a1c"`,
+			"CONFIG_HZ":           "250",
+			"CONFIG_USB":          "n",
+			"CONFIG_EXT4_FS":      "m",
+		}, configs, name)
+	}
+
+	k := Kernel{ImagePath: filepath.Join(dir, "Image-arm64")}
+	data, err := k.Data()
+	assert.Nil(t, err)
+	assert.Equal(t, arm64, data)
+
+	// no IKCONFIG
+	path := filepath.Join(dir, "noconfig")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(testBanner+"\n"), 0644))
+	k = Kernel{ImagePath: path}
+	_, err = k.Configs()
+	assert.NotNil(t, err)
+
+	// not a kernel
+	k.ImagePath = filepath.Join(dir, "Image.gz")
+	assert.Nil(t, ioutil.WriteFile(k.ImagePath, gzipData([]byte("hello")), 0644))
+	_, err = k.Version()
+	assert.NotNil(t, err)
+}
+
+// compressCommand return the data compressed with the command
+func compressCommand(t *testing.T, name string, data []byte) []byte {
+	cmd := exec.Command(name, "-c")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	assert.Nil(t, err)
+	return out
+}
+
+func TestParseKernelVersion(t *testing.T) {
+	v, err := ParseKernelVersion(testBanner)
+	assert.Nil(t, err)
+	assert.Equal(t, &KernelVersion{
+		Banner:    testBanner,
+		Release:   "4.19.157-g0e2a1c",
+		BuildUser: "builder",
+		BuildHost: "build-host",
+		Compiler:  "Android (6443078 based on r383902) clang version 11.0.1, LLD 11.0.1",
+		Build:     "1",
+		SMP:       true,
+		Preempt:   true,
+		BuildTime: "Mon Jan 11 10:11:12 UTC 2021",
+	}, v)
+
+	v, err = ParseKernelVersion("Linux version 5.10.0-rt (root@localhost) (gcc version 10.2.1 20210110 (Debian 10.2.1-6) ) #2 PREEMPT_RT Tue Mar 2 2021")
+	assert.Nil(t, err)
+	assert.Equal(t, "gcc version 10.2.1 20210110 (Debian 10.2.1-6)", v.Compiler)
+	assert.Equal(t, "2", v.Build)
+	assert.False(t, v.SMP)
+	assert.True(t, v.PreemptRT)
+	assert.Equal(t, "Tue Mar 2 2021", v.BuildTime)
+
+	_, err = ParseKernelVersion("Linux")
+	assert.NotNil(t, err)
+
+	_, err = ParseConfigs(strings.NewReader("CONFIG_A=y\nCONFIG_B\n"))
+	assert.NotNil(t, err)
+}
+
+func TestCheckKconfig(t *testing.T) {
+	for _, v := range []string{"Android O", "o", "Oreo", "8.1.0", "android 8"} {
+		r, err := AndroidRelease(v)
+		assert.Nil(t, err, v)
+		assert.Equal(t, "o", r, v)
+	}
+	_, err := AndroidRelease("Android Z")
+	assert.NotNil(t, err)
+
+	o, err := AndroidKconfigFragment("O")
+	assert.Nil(t, err)
+	assert.Equal(t, "y", o.Configs["CONFIG_ANDROID_LOW_MEMORY_KILLER"])
+	assert.Equal(t, "n", o.Configs["CONFIG_DEVMEM"])
+	r, err := AndroidKconfigFragment("11")
+	assert.Nil(t, err)
+	assert.Equal(t, "", r.Configs["CONFIG_ANDROID_LOW_MEMORY_KILLER"])
+	assert.Equal(t, "y", r.Configs["CONFIG_PSI"])
+
+	wifi, ok := FeatureKconfigFragment("wifi")
+	assert.True(t, ok)
+	_, ok = FeatureKconfigFragment("vr")
+	assert.False(t, ok)
+
+	dir, err := ioutil.TempDir("", "kconfig")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "android-base.config")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("CONFIG_HZ=250\n# CONFIG_USB is not set\nCONFIG_EXT4_FS=y\n"), 0644))
+	local, err := LoadKconfigFragment(path)
+	assert.Nil(t, err)
+
+	configs, err := ParseConfigs(strings.NewReader(testConfig + "CONFIG_CFG80211=y\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []KconfigMismatch{
+		{Option: "CONFIG_EXT4_FS", Want: "y", Got: "m", Source: path},
+	}, CheckKconfig(configs, wifi, local))
+
+	configs["CONFIG_CFG80211"] = "n"
+	mismatches := CheckKconfig(configs, wifi)
+	assert.Equal(t, 1, len(mismatches))
+	assert.Equal(t, "CONFIG_CFG80211 is not set, wifi requires m", mismatches[0].String())
+
+	// the later m doesn't relax the earlier y
+	configs["CONFIG_CFG80211"] = "m"
+	strict := KconfigFragment{Source: "base", Configs: map[string]string{"CONFIG_CFG80211": "y"}}
+	mismatches = CheckKconfig(configs, strict, wifi)
+	assert.Equal(t, []KconfigMismatch{{Option: "CONFIG_CFG80211", Want: "y", Got: "m", Source: "base"}}, mismatches)
+	mismatches = CheckKconfig(configs, wifi, strict)
+	assert.Equal(t, []KconfigMismatch{{Option: "CONFIG_CFG80211", Want: "y", Got: "m", Source: "base"}}, mismatches)
+
+	// n and m can't be both met
+	configs["CONFIG_CFG80211"] = "n"
+	off := KconfigFragment{Source: "no-wifi", Configs: map[string]string{"CONFIG_CFG80211": "n"}}
+	mismatches = CheckKconfig(configs, off, wifi)
+	assert.Equal(t, 1, len(mismatches))
+	assert.Equal(t, "CONFIG_CFG80211, no-wifi requires n but wifi requires m", mismatches[0].String())
+}
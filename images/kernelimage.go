@@ -0,0 +1,550 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// KernelImage is the kernel image of an architecture, as the bootloader loads it. There may
+// be something appended after the kernel in the file, usually the dtbs.
+type KernelImage interface {
+	// Arch return the architecture of the kernel, e.g arm64
+	Arch() string
+	// Describe return the info in the header, or error if it isn't the image of the format
+	Describe() (string, error)
+	// KernelSize return the size of the kernel in the file, what is after it is appended
+	KernelSize() (int64, error)
+}
+
+// DetectKernelImage return the kernel image of the format the file is in: arm64 and RISC-V
+// Image, arm zImage, x86 bzImage, and the Image.gz and Image.lz4 of them. The format is told
+// by the magics in the head of the file, which is read once.
+func DetectKernelImage(path string) (KernelImage, error) {
+	head, err := readAt(path, 0, bzImageHeaderStart+binary.Size(BzImageHeader{}))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		z ZImageHeader
+		b BzImageHeader
+		a Arm64ImageHeader
+		r RiscvImageHeader
+	)
+	switch {
+	case decodeHeader(head, zImageHeaderStart, &z) && z.Magic == zImageMagic && z.End >= z.Start:
+		return &ZImage{ImagePath: path}, nil
+	case decodeHeader(head, bzImageHeaderStart, &b) && b.BootFlag == bzImageBootFlag &&
+		string(b.Header[:]) == bzImageHeaderMagic:
+		return &BzImage{ImagePath: path}, nil
+	case decodeHeader(head, 0, &a) && string(a.Magic[:]) == linuxARM64ImageMagic:
+		return &Arm64Image{ImagePath: path}, nil
+	case decodeHeader(head, 0, &r) &&
+		(string(r.Magic2[:]) == riscvImageMagic2 || string(r.Magic[:]) == riscvImageMagic):
+		return &RiscvImage{ImagePath: path}, nil
+	case bytes.HasPrefix(head, kernelCompressions[0].magic) || isLz4Legacy(head):
+		return &CompressedKernel{ImagePath: path}, nil
+	}
+	return nil, fmt.Errorf("%s: unknown kernel image format", path)
+}
+
+// HasAppendedDtb return true if there is a dtb right after the kernel
+func HasAppendedDtb(path string, k KernelImage) (bool, error) {
+	size, err := k.KernelSize()
+	if err != nil {
+		return false, err
+	}
+	dtbs, err := AppendedDtbs(path, k)
+	if err != nil {
+		return false, err
+	}
+	return len(dtbs) > 0 && dtbs[0].Offset == size, nil
+}
+
+// AppendedDtb is a dtb appended after the kernel
+type AppendedDtb struct {
+	// Offset is where the dtb is in the kernel image file
+	Offset int64
+	Dtb    []byte
+	// Model and Compatible are the ones of the root node
+	Model      string
+	Compatible []string
+}
+
+// String return the offset, size, model and compatible of the dtb
+func (d AppendedDtb) String() string {
+	return fmt.Sprintf("dtb at 0x%x, size %d, model \"%s\", compatible \"%s\"",
+		d.Offset, len(d.Dtb), d.Model, strings.Join(d.Compatible, "\", \""))
+}
+
+// AppendedDtbs return all the dtbs appended after the kernel, in order. They are found by the
+// dtb magic, what is between them (e.g the padding) or isn't a valid dtb is skipped.
+func AppendedDtbs(path string, k KernelImage) ([]AppendedDtb, error) {
+	size, err := k.KernelSize()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 4)
+	binary.BigEndian.PutUint32(magic, dtbHeaderMagic)
+	var dtbs []AppendedDtb
+	for off := size; off < int64(len(data)); {
+		i := bytes.Index(data[off:], magic)
+		if i < 0 {
+			break
+		}
+		off += int64(i)
+		fdt, err := ParseFdt(data[off:])
+		if err != nil {
+			off++
+			continue
+		}
+		dtb := AppendedDtb{Offset: off, Dtb: data[off : off+int64(fdt.Header.TotalSize)]}
+		if p := fdt.Root.Property("model"); p != nil {
+			dtb.Model, _ = p.StringValue()
+		}
+		if p := fdt.Root.Property("compatible"); p != nil {
+			dtb.Compatible, _ = p.Strings()
+		}
+		dtbs = append(dtbs, dtb)
+		off += int64(fdt.Header.TotalSize)
+	}
+	return dtbs, nil
+}
+
+// SplitKernelImage writes the kernel to prefix.kernel and each of the appended dtbs to
+// prefix.dtb.N, and return the dtbs
+func SplitKernelImage(path string, k KernelImage, prefix string) ([]AppendedDtb, error) {
+	size, err := k.KernelSize()
+	if err != nil {
+		return nil, err
+	}
+	dtbs, err := AppendedDtbs(path, k)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if size > int64(len(data)) {
+		return nil, fmt.Errorf("%s: kernel size %d is larger than the file", path, size)
+	}
+
+	if err := ioutil.WriteFile(prefix+".kernel", data[:size], 0644); err != nil {
+		return nil, err
+	}
+	for i, dtb := range dtbs {
+		if err := ioutil.WriteFile(fmt.Sprintf("%s.dtb.%d", prefix, i), dtb.Dtb, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return dtbs, nil
+}
+
+// readHeader reads the header at off of the file, in little endian
+func readHeader(path string, off int64, hdr interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return binary.Read(io.NewSectionReader(f, off, int64(binary.Size(hdr))), binary.LittleEndian, hdr)
+}
+
+// decodeHeader decodes the header at off of head, in little endian, false if head is short
+func decodeHeader(head []byte, off int, hdr interface{}) bool {
+	return off <= len(head) && binary.Read(bytes.NewReader(head[off:]), binary.LittleEndian, hdr) == nil
+}
+
+// readAt return n bytes at off of the file, less if the file ends before
+func readAt(path string, off int64, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, n)
+	m, err := f.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b[:m], nil
+}
+
+// fileSize return the size of the file
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+const (
+	zImageMagic       = 0x016f2818
+	zImageHeaderStart = 0x24
+)
+
+// ZImageHeader is the header of the arm zImage, see arch/arm/boot/compressed/head.S
+type ZImageHeader struct {
+	Magic uint32
+	// Start and End are the addresses the zImage is linked at, the size is the difference
+	Start uint32
+	End   uint32
+}
+
+// ZImage is the arm (32 bit) zImage
+type ZImage struct {
+	ImagePath string
+}
+
+// Hdr return the header of the zImage
+func (z *ZImage) Hdr() (*ZImageHeader, error) {
+	var hdr ZImageHeader
+	if err := readHeader(z.ImagePath, zImageHeaderStart, &hdr); err != nil || hdr.Magic != zImageMagic {
+		return nil, fmt.Errorf("%s is not an arm zImage", z.ImagePath)
+	}
+	if hdr.End < hdr.Start {
+		return nil, fmt.Errorf("%s: invalid zImage start 0x%x end 0x%x", z.ImagePath, hdr.Start, hdr.End)
+	}
+	return &hdr, nil
+}
+
+// Arch is arm
+func (z *ZImage) Arch() string {
+	return "arm"
+}
+
+// Describe return the header info
+func (z *ZImage) Describe() (string, error) {
+	hdr, err := z.Hdr()
+	if err != nil {
+		return "", err
+	}
+	size := hdr.End - hdr.Start
+	return fmt.Sprintf("arm zImage, start 0x%x, end 0x%x, size 0x%x(%d)", hdr.Start, hdr.End, size, size), nil
+}
+
+// KernelSize return the size in the header
+func (z *ZImage) KernelSize() (int64, error) {
+	hdr, err := z.Hdr()
+	if err != nil {
+		return 0, err
+	}
+	return int64(hdr.End - hdr.Start), nil
+}
+
+const (
+	bzImageHeaderStart = 0x1f1
+	bzImageBootFlag    = 0xaa55
+	bzImageHeaderMagic = "HdrS"
+	bzImageSectorSize  = 512
+)
+
+// BzImageHeader is the setup header of the x86 bzImage, see
+// https://www.kernel.org/doc/Documentation/x86/boot.txt
+type BzImageHeader struct {
+	SetupSects          uint8
+	RootFlags           uint16
+	SysSize             uint32
+	RamSize             uint16
+	VidMode             uint16
+	RootDev             uint16
+	BootFlag            uint16
+	Jump                uint16
+	Header              [4]byte
+	Version             uint16
+	RealmodeSwtch       uint32
+	StartSysSeg         uint16
+	KernelVersion       uint16
+	TypeOfLoader        uint8
+	LoadFlags           uint8
+	SetupMoveSize       uint16
+	Code32Start         uint32
+	RamdiskImage        uint32
+	RamdiskSize         uint32
+	BootsectKludge      uint32
+	HeapEndPtr          uint16
+	ExtLoaderVer        uint8
+	ExtLoaderType       uint8
+	CmdLinePtr          uint32
+	InitrdAddrMax       uint32
+	KernelAlignment     uint32
+	RelocatableKernel   uint8
+	MinAlignment        uint8
+	XLoadFlags          uint16
+	CmdlineSize         uint32
+	HardwareSubarch     uint32
+	HardwareSubarchData uint64
+	PayloadOffset       uint32
+	PayloadLength       uint32
+	SetupData           uint64
+	PrefAddress         uint64
+	InitSize            uint32
+	HandoverOffset      uint32
+}
+
+// BzImage is the x86 bzImage
+type BzImage struct {
+	ImagePath string
+}
+
+// Hdr return the setup header of the bzImage
+func (b *BzImage) Hdr() (*BzImageHeader, error) {
+	var hdr BzImageHeader
+	if err := readHeader(b.ImagePath, bzImageHeaderStart, &hdr); err != nil ||
+		hdr.BootFlag != bzImageBootFlag || string(hdr.Header[:]) != bzImageHeaderMagic {
+		return nil, fmt.Errorf("%s is not an x86 bzImage", b.ImagePath)
+	}
+	return &hdr, nil
+}
+
+// setupSize return the size of the real mode setup, before the protected mode kernel
+func (hdr *BzImageHeader) setupSize() int64 {
+	sects := int64(hdr.SetupSects)
+	if sects == 0 {
+		sects = 4
+	}
+	return (sects + 1) * bzImageSectorSize
+}
+
+// Arch is x86
+func (b *BzImage) Arch() string {
+	return "x86"
+}
+
+// Describe return the header info, with the kernel version and the compression of the payload
+func (b *BzImage) Describe() (string, error) {
+	hdr, err := b.Hdr()
+	if err != nil {
+		return "", err
+	}
+
+	s := fmt.Sprintf("x86 bzImage, boot protocol %d.%02d", hdr.Version>>8, hdr.Version&0xff)
+	if hdr.KernelVersion != 0 {
+		// the version string is in the setup, it is short
+		off := int64(hdr.KernelVersion) + bzImageSectorSize
+		if data, err := readAt(b.ImagePath, off, 256); err == nil {
+			if v, err := fdtString(data, 0); err == nil {
+				s += ", version " + v
+			}
+		}
+	}
+	size := hdr.setupSize() + int64(hdr.SysSize)*16
+	s += fmt.Sprintf(", setup 0x%x, size 0x%x(%d)", hdr.setupSize(), size, size)
+	// the payload is since boot protocol 2.08
+	if hdr.Version >= 0x208 {
+		magic, err := readAt(b.ImagePath, hdr.setupSize()+int64(hdr.PayloadOffset), 8)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range kernelCompressions {
+			if bytes.HasPrefix(magic, c.magic) {
+				s += ", " + c.name + " compressed"
+			}
+		}
+	}
+	return s, nil
+}
+
+// KernelSize return the size of the setup and the protected mode kernel
+func (b *BzImage) KernelSize() (int64, error) {
+	hdr, err := b.Hdr()
+	if err != nil {
+		return 0, err
+	}
+	return hdr.setupSize() + int64(hdr.SysSize)*16, nil
+}
+
+const (
+	riscvImageMagic  = "RISCV\x00\x00\x00"
+	riscvImageMagic2 = "RSC\x05"
+)
+
+// RiscvImageHeader is the header of the RISC-V Image, see
+// https://www.kernel.org/doc/Documentation/riscv/boot-image-header.rst
+type RiscvImageHeader struct {
+	Code0      uint32
+	Code1      uint32
+	TextOffset uint64
+	// ImageSize is the size in the memory, including the bss
+	ImageSize uint64
+	Flags     uint64
+	Version   uint32
+	Res1      uint32
+	Res2      uint64
+	// Magic is deprecated by Magic2
+	Magic  [8]byte
+	Magic2 [4]byte
+	Res3   uint32
+}
+
+// RiscvImage is the RISC-V Image
+type RiscvImage struct {
+	ImagePath string
+}
+
+// Hdr return the header of the Image
+func (r *RiscvImage) Hdr() (*RiscvImageHeader, error) {
+	var hdr RiscvImageHeader
+	if err := readHeader(r.ImagePath, 0, &hdr); err != nil ||
+		(string(hdr.Magic2[:]) != riscvImageMagic2 && string(hdr.Magic[:]) != riscvImageMagic) {
+		return nil, fmt.Errorf("%s is not a RISC-V Image", r.ImagePath)
+	}
+	return &hdr, nil
+}
+
+// Arch is riscv
+func (r *RiscvImage) Arch() string {
+	return "riscv"
+}
+
+// Describe return the header info
+func (r *RiscvImage) Describe() (string, error) {
+	hdr, err := r.Hdr()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("RISC-V Image, header version %d.%d, text offset 0x%x, image size 0x%x(%d), flags 0x%x",
+		hdr.Version>>16, hdr.Version&0xffff, hdr.TextOffset, hdr.ImageSize, hdr.ImageSize, hdr.Flags), nil
+}
+
+// KernelSize return the size of the file, the header has the size in the memory only
+func (r *RiscvImage) KernelSize() (int64, error) {
+	if _, err := r.Hdr(); err != nil {
+		return 0, err
+	}
+	return fileSize(r.ImagePath)
+}
+
+// CompressedKernel is the Image.gz and Image.lz4
+type CompressedKernel struct {
+	ImagePath string
+}
+
+// read return the name of the compression, the compressed size and the kernel decompressed
+func (c *CompressedKernel) read() (string, int64, []byte, error) {
+	f, err := os.Open(c.ImagePath)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return "", 0, nil, fmt.Errorf("%s is not a gzip or lz4 compressed kernel", c.ImagePath)
+	}
+	switch {
+	case bytes.HasPrefix(magic, kernelCompressions[0].magic):
+		// the gzip stream is read from the file, what it takes is what is counted less what
+		// is left in the buffer
+		cr := &countReader{r: io.MultiReader(bytes.NewReader(magic), f)}
+		br := bufio.NewReader(cr)
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		zr.Multistream(false)
+		kernel, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return "", 0, nil, fmt.Errorf("%s: %s", c.ImagePath, err)
+		}
+		return "gzip", cr.n - int64(br.Buffered()), kernel, nil
+	case isLz4Legacy(magic):
+		// the blocks are sized by the data after them, lz4 needs it all anyway
+		data, err := ioutil.ReadFile(c.ImagePath)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		size := lz4LegacySize(data)
+		kernel, err := lz4LegacyDecompress(data[:size])
+		if err != nil {
+			return "", 0, nil, fmt.Errorf("%s: %s", c.ImagePath, err)
+		}
+		return "lz4", int64(size), kernel, nil
+	}
+	return "", 0, nil, fmt.Errorf("%s is not a gzip or lz4 compressed kernel", c.ImagePath)
+}
+
+// countReader counts the bytes read
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// lz4LegacySize return the size of the lz4 legacy stream, the blocks until what can't be
+// one, e.g the dtb appended
+func lz4LegacySize(data []byte) int {
+	i := 4
+	for i+4 <= len(data) {
+		size := binary.LittleEndian.Uint32(data[i:])
+		if size == lz4LegacyMagic {
+			i += 4
+			continue
+		}
+		if binary.BigEndian.Uint32(data[i:]) == dtbHeaderMagic ||
+			uint64(i)+4+uint64(size) > uint64(len(data)) {
+			break
+		}
+		i += 4 + int(size)
+	}
+	return i
+}
+
+// kernelArch return the arch and the header info of the kernel decompressed
+func kernelArch(kernel []byte) (string, string) {
+	var arm64 Arm64ImageHeader
+	if binary.Read(bytes.NewReader(kernel), binary.LittleEndian, &arm64) == nil &&
+		string(arm64.Magic[:]) == linuxARM64ImageMagic {
+		return "arm64", "arm64 Image\n" + arm64.String()
+	}
+	var riscv RiscvImageHeader
+	if binary.Read(bytes.NewReader(kernel), binary.LittleEndian, &riscv) == nil &&
+		(string(riscv.Magic2[:]) == riscvImageMagic2 || string(riscv.Magic[:]) == riscvImageMagic) {
+		return "riscv", "RISC-V Image"
+	}
+	return "", "unknown kernel"
+}
+
+// Arch return the arch of the kernel decompressed, "" if unknown
+func (c *CompressedKernel) Arch() string {
+	_, _, kernel, err := c.read()
+	if err != nil {
+		return ""
+	}
+	arch, _ := kernelArch(kernel)
+	return arch
+}
+
+// Describe return the compression and the header info of the kernel decompressed
+func (c *CompressedKernel) Describe() (string, error) {
+	name, size, kernel, err := c.read()
+	if err != nil {
+		return "", err
+	}
+	_, info := kernelArch(kernel)
+	return fmt.Sprintf("%s compressed 0x%x(%d), decompressed 0x%x(%d), %s",
+		name, size, size, len(kernel), len(kernel), info), nil
+}
+
+// KernelSize return the size of the compressed kernel
+func (c *CompressedKernel) KernelSize() (int64, error) {
+	_, size, _, err := c.read()
+	return size, err
+}
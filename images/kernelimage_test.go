@@ -0,0 +1,150 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testArm64Image return an arm64 Image of size bytes
+func testArm64Image(size int) []byte {
+	data := make([]byte, size)
+	copy(data[56:], linuxARM64ImageMagic)
+	// ActualKernelSize is the _stext plus the raw size in the image
+	binary.LittleEndian.PutUint32(data[KERNEL_IMAGE_STEXT_OFFSET:], 0x100)
+	binary.LittleEndian.PutUint32(data[KERNEL_IMAGE_RAW_SIZE_OFFSET:], uint32(size-0x100))
+	return data
+}
+
+func TestKernelImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kernelimage")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dtb := testFdt().Bytes()
+
+	zImage := make([]byte, 0x1000)
+	binary.LittleEndian.PutUint32(zImage[0x24:], zImageMagic)
+	binary.LittleEndian.PutUint32(zImage[0x2c:], 0x1000)
+
+	bzImage := make([]byte, 0x800)
+	hdr := BzImageHeader{SetupSects: 1, SysSize: 0x40, BootFlag: bzImageBootFlag, Version: 0x20f,
+		KernelVersion: 0x100, PayloadOffset: 0x10}
+	copy(hdr.Header[:], bzImageHeaderMagic)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &hdr)
+	copy(bzImage[bzImageHeaderStart:], buf.Bytes())
+	copy(bzImage[0x300:], "5.4.0 (user@host) #1\x00")
+	copy(bzImage[0x410:], kernelCompressions[0].magic)
+
+	riscv := make([]byte, 0x400)
+	binary.LittleEndian.PutUint32(riscv[0x20:], 0x2) // version 0.2
+	copy(riscv[0x38:], riscvImageMagic2)
+
+	arm64 := testArm64Image(0x1000)
+
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		arch    string
+		size    int64
+		dtb     bool
+		comment string
+	}{
+		{"zImage", zImage, "arm", 0x1000, false, "arm zImage, start 0x0, end 0x1000"},
+		{"zImage-dtb", append(append([]byte{}, zImage...), dtb...), "arm", 0x1000, true, "arm zImage"},
+		{"bzImage", bzImage, "x86", 0x800, false, "version 5.4.0 (user@host) #1, setup 0x400, size 0x800(2048), gzip compressed"},
+		{"Image-riscv", riscv, "riscv", 0x400, false, "RISC-V Image, header version 0.2"},
+		{"Image", arm64, "arm64", 0x1000, false, "arm64 Image"},
+		{"Image.gz-dtb", append(gzipData(arm64), dtb...), "arm64", int64(len(gzipData(arm64))), true, "gzip compressed"},
+		{"Image.lz4-dtb", append(lz4LegacyCompress(arm64), append(dtb, dtb...)...), "arm64",
+			int64(len(lz4LegacyCompress(arm64))), true, "lz4 compressed"},
+	} {
+		path := filepath.Join(dir, c.name)
+		assert.Nil(t, ioutil.WriteFile(path, c.data, 0644))
+		k, err := DetectKernelImage(path)
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, c.arch, k.Arch(), c.name)
+		info, err := k.Describe()
+		assert.Nil(t, err, c.name)
+		assert.Contains(t, info, c.comment, c.name)
+		size, err := k.KernelSize()
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, c.size, size, c.name)
+		appended, err := HasAppendedDtb(path, k)
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, c.dtb, appended, c.name)
+	}
+
+	path := filepath.Join(dir, "unknown")
+	assert.Nil(t, ioutil.WriteFile(path, make([]byte, 0x1000), 0644))
+	_, err = DetectKernelImage(path)
+	assert.NotNil(t, err)
+}
+
+func TestSplitKernelImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kernelimage")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var dtbs [][]byte
+	for _, model := range []string{"board a", "board b", "board c"} {
+		fdt := testFdt()
+		fdt.Root.SetProperty("model", []byte(model+"\x00"))
+		dtbs = append(dtbs, fdt.Bytes())
+	}
+	kernel := gzipData(testArm64Image(0x1000))
+	// the dtbs are padded to 8 bytes, plus something not a dtb with the magic
+	data := append([]byte{}, kernel...)
+	for _, dtb := range dtbs {
+		data = append(data, dtb...)
+		data = append(data, make([]byte, 8-len(data)%8)...)
+	}
+	data = append(data, 0xd0, 0x0d, 0xfe, 0xed, 0, 0)
+
+	path := filepath.Join(dir, "Image.gz-dtb")
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	k, err := DetectKernelImage(path)
+	assert.Nil(t, err)
+	prefix := filepath.Join(dir, "out")
+	split, err := SplitKernelImage(path, k, prefix)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(split))
+	out, err := ioutil.ReadFile(prefix + ".kernel")
+	assert.Nil(t, err)
+	assert.Equal(t, kernel, out)
+	for i, dtb := range split {
+		assert.Equal(t, []string{"board a", "board b", "board c"}[i], dtb.Model)
+		assert.Equal(t, []string{"hisilicon,hi3798cv200-poplar", "hisilicon,hi3798cv200"}, dtb.Compatible)
+		out, err := ioutil.ReadFile(fmt.Sprintf("%s.dtb.%d", prefix, i))
+		assert.Nil(t, err)
+		assert.Equal(t, dtbs[i], out)
+	}
+	assert.Equal(t, int64(len(kernel)), split[0].Offset)
+
+	// zImage-dtb
+	zImage := make([]byte, 0x1000)
+	binary.LittleEndian.PutUint32(zImage[0x24:], zImageMagic)
+	binary.LittleEndian.PutUint32(zImage[0x2c:], 0x1000)
+	path = filepath.Join(dir, "zImage-dtb")
+	assert.Nil(t, ioutil.WriteFile(path, append(append(zImage, dtbs[0]...), dtbs[1]...), 0644))
+	k, err = DetectKernelImage(path)
+	assert.Nil(t, err)
+	split, err = SplitKernelImage(path, k, path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(split))
+	assert.Equal(t, "board b", split[1].Model)
+	assert.Equal(t, int64(0x1000+len(dtbs[0])), split[1].Offset)
+	out, err = ioutil.ReadFile(path + ".kernel")
+	assert.Nil(t, err)
+	assert.Equal(t, zImage, out)
+
+	// error instead of an empty split
+	_, err = SplitKernelImage(filepath.Join(dir, "missing"), &Arm64Image{ImagePath: filepath.Join(dir, "missing")}, prefix)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,212 @@
+package images
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The lz4 legacy format [1] is what the kernel and `lz4 -l` use for the compressed ramdisk.
+// It is a magic followed by blocks, each one is the compressed size and an lz4 block [2] of
+// at most 8M uncompressed.
+// [1] https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md#legacy-frame
+// [2] https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+
+const (
+	lz4LegacyMagic     = 0x184C2102
+	lz4LegacyBlockSize = 8 << 20
+
+	lz4MinMatch = 4
+	lz4HashLog  = 16
+	lz4MaxDist  = 65535
+	// the last match must start at least 12 bytes before the end of the block, and the
+	// last 5 bytes are always literals
+	lz4MatchLimit   = 12
+	lz4LastLiterals = 5
+)
+
+// isLz4Legacy return true if data is in the lz4 legacy format
+func isLz4Legacy(data []byte) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == lz4LegacyMagic
+}
+
+// lz4LegacyDecompress decompresses the lz4 legacy data, the streams concatenated are
+// decompressed as well. If any error, what is decompressed so far is returned with it.
+func lz4LegacyDecompress(data []byte) ([]byte, error) {
+	if !isLz4Legacy(data) {
+		return nil, fmt.Errorf("not lz4 legacy format")
+	}
+
+	var out []byte
+	for i := 4; i < len(data); {
+		if i+4 > len(data) {
+			return out, fmt.Errorf("lz4: truncated block size")
+		}
+		size := binary.LittleEndian.Uint32(data[i:])
+		i += 4
+		if size == lz4LegacyMagic {
+			continue
+		}
+		if uint64(i)+uint64(size) > uint64(len(data)) {
+			return out, fmt.Errorf("lz4: truncated block")
+		}
+		block, err := lz4DecompressBlock(out, data[i:i+int(size)])
+		if err != nil {
+			return out, err
+		}
+		out = block
+		i += int(size)
+	}
+	return out, nil
+}
+
+// lz4DecompressBlock decompresses the block and appends the result to dst
+func lz4DecompressBlock(dst, src []byte) ([]byte, error) {
+	start := len(dst)
+	corrupt := fmt.Errorf("lz4: corrupt block")
+
+	length := func(i int, n int) (int, int, error) {
+		if n != 15 {
+			return i, n, nil
+		}
+		for {
+			if i >= len(src) {
+				return 0, 0, corrupt
+			}
+			b := src[i]
+			i++
+			n += int(b)
+			if b != 255 {
+				return i, n, nil
+			}
+		}
+	}
+
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		var lits, match int
+		var err error
+		if i, lits, err = length(i, int(token>>4)); err != nil {
+			return nil, err
+		}
+		if i+lits > len(src) {
+			return nil, corrupt
+		}
+		dst = append(dst, src[i:i+lits]...)
+		i += lits
+		// the last sequence has literals only
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, corrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst)-start {
+			return nil, corrupt
+		}
+		if i, match, err = length(i, int(token&0x0F)); err != nil {
+			return nil, err
+		}
+		match += lz4MinMatch
+		// the match can overlap with what it is copying
+		pos := len(dst) - offset
+		for k := 0; k < match; k++ {
+			dst = append(dst, dst[pos+k])
+		}
+	}
+	return dst, nil
+}
+
+// lz4LegacyCompress compresses data in the lz4 legacy format
+func lz4LegacyCompress(data []byte) []byte {
+	out := make([]byte, 4, len(data)/2+16)
+	binary.LittleEndian.PutUint32(out, lz4LegacyMagic)
+	for i := 0; i < len(data); i += lz4LegacyBlockSize {
+		end := i + lz4LegacyBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		block := lz4CompressBlock(data[i:end])
+		size := make([]byte, 4)
+		binary.LittleEndian.PutUint32(size, uint32(len(block)))
+		out = append(out, size...)
+		out = append(out, block...)
+	}
+	return out
+}
+
+// lz4CompressBlock compresses src into an lz4 block, with a greedy match on a hash table of
+// the 4 bytes sequences
+func lz4CompressBlock(src []byte) []byte {
+	var table [1 << lz4HashLog]int
+	var dst []byte
+	anchor := 0
+
+	for i := 0; i+lz4MatchLimit < len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		// the position in the table is +1 so that 0 is empty
+		ref := table[h] - 1
+		table[h] = i + 1
+		if ref < 0 || i-ref > lz4MaxDist || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		match := lz4MinMatch
+		for i+match < len(src)-lz4LastLiterals && src[ref+match] == src[i+match] {
+			match++
+		}
+		dst = lz4Sequence(dst, src[anchor:i], i-ref, match)
+		i += match
+		anchor = i
+	}
+
+	return lz4Sequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4Sequence appends a sequence of the literals and the match to dst, match is 0 for the
+// last sequence
+func lz4Sequence(dst, lits []byte, offset, match int) []byte {
+	var token byte
+	if len(lits) >= 15 {
+		token = 0xF0
+	} else {
+		token = byte(len(lits) << 4)
+	}
+	m := match - lz4MinMatch
+	if match != 0 {
+		if m >= 15 {
+			token |= 0x0F
+		} else {
+			token |= byte(m)
+		}
+	}
+
+	dst = append(dst, token)
+	if len(lits) >= 15 {
+		dst = lz4Length(dst, len(lits)-15)
+	}
+	dst = append(dst, lits...)
+	if match == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if m >= 15 {
+		dst = lz4Length(dst, m-15)
+	}
+	return dst
+}
+
+// lz4Length appends the rest of the length, in bytes of 255 and the last one less than that
+func lz4Length(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
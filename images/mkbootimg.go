@@ -0,0 +1,375 @@
+package images
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// the defaults of mkbootimg [1] not in the device config
+// [1] https://android.googlesource.com/platform/system/core/+/master/mkbootimg/mkbootimg
+const (
+	DefaultSecondOffset = 0x00f00000
+	DefaultTagsOffset   = 0x00000100
+	DefaultDtbOffset    = 0x01f00000
+	DefaultPageSize     = 2048
+
+	bootMagic = "ANDROID!"
+	// the size of BootImgHdr.CmdLine and BootImgHdr.ExtraCmdline
+	bootArgsSize      = 512
+	bootExtraArgsSize = 1024
+	// the size of BootImgHdrV3.CmdLine
+	bootArgsV3Size = bootArgsSize + bootExtraArgsSize
+)
+
+// BootImgArgs are what a boot image is built from, the same as the arguments of mkbootimg.
+// The load addresses in the header are Base plus the offsets.
+// Since v3, only the kernel, ramdisk, cmdline, os version and the signature (v4) are in the
+// boot image, the rest are in the vendor_boot image.
+type BootImgArgs struct {
+	HeaderVersion uint32
+	Kernel        []byte
+	Ramdisk       []byte
+	Second        []byte
+	// RecoveryDtbo is since v1, and Dtb since v2
+	RecoveryDtbo []byte
+	Dtb          []byte
+	// Signature is the boot signature of v4
+	Signature []byte
+	CmdLine   string
+	// Board is the product name
+	Board         string
+	Base          uint32
+	KernelOffset  uint32
+	RamdiskOffset uint32
+	SecondOffset  uint32
+	TagsOffset    uint32
+	DtbOffset     uint32
+	PageSize      uint32
+	// OsVersion is A.B.C, e.g 9.0.0, and OsPatchLevel is YYYY-MM, e.g 2018-06
+	OsVersion    string
+	OsPatchLevel string
+}
+
+// DefaultBootImgArgs return the args with the default values of mkbootimg
+func DefaultBootImgArgs() *BootImgArgs {
+	return &BootImgArgs{
+		Base:          DefaultLoadBaseAddr,
+		KernelOffset:  DefaultKernelOffset,
+		RamdiskOffset: DefaultRamdiskOffset,
+		SecondOffset:  DefaultSecondOffset,
+		TagsOffset:    DefaultTagsOffset,
+		DtbOffset:     DefaultDtbOffset,
+		PageSize:      DefaultPageSize,
+	}
+}
+
+// osVersion encodes the os version and patch level as BootImgHdr.OsVersion
+func osVersion(version, patchLevel string) (uint32, error) {
+	var ver, lvl uint32
+	if version != "" {
+		var a, b, c uint32
+		parts := strings.Split(version, ".")
+		if len(parts) > 3 {
+			return 0, fmt.Errorf("invalid os version %q", version)
+		}
+		v := []*uint32{&a, &b, &c}
+		for i, p := range parts {
+			n, err := strconv.ParseUint(p, 10, 7)
+			if err != nil {
+				return 0, fmt.Errorf("invalid os version %q", version)
+			}
+			*v[i] = uint32(n)
+		}
+		ver = a<<14 | b<<7 | c
+	}
+	if patchLevel != "" {
+		var y, m uint32
+		if _, err := fmt.Sscanf(patchLevel, "%d-%d", &y, &m); err != nil ||
+			y < 2000 || y >= 2128 || m < 1 || m > 12 {
+			return 0, fmt.Errorf("invalid os patch level %q", patchLevel)
+		}
+		lvl = (y-2000)<<4 | m
+	}
+	return ver<<11 | lvl, nil
+}
+
+// osVersionString decodes BootImgHdr.OsVersion into the version and patch level
+func osVersionString(v uint32) (string, string) {
+	ver, lvl := v>>11, v&((1<<11)-1)
+	var version, patchLevel string
+	if ver != 0 {
+		version = fmt.Sprintf("%d.%d.%d", (ver>>14)&0x7F, (ver>>7)&0x7F, ver&0x7F)
+	}
+	if lvl != 0 {
+		patchLevel = fmt.Sprintf("%d-%02d", (lvl>>4)+2000, lvl&0x0F)
+	}
+	return version, patchLevel
+}
+
+// bootImgID return the ID of the boot image, the SHA-1 of each section followed by its
+// size, as mkbootimg does
+func bootImgID(sections ...[]byte) [32]byte {
+	h := sha1.New()
+	size := make([]byte, 4)
+	for _, s := range sections {
+		h.Write(s)
+		binary.LittleEndian.PutUint32(size, uint32(len(s)))
+		h.Write(size)
+	}
+	var id [32]byte
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// writePadded writes data to buf and pads it to pageSize
+func writePadded(buf *bytes.Buffer, data []byte, pageSize uint32) {
+	buf.Write(data)
+	if pad := align(uint32(buf.Len()), pageSize) - uint32(buf.Len()); pad != 0 {
+		buf.Write(make([]byte, pad))
+	}
+}
+
+// sections return the sections of the v0-v2 boot image, in order
+func (a *BootImgArgs) sections() [][]byte {
+	sections := [][]byte{a.Kernel, a.Ramdisk, a.Second}
+	if a.HeaderVersion > 0 {
+		sections = append(sections, a.RecoveryDtbo)
+	}
+	if a.HeaderVersion > 1 {
+		sections = append(sections, a.Dtb)
+	}
+	return sections
+}
+
+// Build return the boot image built from args, byte to byte the same as mkbootimg's.
+func (a *BootImgArgs) Build() ([]byte, error) {
+	if a.HeaderVersion > 4 {
+		return nil, fmt.Errorf("unsupported header version %d", a.HeaderVersion)
+	}
+	osv, err := osVersion(a.OsVersion, a.OsPatchLevel)
+	if err != nil {
+		return nil, err
+	}
+	if a.HeaderVersion >= 3 {
+		return a.buildV3(osv)
+	}
+
+	if a.PageSize == 0 || a.PageSize&(a.PageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid page size %d", a.PageSize)
+	}
+	if len(a.Board) >= 16 {
+		return nil, fmt.Errorf("board name %q is longer than 15", a.Board)
+	}
+	if len(a.CmdLine) > bootArgsSize+bootExtraArgsSize {
+		return nil, fmt.Errorf("cmdline is longer than %d", bootArgsSize+bootExtraArgsSize)
+	}
+	if len(a.RecoveryDtbo) != 0 && a.HeaderVersion < 1 {
+		return nil, fmt.Errorf("recovery dtbo needs header version 1 or later")
+	}
+	if len(a.Dtb) != 0 && a.HeaderVersion < 2 {
+		return nil, fmt.Errorf("dtb needs header version 2 or later")
+	}
+	if len(a.Signature) != 0 {
+		return nil, fmt.Errorf("boot signature needs header version 4")
+	}
+
+	sections := a.sections()
+
+	hdr := BootImgHdr{
+		KernelSize:        uint32(len(a.Kernel)),
+		KernelAddr:        a.Base + a.KernelOffset,
+		RamdiskSize:       uint32(len(a.Ramdisk)),
+		RamdiskAddr:       a.Base + a.RamdiskOffset,
+		SecondSize:        uint32(len(a.Second)),
+		SecondAddr:        a.Base + a.SecondOffset,
+		TagAddr:           a.Base + a.TagsOffset,
+		PageSize:          a.PageSize,
+		BootImgHdrVersion: a.HeaderVersion,
+		OsVersion:         osv,
+		ID:                bootImgID(sections...),
+	}
+	copy(hdr.Magic[:], bootMagic)
+	copy(hdr.ProductName[:], a.Board)
+	// the cmdline goes to the extra cmdline when it doesn't fit
+	if len(a.CmdLine) > bootArgsSize {
+		copy(hdr.CmdLine[:], a.CmdLine[:bootArgsSize])
+		copy(hdr.ExtraCmdline[:], a.CmdLine[bootArgsSize:])
+	} else {
+		copy(hdr.CmdLine[:], a.CmdLine)
+	}
+	if a.HeaderVersion > 0 {
+		hdr.HeaderSize = bootImgHdrV1Size
+		hdr.RecoveryDtboSize = uint32(len(a.RecoveryDtbo))
+		if len(a.RecoveryDtbo) != 0 {
+			l := layout(bootImgHdrV0Size, a.PageSize, []imgSection{
+				{size: hdr.KernelSize}, {size: hdr.RamdiskSize}, {size: hdr.SecondSize}, {}})
+			hdr.RecoveryDtboOffset = uint64(l[3].start)
+		}
+	}
+	if a.HeaderVersion > 1 {
+		hdr.HeaderSize = bootImgHdrV2Size
+		hdr.DtbSize = uint32(len(a.Dtb))
+		hdr.DtbAddr = uint64(a.Base) + uint64(a.DtbOffset)
+	}
+
+	// the fields of the later versions are 0, the same as the padding
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	writePadded(&buf, nil, a.PageSize)
+	for _, s := range sections {
+		writePadded(&buf, s, a.PageSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// buildV3 builds the v3 or v4 boot image
+func (a *BootImgArgs) buildV3(osv uint32) ([]byte, error) {
+	if len(a.Second) != 0 || len(a.RecoveryDtbo) != 0 || len(a.Dtb) != 0 {
+		return nil, fmt.Errorf("v%d boot image has no second, recovery dtbo or dtb", a.HeaderVersion)
+	}
+	if len(a.CmdLine) > bootArgsV3Size {
+		return nil, fmt.Errorf("cmdline is longer than %d", bootArgsV3Size)
+	}
+	if len(a.Signature) != 0 && a.HeaderVersion < 4 {
+		return nil, fmt.Errorf("boot signature needs header version 4")
+	}
+
+	hdr := BootImgHdrV3{
+		KernelSize:    uint32(len(a.Kernel)),
+		RamdiskSize:   uint32(len(a.Ramdisk)),
+		OsVersion:     osv,
+		HeaderSize:    bootImgHdrV3Size,
+		HeaderVersion: a.HeaderVersion,
+	}
+	copy(hdr.Magic[:], bootMagic)
+	copy(hdr.CmdLine[:], a.CmdLine)
+	if a.HeaderVersion > 3 {
+		hdr.HeaderSize = bootImgHdrV4Size
+		hdr.SignatureSize = uint32(len(a.Signature))
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	writePadded(&buf, nil, bootImgV3PageSize)
+	writePadded(&buf, a.Kernel, bootImgV3PageSize)
+	writePadded(&buf, a.Ramdisk, bootImgV3PageSize)
+	writePadded(&buf, a.Signature, bootImgV3PageSize)
+	return buf.Bytes(), nil
+}
+
+// cString return the string in a null terminated byte array
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// Args return the args the boot image is built from, Build with them gives the same image.
+// The base isn't in the image, it is assumed to be the kernel address minus the default
+// kernel offset, which is true for most of the images.
+func (b *Bootimg) Args() (*BootImgArgs, error) {
+	sections, err := b.sections()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(b.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &BootImgArgs{}
+	files := map[string]*[]byte{
+		"kernel":        &a.Kernel,
+		"ramdisk":       &a.Ramdisk,
+		"second":        &a.Second,
+		"recovery_dtbo": &a.RecoveryDtbo,
+		"dtb":           &a.Dtb,
+		"signature":     &a.Signature,
+	}
+	for _, s := range sections {
+		if uint64(s.start)+uint64(s.size) > uint64(len(data)) {
+			return nil, fmt.Errorf("%s is truncated", b.ImagePath)
+		}
+		if s.size != 0 {
+			*files[s.name] = data[s.start : s.start+s.size]
+		}
+	}
+
+	version, err := b.Version()
+	if err != nil {
+		return nil, err
+	}
+	if version >= 3 {
+		hdr, err := b.HdrV3()
+		if err != nil {
+			return nil, err
+		}
+		a.HeaderVersion = hdr.HeaderVersion
+		a.CmdLine = cString(hdr.CmdLine[:])
+		a.OsVersion, a.OsPatchLevel = osVersionString(hdr.OsVersion)
+		return a, nil
+	}
+
+	hdr, err := b.Hdr()
+	if err != nil {
+		return nil, err
+	}
+	var base uint32
+	if hdr.KernelAddr >= DefaultKernelOffset {
+		base = hdr.KernelAddr - DefaultKernelOffset
+	}
+	a.HeaderVersion = hdr.BootImgHdrVersion
+	a.CmdLine = cString(hdr.CmdLine[:]) + cString(hdr.ExtraCmdline[:])
+	a.Board = cString(hdr.ProductName[:])
+	a.Base = base
+	a.KernelOffset = hdr.KernelAddr - base
+	a.RamdiskOffset = hdr.RamdiskAddr - base
+	a.SecondOffset = hdr.SecondAddr - base
+	a.TagsOffset = hdr.TagAddr - base
+	a.DtbOffset = DefaultDtbOffset
+	if hdr.BootImgHdrVersion > 1 {
+		a.DtbOffset = uint32(hdr.DtbAddr) - base
+	}
+	a.PageSize = hdr.PageSize
+	a.OsVersion, a.OsPatchLevel = osVersionString(hdr.OsVersion)
+	return a, nil
+}
+
+// Pack builds the boot image from args and writes it to ImagePath
+func (b *Bootimg) Pack(args *BootImgArgs) error {
+	data, err := args.Build()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.ImagePath, data, 0644)
+}
+
+// Verify return error if the ID of the boot image doesn't match its content.
+// The v3 and later boot images have no ID, they are always fine.
+func (b *Bootimg) Verify() error {
+	a, err := b.Args()
+	if err != nil {
+		return err
+	}
+	if a.HeaderVersion >= 3 {
+		return nil
+	}
+	hdr, err := b.Hdr()
+	if err != nil {
+		return err
+	}
+	if bootImgID(a.sections()...) != hdr.ID {
+		return fmt.Errorf("%s: the ID doesn't match the content", b.ImagePath)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package images
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The device tree overlay [1] is applied to the base dtb the same way as libfdt
+// fdt_overlay_apply does, the base has to be compiled with dtc -@ to have the __symbols__
+// for the overlay referring to the labels in the base.
+// [1] https://www.kernel.org/doc/Documentation/devicetree/overlay-notes.txt
+
+// the special nodes of the overlay
+const (
+	fdtOverlayNode     = "__overlay__"
+	fdtSymbolsNode     = "__symbols__"
+	fdtFixupsNode      = "__fixups__"
+	fdtLocalFixupsNode = "__local_fixups__"
+)
+
+// setU32 sets the cell at off of the property value
+func (p *FdtProperty) setU32(off int, v uint32) error {
+	if off < 0 || off+4 > len(p.Value) {
+		return fmt.Errorf("offset %d out of property %s", off, p.Name)
+	}
+	value := append([]byte{}, p.Value...)
+	binary.BigEndian.PutUint32(value[off:], v)
+	p.Value = value
+	return nil
+}
+
+// SetProperty sets the value of the property, it is added to the end if it doesn't exist
+func (n *FdtNode) SetProperty(name string, value []byte) {
+	if p := n.Property(name); p != nil {
+		p.Value = value
+		return
+	}
+	n.Properties = append(n.Properties, FdtProperty{Name: name, Value: value})
+}
+
+// maxPhandle return the largest phandle in the tree, 0 if there is none
+func (f *Fdt) maxPhandle() uint32 {
+	var max uint32
+	for p := range f.Phandles() {
+		if p > max && p != 0xffffffff {
+			max = p
+		}
+	}
+	return max
+}
+
+// ApplyOverlay applies the overlay to the device tree, the overlay is not changed.
+// The tree is not changed if any error.
+func (f *Fdt) ApplyOverlay(overlay *Fdt) error {
+	// work on a copy, the phandles and the fixups are written to it
+	o, err := ParseFdt(overlay.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if err := o.adjustPhandles(f.maxPhandle()); err != nil {
+		return err
+	}
+	if err := o.fixup(f); err != nil {
+		return err
+	}
+
+	// resolve all the targets before changing the tree
+	targets := map[*FdtNode]*FdtNode{}
+	for _, c := range o.Root.Children {
+		if c.Child(fdtOverlayNode) == nil {
+			continue
+		}
+		target, err := f.overlayTarget(c)
+		if err != nil {
+			return err
+		}
+		targets[c] = target
+	}
+
+	for _, c := range o.Root.Children {
+		if target, ok := targets[c]; ok {
+			mergeNode(target, c.Child(fdtOverlayNode))
+		}
+	}
+	f.mergeSymbols(o, targets)
+	return nil
+}
+
+// adjustPhandles adds delta to the phandles of the overlay, and to the references to them,
+// which are listed in the __local_fixups__ node
+func (f *Fdt) adjustPhandles(delta uint32) error {
+	f.Root.Walk(func(n *FdtNode) {
+		for _, name := range []string{"phandle", "linux,phandle"} {
+			if p := n.Property(name); p != nil {
+				if v, err := p.U32(); err == nil {
+					p.setU32(0, v+delta)
+				}
+			}
+		}
+	})
+
+	fixups := f.Root.Child(fdtLocalFixupsNode)
+	if fixups == nil {
+		return nil
+	}
+	var adjust func(fixup, n *FdtNode) error
+	adjust = func(fixup, n *FdtNode) error {
+		for _, fp := range fixup.Properties {
+			p := n.Property(fp.Name)
+			if p == nil {
+				return fmt.Errorf("local fixup: %s has no property %s", n.Path(), fp.Name)
+			}
+			offs, err := fp.Cells()
+			if err != nil {
+				return fmt.Errorf("local fixup: %s", err)
+			}
+			for _, off := range offs {
+				if int(off)+4 > len(p.Value) {
+					return fmt.Errorf("local fixup: offset %d out of %s:%s", off, n.Path(), p.Name)
+				}
+				v := binary.BigEndian.Uint32(p.Value[off:])
+				p.setU32(int(off), v+delta)
+			}
+		}
+		for _, c := range fixup.Children {
+			child := n.Child(c.Name)
+			if child == nil || child.Name != c.Name {
+				return fmt.Errorf("local fixup: %s has no node %s", n.Path(), c.Name)
+			}
+			if err := adjust(c, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return adjust(fixups, f.Root)
+}
+
+// fixup writes the phandles of the labels in the base to the overlay, the references are
+// listed in the __fixups__ node as label = "path:property:offset", ...
+func (f *Fdt) fixup(base *Fdt) error {
+	fixups := f.Root.Child(fdtFixupsNode)
+	if fixups == nil {
+		return nil
+	}
+	symbols := base.Root.Child(fdtSymbolsNode)
+	if symbols == nil {
+		return fmt.Errorf("the base has no %s, compile it with dtc -@", fdtSymbolsNode)
+	}
+
+	for _, fp := range fixups.Properties {
+		sp := symbols.Property(fp.Name)
+		if sp == nil {
+			return fmt.Errorf("fixup: no label %s in the base", fp.Name)
+		}
+		path, _ := sp.StringValue()
+		target := base.Find(path)
+		if target == nil {
+			return fmt.Errorf("fixup: label %s refers to %q, not found in the base", fp.Name, path)
+		}
+		pp := target.Property("phandle")
+		if pp == nil {
+			pp = target.Property("linux,phandle")
+		}
+		if pp == nil {
+			return fmt.Errorf("fixup: %s has no phandle", path)
+		}
+		phandle, err := pp.U32()
+		if err != nil {
+			return fmt.Errorf("fixup: %s", err)
+		}
+
+		refs, ok := fp.Strings()
+		if !ok {
+			return fmt.Errorf("fixup: invalid %s", fp.Name)
+		}
+		for _, ref := range refs {
+			// the path and the property name don't have ":"
+			fields := strings.Split(ref, ":")
+			if len(fields) != 3 {
+				return fmt.Errorf("fixup: invalid %q", ref)
+			}
+			off, err := strconv.ParseUint(fields[2], 10, 32)
+			if err != nil {
+				return fmt.Errorf("fixup: invalid %q", ref)
+			}
+			n := f.Find(fields[0])
+			if n == nil {
+				return fmt.Errorf("fixup: %s not found in the overlay", fields[0])
+			}
+			p := n.Property(fields[1])
+			if p == nil {
+				return fmt.Errorf("fixup: %s has no property %s", fields[0], fields[1])
+			}
+			if err := p.setU32(int(off), phandle); err != nil {
+				return fmt.Errorf("fixup: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// overlayTarget return the node in the tree the fragment applies to, by the target phandle
+// or the target-path
+func (f *Fdt) overlayTarget(fragment *FdtNode) (*FdtNode, error) {
+	if p := fragment.Property("target"); p != nil {
+		phandle, err := p.U32()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fragment.Name, err)
+		}
+		n := f.Phandles()[phandle]
+		if n == nil {
+			return nil, fmt.Errorf("%s: target phandle 0x%x not found", fragment.Name, phandle)
+		}
+		return n, nil
+	}
+	if p := fragment.Property("target-path"); p != nil {
+		path, _ := p.StringValue()
+		n := f.Find(path)
+		if n == nil {
+			return nil, fmt.Errorf("%s: target-path %q not found", fragment.Name, path)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("%s has no target", fragment.Name)
+}
+
+// mergeNode sets the properties of the overlay node to the target, and merges the children
+// of the same name, the others are added
+func mergeNode(target, overlay *FdtNode) {
+	for _, p := range overlay.Properties {
+		target.SetProperty(p.Name, p.Value)
+	}
+	for _, c := range overlay.Children {
+		var existing *FdtNode
+		for _, tc := range target.Children {
+			if tc.Name == c.Name {
+				existing = tc
+				break
+			}
+		}
+		if existing != nil {
+			mergeNode(existing, c)
+			continue
+		}
+		c.Parent = target
+		target.Children = append(target.Children, c)
+	}
+}
+
+// mergeSymbols adds the labels of the overlay to the __symbols__ of the tree, the paths in
+// the fragments, /fragment@0/__overlay__/..., are changed to the target paths
+func (f *Fdt) mergeSymbols(overlay *Fdt, targets map[*FdtNode]*FdtNode) {
+	symbols := overlay.Root.Child(fdtSymbolsNode)
+	if symbols == nil {
+		return
+	}
+	base := f.Root.Child(fdtSymbolsNode)
+	if base == nil {
+		base = &FdtNode{Name: fdtSymbolsNode, Parent: f.Root}
+		f.Root.Children = append(f.Root.Children, base)
+	}
+
+	for _, p := range symbols.Properties {
+		path, ok := p.StringValue()
+		if !ok {
+			continue
+		}
+		// "", fragment, __overlay__, the rest
+		fields := strings.SplitN(path, "/", 4)
+		if len(fields) < 3 || fields[0] != "" || fields[2] != fdtOverlayNode {
+			continue
+		}
+		var target *FdtNode
+		for frag, t := range targets {
+			if frag.Name == fields[1] {
+				target = t
+			}
+		}
+		if target == nil {
+			continue
+		}
+		path = target.Path()
+		if len(fields) == 4 {
+			path = strings.TrimSuffix(path, "/") + "/" + fields[3]
+		}
+		base.SetProperty(p.Name, append([]byte(path), 0))
+	}
+}
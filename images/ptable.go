@@ -0,0 +1,493 @@
+package images
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// The partition table is either GPT [1], or MBR with the EBRs for the logical partitions
+// when there are more than 4 partitions [2].
+// [1] UEFI specification, chapter 5 GUID Partition Table (GPT) Disk Layout
+// [2] https://en.wikipedia.org/wiki/Extended_boot_record
+
+const (
+	sectorSize = 512
+
+	gptSignature  = "EFI PART"
+	gptRevision   = 0x00010000
+	gptHeaderSize = 92
+	gptEntrySize  = 128
+	gptEntryCount = 128
+	// the sectors of the entries, and of the entries and the header
+	gptEntriesSectors = gptEntrySize * gptEntryCount / sectorSize
+	gptTableSectors   = gptEntriesSectors + 1
+	gptNameLength     = 36
+
+	mbrSignature    = 0xaa55
+	mbrEntriesStart = 446
+	mbrMaxEntries   = 4
+	mbrTypeLinux    = 0x83
+	mbrTypeEBR      = 0x05
+	mbrTypeExtended = 0x0f
+	mbrTypeGPT      = 0xee
+	mbrMaxSectors   = 0xffffffff
+
+	// LinuxDataGUID is the GPT type of the Linux file system data
+	LinuxDataGUID = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+)
+
+// the GPT types of the Android partitions, see the Android-IA of [1]
+// [1] https://en.wikipedia.org/wiki/GUID_Partition_Table#Partition_type_GUIDs
+var androidPartitionTypes = map[string]string{
+	"boot":     "49A4D17F-93A3-45C1-A0DE-F50B2EBE2599",
+	"recovery": "4177C722-9E92-4AAB-8644-43502BFD5506",
+	"misc":     "EF32A33B-A409-486C-9141-9FFB711F6266",
+	"metadata": "20AC26BE-20B7-11E3-84C5-6CFDB94711E9",
+	"system":   "38F428E6-D326-425D-9140-6E0EA133647C",
+	"cache":    "A893EF21-E428-470A-9E55-0668FD91A2D9",
+	"userdata": "DC76DDA9-5AC1-491C-AF42-A82591580C0D",
+	"vendor":   "C5A0AEEC-13EA-11E5-A1B1-001E67CA0C3C",
+}
+
+// PartitionTypeGUID return the GPT type of the Android partition, LinuxDataGUID if it isn't
+// one of them
+func PartitionTypeGUID(name string) string {
+	if guid, ok := androidPartitionTypes[name]; ok {
+		return guid
+	}
+	return LinuxDataGUID
+}
+
+// guidBytes return the GUID in the on disk format, the first 3 fields are little endian
+func guidBytes(guid string) ([16]byte, error) {
+	var b [16]byte
+	s := strings.Replace(guid, "-", "", -1)
+	if len(s) != 32 || strings.Count(guid, "-") != 4 {
+		return b, fmt.Errorf("invalid GUID %q", guid)
+	}
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return b, fmt.Errorf("invalid GUID %q", guid)
+	}
+	copy(b[:], raw)
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b, nil
+}
+
+// NameGUID return the GUID derived from the name, it is unique for the name and stays the
+// same across the builds
+func NameGUID(name string) string {
+	h := sha1.Sum([]byte(name))
+	// version 5 and the variant of RFC 4122
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16]))
+}
+
+// PartitionArgs is a partition to lay out
+type PartitionArgs struct {
+	Name string
+	// Size is in bytes
+	Size int64
+	// Offset is where the partition starts in bytes, 0 to start at the alignment after the
+	// previous one
+	Offset int64
+	// TypeGUID is the GPT type, default to PartitionTypeGUID of the name
+	TypeGUID string
+}
+
+// PartitionTableArgs are what the partition table is created from
+type PartitionTableArgs struct {
+	// Scheme is mbr or gpt
+	Scheme string
+	// Alignment is the alignment of the start of the partitions in bytes, e.g the erase
+	// block size of the flash
+	Alignment int64
+	// DiskSize is the size of the storage in bytes. For mbr it can be 0 if unknown, the disk
+	// is then just large enough for the partitions. gpt needs it, the backup GPT is at the end
+	// of the disk.
+	DiskSize int64
+	// Seed makes the GUIDs unique to the device, e.g the device name
+	Seed       string
+	Partitions []PartitionArgs
+}
+
+// PartitionEntry is a partition in the layout, in bytes
+type PartitionEntry struct {
+	Name     string
+	Start    int64
+	Size     int64
+	TypeGUID string
+	GUID     string
+	// EBR is where the EBR of the logical partition of MBR is, 0 for the primary ones
+	EBR int64
+}
+
+// PartitionLayout is where the partitions are on the storage
+type PartitionLayout struct {
+	Scheme     string
+	DiskSize   int64
+	DiskGUID   string
+	Partitions []PartitionEntry
+}
+
+// alignUp return n rounded up to the multiple of a
+func alignUp(n, a int64) int64 {
+	return (n + a - 1) / a * a
+}
+
+// Layout return where the partitions are, in the order of a.Partitions, each starts at its
+// offset or the alignment after the previous one. Error if they overlap or don't fit in the disk.
+func (a *PartitionTableArgs) Layout() (*PartitionLayout, error) {
+	if a.Scheme != "gpt" && a.Scheme != "mbr" {
+		return nil, fmt.Errorf("unknown partition scheme %q, use gpt or mbr", a.Scheme)
+	}
+	if a.Alignment <= 0 || a.Alignment%sectorSize != 0 {
+		return nil, fmt.Errorf("alignment %d is not a multiple of the sector size %d", a.Alignment, sectorSize)
+	}
+	if a.DiskSize < 0 || a.DiskSize%sectorSize != 0 {
+		return nil, fmt.Errorf("storage size %d is not a multiple of the sector size %d", a.DiskSize, sectorSize)
+	}
+	if a.Scheme == "gpt" && a.DiskSize == 0 {
+		return nil, fmt.Errorf("gpt needs the storage size, the backup GPT is at the end of the storage")
+	}
+	if a.Scheme == "gpt" && len(a.Partitions) > gptEntryCount {
+		return nil, fmt.Errorf("%d partitions, gpt supports up to %d", len(a.Partitions), gptEntryCount)
+	}
+
+	l := PartitionLayout{Scheme: a.Scheme, DiskGUID: NameGUID(a.Seed)}
+	names := map[string]bool{}
+	// the end of the tables at the beginning of the disk
+	next := int64(sectorSize)
+	if a.Scheme == "gpt" {
+		next = (1 + gptTableSectors) * sectorSize
+	}
+	for i, p := range a.Partitions {
+		if p.Size <= 0 || p.Size%sectorSize != 0 {
+			return nil, fmt.Errorf("partition %s: size %d is not a multiple of the sector size %d", p.Name, p.Size, sectorSize)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("partition %s is declared twice", p.Name)
+		}
+		names[p.Name] = true
+		if a.Scheme == "gpt" && len(utf16.Encode([]rune(p.Name))) > gptNameLength {
+			return nil, fmt.Errorf("partition %s: name longer than %d", p.Name, gptNameLength)
+		}
+		e := PartitionEntry{Name: p.Name, Size: p.Size, TypeGUID: p.TypeGUID, GUID: NameGUID(a.Seed + ":" + p.Name)}
+		if e.TypeGUID == "" {
+			e.TypeGUID = PartitionTypeGUID(p.Name)
+		}
+		if _, err := guidBytes(e.TypeGUID); err != nil {
+			return nil, fmt.Errorf("partition %s: %s", p.Name, err)
+		}
+		// the 4th and the later ones are logical when there are more than 4 in MBR
+		if a.Scheme == "mbr" && len(a.Partitions) > mbrMaxEntries && i >= mbrMaxEntries-1 {
+			e.EBR = alignUp(next, a.Alignment)
+			next = e.EBR + sectorSize
+		}
+		e.Start = alignUp(next, a.Alignment)
+		if p.Offset != 0 {
+			if p.Offset%a.Alignment != 0 {
+				return nil, fmt.Errorf("partition %s: offset %d is not a multiple of the alignment %d", p.Name, p.Offset, a.Alignment)
+			}
+			if p.Offset < next {
+				what := "the partition tables"
+				if i > 0 {
+					what = "partition " + a.Partitions[i-1].Name
+				}
+				if e.EBR != 0 {
+					what = "its EBR"
+				}
+				return nil, fmt.Errorf("partition %s at %d overlaps %s ending at %d", p.Name, p.Offset, what, next)
+			}
+			e.Start = p.Offset
+		}
+		next = e.Start + e.Size
+		l.Partitions = append(l.Partitions, e)
+	}
+
+	// the backup GPT is at the end of the disk
+	end := next
+	if a.Scheme == "gpt" {
+		end += gptTableSectors * sectorSize
+	}
+	l.DiskSize = a.DiskSize
+	if l.DiskSize == 0 {
+		l.DiskSize = end
+	}
+	if end > l.DiskSize {
+		return nil, fmt.Errorf("partitions need %d bytes, larger than the storage of %d bytes", end, l.DiskSize)
+	}
+	if a.Scheme == "mbr" && l.DiskSize/sectorSize > mbrMaxSectors {
+		return nil, fmt.Errorf("mbr supports up to 2TiB, the storage is %d bytes", l.DiskSize)
+	}
+	return &l, nil
+}
+
+// Tables return the sectors of the partition tables, by the offset on the disk
+func (l *PartitionLayout) Tables() (map[int64][]byte, error) {
+	if l.Scheme == "gpt" {
+		return l.gpt()
+	}
+	return l.mbr(), nil
+}
+
+// mbrEntry is the partition entry of MBR and EBR
+type mbrEntry struct {
+	Status   uint8
+	CHSFirst [3]byte
+	Type     uint8
+	CHSLast  [3]byte
+	LBA      uint32
+	Sectors  uint32
+}
+
+// newMbrEntry return the entry of the sectors, the CHS is the maximum as only LBA is used
+func newMbrEntry(typ uint8, start, size int64) mbrEntry {
+	chs := [3]byte{0xfe, 0xff, 0xff}
+	return mbrEntry{CHSFirst: chs, Type: typ, CHSLast: chs, LBA: uint32(start / sectorSize), Sectors: uint32(size / sectorSize)}
+}
+
+// mbrSector return the MBR or EBR sector of the entries
+func mbrSector(entries ...mbrEntry) []byte {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, mbrEntriesStart))
+	binary.Write(&buf, binary.LittleEndian, entries)
+	buf.Write(make([]byte, (mbrMaxEntries-len(entries))*binary.Size(mbrEntry{})))
+	binary.Write(&buf, binary.LittleEndian, uint16(mbrSignature))
+	return buf.Bytes()
+}
+
+// mbr return the MBR and the EBRs
+func (l *PartitionLayout) mbr() map[int64][]byte {
+	var primary, logical []PartitionEntry
+	for _, p := range l.Partitions {
+		if p.EBR == 0 {
+			primary = append(primary, p)
+		} else {
+			logical = append(logical, p)
+		}
+	}
+
+	tables := map[int64][]byte{}
+	var entries []mbrEntry
+	for _, p := range primary {
+		entries = append(entries, newMbrEntry(mbrTypeLinux, p.Start, p.Size))
+	}
+	if len(logical) != 0 {
+		// the extended partition covers all the logical ones, and the addresses of the EBRs
+		// are relative to it
+		ext := logical[0].EBR
+		last := logical[len(logical)-1]
+		entries = append(entries, newMbrEntry(mbrTypeExtended, ext, last.Start+last.Size-ext))
+		for i, p := range logical {
+			ebr := []mbrEntry{newMbrEntry(mbrTypeLinux, p.Start-p.EBR, p.Size)}
+			if i+1 < len(logical) {
+				n := logical[i+1]
+				ebr = append(ebr, newMbrEntry(mbrTypeEBR, n.EBR-ext, n.Start+n.Size-n.EBR))
+			}
+			tables[p.EBR] = mbrSector(ebr...)
+		}
+	}
+	tables[0] = mbrSector(entries...)
+	return tables
+}
+
+// gptHeader is the GPT header
+type gptHeader struct {
+	Signature         [8]byte
+	Revision          uint32
+	HeaderSize        uint32
+	HeaderCRC32       uint32
+	Reserved          uint32
+	MyLBA             uint64
+	AlternateLBA      uint64
+	FirstUsableLBA    uint64
+	LastUsableLBA     uint64
+	DiskGUID          [16]byte
+	PartitionEntryLBA uint64
+	NumberOfEntries   uint32
+	SizeOfEntry       uint32
+	EntriesCRC32      uint32
+}
+
+// gptEntry is the GPT partition entry
+type gptEntry struct {
+	TypeGUID   [16]byte
+	GUID       [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [gptNameLength]uint16
+}
+
+// gpt return the protective MBR and the primary GPT at the beginning of the disk, and the
+// backup GPT at the end
+func (l *PartitionLayout) gpt() (map[int64][]byte, error) {
+	var entries bytes.Buffer
+	for _, p := range l.Partitions {
+		e := gptEntry{FirstLBA: uint64(p.Start / sectorSize), LastLBA: uint64((p.Start+p.Size)/sectorSize - 1)}
+		var err error
+		if e.TypeGUID, err = guidBytes(p.TypeGUID); err != nil {
+			return nil, err
+		}
+		if e.GUID, err = guidBytes(p.GUID); err != nil {
+			return nil, err
+		}
+		copy(e.Name[:], utf16.Encode([]rune(p.Name)))
+		binary.Write(&entries, binary.LittleEndian, &e)
+	}
+	entries.Write(make([]byte, gptEntriesSectors*sectorSize-entries.Len()))
+
+	last := uint64(l.DiskSize/sectorSize - 1)
+	hdr := gptHeader{
+		Revision:        gptRevision,
+		HeaderSize:      gptHeaderSize,
+		FirstUsableLBA:  1 + gptTableSectors,
+		LastUsableLBA:   last - gptTableSectors,
+		NumberOfEntries: gptEntryCount,
+		SizeOfEntry:     gptEntrySize,
+		EntriesCRC32:    crc32.ChecksumIEEE(entries.Bytes()),
+	}
+	copy(hdr.Signature[:], gptSignature)
+	var err error
+	if hdr.DiskGUID, err = guidBytes(l.DiskGUID); err != nil {
+		return nil, err
+	}
+	header := func(my, alternate, entriesLBA uint64) []byte {
+		h := hdr
+		h.MyLBA, h.AlternateLBA, h.PartitionEntryLBA = my, alternate, entriesLBA
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, &h)
+		h.HeaderCRC32 = crc32.ChecksumIEEE(buf.Bytes())
+		buf.Reset()
+		binary.Write(&buf, binary.LittleEndian, &h)
+		buf.Write(make([]byte, sectorSize-gptHeaderSize))
+		return buf.Bytes()
+	}
+
+	sectors := l.DiskSize/sectorSize - 1
+	if sectors > mbrMaxSectors {
+		sectors = mbrMaxSectors
+	}
+	pmbr := mbrSector(newMbrEntry(mbrTypeGPT, sectorSize, sectors*sectorSize))
+	primary := append(append(pmbr, header(1, last, 2)...), entries.Bytes()...)
+	backup := append(entries.Bytes(), header(last, 1, last-gptEntriesSectors)...)
+	return map[int64][]byte{
+		0: primary,
+		int64(last+1-gptTableSectors) * sectorSize: backup,
+	}, nil
+}
+
+// Image return the sparse image of the whole disk with only the partition tables, the
+// rest are don't care. Flash it to the storage to create the partitions.
+func (l *PartitionLayout) Image() (*SparseImage, error) {
+	tables, err := l.Tables()
+	if err != nil {
+		return nil, err
+	}
+	var offsets []int64
+	for off := range tables {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	s := SparseImage{BlockSize: sectorSize, Blocks: uint32(l.DiskSize / sectorSize)}
+	var next int64
+	for _, off := range offsets {
+		if off > next {
+			s.Chunks = append(s.Chunks, SparseChunk{Type: SparseChunkDontCare, Blocks: uint32((off - next) / sectorSize)})
+		}
+		data := tables[off]
+		s.Chunks = append(s.Chunks, SparseChunk{Type: SparseChunkRaw, Blocks: uint32(len(data) / sectorSize), Data: data})
+		next = off + int64(len(data))
+	}
+	if next < l.DiskSize {
+		s.Chunks = append(s.Chunks, SparseChunk{Type: SparseChunkDontCare, Blocks: uint32((l.DiskSize - next) / sectorSize)})
+	}
+	return &s, nil
+}
+
+// partitionXML is the partition.xml of the layout
+type partitionXML struct {
+	XMLName    xml.Name            `xml:"partitions"`
+	Scheme     string              `xml:"scheme,attr"`
+	SectorSize int                 `xml:"sector_size,attr"`
+	DiskSize   int64               `xml:"disk_size,attr"`
+	DiskGUID   string              `xml:"disk_guid,attr,omitempty"`
+	Partitions []partitionXMLEntry `xml:"partition"`
+}
+
+type partitionXMLEntry struct {
+	Label      string `xml:"label,attr"`
+	StartLBA   int64  `xml:"start_lba,attr"`
+	NumSectors int64  `xml:"num_sectors,attr"`
+	TypeGUID   string `xml:"type_guid,attr,omitempty"`
+	GUID       string `xml:"guid,attr,omitempty"`
+	Filename   string `xml:"filename,attr"`
+}
+
+// PartitionXML return the layout in xml, for the flashing tools
+func (l *PartitionLayout) PartitionXML() ([]byte, error) {
+	x := partitionXML{Scheme: l.Scheme, SectorSize: sectorSize, DiskSize: l.DiskSize}
+	if l.Scheme == "gpt" {
+		x.DiskGUID = l.DiskGUID
+	}
+	for _, p := range l.Partitions {
+		e := partitionXMLEntry{Label: p.Name, StartLBA: p.Start / sectorSize, NumSectors: p.Size / sectorSize,
+			Filename: p.Name + ".img"}
+		if l.Scheme == "gpt" {
+			e.TypeGUID, e.GUID = p.TypeGUID, p.GUID
+		}
+		x.Partitions = append(x.Partitions, e)
+	}
+	data, err := xml.MarshalIndent(&x, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// PartedScript return the shell script creating the partitions with parted, the storage is
+// the argument of the script. Setting the GPT types needs parted 3.5 or later.
+func (l *PartitionLayout) PartedScript() string {
+	var b bytes.Buffer
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString("# Create the partitions, e.g partition.sh /dev/mmcblk0\n")
+	b.WriteString("set -e\n\n")
+	b.WriteString(`[ -b "$1" ] || [ -f "$1" ] || { echo "usage: $0 <storage>"; exit 1; }` + "\n")
+	label := "gpt"
+	if l.Scheme == "mbr" {
+		label = "msdos"
+	}
+	fmt.Fprintf(&b, "parted -s \"$1\" mklabel %s\n", label)
+
+	for i, p := range l.Partitions {
+		first, last := p.Start/sectorSize, (p.Start+p.Size)/sectorSize-1
+		switch {
+		case l.Scheme == "gpt":
+			fmt.Fprintf(&b, "parted -s \"$1\" unit s mkpart %s %d %d\n", p.Name, first, last)
+			fmt.Fprintf(&b, "parted -s \"$1\" type %d %s\n", i+1, p.TypeGUID)
+		case p.EBR == 0:
+			fmt.Fprintf(&b, "parted -s \"$1\" unit s mkpart primary %d %d\n", first, last)
+		default:
+			if i == mbrMaxEntries-1 {
+				end := l.Partitions[len(l.Partitions)-1]
+				fmt.Fprintf(&b, "parted -s \"$1\" unit s mkpart extended %d %d\n",
+					p.EBR/sectorSize, (end.Start+end.Size)/sectorSize-1)
+			}
+			fmt.Fprintf(&b, "parted -s \"$1\" unit s mkpart logical %d %d\n", first, last)
+		}
+	}
+	return b.String()
+}
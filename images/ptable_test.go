@@ -0,0 +1,158 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPartitionTableArgs(scheme string) *PartitionTableArgs {
+	a := PartitionTableArgs{Scheme: scheme, Alignment: 1 << 20, DiskSize: 64 << 20, Seed: "poplar"}
+	for _, n := range []string{"boot", "system", "vendor", "cache", "misc", "userdata"} {
+		a.Partitions = append(a.Partitions, PartitionArgs{Name: n, Size: 4 << 20})
+	}
+	return &a
+}
+
+func TestGPT(t *testing.T) {
+	l, err := testPartitionTableArgs("gpt").Layout()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1<<20), l.Partitions[0].Start)
+	assert.Equal(t, int64(21<<20), l.Partitions[5].Start)
+	assert.Equal(t, "38F428E6-D326-425D-9140-6E0EA133647C", l.Partitions[1].TypeGUID)
+	assert.Equal(t, LinuxDataGUID, PartitionTypeGUID("oem"))
+	assert.Equal(t, NameGUID("poplar:system"), l.Partitions[1].GUID)
+
+	img, err := l.Image()
+	assert.Nil(t, err)
+	var disk bytes.Buffer
+	assert.Nil(t, img.Unsparse(&disk))
+	data := disk.Bytes()
+	assert.Equal(t, 64<<20, len(data))
+	assert.Equal(t, byte(mbrTypeGPT), data[mbrEntriesStart+4])
+
+	// the primary and the backup header, and the entries they point to
+	last := uint64(len(data)/sectorSize - 1)
+	for _, lba := range []uint64{1, last} {
+		var hdr gptHeader
+		binary.Read(bytes.NewReader(data[lba*sectorSize:]), binary.LittleEndian, &hdr)
+		assert.Equal(t, gptSignature, string(hdr.Signature[:]))
+		assert.Equal(t, lba, hdr.MyLBA)
+		assert.Equal(t, uint64(34), hdr.FirstUsableLBA)
+		assert.Equal(t, last-33, hdr.LastUsableLBA)
+		crc := hdr.HeaderCRC32
+		hdr.HeaderCRC32 = 0
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, &hdr)
+		assert.Equal(t, crc, crc32.ChecksumIEEE(buf.Bytes()))
+
+		entries := data[hdr.PartitionEntryLBA*sectorSize : hdr.PartitionEntryLBA*sectorSize+gptEntryCount*gptEntrySize]
+		assert.Equal(t, hdr.EntriesCRC32, crc32.ChecksumIEEE(entries))
+		var e gptEntry
+		binary.Read(bytes.NewReader(entries[gptEntrySize:]), binary.LittleEndian, &e)
+		assert.Equal(t, uint64(5<<20/sectorSize), e.FirstLBA)
+		assert.Equal(t, uint64(9<<20/sectorSize-1), e.LastLBA)
+		assert.Equal(t, "system", string(utf16.Decode(e.Name[:6])))
+		guid, _ := guidBytes(l.Partitions[1].TypeGUID)
+		assert.Equal(t, guid, e.TypeGUID)
+	}
+
+	x, err := l.PartitionXML()
+	assert.Nil(t, err)
+	assert.Contains(t, string(x), `<partition label="system" start_lba="10240" num_sectors="8192" `)
+	assert.Contains(t, l.PartedScript(), "parted -s \"$1\" unit s mkpart system 10240 18431\n")
+}
+
+func TestMBR(t *testing.T) {
+	l, err := testPartitionTableArgs("mbr").Layout()
+	assert.Nil(t, err)
+	tables, err := l.Tables()
+	assert.Nil(t, err)
+	// the MBR, and an EBR before each logical partition
+	assert.Equal(t, 4, len(tables))
+
+	entries := func(sector []byte) []mbrEntry {
+		e := make([]mbrEntry, mbrMaxEntries)
+		binary.Read(bytes.NewReader(sector[mbrEntriesStart:]), binary.LittleEndian, e)
+		assert.Equal(t, uint16(mbrSignature), binary.LittleEndian.Uint16(sector[510:]))
+		return e
+	}
+	mbr := entries(tables[0])
+	assert.Equal(t, uint8(mbrTypeLinux), mbr[2].Type)
+	assert.Equal(t, uint32(9<<20/sectorSize), mbr[2].LBA)
+	ext := mbr[3]
+	assert.Equal(t, uint8(mbrTypeExtended), ext.Type)
+
+	// walk the EBRs
+	var starts []int64
+	for ebr := int64(ext.LBA); ; {
+		e := entries(tables[ebr*sectorSize])
+		starts = append(starts, ebr+int64(e[0].LBA))
+		if e[1].Type == 0 {
+			break
+		}
+		ebr = int64(ext.LBA + e[1].LBA)
+	}
+	assert.Equal(t, []int64{l.Partitions[3].Start / sectorSize, l.Partitions[4].Start / sectorSize,
+		l.Partitions[5].Start / sectorSize}, starts)
+	assert.Contains(t, l.PartedScript(), "mkpart extended 26624")
+
+	// 4 partitions are all primary
+	a := testPartitionTableArgs("mbr")
+	a.Partitions = a.Partitions[:4]
+	l, err = a.Layout()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), l.Partitions[3].EBR)
+}
+
+func TestPartitionLayoutErrors(t *testing.T) {
+	for _, f := range []func(a *PartitionTableArgs){
+		func(a *PartitionTableArgs) { a.DiskSize = 8 << 20 },
+		func(a *PartitionTableArgs) { a.Alignment = 1000 },
+		func(a *PartitionTableArgs) { a.Partitions[0].Size = 1000 },
+		func(a *PartitionTableArgs) { a.Partitions[1].Name = "boot" },
+		func(a *PartitionTableArgs) { a.Partitions[1].TypeGUID = "system" },
+		func(a *PartitionTableArgs) { a.Scheme = "apm" },
+		// vendor overlaps system, boot the GPT, misaligned
+		func(a *PartitionTableArgs) { a.Partitions[2].Offset = 6 << 20 },
+		func(a *PartitionTableArgs) { a.Partitions[0].Offset = 8 * sectorSize },
+		func(a *PartitionTableArgs) { a.Partitions[1].Offset = 12<<20 + sectorSize },
+		// more than the GPT entries
+		func(a *PartitionTableArgs) {
+			a.DiskSize = 1 << 30
+			for i := len(a.Partitions); i <= gptEntryCount; i++ {
+				a.Partitions = append(a.Partitions, PartitionArgs{Name: fmt.Sprintf("p%d", i), Size: 1 << 20})
+			}
+		},
+	} {
+		a := testPartitionTableArgs("gpt")
+		f(a)
+		_, err := a.Layout()
+		assert.NotNil(t, err)
+	}
+
+	// the disk is just large enough if the size is unknown, gpt needs it for the backup GPT
+	a := testPartitionTableArgs("mbr")
+	a.DiskSize = 0
+	l, err := a.Layout()
+	assert.Nil(t, err)
+	last := l.Partitions[len(l.Partitions)-1]
+	assert.Equal(t, last.Start+last.Size, l.DiskSize)
+	a = testPartitionTableArgs("gpt")
+	a.DiskSize = 0
+	_, err = a.Layout()
+	assert.NotNil(t, err)
+
+	// fixed offset, the next one follows it
+	a = testPartitionTableArgs("mbr")
+	a.Partitions[1].Offset = 12 << 20
+	l, err = a.Layout()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12<<20), l.Partitions[1].Start)
+	assert.Equal(t, int64(16<<20), l.Partitions[2].Start)
+}
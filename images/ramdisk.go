@@ -2,72 +2,347 @@
 package images
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/pierrchen/avs/utils"
 )
 
+// The compressions of the ramdisk
+const (
+	RamdiskGzip = "gzip"
+	RamdiskLz4  = "lz4"
+	RamdiskNone = "none"
+)
+
+// fsConfigSuffix is the suffix of the file, next to the unpacked ramdisk dir, which has the
+// owner and mode of each file in the ramdisk, in the format of the Android fs_config [1]:
+// path uid gid mode
+// [1] https://android.googlesource.com/platform/system/core/+/master/cpio/mkbootfs.c
+const fsConfigSuffix = ".fs_config"
+
 // Ramdisk is Android ramdisk image
 type Ramdisk struct {
 	// absolution path or the relative to current dir where the command is calling
 	ImagePath string
 }
 
+// decompress return the cpio archive in data and the compression of it
+func decompress(data []byte) ([]byte, string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+		defer r.Close()
+		cpio, err := ioutil.ReadAll(r)
+		return cpio, RamdiskGzip, err
+	case isLz4Legacy(data):
+		cpio, err := lz4LegacyDecompress(data)
+		return cpio, RamdiskLz4, err
+	case bytes.HasPrefix(data, []byte(cpioNewcMagic)):
+		return data, RamdiskNone, nil
+	}
+	return nil, "", fmt.Errorf("unknown ramdisk format, expect a cpio archive in gzip, lz4 or none")
+}
+
+// compress compresses the cpio archive, the result is the same for the same archive
+func compress(cpio []byte, compression string) ([]byte, error) {
+	switch compression {
+	case RamdiskGzip:
+		var buf bytes.Buffer
+		// no name nor mtime in the gzip header
+		w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(cpio); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case RamdiskLz4:
+		return lz4LegacyCompress(cpio), nil
+	case RamdiskNone:
+		return cpio, nil
+	}
+	return nil, fmt.Errorf("unknown ramdisk compression %q, use %s, %s or %s",
+		compression, RamdiskGzip, RamdiskLz4, RamdiskNone)
+}
+
+// Entries return the files in the ramdisk and the compression of it
+func (r *Ramdisk) Entries() ([]CpioEntry, string, error) {
+	data, err := ioutil.ReadFile(r.ImagePath)
+	if err != nil {
+		return nil, "", err
+	}
+	cpio, compression, err := decompress(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", r.ImagePath, err)
+	}
+	entries, err := ReadCpio(bytes.NewReader(cpio))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", r.ImagePath, err)
+	}
+	return entries, compression, nil
+}
+
+// fileMode return the os.FileMode of the permission bits in the cpio mode
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// cpioMode return the permission bits in the cpio mode of the os.FileMode
+func cpioMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
 // Unpack a Andriod ramdisk to dir
 // dir is either absolute dir or relative to current dir where the command is calling
+// The owner and mode of the files are saved to dir.fs_config, since they can't be kept
+// in the dir unless running as root, Pack uses them to build the same ramdisk.
+// The device nodes, fifos and sockets are skipped.
 func (r *Ramdisk) Unpack(dir string) error {
-	img, err := filepath.Abs(r.ImagePath)
+	entries, _, err := r.Entries()
 	if err != nil {
-		return fmt.Errorf("can't find ramdisk image %s", img)
+		return err
+	}
+
+	if exist, _ := utils.FileExists(dir); exist {
+		return fmt.Errorf("%s exsit, remove that first", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
 	}
 
-	if r, _ := utils.FileExists(img); r == false {
-		return fmt.Errorf("can't find ramdisk image %s", img)
+	// set the mode of the dirs at last, since they might be read only
+	type dirMode struct {
+		path string
+		mode os.FileMode
 	}
+	var dirs []dirMode
+	var config []string
 
-	outDir := dir
+	for _, e := range entries {
+		name := strings.TrimPrefix(filepath.Clean("/"+e.Name), "/")
+		if name == "" {
+			continue
+		}
+		if name != strings.TrimPrefix(strings.TrimPrefix(e.Name, "./"), "/") {
+			return fmt.Errorf("%s: invalid file name %q", r.ImagePath, e.Name)
+		}
+		// a symlink unpacked earlier mustn't take the entry out of dir
+		link, err := symlinkIn(dir, filepath.Dir(filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		if link != "" {
+			return fmt.Errorf("%s: %s is under the symlink %s", r.ImagePath, name, link)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// the later entry of the same name wins, don't follow the symlink of the earlier one
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
 
-	// 1. copy ramdisk.img to ramdisk.img.gz in tmp dir
-	tmpDir, err := ioutil.TempDir("", "avs")
-	defer os.RemoveAll(tmpDir)
-	tmpImage := filepath.Join(tmpDir, "ramdisk.img.gz")
-	copyCmd := "cp " + img + " " + tmpImage
-	cmd := exec.Command("bash", "-c", copyCmd)
-	err = cmd.Run()
-	if err != nil {
+		switch e.Type() {
+		case CpioModeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{path, fileMode(e.Mode)})
+		case CpioModeRegular:
+			if err := ioutil.WriteFile(path, e.Data, 0644); err != nil {
+				return err
+			}
+			if err := os.Chmod(path, fileMode(e.Mode)); err != nil {
+				return err
+			}
+		case CpioModeSymlink:
+			if err := os.Symlink(string(e.Data), path); err != nil {
+				return err
+			}
+		default:
+			fmt.Printf("skip %s, mode 0%o\n", name, e.Mode)
+			continue
+		}
+		config = append(config, fmt.Sprintf("%s %d %d %04o", name, e.UID, e.GID, e.Mode&07777))
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+
+	sort.Strings(config)
+	fsConfig := filepath.Clean(dir) + fsConfigSuffix
+	if err := ioutil.WriteFile(fsConfig, []byte(strings.Join(config, "\n")+"\n"), 0644); err != nil {
 		return err
 	}
 
-	// 2. unzip the tmp .gz image and extract it from cpio into the dir specified
-	cmdLine := "gzip -dc " + tmpImage + " | cpio -id"
-	// fmt.Println(cmdLine)
-	cur, _ := os.Getwd()
+	fmt.Printf("ramdisk %s is extracted to %s, the owners and modes are in %s\n", r.ImagePath, dir, fsConfig)
+	return nil
+}
 
-	if r, _ := utils.FileExists(outDir); r == true {
-		log.Fatalf("%s exsit, remove that first\n", outDir)
+// symlinkIn return the first component of name, relative to dir, that is a symlink, or "" if
+// there is none
+func symlinkIn(dir, name string) (string, error) {
+	var p string
+	for _, c := range strings.Split(name, string(filepath.Separator)) {
+		if c == "." || c == "" {
+			continue
+		}
+		p = filepath.Join(p, c)
+		fi, err := os.Lstat(filepath.Join(dir, p))
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return filepath.ToSlash(p), nil
+		}
 	}
+	return "", nil
+}
 
-	ramdiskDir := filepath.Join(cur, outDir)
-	utils.CreateGenDirIfNotExsit(ramdiskDir)
+// fsConfigEntry is a line in the fs_config
+type fsConfigEntry struct {
+	uid, gid, mode uint32
+}
 
-	fmt.Println("Press Enter to finish.")
-	cmd = exec.Command("bash", "-c", cmdLine)
-	cmd.Dir = ramdiskDir
-	err = cmd.Run()
+// loadFsConfig loads the fs_config, by path. It is empty if the file doesn't exist.
+func loadFsConfig(file string) (map[string]fsConfigEntry, error) {
+	config := map[string]fsConfigEntry{}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer f.Close()
 
-	fmt.Printf("ramdisk %s is extracted to %s\n", img, ramdiskDir)
-	return nil
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// the capabilities after the mode, if any, are ignored
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("%s:%d: expect: path uid gid mode", file, n)
+		}
+		var values [3]uint32
+		for i, base := range []int{10, 10, 8} {
+			v, err := strconv.ParseUint(fields[i+1], base, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid %q", file, n, fields[i+1])
+			}
+			values[i] = uint32(v)
+		}
+		config[strings.Trim(fields[0], "/")] = fsConfigEntry{values[0], values[1], values[2] & 07777}
+	}
+	return config, s.Err()
 }
 
-// Pack pack dir to ramdisk image
-func Pack(dir string, image Ramdisk) {
-	// TODO:
+// Pack packs dir to the ramdisk image, with compression gzip, lz4 or none.
+// The ramdisk is reproducible: the files are in the order of the path, the mtime is 0, and
+// the owner is root unless set in dir.fs_config, as written by Unpack, which also overrides
+// the mode of the file.
+func (r *Ramdisk) Pack(dir string, compression string) error {
+	config, err := loadFsConfig(filepath.Clean(dir) + fsConfigSuffix)
+	if err != nil {
+		return err
+	}
+
+	var entries []CpioEntry
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		e := CpioEntry{Name: filepath.ToSlash(rel), Mode: cpioMode(info.Mode())}
+
+		switch {
+		case info.IsDir():
+			e.Mode |= CpioModeDir
+		case info.Mode()&os.ModeSymlink != 0:
+			e.Mode |= CpioModeSymlink
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			e.Data = []byte(target)
+		case info.Mode().IsRegular():
+			e.Mode |= CpioModeRegular
+			if e.Data, err = ioutil.ReadFile(path); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: only dirs, regular files and symlinks are supported", path)
+		}
+
+		if c, ok := config[e.Name]; ok {
+			e.UID, e.GID = c.uid, c.gid
+			e.Mode = e.Type() | c.mode
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var cpio bytes.Buffer
+	if err := WriteCpio(&cpio, entries); err != nil {
+		return err
+	}
+	data, err := compress(cpio.Bytes(), compression)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.ImagePath, data, 0644)
 }
@@ -0,0 +1,238 @@
+package images
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCpio(t *testing.T) {
+	entries := []CpioEntry{
+		{Name: "system", Mode: CpioModeDir | 0755},
+		{Name: "system/bin", Mode: CpioModeDir | 0751, GID: 2000},
+		{Name: "system/bin/sh", Mode: CpioModeRegular | 04755, GID: 2000, Data: []byte("sh")},
+		{Name: "init", Mode: CpioModeSymlink | 0777, Data: []byte("/system/bin/init")},
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, WriteCpio(&buf, entries))
+	// the header and name are padded to 4, so is the data
+	assert.Equal(t, 0, buf.Len()%4)
+
+	got, err := ReadCpio(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), len(got))
+	for i := range entries {
+		assert.Equal(t, entries[i].Name, got[i].Name)
+		assert.Equal(t, entries[i].Mode, got[i].Mode)
+		assert.Equal(t, entries[i].GID, got[i].GID)
+		assert.Equal(t, string(entries[i].Data), string(got[i].Data))
+	}
+
+	// the archives concatenated are read as one
+	data := append(buf.Bytes(), buf.Bytes()...)
+	got, err = ReadCpio(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 2*len(entries), len(got))
+}
+
+func TestLz4Legacy(t *testing.T) {
+	data := []byte(strings.Repeat("ro.product.device=hikey\n", 1000) + "the end")
+	compressed := lz4LegacyCompress(data)
+	assert.True(t, len(compressed) < len(data)/10)
+
+	got, err := lz4LegacyDecompress(compressed)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), string(got))
+
+	// a short one has literals only
+	got, err = lz4LegacyDecompress(lz4LegacyCompress([]byte("init")))
+	assert.Nil(t, err)
+	assert.Equal(t, "init", string(got))
+
+	_, err = lz4LegacyDecompress(compressed[:len(compressed)-1])
+	assert.NotNil(t, err)
+}
+
+func TestRamdiskPack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramdisk")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "system", "bin"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "system", "bin", "sh"), []byte("sh"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "init.rc"), []byte("on init\n"), 0644))
+	assert.Nil(t, os.Symlink("/system/bin/init", filepath.Join(root, "init")))
+	assert.Nil(t, ioutil.WriteFile(root+fsConfigSuffix, []byte("system/bin 0 2000 0751\n"), 0644))
+
+	for _, compression := range []string{RamdiskGzip, RamdiskLz4, RamdiskNone} {
+		r := Ramdisk{ImagePath: filepath.Join(dir, "ramdisk."+compression)}
+		assert.Nil(t, r.Pack(root, compression))
+		entries, c, err := r.Entries()
+		assert.Nil(t, err)
+		assert.Equal(t, compression, c)
+
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+			assert.Equal(t, uint32(0), e.Mtime)
+		}
+		assert.Equal(t, []string{"init", "init.rc", "system", "system/bin", "system/bin/sh"}, names)
+		assert.Equal(t, uint32(CpioModeSymlink), entries[0].Type())
+		assert.Equal(t, "/system/bin/init", string(entries[0].Data))
+		assert.Equal(t, uint32(CpioModeDir|0751), entries[3].Mode)
+		assert.Equal(t, uint32(2000), entries[3].GID)
+	}
+
+	// unpack and pack again gives the same ramdisk
+	r := Ramdisk{ImagePath: filepath.Join(dir, "ramdisk.lz4")}
+	out := filepath.Join(dir, "out")
+	assert.Nil(t, r.Unpack(out))
+	assert.NotNil(t, r.Unpack(out), "dir exists")
+	repacked := Ramdisk{ImagePath: filepath.Join(dir, "repacked.lz4")}
+	assert.Nil(t, repacked.Pack(out, RamdiskLz4))
+	a, _ := ioutil.ReadFile(r.ImagePath)
+	b, _ := ioutil.ReadFile(repacked.ImagePath)
+	assert.Equal(t, a, b)
+}
+
+func TestRamdiskUnpackSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramdisk")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	assert.Nil(t, os.Mkdir(outside, 0755))
+
+	for i, entries := range [][]CpioEntry{
+		{
+			{Name: "lib", Mode: CpioModeSymlink | 0777, Data: []byte(outside)},
+			{Name: "lib/pwned", Mode: CpioModeRegular | 0644, Data: []byte("pwned")},
+		},
+		{
+			{Name: "lib", Mode: CpioModeSymlink | 0777, Data: []byte("../outside")},
+			{Name: "lib/sub/pwned", Mode: CpioModeRegular | 0644, Data: []byte("pwned")},
+		},
+	} {
+		var buf bytes.Buffer
+		assert.Nil(t, WriteCpio(&buf, entries))
+		r := Ramdisk{ImagePath: filepath.Join(dir, "ramdisk.cpio")}
+		assert.Nil(t, ioutil.WriteFile(r.ImagePath, buf.Bytes(), 0644))
+		assert.NotNil(t, r.Unpack(filepath.Join(dir, "bad", strings.Repeat("x", i+1))))
+		files, _ := ioutil.ReadDir(outside)
+		assert.Equal(t, 0, len(files))
+	}
+
+	// a file replacing the symlink of the same name is written in dir
+	entries := []CpioEntry{
+		{Name: "init", Mode: CpioModeSymlink | 0777, Data: []byte(filepath.Join(outside, "init"))},
+		{Name: "init", Mode: CpioModeRegular | 0755, Data: []byte("init")},
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, WriteCpio(&buf, entries))
+	r := Ramdisk{ImagePath: filepath.Join(dir, "ramdisk.cpio")}
+	assert.Nil(t, ioutil.WriteFile(r.ImagePath, buf.Bytes(), 0644))
+	assert.Nil(t, r.Unpack(filepath.Join(dir, "out")))
+	files, _ := ioutil.ReadDir(outside)
+	assert.Equal(t, 0, len(files))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "out", "init"))
+	assert.Nil(t, err)
+	assert.Equal(t, "init", string(data))
+}
+
+func TestRamdiskEdit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramdisk")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	entries := []CpioEntry{
+		{Name: "./init.poplar.rc", Mode: CpioModeRegular | 0750, Data: []byte("on init\n")},
+		{Name: "./system", Mode: CpioModeDir | 0755},
+		{Name: "./system/bin", Mode: CpioModeDir | 0755},
+		{Name: "./system/bin/sh", Mode: CpioModeRegular | 0755, Data: []byte("sh")},
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, WriteCpio(&buf, entries))
+	data, err := compress(buf.Bytes(), RamdiskGzip)
+	assert.Nil(t, err)
+	r := Ramdisk{ImagePath: filepath.Join(dir, "ramdisk.img")}
+	assert.Nil(t, ioutil.WriteFile(r.ImagePath, data, 0644))
+
+	src := filepath.Join(dir, "fstab")
+	assert.Nil(t, ioutil.WriteFile(src, []byte("/dev/block/system /system ext4 ro wait\n"), 0640))
+	rc := filepath.Join(dir, "init.rc")
+	assert.Nil(t, ioutil.WriteFile(rc, []byte("on boot\n"), 0644))
+
+	edit := func(c *Cpio) error {
+		if err := c.Remove("/system"); err != nil {
+			return err
+		}
+		if err := c.AddFile(src, "vendor/etc/fstab.poplar"); err != nil {
+			return err
+		}
+		if err := c.AddFile(rc, "init.poplar.rc"); err != nil {
+			return err
+		}
+		return c.Chmod("vendor/etc/fstab.poplar", 0644)
+	}
+	assert.Nil(t, r.Edit(r.ImagePath, edit))
+
+	got, compression, err := r.Entries()
+	assert.Nil(t, err)
+	assert.Equal(t, RamdiskGzip, compression)
+	var names []string
+	for _, e := range got {
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{"./init.poplar.rc", "vendor", "vendor/etc", "vendor/etc/fstab.poplar"}, names)
+	// replaced with the mode kept
+	assert.Equal(t, uint32(CpioModeRegular|0750), got[0].Mode)
+	assert.Equal(t, "on boot\n", string(got[0].Data))
+	assert.Equal(t, uint32(CpioModeDir|0755), got[1].Mode)
+	assert.Equal(t, uint32(CpioModeRegular|0644), got[3].Mode)
+
+	c := &Cpio{Entries: got}
+	assert.NotNil(t, c.Remove("system"))
+	assert.NotNil(t, c.Add("init.poplar.rc/x", CpioModeRegular|0644, nil))
+
+	// the archives concatenated, the file in the later one is edited
+	var vendor bytes.Buffer
+	assert.Nil(t, WriteCpio(&vendor, []CpioEntry{
+		{Name: "init.poplar.rc", Mode: CpioModeRegular | 0644, Data: []byte("on vendor\n")},
+	}))
+	assert.Nil(t, ioutil.WriteFile(r.ImagePath, append(buf.Bytes(), vendor.Bytes()...), 0644))
+	assert.Nil(t, r.Edit(r.ImagePath, func(c *Cpio) error {
+		if err := c.AddFile(rc, "init.poplar.rc"); err != nil {
+			return err
+		}
+		return c.Chmod("init.poplar.rc", 0600)
+	}))
+	got, _, err = r.Entries()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(got))
+	assert.Equal(t, "on init\n", string(got[0].Data))
+	assert.Equal(t, uint32(CpioModeRegular|0750), got[0].Mode)
+	assert.Equal(t, "on boot\n", string(got[4].Data))
+	assert.Equal(t, uint32(CpioModeRegular|0600), got[4].Mode)
+
+	// the ramdisk in the boot image
+	args := DefaultBootImgArgs()
+	args.Kernel = []byte("kernel")
+	args.Ramdisk = data
+	assert.Nil(t, ioutil.WriteFile(r.ImagePath, data, 0644))
+	assert.Nil(t, r.Edit(r.ImagePath, edit))
+	b := Bootimg{ImagePath: filepath.Join(dir, "boot.img")}
+	assert.Nil(t, b.Pack(args))
+	out := Bootimg{ImagePath: filepath.Join(dir, "boot-edited.img")}
+	assert.Nil(t, b.EditRamdisk(out.ImagePath, edit))
+	assert.Nil(t, out.Verify())
+	edited, err := out.Args()
+	assert.Nil(t, err)
+	ramdisk, err := ioutil.ReadFile(r.ImagePath)
+	assert.Nil(t, err)
+	assert.Equal(t, ramdisk, edited.Ramdisk)
+}
@@ -0,0 +1,183 @@
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Cpio is the files in the cpio archive, to edit the ramdisk in memory
+type Cpio struct {
+	Entries []CpioEntry
+}
+
+// cpioName return the name without the leading "/" or "./", so that the names written by
+// different tools can be compared
+func cpioName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Find return the index of the file in the entries, or -1. The archives concatenated can
+// have the same file, the last one is what the kernel extracts.
+func (c *Cpio) Find(name string) int {
+	name = cpioName(name)
+	for i := len(c.Entries) - 1; i >= 0; i-- {
+		if cpioName(c.Entries[i].Name) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// mkdirAll adds the dirs of name that don't exist, owned by root and 0755
+func (c *Cpio) mkdirAll(name string) error {
+	dir := path.Dir(cpioName(name))
+	if dir == "." {
+		return nil
+	}
+	if i := c.Find(dir); i >= 0 {
+		if c.Entries[i].Type() != CpioModeDir {
+			return fmt.Errorf("%s is not a dir", dir)
+		}
+		return nil
+	}
+	if err := c.mkdirAll(dir); err != nil {
+		return err
+	}
+	c.Entries = append(c.Entries, CpioEntry{Name: dir, Mode: CpioModeDir | 0755})
+	return nil
+}
+
+// Add adds the file, or replaces the content of it if it exists, in which case the owner and
+// the mode are kept. The missing dirs are added. mode has the file type and permission bits.
+func (c *Cpio) Add(name string, mode uint32, data []byte) error {
+	name = cpioName(name)
+	if name == "" {
+		return fmt.Errorf("can't add the root dir")
+	}
+	if i := c.Find(name); i >= 0 {
+		e := &c.Entries[i]
+		if e.Type() != mode&CpioModeTypeMask {
+			return fmt.Errorf("%s exists with a different file type", name)
+		}
+		e.Data = data
+		return nil
+	}
+	if err := c.mkdirAll(name); err != nil {
+		return err
+	}
+	c.Entries = append(c.Entries, CpioEntry{Name: name, Mode: mode, Data: data})
+	return nil
+}
+
+// AddFile adds the regular file or symlink src as name, see Add
+func (c *Cpio) AddFile(src, name string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	mode := cpioMode(info.Mode())
+	var data []byte
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		mode |= CpioModeSymlink
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		data = []byte(target)
+	case info.Mode().IsRegular():
+		mode |= CpioModeRegular
+		if data, err = ioutil.ReadFile(src); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s: only regular files and symlinks can be added", src)
+	}
+	return c.Add(name, mode, data)
+}
+
+// Remove removes the file, or the dir and everything in it
+func (c *Cpio) Remove(name string) error {
+	name = cpioName(name)
+	if c.Find(name) < 0 {
+		return fmt.Errorf("%s doesn't exist", name)
+	}
+	var entries []CpioEntry
+	for _, e := range c.Entries {
+		n := cpioName(e.Name)
+		if n != name && !strings.HasPrefix(n, name+"/") {
+			entries = append(entries, e)
+		}
+	}
+	c.Entries = entries
+	return nil
+}
+
+// Chmod changes the permission bits of the file, mode is like 0750
+func (c *Cpio) Chmod(name string, mode uint32) error {
+	i := c.Find(name)
+	if i < 0 {
+		return fmt.Errorf("%s doesn't exist", cpioName(name))
+	}
+	if mode&^07777 != 0 {
+		return fmt.Errorf("invalid mode %o", mode)
+	}
+	c.Entries[i].Mode = c.Entries[i].Type() | mode
+	return nil
+}
+
+// editRamdisk applies edit to the files of the ramdisk data, and return the new ramdisk in
+// the same compression
+func editRamdisk(data []byte, edit func(*Cpio) error) ([]byte, error) {
+	cpio, compression, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ReadCpio(bytes.NewReader(cpio))
+	if err != nil {
+		return nil, err
+	}
+	c := &Cpio{Entries: entries}
+	if err := edit(c); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := WriteCpio(&buf, c.Entries); err != nil {
+		return nil, err
+	}
+	return compress(buf.Bytes(), compression)
+}
+
+// Edit applies edit to the files in the ramdisk, without extracting them, and writes the
+// ramdisk to out, in the same compression. out can be the ImagePath.
+func (r *Ramdisk) Edit(out string, edit func(*Cpio) error) error {
+	data, err := ioutil.ReadFile(r.ImagePath)
+	if err != nil {
+		return err
+	}
+	if data, err = editRamdisk(data, edit); err != nil {
+		return fmt.Errorf("%s: %s", r.ImagePath, err)
+	}
+	return ioutil.WriteFile(out, data, 0644)
+}
+
+// EditRamdisk applies edit to the files in the ramdisk of the boot image, as Ramdisk.Edit,
+// and writes the boot image repacked to out. out can be the ImagePath.
+func (b *Bootimg) EditRamdisk(out string, edit func(*Cpio) error) error {
+	args, err := b.Args()
+	if err != nil {
+		return err
+	}
+	if len(args.Ramdisk) == 0 {
+		return fmt.Errorf("%s has no ramdisk", b.ImagePath)
+	}
+	if args.Ramdisk, err = editRamdisk(args.Ramdisk, edit); err != nil {
+		return fmt.Errorf("%s: %s", b.ImagePath, err)
+	}
+	o := Bootimg{ImagePath: out}
+	return o.Pack(args)
+}
@@ -0,0 +1,562 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// The sparse image [1] is what img2simg creates for system.img, vendor.img, userdata.img etc.
+// The blocks of the raw image are described by the chunks, a chunk is either the raw data,
+// a 4 bytes pattern to fill, or the blocks don't care. Little endian.
+// [1] https://android.googlesource.com/platform/system/core/+/master/libsparse/sparse_format.h
+
+const (
+	sparseHeaderMagic     = 0xed26ff3a
+	sparseMajorVersion    = 1
+	sparseHeaderSize      = 28
+	sparseChunkHeaderSize = 12
+
+	// DefaultSparseBlockSize is the block size img2simg uses
+	DefaultSparseBlockSize = 4096
+)
+
+// the chunk types
+const (
+	SparseChunkRaw      = 0xcac1
+	SparseChunkFill     = 0xcac2
+	SparseChunkDontCare = 0xcac3
+	SparseChunkCRC32    = 0xcac4
+)
+
+// SparseHeader is the sparse_header
+type SparseHeader struct {
+	Magic        uint32
+	MajorVersion uint16
+	MinorVersion uint16
+	FileHdrSz    uint16
+	ChunkHdrSz   uint16
+	BlkSz        uint32
+	TotalBlks    uint32
+	TotalChunks  uint32
+	// ImageChecksum is the crc32 of the raw image, usually 0 as not computed
+	ImageChecksum uint32
+}
+
+// SparseChunkHeader is the chunk_header
+type SparseChunkHeader struct {
+	ChunkType uint16
+	Reserved1 uint16
+	// ChunkSz is in blocks of the raw image
+	ChunkSz uint32
+	// TotalSz is in bytes of the chunk, including the header
+	TotalSz uint32
+}
+
+// SparseChunk is a chunk of the sparse image
+type SparseChunk struct {
+	Type   uint16
+	Blocks uint32
+	// Data is the data of the raw chunk, nil if it is read on demand from the sparse image
+	// parsed or the raw image it is created from
+	Data []byte
+	// Fill is the pattern of the fill chunk
+	Fill uint32
+	// CRC32 is the checksum of the raw image till the crc32 chunk
+	CRC32 uint32
+
+	// src and off are where the data of the raw chunk is read from, if not in Data
+	src io.ReaderAt
+	off int64
+}
+
+// SparseImage is the sparse image parsed
+type SparseImage struct {
+	BlockSize uint32
+	// Blocks is the size of the raw image in blocks
+	Blocks uint32
+	Chunks []SparseChunk
+
+	// file is what the raw chunks are read from, closed by Close
+	file io.Closer
+}
+
+// Sparse is the sparse image file
+type Sparse struct {
+	// absolution path or the relative to current dir where the command is calling
+	ImagePath string
+}
+
+// IsSparse return true if the file is a sparse image
+func (s *Sparse) IsSparse() bool {
+	f, err := os.Open(s.ImagePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	t := make([]byte, 4)
+	if _, err := io.ReadFull(f, t); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(t) == sparseHeaderMagic
+}
+
+// Hdr return the sparse header
+func (s *Sparse) Hdr() (*SparseHeader, error) {
+	var hdr SparseHeader
+	if err := readHeader(s.ImagePath, 0, &hdr); err != nil || hdr.Magic != sparseHeaderMagic {
+		return nil, fmt.Errorf("%s is not a sparse image", s.ImagePath)
+	}
+	return &hdr, nil
+}
+
+// Image parses the sparse image, the data of the raw chunks is read from the file when it is
+// needed. Close the image after use.
+func (s *Sparse) Image() (*SparseImage, error) {
+	f, err := os.Open(s.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	img, err := ReadSparse(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", s.ImagePath, err)
+	}
+	img.file = f
+	return img, nil
+}
+
+// Close closes the file the image is read from, if any
+func (s *SparseImage) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// ParseSparse parses the sparse image in data, the data of the raw chunks refers to data
+func ParseSparse(data []byte) (*SparseImage, error) {
+	img, err := ReadSparse(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	img.load(data)
+	return img, nil
+}
+
+// ReadSparse parses the sparse image of size bytes in r, only the headers are read, the data
+// of the raw chunks is read from r when it is needed
+func ReadSparse(r io.ReaderAt, size int64) (*SparseImage, error) {
+	var hdr SparseHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, sparseHeaderSize), binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("not a sparse image, %s", err)
+	}
+	if hdr.Magic != sparseHeaderMagic {
+		return nil, fmt.Errorf("not a sparse image, magic 0x%x", hdr.Magic)
+	}
+	if hdr.MajorVersion != sparseMajorVersion {
+		return nil, fmt.Errorf("sparse version %d.%d is not supported", hdr.MajorVersion, hdr.MinorVersion)
+	}
+	if hdr.FileHdrSz < sparseHeaderSize || hdr.ChunkHdrSz < sparseChunkHeaderSize {
+		return nil, fmt.Errorf("invalid header size %d and chunk header size %d", hdr.FileHdrSz, hdr.ChunkHdrSz)
+	}
+	if hdr.BlkSz == 0 || hdr.BlkSz%4 != 0 {
+		return nil, fmt.Errorf("invalid block size %d", hdr.BlkSz)
+	}
+
+	img := SparseImage{BlockSize: hdr.BlkSz, Blocks: hdr.TotalBlks}
+	off := int64(hdr.FileHdrSz)
+	var blocks uint64
+	for i := uint32(0); i < hdr.TotalChunks; i++ {
+		if off+int64(hdr.ChunkHdrSz) > size {
+			return nil, fmt.Errorf("chunk %d truncated", i)
+		}
+		var ch SparseChunkHeader
+		if err := binary.Read(io.NewSectionReader(r, off, sparseChunkHeaderSize), binary.LittleEndian, &ch); err != nil {
+			return nil, fmt.Errorf("chunk %d at 0x%x: %s", i, off, err)
+		}
+		if int64(ch.TotalSz) < int64(hdr.ChunkHdrSz) || off+int64(ch.TotalSz) > size {
+			return nil, fmt.Errorf("chunk %d at 0x%x: invalid size %d", i, off, ch.TotalSz)
+		}
+		body, bodySize := off+int64(hdr.ChunkHdrSz), int64(ch.TotalSz)-int64(hdr.ChunkHdrSz)
+
+		c := SparseChunk{Type: ch.ChunkType, Blocks: ch.ChunkSz}
+		var err error
+		switch ch.ChunkType {
+		case SparseChunkRaw:
+			if bodySize != int64(ch.ChunkSz)*int64(hdr.BlkSz) {
+				return nil, fmt.Errorf("chunk %d at 0x%x: %d bytes of raw data for %d blocks", i, off, bodySize, ch.ChunkSz)
+			}
+			c.src, c.off = r, body
+		case SparseChunkFill:
+			if bodySize != 4 {
+				return nil, fmt.Errorf("chunk %d at 0x%x: fill of %d bytes", i, off, bodySize)
+			}
+			c.Fill, err = readUint32(r, body)
+		case SparseChunkDontCare:
+		case SparseChunkCRC32:
+			if bodySize != 4 {
+				return nil, fmt.Errorf("chunk %d at 0x%x: crc32 of %d bytes", i, off, bodySize)
+			}
+			c.CRC32, err = readUint32(r, body)
+		default:
+			return nil, fmt.Errorf("chunk %d at 0x%x: unknown type 0x%x", i, off, ch.ChunkType)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d at 0x%x: %s", i, off, err)
+		}
+		img.Chunks = append(img.Chunks, c)
+		blocks += uint64(ch.ChunkSz)
+		off += int64(ch.TotalSz)
+	}
+	if blocks != uint64(hdr.TotalBlks) {
+		return nil, fmt.Errorf("chunks have %d blocks, header %d", blocks, hdr.TotalBlks)
+	}
+	return &img, nil
+}
+
+// readUint32 reads the uint32 at off of r, in little endian
+func readUint32(r io.ReaderAt, off int64) (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// load sets the data of the raw chunks to the slices of data, what they are read from
+func (s *SparseImage) load(data []byte) {
+	for i := range s.Chunks {
+		c := &s.Chunks[i]
+		if c.src != nil {
+			c.Data = data[c.off : c.off+int64(c.Blocks)*int64(s.BlockSize)]
+			c.src, c.off = nil, 0
+		}
+	}
+}
+
+// SparseChunkType return the name of the chunk type
+func SparseChunkType(t uint16) string {
+	switch t {
+	case SparseChunkRaw:
+		return "raw"
+	case SparseChunkFill:
+		return "fill"
+	case SparseChunkDontCare:
+		return "don't care"
+	case SparseChunkCRC32:
+		return "crc32"
+	}
+	return fmt.Sprintf("0x%x", t)
+}
+
+// dataSize return the size of the data of the raw chunk
+func (c *SparseChunk) dataSize(blockSize uint32) int64 {
+	if c.src == nil {
+		return int64(len(c.Data))
+	}
+	return int64(c.Blocks) * int64(blockSize)
+}
+
+// data return the reader of the data of the raw chunk
+func (c *SparseChunk) data(blockSize uint32) io.Reader {
+	if c.src == nil {
+		return bytes.NewReader(c.Data)
+	}
+	return io.NewSectionReader(c.src, c.off, c.dataSize(blockSize))
+}
+
+// blocks return the raw chunk of the n blocks from start of c
+func (c SparseChunk) blocks(start, n, blockSize uint32) SparseChunk {
+	from, to := int64(start)*int64(blockSize), int64(start+n)*int64(blockSize)
+	if c.src == nil {
+		c.Data = c.Data[from:to]
+	} else {
+		c.off += from
+	}
+	c.Blocks = n
+	return c
+}
+
+// size return the size of the chunk in the sparse image
+func (c *SparseChunk) size(blockSize uint32) int64 {
+	switch c.Type {
+	case SparseChunkRaw:
+		return sparseChunkHeaderSize + c.dataSize(blockSize)
+	case SparseChunkFill, SparseChunkCRC32:
+		return sparseChunkHeaderSize + 4
+	}
+	return sparseChunkHeaderSize
+}
+
+// Size return the size of the raw image in bytes
+func (s *SparseImage) Size() int64 {
+	return int64(s.Blocks) * int64(s.BlockSize)
+}
+
+// countWriter counts the bytes written
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes the sparse image encoded to w, the data of the raw chunks is copied from
+// where it is read
+func (s *SparseImage) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	err := binary.Write(cw, binary.LittleEndian, &SparseHeader{
+		Magic:        sparseHeaderMagic,
+		MajorVersion: sparseMajorVersion,
+		FileHdrSz:    sparseHeaderSize,
+		ChunkHdrSz:   sparseChunkHeaderSize,
+		BlkSz:        s.BlockSize,
+		TotalBlks:    s.Blocks,
+		TotalChunks:  uint32(len(s.Chunks)),
+	})
+	for i := 0; i < len(s.Chunks) && err == nil; i++ {
+		c := &s.Chunks[i]
+		err = binary.Write(cw, binary.LittleEndian, &SparseChunkHeader{
+			ChunkType: c.Type,
+			ChunkSz:   c.Blocks,
+			TotalSz:   uint32(c.size(s.BlockSize)),
+		})
+		if err != nil {
+			break
+		}
+		switch c.Type {
+		case SparseChunkRaw:
+			_, err = io.Copy(cw, c.data(s.BlockSize))
+		case SparseChunkFill:
+			err = binary.Write(cw, binary.LittleEndian, c.Fill)
+		case SparseChunkCRC32:
+			err = binary.Write(cw, binary.LittleEndian, c.CRC32)
+		}
+	}
+	return cw.n, err
+}
+
+// Bytes return the sparse image encoded, the data of the raw chunks that can't be read is
+// missing, use WriteTo for the error
+func (s *SparseImage) Bytes() []byte {
+	var buf bytes.Buffer
+	s.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// Unsparse writes the raw image to w, the don't care blocks are zeros. The crc32 chunks are
+// verified.
+func (s *SparseImage) Unsparse(w io.Writer) error {
+	block := make([]byte, s.BlockSize)
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(w, crc)
+	for i := range s.Chunks {
+		c := &s.Chunks[i]
+		switch c.Type {
+		case SparseChunkRaw:
+			if _, err := io.Copy(out, c.data(s.BlockSize)); err != nil {
+				return err
+			}
+		case SparseChunkFill, SparseChunkDontCare:
+			for j := 0; j < len(block); j += 4 {
+				binary.LittleEndian.PutUint32(block[j:], c.Fill)
+			}
+			for j := uint32(0); j < c.Blocks; j++ {
+				if _, err := out.Write(block); err != nil {
+					return err
+				}
+			}
+		case SparseChunkCRC32:
+			if crc.Sum32() != c.CRC32 {
+				return fmt.Errorf("chunk %d: crc32 0x%08x, expect 0x%08x", i, crc.Sum32(), c.CRC32)
+			}
+		}
+	}
+	return nil
+}
+
+// NewSparseImage return the sparse image of the raw image, the same as img2simg creates: a
+// block of the same 4 bytes is a fill chunk, other blocks are raw chunks. The raw image is
+// padded with zeros to the block size.
+func NewSparseImage(raw []byte, blockSize uint32) (*SparseImage, error) {
+	s, err := ReadRawImage(bytes.NewReader(raw), int64(len(raw)), blockSize)
+	if err != nil {
+		return nil, err
+	}
+	if pad := len(raw) % int(blockSize); pad != 0 {
+		raw = append(raw[:len(raw):len(raw)], make([]byte, int(blockSize)-pad)...)
+	}
+	s.load(raw)
+	return s, nil
+}
+
+// ReadRawImage return the sparse image of the raw image of size bytes in r, as NewSparseImage
+// does. The data of the raw chunks is read from r again when it is needed.
+func ReadRawImage(r io.ReaderAt, size int64, blockSize uint32) (*SparseImage, error) {
+	if blockSize == 0 || blockSize%4 != 0 {
+		return nil, fmt.Errorf("invalid block size %d", blockSize)
+	}
+	bs := int64(blockSize)
+	src := &paddedReader{r: r, size: size}
+	s := SparseImage{BlockSize: blockSize, Blocks: uint32((size + bs - 1) / bs)}
+
+	// read about 1M at a time
+	buf := make([]byte, (1<<20+bs-1)/bs*bs)
+	padded := int64(s.Blocks) * bs
+	for start := int64(0); start < padded; start += int64(len(buf)) {
+		end := padded - start
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+		if _, err := src.ReadAt(buf[:end], start); err != nil {
+			return nil, err
+		}
+		for i := int64(0); i < end; i += bs {
+			off := start + i
+			c := SparseChunk{Type: SparseChunkRaw, Blocks: 1, src: src, off: off}
+			if fill, ok := fillPattern(buf[i : i+bs]); ok {
+				c = SparseChunk{Type: SparseChunkFill, Blocks: 1, Fill: fill}
+			}
+
+			// merge into the previous chunk of the same
+			if n := len(s.Chunks); n > 0 {
+				last := &s.Chunks[n-1]
+				if last.Type == SparseChunkRaw && c.Type == SparseChunkRaw {
+					last.Blocks++
+					continue
+				}
+				if last.Type == SparseChunkFill && c.Type == SparseChunkFill && last.Fill == c.Fill {
+					last.Blocks++
+					continue
+				}
+			}
+			s.Chunks = append(s.Chunks, c)
+		}
+	}
+	return &s, nil
+}
+
+// paddedReader is the raw image padded with zeros after its size
+type paddedReader struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func (p *paddedReader) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	if off < p.size {
+		end := int64(len(b))
+		if off+end > p.size {
+			end = p.size - off
+		}
+		var err error
+		if n, err = p.r.ReadAt(b[:end], off); int64(n) < end {
+			return n, err
+		}
+	}
+	for i := n; i < len(b); i++ {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// fillPattern return the 4 bytes pattern if the block is filled with it
+func fillPattern(block []byte) (uint32, bool) {
+	for i := 4; i < len(block); i += 4 {
+		if block[i] != block[0] || block[i+1] != block[1] || block[i+2] != block[2] || block[i+3] != block[3] {
+			return 0, false
+		}
+	}
+	return binary.LittleEndian.Uint32(block), true
+}
+
+// Resparse splits the sparse image into the ones no larger than maxSize bytes, the same as
+// simg2simg does. Each of them covers the whole raw image, the blocks in the others are don't
+// care, so that they can be flashed one by one. The crc32 chunks are dropped.
+func (s *SparseImage) Resparse(maxSize int64) ([]*SparseImage, error) {
+	// the header, and the don't care chunks before and after
+	overhead := int64(sparseHeaderSize + 2*sparseChunkHeaderSize)
+
+	var parts []*SparseImage
+	var part *SparseImage
+	var size int64
+	var start, next uint32
+	finish := func() {
+		if next < s.Blocks {
+			part.Chunks = append(part.Chunks, SparseChunk{Type: SparseChunkDontCare, Blocks: s.Blocks - next})
+		}
+		parts = append(parts, part)
+		part = nil
+	}
+	add := func(c SparseChunk) {
+		if part == nil {
+			part = &SparseImage{BlockSize: s.BlockSize, Blocks: s.Blocks}
+			size, next = overhead, 0
+		}
+		if start > next {
+			part.Chunks = append(part.Chunks, SparseChunk{Type: SparseChunkDontCare, Blocks: start - next})
+			size += sparseChunkHeaderSize
+		}
+		part.Chunks = append(part.Chunks, c)
+		size += c.size(s.BlockSize)
+		next = start + c.Blocks
+	}
+
+	for i := 0; i < len(s.Chunks); i++ {
+		c := s.Chunks[i]
+		if c.Type == SparseChunkDontCare || c.Type == SparseChunkCRC32 {
+			start += c.Blocks
+			continue
+		}
+		for c.Blocks > 0 {
+			// the size of c in the current part, with the don't care chunk before it
+			room := maxSize - overhead
+			if part != nil {
+				room = maxSize - size
+				if start > next {
+					room -= sparseChunkHeaderSize
+				}
+			}
+			if c.size(s.BlockSize) <= room {
+				add(c)
+				start += c.Blocks
+				break
+			}
+			// split the raw chunk to fill the part
+			if c.Type == SparseChunkRaw {
+				if n := uint32((room - sparseChunkHeaderSize) / int64(s.BlockSize)); room > sparseChunkHeaderSize && n > 0 {
+					add(c.blocks(0, n, s.BlockSize))
+					start += n
+					c = c.blocks(n, c.Blocks-n, s.BlockSize)
+				}
+			}
+			if part == nil {
+				return nil, fmt.Errorf("max size %d is too small for a chunk of %d bytes", maxSize, c.size(s.BlockSize))
+			}
+			finish()
+		}
+	}
+	if part != nil {
+		finish()
+	}
+	if len(parts) == 0 {
+		// nothing but don't care
+		part, next = &SparseImage{BlockSize: s.BlockSize, Blocks: s.Blocks}, 0
+		finish()
+	}
+	return parts, nil
+}
@@ -0,0 +1,143 @@
+package images
+
+import (
+	"bytes"
+	"hash/crc32"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRaw return the raw image of 2 raw blocks, 3 zero blocks, a fill block, 4 raw blocks and
+// a partial block
+func testRaw() []byte {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	var raw []byte
+	raw = append(raw, random(2*1024)...)
+	raw = append(raw, make([]byte, 3*1024)...)
+	raw = append(raw, bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, 256)...)
+	raw = append(raw, random(4*1024)...)
+	raw = append(raw, random(100)...)
+	return raw
+}
+
+func TestSparse(t *testing.T) {
+	raw := testRaw()
+	padded := append(append([]byte{}, raw...), make([]byte, 1024-100)...)
+
+	img, err := NewSparseImage(raw, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(11), img.Blocks)
+	var types []string
+	for _, c := range img.Chunks {
+		types = append(types, SparseChunkType(c.Type))
+	}
+	assert.Equal(t, []string{"raw", "fill", "fill", "raw"}, types)
+	assert.Equal(t, uint32(0xefbeadde), img.Chunks[2].Fill)
+	assert.Equal(t, uint32(5), img.Chunks[3].Blocks)
+
+	// encode and parse
+	data := img.Bytes()
+	parsed, err := ParseSparse(data)
+	assert.Nil(t, err)
+	assert.Equal(t, img, parsed)
+	var out bytes.Buffer
+	assert.Nil(t, parsed.Unsparse(&out))
+	assert.Equal(t, padded, out.Bytes())
+
+	// read on demand, the same as in memory
+	streamed, err := ReadRawImage(bytes.NewReader(raw), int64(len(raw)), 1024)
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	n, err := streamed.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, buf.Bytes())
+	streamed, err = ReadSparse(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	assert.True(t, streamed.Chunks[0].Data == nil)
+	out.Reset()
+	assert.Nil(t, streamed.Unsparse(&out))
+	assert.Equal(t, padded, out.Bytes())
+	_, err = streamed.WriteTo(&buf)
+	assert.Nil(t, err)
+	_, err = ReadSparse(bytes.NewReader(data), int64(len(data)-1))
+	assert.NotNil(t, err)
+
+	// crc32 chunk, and don't care at the end
+	img.Chunks = append(img.Chunks, SparseChunk{Type: SparseChunkCRC32, CRC32: crc32.ChecksumIEEE(padded)},
+		SparseChunk{Type: SparseChunkDontCare, Blocks: 2})
+	img.Blocks += 2
+	parsed, err = ParseSparse(img.Bytes())
+	assert.Nil(t, err)
+	out.Reset()
+	assert.Nil(t, parsed.Unsparse(&out))
+	assert.Equal(t, append(padded, make([]byte, 2048)...), out.Bytes())
+	parsed.Chunks[4].CRC32++
+	assert.NotNil(t, parsed.Unsparse(&out))
+
+	// invalid
+	_, err = ParseSparse(data[:len(data)-1])
+	assert.NotNil(t, err)
+	_, err = ParseSparse(raw)
+	assert.NotNil(t, err)
+	_, err = NewSparseImage(raw, 1023)
+	assert.NotNil(t, err)
+}
+
+func TestResparse(t *testing.T) {
+	raw := testRaw()
+	img, err := NewSparseImage(raw, 1024)
+	assert.Nil(t, err)
+	img.Chunks = append(img.Chunks, SparseChunk{Type: SparseChunkDontCare, Blocks: 5})
+	img.Blocks += 5
+	whole := bytes.Buffer{}
+	assert.Nil(t, img.Unsparse(&whole))
+	// the same, read on demand
+	data := img.Bytes()
+	streamed, err := ReadSparse(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+
+	for i, max := range []int64{3000, 4096, 1 << 20, 3000, 4096} {
+		from := img
+		if i >= 3 {
+			from = streamed
+		}
+		parts, err := from.Resparse(max)
+		assert.Nil(t, err)
+		// flash the parts one by one
+		flashed := make([]byte, img.Size())
+		for _, p := range parts {
+			var buf bytes.Buffer
+			_, err := p.WriteTo(&buf)
+			assert.Nil(t, err)
+			data := buf.Bytes()
+			assert.True(t, int64(len(data)) <= max, "%d > %d", len(data), max)
+			parsed, err := ParseSparse(data)
+			assert.Nil(t, err)
+			assert.Equal(t, img.Blocks, parsed.Blocks)
+			var block uint32
+			for _, c := range parsed.Chunks {
+				if c.Type != SparseChunkDontCare {
+					var out bytes.Buffer
+					(&SparseImage{BlockSize: 1024, Blocks: c.Blocks, Chunks: []SparseChunk{c}}).Unsparse(&out)
+					copy(flashed[block*1024:], out.Bytes())
+				}
+				block += c.Blocks
+			}
+		}
+		assert.Equal(t, whole.Bytes(), flashed, "max size %d", max)
+		if max == 1<<20 {
+			assert.Equal(t, 1, len(parts))
+		}
+	}
+
+	_, err = img.Resparse(100)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,148 @@
+package images
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// the superblocks of the file systems, see [1] and [2]
+// [1] https://www.kernel.org/doc/html/latest/filesystems/ext4/globals.html#super-block
+// [2] https://github.com/plougher/squashfs-tools/blob/master/squashfs-tools/squashfs_fs.h
+const (
+	superBlockOffset = 1024
+
+	extMagic         = 0xef53
+	extMagicOffset   = 0x38
+	extCompatOffset  = 0x5c
+	extIncompOffset  = 0x60
+	extHasJournal    = 0x4
+	extIncompExtents = 0x40
+	extIncomp64Bit   = 0x80
+	extIncompFlexBg  = 0x200
+
+	squashfsMagic = "hsqs"
+	erofsMagic    = 0xe0f5e1e2
+	f2fsMagic     = 0xf2f52010
+
+	// the head of the image needed to find out the file system
+	userImageHeadSize = 4096
+)
+
+// UserImage is the image of a file system partition, e.g system.img, either raw or sparse
+type UserImage struct {
+	// absolution path or the relative to current dir where the command is calling
+	ImagePath string
+}
+
+// IsSparse return true if it is a sparse image
+func (u *UserImage) IsSparse() bool {
+	s := Sparse{ImagePath: u.ImagePath}
+	return s.IsSparse()
+}
+
+// Size return the size of the raw image, i.e what is written to the partition
+func (u *UserImage) Size() (int64, error) {
+	if u.IsSparse() {
+		s := Sparse{ImagePath: u.ImagePath}
+		hdr, err := s.Hdr()
+		if err != nil {
+			return 0, err
+		}
+		return int64(hdr.TotalBlks) * int64(hdr.BlkSz), nil
+	}
+	return fileSize(u.ImagePath)
+}
+
+// Head return the first n bytes of the raw image, less if the image is smaller.
+// The sparse image isn't read in full.
+func (u *UserImage) Head(n int) ([]byte, error) {
+	f, err := os.Open(u.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if !u.IsSparse() {
+		head := make([]byte, n)
+		m, err := io.ReadFull(f, head)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return head[:m], nil
+	}
+
+	var hdr SparseHeader
+	if err := binary.Read(f, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	var head []byte
+	off := int64(hdr.FileHdrSz)
+	for i := uint32(0); i < hdr.TotalChunks && len(head) < n; i++ {
+		var ch SparseChunkHeader
+		if err := binary.Read(io.NewSectionReader(f, off, sparseChunkHeaderSize), binary.LittleEndian, &ch); err != nil {
+			return nil, fmt.Errorf("%s: chunk %d: %s", u.ImagePath, i, err)
+		}
+		body := io.NewSectionReader(f, off+int64(hdr.ChunkHdrSz), int64(ch.TotalSz)-int64(hdr.ChunkHdrSz))
+		size := int64(ch.ChunkSz) * int64(hdr.BlkSz)
+		if size > int64(n-len(head)) {
+			size = int64(n - len(head))
+		}
+		data := make([]byte, size)
+		switch ch.ChunkType {
+		case SparseChunkRaw:
+			if _, err := io.ReadFull(body, data); err != nil {
+				return nil, fmt.Errorf("%s: chunk %d: %s", u.ImagePath, i, err)
+			}
+		case SparseChunkFill:
+			fill := make([]byte, 4)
+			if _, err := io.ReadFull(body, fill); err != nil {
+				return nil, fmt.Errorf("%s: chunk %d: %s", u.ImagePath, i, err)
+			}
+			for j := range data {
+				data[j] = fill[j%4]
+			}
+		}
+		head = append(head, data...)
+		off += int64(ch.TotalSz)
+	}
+	return head, nil
+}
+
+// FsType return the file system of the image: ext2, ext3, ext4, squashfs, erofs or f2fs, or
+// "" if unknown
+func (u *UserImage) FsType() (string, error) {
+	head, err := u.Head(userImageHeadSize)
+	if err != nil {
+		return "", err
+	}
+	return FsType(head), nil
+}
+
+// FsType return the file system of the raw image by its superblock, see UserImage.FsType
+func FsType(head []byte) string {
+	if len(head) >= 4 && string(head[:4]) == squashfsMagic {
+		return "squashfs"
+	}
+	if len(head) < superBlockOffset+extIncompOffset+4 {
+		return ""
+	}
+	sb := head[superBlockOffset:]
+	switch binary.LittleEndian.Uint32(sb) {
+	case erofsMagic:
+		return "erofs"
+	case f2fsMagic:
+		return "f2fs"
+	}
+	if binary.LittleEndian.Uint16(sb[extMagicOffset:]) != extMagic {
+		return ""
+	}
+	if binary.LittleEndian.Uint32(sb[extIncompOffset:])&(extIncompExtents|extIncomp64Bit|extIncompFlexBg) != 0 {
+		return "ext4"
+	}
+	if binary.LittleEndian.Uint32(sb[extCompatOffset:])&extHasJournal != 0 {
+		return "ext3"
+	}
+	return "ext2"
+}
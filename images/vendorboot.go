@@ -0,0 +1,419 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+// The vendor_boot image comes with the v3 and later boot image, it has what's moved out of
+// the boot image: the load addresses, the vendor ramdisks, the dtb and the bootconfig.
+// The format follows bootimg.h, see the Bootimg.
+
+const (
+	vendorBootMagic = "VNDRBOOT"
+
+	vendorBootImgHdrV3Size = 2112
+	vendorBootImgHdrV4Size = 2128
+
+	// the size of VendorBootImgHdr.CmdLine, VendorRamdiskEntry.Name
+	vendorBootArgsSize     = 2048
+	vendorRamdiskNameSize  = 32
+	vendorRamdiskEntrySize = 108
+)
+
+// Vendor ramdisk types, VendorRamdiskEntry.Type
+const (
+	VendorRamdiskTypeNone     = 0
+	VendorRamdiskTypePlatform = 1
+	VendorRamdiskTypeRecovery = 2
+	VendorRamdiskTypeDlkm     = 3
+)
+
+var vendorRamdiskTypeNames = map[uint32]string{
+	VendorRamdiskTypeNone:     "none",
+	VendorRamdiskTypePlatform: "platform",
+	VendorRamdiskTypeRecovery: "recovery",
+	VendorRamdiskTypeDlkm:     "dlkm",
+}
+
+// VendorBootimg is to handle android vendor_boot image
+type VendorBootimg struct {
+	// absolution path or the relative to current dir where the command is calling
+	ImagePath string
+}
+
+// VendorBootImgHdr is the vendor_boot image header of version 3 and 4.
+// The fields of v4 are 0 for v3.
+type VendorBootImgHdr struct {
+	Magic             [8]byte
+	HeaderVersion     uint32
+	PageSize          uint32
+	KernelAddr        uint32
+	RamdiskAddr       uint32
+	VendorRamdiskSize uint32
+	CmdLine           [2048]byte
+	TagsAddr          uint32
+	Name              [16]byte
+	HeaderSize        uint32
+	DtbSize           uint32
+	DtbAddr           uint64
+	// v4
+	VendorRamdiskTableSize      uint32
+	VendorRamdiskTableEntryNum  uint32
+	VendorRamdiskTableEntrySize uint32
+	VendorBootconfigSize        uint32
+}
+
+// VendorRamdiskEntry is an entry of the vendor ramdisk table of v4, which describes one
+// of the ramdisk fragments concatenated in the vendor ramdisk section
+type VendorRamdiskEntry struct {
+	RamdiskSize uint32
+	// RamdiskOffset is the offset in the vendor ramdisk section
+	RamdiskOffset uint32
+	RamdiskType   uint32
+	RamdiskName   [32]byte
+	BoardID       [16]uint32
+}
+
+// String print hdr info
+func (h *VendorBootImgHdr) String() string {
+	var s = ""
+	s += fmt.Sprintf("HeaderVersion:%d\n", h.HeaderVersion)
+	s += fmt.Sprintf("HeaderSize  :%d\n", h.HeaderSize)
+	s += fmt.Sprintf("Product:%s\n", cString(h.Name[:]))
+	s += fmt.Sprintf("CmdLine:%s\n", cString(h.CmdLine[:]))
+
+	s += fmt.Sprintf("KernelAddr  :0x%x", h.KernelAddr)
+	if h.KernelAddr == DefaultKernelLoadAddr {
+		s += fmt.Sprintf("(default)")
+	}
+	s += "\n"
+
+	s += fmt.Sprintf("Ramdisk     :0x%x", h.RamdiskAddr)
+	if h.RamdiskAddr == DefaultRamdiskLoadAddr {
+		s += fmt.Sprintf("(default)")
+	}
+	s += "\n"
+
+	s += fmt.Sprintf("TagsAddr    :0x%x\n", h.TagsAddr)
+	s += fmt.Sprintf("PageSize    :0x%x(%d)\n", h.PageSize, h.PageSize)
+	s += fmt.Sprintf("VendorRamdiskSize:0x%x(%d)\n", h.VendorRamdiskSize, h.VendorRamdiskSize)
+	s += fmt.Sprintf("DtbSize     :0x%x(%d)\n", h.DtbSize, h.DtbSize)
+	s += fmt.Sprintf("DtbAddr     :0x%x\n", h.DtbAddr)
+
+	if h.HeaderVersion > 3 {
+		s += fmt.Sprintf("VendorRamdiskTableEntryNum:%d\n", h.VendorRamdiskTableEntryNum)
+		s += fmt.Sprintf("BootconfigSize:0x%x(%d)\n", h.VendorBootconfigSize, h.VendorBootconfigSize)
+	}
+	return s
+}
+
+// String print the ramdisk fragment info
+func (e *VendorRamdiskEntry) String() string {
+	t, ok := vendorRamdiskTypeNames[e.RamdiskType]
+	if !ok {
+		t = fmt.Sprintf("%d", e.RamdiskType)
+	}
+	return fmt.Sprintf("Ramdisk %q: type %s, offset 0x%x, size 0x%x(%d)",
+		cString(e.RamdiskName[:]), t, e.RamdiskOffset, e.RamdiskSize, e.RamdiskSize)
+}
+
+// IsVendorBoot is vendor_boot image or not
+func (v *VendorBootimg) IsVendorBoot() bool {
+	var magic [8]byte
+	return readHdr(v.ImagePath, vendorBootMagic, &magic) == nil
+}
+
+// Hdr return the Hdr of the vendor_boot image
+func (v *VendorBootimg) Hdr() (*VendorBootImgHdr, error) {
+	var hdr VendorBootImgHdr
+	if err := readHdr(v.ImagePath, vendorBootMagic, &hdr); err != nil {
+		return nil, err
+	}
+
+	switch hdr.HeaderVersion {
+	case 3:
+		hdr.VendorRamdiskTableSize, hdr.VendorRamdiskTableEntryNum = 0, 0
+		hdr.VendorRamdiskTableEntrySize, hdr.VendorBootconfigSize = 0, 0
+	case 4:
+	default:
+		return nil, fmt.Errorf("unsupported vendor_boot header version %d", hdr.HeaderVersion)
+	}
+	if hdr.PageSize == 0 {
+		return nil, fmt.Errorf("%s: invalid page size 0", v.ImagePath)
+	}
+
+	return &hdr, nil
+}
+
+// sections return the sections in the vendor_boot image
+func (v *VendorBootimg) sections(hdr *VendorBootImgHdr) []imgSection {
+	return layout(vendorBootImgHdrV4Size, hdr.PageSize, []imgSection{
+		{name: "vendor_ramdisk", size: hdr.VendorRamdiskSize},
+		{name: "dtb", size: hdr.DtbSize},
+		{name: "vendor_ramdisk_table", size: hdr.VendorRamdiskTableSize},
+		{name: "bootconfig", size: hdr.VendorBootconfigSize},
+	})
+}
+
+// RamdiskTable return the vendor ramdisk table, it is empty for v3
+func (v *VendorBootimg) RamdiskTable() ([]VendorRamdiskEntry, error) {
+	hdr, err := v.Hdr()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.VendorRamdiskTableEntryNum == 0 {
+		return nil, nil
+	}
+	if hdr.VendorRamdiskTableEntrySize < vendorRamdiskEntrySize {
+		return nil, fmt.Errorf("%s: invalid ramdisk table entry size %d", v.ImagePath, hdr.VendorRamdiskTableEntrySize)
+	}
+
+	data, err := ioutil.ReadFile(v.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	table := v.sections(hdr)[2]
+	var entries []VendorRamdiskEntry
+	for i := uint32(0); i < hdr.VendorRamdiskTableEntryNum; i++ {
+		off := uint64(table.start) + uint64(i)*uint64(hdr.VendorRamdiskTableEntrySize)
+		if off+vendorRamdiskEntrySize > uint64(len(data)) {
+			return nil, fmt.Errorf("%s is truncated", v.ImagePath)
+		}
+		var e VendorRamdiskEntry
+		if err := binary.Read(bytes.NewReader(data[off:]), binary.LittleEndian, &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Unpack extracts the vendor ramdisks, dtb and bootconfig. The ramdisk fragments of v4 are
+// extracted as vendor_ramdisk00.out, vendor_ramdisk01.out ... as unpack_bootimg does.
+func (v *VendorBootimg) Unpack() error {
+	hdr, err := v.Hdr()
+	if err != nil {
+		return err
+	}
+	entries, err := v.RamdiskTable()
+	if err != nil {
+		return err
+	}
+
+	var sections []imgSection
+	for _, s := range v.sections(hdr) {
+		switch {
+		case s.name == "vendor_ramdisk_table":
+			continue
+		case s.name == "vendor_ramdisk" && len(entries) != 0:
+			for i, e := range entries {
+				sections = append(sections, imgSection{
+					name:  fmt.Sprintf("vendor_ramdisk%02d", i),
+					start: s.start + e.RamdiskOffset,
+					size:  e.RamdiskSize,
+				})
+			}
+		default:
+			sections = append(sections, s)
+		}
+	}
+	return unpackSections(v.ImagePath, sections)
+}
+
+// VendorRamdisk is a ramdisk fragment in the vendor_boot image
+type VendorRamdisk struct {
+	Name    string
+	Type    uint32
+	BoardID [16]uint32
+	Data    []byte
+}
+
+// VendorBootImgArgs are what a vendor_boot image is built from, the same as the arguments
+// of mkbootimg with --vendor_boot.
+// There is only one ramdisk, without name and type, in v3.
+type VendorBootImgArgs struct {
+	HeaderVersion uint32
+	Ramdisks      []VendorRamdisk
+	Dtb           []byte
+	// Bootconfig is since v4
+	Bootconfig    []byte
+	CmdLine       string
+	Board         string
+	Base          uint32
+	KernelOffset  uint32
+	RamdiskOffset uint32
+	TagsOffset    uint32
+	DtbOffset     uint32
+	PageSize      uint32
+}
+
+// DefaultVendorBootImgArgs return the args of v4 vendor_boot with the default values of mkbootimg
+func DefaultVendorBootImgArgs() *VendorBootImgArgs {
+	return &VendorBootImgArgs{
+		HeaderVersion: 4,
+		Base:          DefaultLoadBaseAddr,
+		KernelOffset:  DefaultKernelOffset,
+		RamdiskOffset: DefaultRamdiskOffset,
+		TagsOffset:    DefaultTagsOffset,
+		DtbOffset:     DefaultDtbOffset,
+		PageSize:      DefaultPageSize,
+	}
+}
+
+// Build return the vendor_boot image built from args, byte to byte the same as mkbootimg's.
+func (a *VendorBootImgArgs) Build() ([]byte, error) {
+	if a.HeaderVersion != 3 && a.HeaderVersion != 4 {
+		return nil, fmt.Errorf("unsupported vendor_boot header version %d", a.HeaderVersion)
+	}
+	if a.PageSize == 0 || a.PageSize&(a.PageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid page size %d", a.PageSize)
+	}
+	if len(a.Board) >= 16 {
+		return nil, fmt.Errorf("board name %q is longer than 15", a.Board)
+	}
+	if len(a.CmdLine) >= vendorBootArgsSize {
+		return nil, fmt.Errorf("vendor cmdline is longer than %d", vendorBootArgsSize-1)
+	}
+	if a.HeaderVersion == 3 && (len(a.Ramdisks) > 1 || len(a.Bootconfig) != 0) {
+		return nil, fmt.Errorf("v3 vendor_boot has only one ramdisk and no bootconfig")
+	}
+
+	var ramdisk, table bytes.Buffer
+	for _, r := range a.Ramdisks {
+		if len(r.Name) >= vendorRamdiskNameSize {
+			return nil, fmt.Errorf("ramdisk name %q is longer than %d", r.Name, vendorRamdiskNameSize-1)
+		}
+		e := VendorRamdiskEntry{
+			RamdiskSize:   uint32(len(r.Data)),
+			RamdiskOffset: uint32(ramdisk.Len()),
+			RamdiskType:   r.Type,
+			BoardID:       r.BoardID,
+		}
+		copy(e.RamdiskName[:], r.Name)
+		if err := binary.Write(&table, binary.LittleEndian, &e); err != nil {
+			return nil, err
+		}
+		ramdisk.Write(r.Data)
+	}
+
+	hdr := VendorBootImgHdr{
+		HeaderVersion:     a.HeaderVersion,
+		PageSize:          a.PageSize,
+		KernelAddr:        a.Base + a.KernelOffset,
+		RamdiskAddr:       a.Base + a.RamdiskOffset,
+		VendorRamdiskSize: uint32(ramdisk.Len()),
+		TagsAddr:          a.Base + a.TagsOffset,
+		HeaderSize:        vendorBootImgHdrV3Size,
+		DtbSize:           uint32(len(a.Dtb)),
+		DtbAddr:           uint64(a.Base) + uint64(a.DtbOffset),
+	}
+	copy(hdr.Magic[:], vendorBootMagic)
+	copy(hdr.CmdLine[:], a.CmdLine)
+	copy(hdr.Name[:], a.Board)
+	if a.HeaderVersion > 3 {
+		hdr.HeaderSize = vendorBootImgHdrV4Size
+		hdr.VendorRamdiskTableSize = uint32(table.Len())
+		hdr.VendorRamdiskTableEntryNum = uint32(len(a.Ramdisks))
+		hdr.VendorRamdiskTableEntrySize = vendorRamdiskEntrySize
+		hdr.VendorBootconfigSize = uint32(len(a.Bootconfig))
+	} else {
+		table.Reset()
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	writePadded(&buf, nil, a.PageSize)
+	writePadded(&buf, ramdisk.Bytes(), a.PageSize)
+	writePadded(&buf, a.Dtb, a.PageSize)
+	writePadded(&buf, table.Bytes(), a.PageSize)
+	writePadded(&buf, a.Bootconfig, a.PageSize)
+	return buf.Bytes(), nil
+}
+
+// Args return the args the vendor_boot image is built from, Build with them gives the same
+// image. The base is assumed the same way as Bootimg.Args.
+func (v *VendorBootimg) Args() (*VendorBootImgArgs, error) {
+	hdr, err := v.Hdr()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := v.RamdiskTable()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(v.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	section := func(s imgSection) ([]byte, error) {
+		if uint64(s.start)+uint64(s.size) > uint64(len(data)) {
+			return nil, fmt.Errorf("%s is truncated", v.ImagePath)
+		}
+		if s.size == 0 {
+			return nil, nil
+		}
+		return data[s.start : s.start+s.size], nil
+	}
+
+	var base uint32
+	if hdr.KernelAddr >= DefaultKernelOffset {
+		base = hdr.KernelAddr - DefaultKernelOffset
+	}
+	a := &VendorBootImgArgs{
+		HeaderVersion: hdr.HeaderVersion,
+		CmdLine:       cString(hdr.CmdLine[:]),
+		Board:         cString(hdr.Name[:]),
+		Base:          base,
+		KernelOffset:  hdr.KernelAddr - base,
+		RamdiskOffset: hdr.RamdiskAddr - base,
+		TagsOffset:    hdr.TagsAddr - base,
+		DtbOffset:     uint32(hdr.DtbAddr) - base,
+		PageSize:      hdr.PageSize,
+	}
+
+	sections := v.sections(hdr)
+	ramdisk, err := section(sections[0])
+	if err != nil {
+		return nil, err
+	}
+	if a.Dtb, err = section(sections[1]); err != nil {
+		return nil, err
+	}
+	if a.Bootconfig, err = section(sections[3]); err != nil {
+		return nil, err
+	}
+
+	if hdr.HeaderVersion == 3 {
+		if len(ramdisk) != 0 {
+			a.Ramdisks = []VendorRamdisk{{Data: ramdisk}}
+		}
+		return a, nil
+	}
+	for _, e := range entries {
+		if uint64(e.RamdiskOffset)+uint64(e.RamdiskSize) > uint64(len(ramdisk)) {
+			return nil, fmt.Errorf("%s: ramdisk %q is out of the vendor ramdisk", v.ImagePath, cString(e.RamdiskName[:]))
+		}
+		a.Ramdisks = append(a.Ramdisks, VendorRamdisk{
+			Name:    cString(e.RamdiskName[:]),
+			Type:    e.RamdiskType,
+			BoardID: e.BoardID,
+			Data:    ramdisk[e.RamdiskOffset : e.RamdiskOffset+e.RamdiskSize],
+		})
+	}
+	return a, nil
+}
+
+// Pack builds the vendor_boot image from args and writes it to ImagePath
+func (v *VendorBootimg) Pack(args *VendorBootImgArgs) error {
+	data, err := args.Build()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(v.ImagePath, data, 0644)
+}
@@ -27,17 +27,26 @@ const (
 
 // PartitionTable is the partion table for the device.
 type PartitionTable struct {
-	FlashBockSize string `json:"flash_block_size"`
+	FlashBockSize Size `json:"flash_block_size"`
 	// mbr/ebr, gpt, others
-	Scheme     string      `json:"scheme"`
-	Partitions []Partition `json:"partitions"`
+	Scheme string `json:"scheme"`
+	// StorageSize is the size of the storage, e.g the eMMC, the partitions must fit in it.
+	// The backup GPT is at the end of it, so gpt requires it. See `avs partition-table`.
+	StorageSize Size        `json:"storage_size,omitempty"`
+	Partitions  []Partition `json:"partitions"`
 }
 
 // Partition is the configration for each partition.
 type Partition struct {
 	Name string `json:"name"`
 	Type string `json:"type"`
-	Size string `json:"size"`
+	Size Size   `json:"size"`
+	// Offset is where the partition starts on the storage, default to the flash block after
+	// the previous one. Useful for the partitions the boot ROM loads from a fixed offset.
+	Offset Size `json:"offset,omitempty"`
+	// TypeGUID is the GPT partition type, default to the one of the Android partition of the
+	// name, or Linux filesystem data.
+	TypeGUID string `json:"type_guid,omitempty"`
 }
 
 // Fstab is the mount configration.
@@ -0,0 +1,123 @@
+package spec
+
+import (
+	"reflect"
+	"strings"
+)
+
+// SchemaDraft is the JSON Schema version of the generated schema.
+const SchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// schemaEnums are the valid values of the string attributes, or the items of the string
+// list attributes, by "Type.Field".
+var schemaEnums = map[string][]string{
+	"Manifest.Format":               {HIDL, NATIVE},
+	"Transport.Mode":                {HB, PT},
+	"Transport.Arch":                {A32, A64, AB},
+	"Partition.Type":                {string(EXT4), string(SQUASH)},
+	"PartitionTable.Scheme":         {MBR, GPT},
+	"SELinux.Mode":                  {SElinuxModePermissive, SElinuxModeEnforcing},
+	"Product.BuildVariants":         {VariantEng, VariantUserdebug, VariantUser},
+	"ProductOverride.BuildVariants": {VariantEng, VariantUserdebug, VariantUser},
+}
+
+// JSONField is the json name of a struct field and if it is required, i.e without omitempty.
+// ok is false if the field isn't encoded at all.
+func JSONField(f reflect.StructField) (name string, required bool, ok bool) {
+	if f.PkgPath != "" {
+		return "", false, false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	opts := strings.Split(tag, ",")
+	name = opts[0]
+	if name == "" {
+		name = f.Name
+	}
+	for _, o := range opts[1:] {
+		if o == "omitempty" {
+			return name, false, true
+		}
+	}
+	return name, true, true
+}
+
+// Schema return the JSON Schema of the config.json, derived from Spec.
+// Attributes without "omitempty" are required, and unknown attributes are not allowed.
+func Schema() map[string]interface{} {
+	defs := map[string]interface{}{}
+	root := schemaOf(reflect.TypeOf(Spec{}), "", defs)
+	return map[string]interface{}{
+		"$schema":     SchemaDraft,
+		"title":       "AVS device config",
+		"$ref":        root["$ref"],
+		"definitions": defs,
+	}
+}
+
+// schemaOf return the schema for type t, struct types are added to defs and referred to.
+// enumKey is the "Type.Field" t is for, used to look up the valid values.
+func schemaOf(t reflect.Type, enumKey string, defs map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+		if _, done := defs[t.Name()]; done {
+			return ref
+		}
+		// placeholder for recursive types
+		defs[t.Name()] = nil
+
+		props := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, req, ok := JSONField(f)
+			if !ok {
+				continue
+			}
+			props[name] = schemaOf(f.Type, t.Name()+"."+f.Name, defs)
+			if req {
+				required = append(required, name)
+			}
+		}
+		def := map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+		if len(required) != 0 {
+			def["required"] = required
+		}
+		defs[t.Name()] = def
+		return ref
+	case reflect.Slice, reflect.Array:
+		// nil slices are encoded as null
+		return map[string]interface{}{
+			"type":  []string{"array", "null"},
+			"items": schemaOf(t.Elem(), enumKey, defs),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaOf(t.Elem(), "", defs),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.String:
+		s := map[string]interface{}{"type": "string"}
+		if enum, ok := schemaEnums[enumKey]; ok {
+			s["enum"] = enum
+		}
+		return s
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,70 @@
+package spec
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Size is a size in bytes: a decimal number, a 0x prefixed hex number, or either of them
+// followed by a unit, K, M, G or T, which are the powers of 1024, e.g "1G", "512M", "0x100K".
+// KB/KiB, MB/MiB and so on are the same, case insensitive.
+type Size string
+
+// the units of Size
+var sizeUnits = map[string]int64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// Bytes return the size in bytes, error if it is invalid or negative
+func (s Size) Bytes() (int64, error) {
+	v := strings.TrimSpace(string(s))
+	if v == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	// the number is up to the unit, hex numbers have the digits a-f
+	digits, base, start := "0123456789", 10, 0
+	if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+		digits, base, start = "0123456789abcdefABCDEF", 16, 2
+	}
+	i := start
+	for i < len(v) && strings.IndexByte(digits, v[i]) >= 0 {
+		i++
+	}
+	number, unit := v[start:i], strings.ToUpper(strings.TrimSpace(v[i:]))
+	if len(unit) > 1 {
+		// KB, KiB
+		if unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I"); len(unit) != 1 || unit == "B" {
+			unit = "?"
+		}
+	}
+	scale, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q, unknown unit %q", string(s), v[i:])
+	}
+	n, err := strconv.ParseInt(number, base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", string(s))
+	}
+	if n > math.MaxInt64/scale {
+		return 0, fmt.Errorf("invalid size %q, too large", string(s))
+	}
+	return n * scale, nil
+}
+
+// Canonical return the size in bytes in decimal, what the build system expects, or the size
+// as it is if it is invalid
+func (s Size) Canonical() string {
+	n, err := s.Bytes()
+	if err != nil {
+		return string(s)
+	}
+	return strconv.FormatInt(n, 10)
+}
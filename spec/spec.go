@@ -6,15 +6,35 @@ package spec
 // Spec is the specification for Android device configration.
 // Attributes without "omitempty" are required, otherwise it is schema error.
 type Spec struct {
-	Version          *Version          `json:"version"`
-	Product          *Product          `json:"product"`
+	// JSONSchema is the optional "$schema" for editors, e.g the output of `avs schema`.
+	JSONSchema string `json:"$schema,omitempty"`
+	// Extends is the parent spec, a path or a name in the library, this spec is merged into.
+	// See specconv.LoadSpec.
+	Extends string   `json:"extends,omitempty"`
+	Version *Version `json:"version"`
+	Product *Product `json:"product"`
+	// Products are the products to generate when there are more than one, they share
+	// the spec of the device and override part of Product.
+	Products         []ProductOverride `json:"products,omitempty"`
 	BoardConfig      *BoardConfig      `json:"boardConfig"`
 	BootImage        *BootImage        `json:"boot_image"`
 	FrameworkConfigs *FrameworkConfigs `json:"framework_configs,omitempty"`
 	Hals             []HAL             `json:"hals"`
+	Manifest         *DeviceManifest   `json:"manifest,omitempty"`
 	VendorRaw        *VendorRaw        `json:"vendor_raw,omitempty"`
+	Validation       *Validation       `json:"validation,omitempty"`
+	// Overlays are the files, absolute or relative to the device directory, applied on top
+	// of this spec in order, e.g the variants of a board. See specconv.LoadDeviceSpec.
+	Overlays []string `json:"overlays,omitempty"`
 }
 
+// SchemaVersion is the current version of the spec schema, config files with an older
+// Version.Schema need to be migrated with `avs migrate`.
+//
+//	0.1: the initial version
+//	0.2: ramkdisk_offset renamed to ramdisk_offset, SELinux.Version moved to Manifest
+const SchemaVersion = "0.2"
+
 // Version describe the avs spec version, as well as the Android version this spec applies for.
 type Version struct {
 	Schema  string `json:"schema"`
@@ -34,6 +54,74 @@ type Product struct {
 	// we currently looking for.
 	// [1] https://android.googlesource.com/platform/build/+/master/target/product/
 	InheritProducts []string `json:"inherit_products,omitempty"`
+	// BuildVariants are the variants a lunch combo is added for, see ProductVariants.
+	// Default is eng only.
+	BuildVariants []string `json:"build_variants,omitempty"`
+	// Packages are the product specific PRODUCT_PACKAGES.
+	Packages []string `json:"packages,omitempty"`
+	// Properties are the product specific PRODUCT_PROPERTY_OVERRIDES.
+	Properties []string `json:"properties,omitempty"`
+}
+
+// valid build variants
+const (
+	VariantEng       = "eng"
+	VariantUserdebug = "userdebug"
+	VariantUser      = "user"
+)
+
+// ProductVariants is the build variants of the product, i.e the lunch combos.
+func (p *Product) ProductVariants() []string {
+	if len(p.BuildVariants) == 0 {
+		return []string{VariantEng}
+	}
+	return p.BuildVariants
+}
+
+// ProductOverride is another product built from the same device, e.g poplar_tv for poplar.
+// The attributes not set are the same as Spec.Product, except Packages and Properties which
+// are added to the ones of Spec.Product.
+type ProductOverride struct {
+	Name            string   `json:"name"`
+	Brand           string   `json:"brand,omitempty"`
+	Model           string   `json:"model,omitempty"`
+	InheritProducts []string `json:"inherit_products,omitempty"`
+	BuildVariants   []string `json:"build_variants,omitempty"`
+	Packages        []string `json:"packages,omitempty"`
+	Properties      []string `json:"properties,omitempty"`
+}
+
+// AllProducts return all the products to generate, Product if there is no Products, otherwise
+// one for each of Products.
+func (s *Spec) AllProducts() []Product {
+	if s.Product == nil {
+		return nil
+	}
+	if len(s.Products) == 0 {
+		return []Product{*s.Product}
+	}
+
+	var products []Product
+	for _, o := range s.Products {
+		p := *s.Product
+		p.Name = o.Name
+		if o.Brand != "" {
+			p.Brand = o.Brand
+		}
+		if o.Model != "" {
+			p.Model = o.Model
+		}
+		if o.InheritProducts != nil {
+			p.InheritProducts = o.InheritProducts
+		}
+		if o.BuildVariants != nil {
+			p.BuildVariants = o.BuildVariants
+		}
+		p.Packages = append(append([]string{}, s.Product.Packages...), o.Packages...)
+		p.Properties = append(append([]string{}, s.Product.Properties...), o.Properties...)
+		products = append(products, p)
+	}
+	return products
 }
 
 // BoardConfig is configrations for the Board. All the build time configurations belongs to a
@@ -91,6 +179,26 @@ type BootImage struct {
 	Args   *MkBootImageArgs `json:"args,omitempty"`
 	Kernel *Kernel          `json:"kernel"`
 	Rootfs *RootfsOverlay   `json:"rootfs_overlay"`
+	// Dtbo is the dtbo.img built with the overlays by mkdtimg, BOARD_PREBUILT_DTBOIMAGE
+	Dtbo *Dtbo `json:"dtbo,omitempty"`
+}
+
+// Dtbo is the dtbo.img, the DT table of the overlays the bootloader picks from and applies
+// to the dtb. See `avi dtbo`.
+type Dtbo struct {
+	// PageSize is the page size in the header, default to 2048
+	PageSize Size        `json:"page_size,omitempty"`
+	Entries  []DtboEntry `json:"entries"`
+}
+
+// DtboEntry is an entry of the dtbo.img. ID, Rev and Custom are for the bootloader to pick
+// the entry, in decimal or 0x prefixed hex, default to 0.
+type DtboEntry struct {
+	// File is the dtbo, e.g $(LOCAL_PATH)/board-a.dtbo
+	File   string   `json:"file"`
+	ID     string   `json:"id,omitempty"`
+	Rev    string   `json:"rev,omitempty"`
+	Custom []string `json:"custom,omitempty"`
 }
 
 // MkBootImageArgs provides the *part* of the args passing to mkbootimage
@@ -106,7 +214,7 @@ type MkBootImageArgs struct {
 type MkBootImageLoadArgsLoadAddress struct {
 	LoadBase string `json:"load_base"`
 	// default to 0x8000
-	RamdiskOffset string `json:"ramkdisk_offset"`
+	RamdiskOffset string `json:"ramdisk_offset"`
 	// default to 0x1000000
 	KernelOffset string `json:"kernel_offset"`
 }
@@ -122,6 +230,10 @@ type Kernel struct {
 	LocalKernel string `json:"local_kernel"`
 	Compressed  string `json:"compressed,omitempty"`
 	LocalDTB    string `json:"local_dtb,omitempty"`
+	// ConfigFragments are the kernel config fragments the LocalKernel must satisfy, e.g
+	// android-base.config of kernel/configs, on top of the built in requirements of the
+	// Android version and the HALs. See the kernel-configs rule.
+	ConfigFragments []string `json:"config_fragments,omitempty"`
 }
 
 // RootfsOverlay includes the files that will be included in the rootfs (part of the boot image).
@@ -146,9 +258,24 @@ type FrameworkConfigs struct {
 	Properties []string `json:"properties,omitempty"`
 }
 
+// DeviceManifest is the device level data of the manifest.xml, other than the HAL manifests
+// which are in HAL.Manifests.
+type DeviceManifest struct {
+	// SEPolicyVersion is the vendor sepolicy version, e.g "26.0"
+	SEPolicyVersion string `json:"sepolicy_version,omitempty"`
+}
+
 // VendorRaw are the raw instructions that will be copied directly to the device.mk.
 // It is a fallback for things that can't be expressed nicely in current specification.
 // Use it *rarely*.
 type VendorRaw struct {
 	Instructions []string `json:"instructions"`
 }
+
+// Validation configures the validation rules (avs v) for this device, see `avs rules`
+// for all the rules available.
+type Validation struct {
+	// Rules maps the rule ID to its severity, one of "off", "info", "warning", "error".
+	// It overrides the default severity of the rule, "off" disables it.
+	Rules map[string]string `json:"rules,omitempty"`
+}
@@ -1,5 +1,7 @@
 package spec
 
+import "fmt"
+
 func ExampleSpec() {
 	_ = Spec{
 		Version: &Version{
@@ -79,3 +81,17 @@ func ExampleSEPolicyF_labeANewDaemon() {
 		},
 	}
 }
+
+func ExampleSize() {
+	for _, s := range []Size{"1073741824", "0x40000000", "1G", "1024MiB", "512 KB", "1.5G"} {
+		n, err := s.Bytes()
+		fmt.Println(n, err)
+	}
+	// Output:
+	// 1073741824 <nil>
+	// 1073741824 <nil>
+	// 1073741824 <nil>
+	// 1073741824 <nil>
+	// 524288 <nil>
+	// 0 invalid size "1.5G", unknown unit ".5G"
+}
@@ -7,8 +7,9 @@ type UeventRc struct {
 	File string `json:"file,omitempty"`
 	// Name will be the file name for the generated script and it will be copied to device
 	// with same name. Default name ueventd.rc.gen
-	Name  string       `json:"name,omitempty"`
-	Rules []UeventRule `json:"rules"`
+	Name string `json:"name,omitempty"`
+	// Rules can be empty when all the device nodes come from HAL.Devices
+	Rules []UeventRule `json:"rules,omitempty"`
 }
 
 // UeventRule is rule for eventd.
@@ -1,6 +1,7 @@
 package specconv
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -16,20 +17,35 @@ import (
 type AvsState struct {
 	GenDir          string   `json:"gen_dir"`
 	GenereatedFiles []string `json:"generated_files"`
+	// FileHashes is the sha256 of the generated files, by path
+	FileHashes map[string]string `json:"file_hashes,omitempty"`
 }
 
+// fileHash return the hash of the file content, as in FileHashes
+func fileHash(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// avsStateFile is the file name of the AvsState in $genDir
+const avsStateFile = ".avsstate"
+
 // Update persistent it self to $GenDir/.avsstae
 func (s *AvsState) Update() error {
 	if s.GenDir == "" {
 		s.GenDir, _ = os.Getwd()
 	}
-	o := filepath.Join(s.GenDir, ".avsstate")
+	o := filepath.Join(s.GenDir, avsStateFile)
 	return SaveSpecToJSON(s, o)
 }
 
+// data return the state as saved by Update
+func (s *AvsState) data() ([]byte, error) {
+	return json.MarshalIndent(s, "", "    ")
+}
+
 // LoadAvsState load the avs state, or error
 func LoadAvsState(genDir string) (state *AvsState, err error) {
-	stateFile := filepath.Join(genDir, ".avsstate")
+	stateFile := filepath.Join(genDir, avsStateFile)
 	if r, err := utils.FileExists(stateFile); r != true {
 		return nil, err
 	}
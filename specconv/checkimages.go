@@ -0,0 +1,250 @@
+package specconv
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pierrchen/avs/images"
+	"github.com/pierrchen/avs/spec"
+	"github.com/pierrchen/avs/utils"
+	"github.com/pierrchen/avs/vdts"
+)
+
+func init() {
+	vdts.Register(vdts.Rule{
+		ID:          "image-missing",
+		Description: "the partition images and the boot image are built",
+		Severity:    vdts.SeverityWarning,
+		Stage:       vdts.StageImages,
+		Check:       validateImagesBuilt,
+	})
+	vdts.Register(vdts.Rule{
+		ID:          "image-fs-type",
+		Description: "the partition images have the file system of the partition type",
+		Severity:    vdts.SeverityError,
+		Stage:       vdts.StageImages,
+		Check:       validateImageFsTypes,
+	})
+	vdts.Register(vdts.Rule{
+		ID:          "image-size",
+		Description: "the partition images fit in the partitions",
+		Severity:    vdts.SeverityError,
+		Stage:       vdts.StageImages,
+		Check:       validateImageSizes,
+	})
+	vdts.Register(vdts.Rule{
+		ID:          "bootimg-args",
+		Description: "the page size, the load addresses and the kernel command line of the boot image are as the spec",
+		Severity:    vdts.SeverityError,
+		Stage:       vdts.StageImages,
+		Check:       validateBootImgArgs,
+	})
+}
+
+// CheckImages checks the images built in the product out dir, e.g out/target/product/poplar,
+// against the spec of the device: the file system and the size of the partition images, and
+// the header of the boot image. See the images rules of `avs rules`.
+// The report lists all the problems found, error is non nil if any of them is an error.
+func CheckImages(deviceDir, outDir string) (*vdts.Report, error) {
+	s, err := LoadDeviceSpec(deviceDir)
+	if err != nil {
+		return loadErrorReport(filepath.Join(deviceDir, defaultConfigJSONName), err), err
+	}
+	return vdts.ValidateImages(s, deviceDir, outDir)
+}
+
+// outImage return the path of the image in the out dir, or "" if it isn't built
+func outImage(outDir, name string) string {
+	path := filepath.Join(outDir, name)
+	if r, _ := utils.FileExists(path); r == false {
+		return ""
+	}
+	return path
+}
+
+// partitionPath return the json path of the ith partition
+func partitionPath(i int) string {
+	return fmt.Sprintf("boardConfig.partition_table.partitions[%d]", i)
+}
+
+// - BoardConfig.PartitionTable.Partitions
+// - BootImage
+// The image of every partition, and the boot image, vendor_boot.img since v3, are built.
+func validateImagesBuilt(s *spec.Spec, outDir string, r *vdts.Report) {
+	hint := "build it or check --out"
+	for i, p := range s.BoardConfig.PartitionTable.Partitions {
+		if outImage(outDir, p.Name+".img") == "" {
+			r.Addf(partitionPath(i), hint, "no %s.img in %s", p.Name, outDir)
+		}
+	}
+	image := outImage(outDir, "boot.img")
+	if image == "" {
+		r.Addf("boot_image", hint, "no boot.img in %s", outDir)
+		return
+	}
+	b := images.Bootimg{ImagePath: image}
+	// a broken one is reported by bootimg-args
+	if args, err := b.Args(); err == nil && args.HeaderVersion >= 3 && outImage(outDir, "vendor_boot.img") == "" {
+		r.Addf("boot_image", hint, "no vendor_boot.img in %s, boot.img is v%d", outDir, args.HeaderVersion)
+	}
+}
+
+// - BoardConfig.PartitionTable.Partitions
+// The partition image has the file system of the partition type.
+func validateImageFsTypes(s *spec.Spec, outDir string, r *vdts.Report) {
+	for i, p := range s.BoardConfig.PartitionTable.Partitions {
+		image := outImage(outDir, p.Name+".img")
+		if image == "" || p.Type == "" {
+			continue
+		}
+		u := images.UserImage{ImagePath: image}
+		fs, err := u.FsType()
+		if err != nil {
+			r.Addf(partitionPath(i)+".type", "", "%s: %s", image, err)
+		} else if fs != p.Type {
+			if fs == "" {
+				fs = "unknown"
+			}
+			r.Addf(partitionPath(i)+".type", fmt.Sprintf("make the image with %s, or change the type", p.Type),
+				"%s.img is %s, partition type %s", p.Name, fs, p.Type)
+		}
+	}
+}
+
+// - BoardConfig.PartitionTable.Partitions
+// The partition image, raw or sparse, fits in the partition.
+func validateImageSizes(s *spec.Spec, outDir string, r *vdts.Report) {
+	for i, p := range s.BoardConfig.PartitionTable.Partitions {
+		image := outImage(outDir, p.Name+".img")
+		if image == "" || p.Size == "" {
+			continue
+		}
+		want, err := p.Size.Bytes()
+		if err != nil {
+			// reported by partition-sizes
+			continue
+		}
+		u := images.UserImage{ImagePath: image}
+		size, err := u.Size()
+		if err != nil {
+			r.Addf(partitionPath(i)+".size", "", "%s: %s", image, err)
+		} else if size > want {
+			r.Addf(partitionPath(i)+".size", "increase the partition size, or remove something from the image",
+				"%s.img is %d bytes, larger than the partition of %d bytes", p.Name, size, want)
+		}
+	}
+}
+
+// specBootImgArgs return the page size and the load addresses of the boot image in the spec,
+// the defaults of mkbootimg if not set
+func specBootImgArgs(s *spec.Spec) (*images.BootImgArgs, error) {
+	a := images.DefaultBootImgArgs()
+	args := s.BootImage.Args
+	if args == nil {
+		return a, nil
+	}
+	if args.PageSize != "" {
+		n, err := strconv.ParseUint(args.PageSize, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid page_size %q", args.PageSize)
+		}
+		a.PageSize = uint32(n)
+	}
+	if args.Lda != nil && args.Lda.LoadBase != "" {
+		for _, v := range []struct {
+			name, value string
+			n           *uint32
+		}{
+			{"load_base", args.Lda.LoadBase, &a.Base},
+			{"kernel_offset", args.Lda.KernelOffset, &a.KernelOffset},
+			{"ramdisk_offset", args.Lda.RamdiskOffset, &a.RamdiskOffset},
+		} {
+			n, err := strconv.ParseUint(v.value, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", v.name, v.value)
+			}
+			*v.n = uint32(n)
+		}
+	}
+	return a, nil
+}
+
+// - BootImage
+// The page size, the load addresses and the kernel command line in the header of boot.img,
+// or vendor_boot.img since v3, are what the spec generates.
+func validateBootImgArgs(s *spec.Spec, outDir string, r *vdts.Report) {
+	path := "boot_image.args"
+	want, err := specBootImgArgs(s)
+	if err != nil {
+		r.Addf(path, "", "%s", err)
+		return
+	}
+
+	// missing ones are reported by image-missing
+	image := outImage(outDir, "boot.img")
+	if image == "" {
+		return
+	}
+	b := images.Bootimg{ImagePath: image}
+	got, err := b.Args()
+	if err != nil {
+		r.Addf("boot_image", "", "%s", err)
+		return
+	}
+	name := "boot.img"
+	cmdline := got.CmdLine
+	if got.HeaderVersion >= 3 {
+		vendorImage := outImage(outDir, "vendor_boot.img")
+		if vendorImage == "" {
+			return
+		}
+		v := images.VendorBootimg{ImagePath: vendorImage}
+		vendor, err := v.Args()
+		if err != nil {
+			r.Addf("boot_image", "", "%s", err)
+			return
+		}
+		name = "vendor_boot.img"
+		cmdline = vendor.CmdLine + " " + got.CmdLine
+		got.PageSize, got.Base = vendor.PageSize, vendor.Base
+		got.KernelOffset, got.RamdiskOffset = vendor.KernelOffset, vendor.RamdiskOffset
+	}
+
+	if got.PageSize != want.PageSize {
+		r.Addf(path+".page_size", "", "%s has page size %d, expect %d", name, got.PageSize, want.PageSize)
+	}
+	// the base isn't in the image, compare the addresses
+	for _, a := range []struct {
+		name      string
+		got, want uint32
+	}{
+		{"kernel", got.Base + got.KernelOffset, want.Base + want.KernelOffset},
+		{"ramdisk", got.Base + got.RamdiskOffset, want.Base + want.RamdiskOffset},
+	} {
+		if a.got != a.want {
+			r.Addf(path+".load_addresses", "", "%s has %s address 0x%x, expect 0x%x", name, a.name, a.got, a.want)
+		}
+	}
+
+	// getFullKernelCommand needs it, the rest is required by the spec anyway
+	if s.BoardConfig.SELinux == nil {
+		return
+	}
+	// the build system may add more, e.g buildvariant
+	params := map[string]bool{}
+	for _, p := range strings.Fields(cmdline) {
+		params[p] = true
+	}
+	var missing []string
+	for _, p := range strings.Fields(getFullKernelCommand(s)) {
+		if !params[p] {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) != 0 {
+		r.Addf("boot_image.kernel.cmd_line", "rebuild the boot image after avs update",
+			"%s cmdline %q misses %s", name, cmdline, strings.Join(missing, " "))
+	}
+}
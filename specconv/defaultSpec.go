@@ -4,7 +4,7 @@ package specconv
 var DefaultSpec = `
 {
     "version": {
-        "schema": "0.1",
+        "schema": "0.2",
         "android": "Android O"
     },
     "product": {
@@ -0,0 +1,157 @@
+package specconv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pierrchen/avs/spec"
+)
+
+// A doc is the generic form of a json spec file, as decoded into interface{}, i.e
+// map[string]interface{}, []interface{}, string, json.Number, bool or nil.
+// It is used when the file can't be decoded into spec.Spec yet, e.g an old schema or
+// a partial spec.
+
+// decodeDoc decodes json data into a doc, numbers are kept as they are
+func decodeDoc(file string, data []byte) (interface{}, error) {
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, decodeError(file, data, err)
+	}
+	return doc, nil
+}
+
+// encodeDoc encodes the doc in the same layout as SaveSpecToJSON, the attributes are
+// ordered as the fields of type t, so that the file reads the same as a saved spec.
+// Attributes not in t go last in alphabetical order.
+func encodeDoc(doc interface{}, t reflect.Type) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeDoc(&buf, doc, t, ""); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeDoc(buf *bytes.Buffer, doc interface{}, t reflect.Type, indent string) error {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	const step = "    "
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+		keys, types := orderedKeys(v, t)
+		buf.WriteString("{\n")
+		for i, k := range keys {
+			name, _ := json.Marshal(k)
+			fmt.Fprintf(buf, "%s%s%s: ", indent, step, name)
+			if err := writeDoc(buf, v[k], types[i], indent+step); err != nil {
+				return err
+			}
+			if i != len(keys)-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + "}")
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString("[]")
+			return nil
+		}
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		buf.WriteString("[\n")
+		for i, e := range v {
+			buf.WriteString(indent + step)
+			if err := writeDoc(buf, e, elem, indent+step); err != nil {
+				return err
+			}
+			if i != len(v)-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + "]")
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+// orderedKeys return the keys of m in the order of the fields of the struct t, and the
+// type of each of them (nil if unknown)
+func orderedKeys(m map[string]interface{}, t reflect.Type) ([]string, []reflect.Type) {
+	var keys []string
+	var types []reflect.Type
+	done := map[string]bool{}
+
+	if t != nil && t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			name, _, ok := spec.JSONField(t.Field(i))
+			if _, has := m[name]; ok && has {
+				keys = append(keys, name)
+				types = append(types, t.Field(i).Type)
+				done[name] = true
+			}
+		}
+	}
+
+	var rest []string
+	for k := range m {
+		if !done[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+
+	var elem reflect.Type
+	if t != nil && t.Kind() == reflect.Map {
+		elem = t.Elem()
+	}
+	for _, k := range rest {
+		keys = append(keys, k)
+		types = append(types, elem)
+	}
+	return keys, types
+}
+
+// docObject return the object at the dot separated path in doc, or nil if there isn't one
+func docObject(doc interface{}, path string) map[string]interface{} {
+	cur, _ := doc.(map[string]interface{})
+	if path == "" {
+		return cur
+	}
+	for _, p := range strings.Split(path, ".") {
+		if cur == nil {
+			return nil
+		}
+		cur, _ = cur[p].(map[string]interface{})
+	}
+	return cur
+}
+
+// docSchemaVersion return the schema version of a spec doc, "" if it has no version
+func docSchemaVersion(doc interface{}) string {
+	if v := docObject(doc, "version"); v != nil {
+		s, _ := v["schema"].(string)
+		return s
+	}
+	return ""
+}
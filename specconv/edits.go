@@ -0,0 +1,73 @@
+package specconv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pierrchen/avs/utils"
+)
+
+// The generated files shouldn't be edited by hand, the edits are lost the next time they
+// are generated. avs records the hash of every generated file in the .avsstate, and refuses
+// to overwrite or delete a file that doesn't match it anymore, unless forced.
+// When forced, the edited file is saved as <file>.orig first.
+
+// editedSuffix is added to the edited files before they are overwritten or deleted
+const editedSuffix = ".orig"
+
+// EditedError is returned when the generated files have been edited by hand.
+type EditedError struct {
+	Files []string
+}
+
+func (e *EditedError) Error() string {
+	return fmt.Sprintf("%d generated file(s) edited by hand, use --force to overwrite them:\n%s",
+		len(e.Files), strings.Join(e.Files, "\n"))
+}
+
+// editedByHand return true if the file content doesn't match the hash recorded when it
+// was generated. Files without a recorded hash, e.g generated by an old avs, are not checked.
+func editedByHand(state *AvsState, path string, data []byte) bool {
+	if state == nil {
+		return false
+	}
+	h, ok := state.FileHashes[path]
+	return ok && h != fileHash(data)
+}
+
+// saveEdited saves the edited file as <file>.orig
+func saveEdited(path string, data []byte) error {
+	fmt.Printf("%s was edited by hand, saved as %s\n", path, path+editedSuffix)
+	return ioutil.WriteFile(path+editedSuffix, data, 0644)
+}
+
+// printEdits prints the edits made by hand to the generated file, i.e how it differs from
+// what avs generates, and how to keep them in config.json if possible
+func printEdits(path string, generated, edited []byte) {
+	name := filepath.Base(path)
+	fmt.Printf("%s was edited by hand, the edits below would be lost:\n", path)
+	fmt.Print(utils.UnifiedDiff("generated/"+name, "edited/"+name, generated, edited))
+
+	// only device.mk has the raw instructions
+	if name != "device.mk" {
+		fmt.Println("please make the changes in config.json instead")
+		return
+	}
+	var raw []string
+	for _, l := range utils.AddedLines(generated, edited) {
+		if strings.TrimSpace(l) != "" {
+			raw = append(raw, l)
+		}
+	}
+	if len(raw) == 0 {
+		return
+	}
+	snippet, _ := json.MarshalIndent(map[string]interface{}{
+		"vendor_raw": map[string]interface{}{"instructions": raw},
+	}, "", "    ")
+	fmt.Printf("to keep the added lines, add them to config.json (or to the \"raw\" of the HAL):\n%s\n",
+		snippet)
+}
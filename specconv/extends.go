@@ -0,0 +1,225 @@
+package specconv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/pierrchen/avs/spec"
+	"github.com/pierrchen/avs/utils"
+)
+
+// A spec can extend another one with Spec.Extends, e.g the boards of the same SoC extend
+// the spec of the SoC and have only what is different in their config.json.
+//
+// Extends is either
+// 1. a path to the parent spec, relative to the spec extending it, or the directory of it
+//    which has a config.json, e.g "../poplar";
+// 2. or a name of a spec in the library, i.e $AVS_LIBRARY/<name>.json or
+//    $AVS_LIBRARY/<name>/config.json. The library is ~/.avs/library by default.
+//
+// The spec is merged into its parent: objects are merged attribute by attribute, a null
+// attribute deletes it from the parent, and lists are replaced, except the ones in
+// listKeys whose items are merged by the key attribute, a new item is added to the end.
+// The parent can extend another spec, but not one of its children.
+// The overlays of the parent are for the parent device, they are not inherited.
+
+// listKeys are the lists merged item by item, and the attribute identifying the item
+var listKeys = map[string]string{
+	"hals":                                      "name",
+	"boardConfig.partition_table.partitions":    "name",
+	"boot_image.rootfs_overlay.uevent.rc.rules": "node",
+	"products":                                  "name",
+}
+
+// libraryDir return the directory of the named parent specs
+func libraryDir() string {
+	if dir := os.Getenv("AVS_LIBRARY"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".avs", "library")
+}
+
+// resolveExtends return the spec file that Extends ref refers to, dir is the directory
+// of the spec extending it
+func resolveExtends(dir string, ref string) (string, error) {
+	var file string
+	if strings.ContainsRune(ref, '/') || strings.HasPrefix(ref, ".") || strings.HasSuffix(ref, ".json") {
+		file = ref
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, ref)
+		}
+	} else {
+		file = filepath.Join(libraryDir(), ref)
+		if r, _ := utils.FileExists(file + ".json"); r {
+			file += ".json"
+		}
+	}
+
+	if fi, err := os.Stat(file); err == nil && fi.IsDir() {
+		file = filepath.Join(file, defaultConfigJSONName)
+	}
+	if r, _ := utils.FileExists(file); !r {
+		return "", fmt.Errorf("can't find the spec %q extends, %s doesn't exist", ref, file)
+	}
+	return filepath.Abs(file)
+}
+
+// sourceName is how file is referred to in the provenance, relative to the device dir
+func sourceName(deviceDir, file string) string {
+	if rel, err := filepath.Rel(deviceDir, file); err == nil {
+		return rel
+	}
+	return file
+}
+
+// loadSpecDoc loads the spec file as a doc with the specs it extends merged in, and
+// which file each leaf of the doc comes from. chain is the specs extending this one.
+func loadSpecDoc(file string, deviceDir string, chain []string) (interface{}, map[string]string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, c := range chain {
+		if c == abs {
+			return nil, nil, fmt.Errorf("%s: extends cycle: %s -> %s", chain[len(chain)-1],
+				strings.Join(chain[i:], " -> "), abs)
+		}
+	}
+	chain = append(chain, abs)
+
+	data, err := readSpecFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := decodeDoc(file, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkSchemaVersion(file, doc); err != nil {
+		return nil, nil, err
+	}
+
+	var ref string
+	if root, ok := doc.(map[string]interface{}); ok {
+		ref, _ = root["extends"].(string)
+	}
+	name := sourceName(deviceDir, file)
+
+	// a spec extending or extended by another one is part of the spec, required attributes
+	// are checked once all merged
+	if ref == "" && len(chain) == 1 {
+		err = checkStrict(file, data, reflect.TypeOf(spec.Spec{}))
+	} else {
+		err = checkUnknown(file, data, reflect.TypeOf(spec.Spec{}))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ref == "" {
+		sources := map[string]string{}
+		for p := range flattenDoc(doc, "") {
+			sources[p] = name
+		}
+		return doc, sources, nil
+	}
+
+	parentFile, err := resolveExtends(filepath.Dir(abs), ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", file, err)
+	}
+	parent, sources, err := loadSpecDoc(parentFile, deviceDir, chain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p, ok := parent.(map[string]interface{}); ok {
+		delete(p, "overlays")
+		for path := range sources {
+			if path == "overlays" || strings.HasPrefix(path, "overlays[") {
+				delete(sources, path)
+			}
+		}
+	}
+
+	before := flattenDoc(parent, "")
+	merged := mergeSpecDoc(parent, doc, "")
+	updateSources(sources, before, flattenDoc(merged, ""), name)
+	return merged, sources, nil
+}
+
+// mergeSpecDoc merges the child spec doc into the parent and return the result, parent is
+// modified. path is the json path of the docs.
+func mergeSpecDoc(parent, child interface{}, path string) interface{} {
+	join := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+
+	switch c := child.(type) {
+	case map[string]interface{}:
+		p, ok := parent.(map[string]interface{})
+		if !ok {
+			// drop the nulls
+			return mergePatch(nil, c)
+		}
+		for k, v := range c {
+			if v == nil {
+				delete(p, k)
+			} else {
+				p[k] = mergeSpecDoc(p[k], v, join(k))
+			}
+		}
+		return p
+	case []interface{}:
+		key, ok := listKeys[path]
+		p, isList := parent.([]interface{})
+		if !ok || !isList {
+			return c
+		}
+		for _, item := range c {
+			id := itemKey(item, key)
+			merged := false
+			for i, pi := range p {
+				if id != nil && itemKey(pi, key) == id {
+					p[i] = mergeSpecDoc(pi, item, path+"[]")
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				p = append(p, item)
+			}
+		}
+		return p
+	}
+	return child
+}
+
+// itemKey return the key attribute of a list item, nil if there isn't
+func itemKey(item interface{}, key string) interface{} {
+	if m, ok := item.(map[string]interface{}); ok {
+		if v, ok := m[key].(string); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// updateSources sets the source of the leaves changed from before to after
+func updateSources(sources map[string]string, before, after map[string]string, source string) {
+	for p, v := range after {
+		if old, ok := before[p]; !ok || old != v {
+			sources[p] = source
+		}
+	}
+	for p := range before {
+		if _, ok := after[p]; !ok {
+			delete(sources, p)
+		}
+	}
+}
@@ -34,7 +34,8 @@ func SaveSpecToJSON(jsonData interface{}, path string) error {
 	return nil
 }
 
-// LoadSpecFromString return a spec from jsonSting, return error on error
+// LoadSpecFromString return a spec from jsonSting, return error on error.
+// Unlike LoadSpec, unknown and missing attributes are not checked.
 func LoadSpecFromString(jsonString string) (spec *spec.Spec, err error) {
 	if err = json.NewDecoder(strings.NewReader(jsonString)).Decode(&spec); err != nil {
 		fmt.Printf("%#v", err)
@@ -43,37 +44,37 @@ func LoadSpecFromString(jsonString string) (spec *spec.Spec, err error) {
 	return spec, nil
 }
 
-// LoadSpec load config.json file and return an Spec object
-func LoadSpec(configFile string) (spec *spec.Spec, err error) {
-	cf, err := os.Open(configFile)
+// readSpecFile return the content of a spec file
+func readSpecFile(configFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, fmt.Errorf("JSON specification file %s not found", configFile)
 		}
 		return nil, err
 	}
-	defer cf.Close()
+	return data, nil
+}
 
-	if err = json.NewDecoder(cf).Decode(&spec); err != nil {
-		fmt.Printf("%#v", err)
+// LoadSpec load config.json file and return an Spec object, with the specs it extends merged.
+// Unknown attributes and missing required attributes are errors, see StrictError.
+// The config file must be of the current schema version, see MigrateDeviceConfigs.
+func LoadSpec(configFile string) (spec *spec.Spec, err error) {
+	doc, sources, err := loadSpecDoc(configFile, filepath.Dir(configFile), nil)
+	if err != nil {
 		return nil, err
 	}
-	return spec, nil
+	return newDeviceDoc(configFile, doc, sources).spec()
 }
 
 // LoadHalSpec load a HAL spec from json file
 func LoadHalSpec(configFile string) (spec *spec.HAL, err error) {
-	cf, err := os.Open(configFile)
+	data, err := readSpecFile(configFile)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("JSON specification file %s not found", configFile)
-		}
 		return nil, err
 	}
-	defer cf.Close()
 
-	if err = json.NewDecoder(cf).Decode(&spec); err != nil {
-		fmt.Printf("%#v", err)
+	if err = strictDecode(configFile, data, &spec); err != nil {
 		return nil, err
 	}
 	return spec, nil
@@ -0,0 +1,407 @@
+package specconv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pierrchen/avs/spec"
+)
+
+// migration upgrades a spec doc from schema From to To.
+// Spec migrates the config.json and the merge patch overlays, Hal migrates a HAL overlay
+// (ol.hal.*.json), either can be nil. Both return the description of each change they made.
+// Renames are the json pointers of the fields Spec renames or moves, old -> new, for the
+// JSON Patch overlays.
+type migration struct {
+	From    string
+	To      string
+	Spec    func(doc map[string]interface{}) []string
+	Hal     func(doc map[string]interface{}) []string
+	Renames map[string]string
+}
+
+// migrations is the chain of all the schema migrations, in order.
+// Add one every time the schema (spec.SchemaVersion) changes.
+var migrations = []migration{
+	{From: "0.1", To: "0.2", Spec: migrate01To02, Renames: map[string]string{
+		"/boot_image/args/load_addresses/ramkdisk_offset": "/boot_image/args/load_addresses/ramdisk_offset",
+		"/boardConfig/selinux/version":                    "/manifest/sepolicy_version",
+	}},
+}
+
+// first schema version, used for config files without version
+const firstSchemaVersion = "0.1"
+
+// compareVersion compares schema versions "major.minor", it return -1, 0, 1 when a is
+// older than, same as, newer than b
+func compareVersion(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkSchemaVersion return error if the spec doc isn't of the current schema version
+func checkSchemaVersion(file string, doc interface{}) error {
+	v := docSchemaVersion(doc)
+	if v == "" {
+		// missing version is reported by the strict check
+		return nil
+	}
+	switch compareVersion(v, spec.SchemaVersion) {
+	case -1:
+		return fmt.Errorf("%s uses schema %s, the current schema is %s, run `avs migrate` first",
+			file, v, spec.SchemaVersion)
+	case 1:
+		return fmt.Errorf("%s uses schema %s which is newer than %s, please upgrade avs",
+			file, v, spec.SchemaVersion)
+	}
+	return nil
+}
+
+// migrationChain return the migrations to upgrade from schema version v to the current one
+func migrationChain(v string) ([]migration, error) {
+	var chain []migration
+	for compareVersion(v, spec.SchemaVersion) < 0 {
+		found := false
+		for _, m := range migrations {
+			if m.From == v {
+				chain = append(chain, m)
+				v = m.To
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("don't know how to migrate schema %s", v)
+		}
+	}
+	return chain, nil
+}
+
+// MigrationResult is the changes made to a file by the migration.
+type MigrationResult struct {
+	File    string
+	From    string
+	To      string
+	Changes []string
+	// Backup is the copy of the original file, "" if the file is unchanged or dry run
+	Backup string
+}
+
+// the kinds of the files to migrate
+const (
+	migrateSpec = iota
+	migrateHal
+	migrateMergePatch
+	migrateJSONPatch
+)
+
+// jsonPatchOp is a JSON Patch operation, for writing the migrated ones in the usual order
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	From  string      `json:"from,omitempty"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// migrationJob is a file to migrate, from its schema version
+type migrationJob struct {
+	file  string
+	data  []byte
+	doc   interface{}
+	kind  int
+	from  string
+	chain []migration
+}
+
+// specMigrationJob reads the spec file and return the job to migrate it
+func specMigrationJob(file string) (*migrationJob, error) {
+	data, err := readSpecFile(file)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeDoc(file, data)
+	if err != nil {
+		return nil, err
+	}
+
+	from := docSchemaVersion(doc)
+	if from == "" {
+		from = firstSchemaVersion
+	}
+	if compareVersion(from, spec.SchemaVersion) > 0 {
+		return nil, fmt.Errorf("%s uses schema %s which is newer than %s, please upgrade avs",
+			file, from, spec.SchemaVersion)
+	}
+	chain, err := migrationChain(from)
+	if err != nil {
+		return nil, err
+	}
+	return &migrationJob{file, data, doc, migrateSpec, from, chain}, nil
+}
+
+// MigrateDeviceConfigs migrates the config.json in deviceDir and the specs it extends, as
+// well as its overlays, the ones in Spec.Overlays or all the HAL overlays (ol.hal.*.json) if
+// not listed, to the current schema. Each spec is migrated from its own version. The overlays
+// don't carry a version, they are assumed to be of the same version as the config.json.
+// The merge patch overlays are migrated as the config.json, the pointers of the JSON Patch
+// overlays are changed to the new fields.
+// The original files are backed up as <file>.<version>.bak, nothing is written if dryRun.
+func MigrateDeviceConfigs(deviceDir string, dryRun bool) ([]MigrationResult, error) {
+	specFile := filepath.Join(deviceDir, defaultConfigJSONName)
+	top, err := specMigrationJob(specFile)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*migrationJob{top}
+
+	// the specs extended, resolved as when loading the spec
+	seen := map[string]bool{}
+	for j := top; ; {
+		abs, err := filepath.Abs(j.file)
+		if err != nil {
+			return nil, err
+		}
+		if seen[abs] {
+			return nil, fmt.Errorf("%s: extends cycle", abs)
+		}
+		seen[abs] = true
+		root, _ := j.doc.(map[string]interface{})
+		ref, _ := root["extends"].(string)
+		if ref == "" {
+			break
+		}
+		parent, err := resolveExtends(filepath.Dir(abs), ref)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", j.file, err)
+		}
+		if j, err = specMigrationJob(parent); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+
+	overlays, err := overlayFiles(deviceDir, top.doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range overlays {
+		f := overlayPath(deviceDir, name)
+		data, err := readSpecFile(f)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := decodeDoc(f, data)
+		if err != nil {
+			return nil, err
+		}
+		kind := migrateMergePatch
+		if _, ok := doc.([]interface{}); ok {
+			kind = migrateJSONPatch
+		} else if strings.HasPrefix(filepath.Base(name), halOverlayPrefix) {
+			kind = migrateHal
+		}
+		jobs = append(jobs, &migrationJob{f, data, doc, kind, top.from, top.chain})
+	}
+
+	var results []MigrationResult
+	for _, j := range jobs {
+		res := MigrationResult{File: j.file, From: j.from, To: spec.SchemaVersion}
+		t := reflect.TypeOf(spec.Spec{})
+
+		switch j.kind {
+		case migrateJSONPatch:
+			t = reflect.TypeOf([]jsonPatchOp{})
+			for _, m := range j.chain {
+				changes, err := migrateJSONPatchOps(j.doc.([]interface{}), m.Renames)
+				if err != nil {
+					return results, fmt.Errorf("%s: %s", j.file, err)
+				}
+				for _, c := range changes {
+					res.Changes = append(res.Changes, fmt.Sprintf("%s -> %s: %s", m.From, m.To, c))
+				}
+			}
+		default:
+			obj, ok := j.doc.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: not a json object", j.file)
+			}
+			if j.kind == migrateHal {
+				t = reflect.TypeOf(spec.HAL{})
+			}
+			for _, m := range j.chain {
+				step := m.Spec
+				if j.kind == migrateHal {
+					step = m.Hal
+				}
+				if step == nil {
+					continue
+				}
+				for _, c := range step(obj) {
+					res.Changes = append(res.Changes, fmt.Sprintf("%s -> %s: %s", m.From, m.To, c))
+				}
+			}
+			if j.kind == migrateSpec && len(j.chain) != 0 {
+				setSchemaVersion(obj, spec.SchemaVersion)
+				res.Changes = append(res.Changes, "version.schema set to "+spec.SchemaVersion)
+			}
+		}
+
+		if len(res.Changes) != 0 && !dryRun {
+			res.Backup = fmt.Sprintf("%s.%s.bak", j.file, j.from)
+			if err := ioutil.WriteFile(res.Backup, j.data, 0644); err != nil {
+				return results, err
+			}
+			out, err := encodeDoc(j.doc, t)
+			if err != nil {
+				return results, err
+			}
+			if err := ioutil.WriteFile(j.file, out, 0644); err != nil {
+				return results, err
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// renamePointer return the json pointer p with the renamed field in it changed to the new one
+func renamePointer(p string, renames map[string]string) (string, bool) {
+	for old, to := range renames {
+		if p == old || strings.HasPrefix(p, old+"/") {
+			return to + p[len(old):], true
+		}
+	}
+	return p, false
+}
+
+// migrateJSONPatchOps changes the path and from of the JSON Patch operations to the renamed
+// fields, as well as the fields in the object values of them, it return the changes made
+func migrateJSONPatchOps(ops []interface{}, renames map[string]string) ([]string, error) {
+	olds := make([]string, 0, len(renames))
+	for old := range renames {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+
+	var changes []string
+	for i, o := range ops {
+		op, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operation %d: not a json object", i)
+		}
+		for _, k := range []string{"path", "from"} {
+			p, ok := op[k].(string)
+			if !ok {
+				continue
+			}
+			if n, ok := renamePointer(p, renames); ok {
+				op[k] = n
+				changes = append(changes, fmt.Sprintf("operation %d: %s %s changed to %s", i, k, p, n))
+			}
+		}
+
+		// the renamed fields inside the value
+		path, _ := op["path"].(string)
+		value, ok := op["value"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, old := range olds {
+			if !strings.HasPrefix(old, path+"/") {
+				continue
+			}
+			rel := strings.Split(old[len(path)+1:], "/")
+			parent := value
+			for _, k := range rel[:len(rel)-1] {
+				if parent, ok = parent[k].(map[string]interface{}); !ok {
+					break
+				}
+			}
+			v, found := parent[rel[len(rel)-1]]
+			if parent == nil || !found {
+				continue
+			}
+			to := renames[old]
+			if !strings.HasPrefix(to, path+"/") {
+				return nil, fmt.Errorf("operation %d: the value has %s which is moved to %s, "+
+					"change it with a separate operation", i, old, to)
+			}
+			delete(parent, rel[len(rel)-1])
+			dst := value
+			rel = strings.Split(to[len(path)+1:], "/")
+			for _, k := range rel[:len(rel)-1] {
+				next, ok := dst[k].(map[string]interface{})
+				if !ok {
+					next = map[string]interface{}{}
+					dst[k] = next
+				}
+				dst = next
+			}
+			dst[rel[len(rel)-1]] = v
+			changes = append(changes, fmt.Sprintf("operation %d: value %s changed to %s", i, old, to))
+		}
+	}
+	return changes, nil
+}
+
+func setSchemaVersion(doc map[string]interface{}, v string) {
+	version, ok := doc["version"].(map[string]interface{})
+	if !ok {
+		version = map[string]interface{}{}
+		doc["version"] = version
+	}
+	version["schema"] = v
+}
+
+// 0.1 -> 0.2
+// - boot_image.args.load_addresses.ramkdisk_offset is renamed to ramdisk_offset
+// - boardConfig.selinux.version is moved to manifest.sepolicy_version
+func migrate01To02(doc map[string]interface{}) []string {
+	var changes []string
+
+	if lda := docObject(doc, "boot_image.args.load_addresses"); lda != nil {
+		if v, ok := lda["ramkdisk_offset"]; ok {
+			if _, has := lda["ramdisk_offset"]; !has {
+				lda["ramdisk_offset"] = v
+			}
+			delete(lda, "ramkdisk_offset")
+			changes = append(changes,
+				"boot_image.args.load_addresses.ramkdisk_offset renamed to ramdisk_offset")
+		}
+	}
+
+	if selinux := docObject(doc, "boardConfig.selinux"); selinux != nil {
+		if v, ok := selinux["version"]; ok {
+			delete(selinux, "version")
+			manifest := docObject(doc, "manifest")
+			if manifest == nil {
+				manifest = map[string]interface{}{}
+				doc["manifest"] = manifest
+			}
+			manifest["sepolicy_version"] = v
+			changes = append(changes,
+				"boardConfig.selinux.version moved to manifest.sepolicy_version")
+		}
+	}
+	return changes
+}
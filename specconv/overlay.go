@@ -0,0 +1,560 @@
+package specconv
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pierrchen/avs/spec"
+)
+
+// Overlays change the spec in config.json without touching it, e.g an eng board that differs
+// from the production one only in a few partition sizes and kernel args.
+//
+// The overlay files are listed in Spec.Overlays, absolute or relative to the device directory,
+// and applied in that order. The format of an overlay is decided by its content:
+// 1. A json object is a JSON merge patch [1], it can change any part of the spec, a null
+//    attribute deletes it.
+// 2. A json array is a JSON Patch [2], with the operations add, remove, replace, move, copy
+//    and test, handy for changing one item of a list, e.g
+//    [{"op": "replace", "path": "/boardConfig/partition_table/partitions/0/size", "value": "1073741824"}]
+// 3. The HAL overlay, which follow the format of `ol.hal.[hw.halFeature].json`, is a
+//    spec.HAL. If there is already a HAL with the same name in the spec, the overlay
+//    will override it; otherwise, it will be added.
+//    When Spec.Overlays is empty, all the ol.hal.*.json in the device directory are applied
+//    in alphabetical order.
+// [1] https://tools.ietf.org/html/rfc7396
+// [2] https://tools.ietf.org/html/rfc6902
+
+// halOverlayPrefix is the file name prefix of the HAL overlays
+const halOverlayPrefix = "ol.hal."
+
+// effectiveSpecName is used in place of a file name for errors in the spec after overlays,
+// the line numbers refer to the output of `avs overlay show --json`
+const effectiveSpecName = "<effective spec>"
+
+// FieldSource is where the value of a spec field comes from.
+type FieldSource struct {
+	// Path is the json path of the field, e.g boardConfig.partition_table.partitions[0].size
+	Path  string
+	Value string
+	// Source is the spec or the overlay file, relative to the device directory
+	Source string
+}
+
+// deviceDoc is the spec of a device as a doc, with the specs it extends and the overlays applied.
+type deviceDoc struct {
+	file     string
+	doc      interface{}
+	extends  bool
+	overlays []string
+	// json path -> source file
+	sources map[string]string
+}
+
+// loadDeviceDoc loads the config.json in deviceDir, with the specs it extends, and applies
+// the overlays.
+func loadDeviceDoc(deviceDir string) (*deviceDoc, error) {
+	specFile := filepath.Join(deviceDir, defaultConfigJSONName)
+	doc, sources, err := loadSpecDoc(specFile, deviceDir, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newDeviceDoc(specFile, doc, sources)
+	if d.overlays, err = overlayFiles(deviceDir, doc); err != nil {
+		return nil, err
+	}
+	for _, f := range d.overlays {
+		if err := d.apply(overlayPath(deviceDir, f)); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func newDeviceDoc(file string, doc interface{}, sources map[string]string) *deviceDoc {
+	d := &deviceDoc{file: file, doc: doc, sources: sources}
+	if root, ok := doc.(map[string]interface{}); ok {
+		_, d.extends = root["extends"]
+	}
+	return d
+}
+
+// overlayPath return the path of the overlay f, which is absolute or relative to deviceDir
+func overlayPath(deviceDir, f string) string {
+	if filepath.IsAbs(f) {
+		return f
+	}
+	return filepath.Join(deviceDir, f)
+}
+
+// overlayFiles return the overlays to apply, absolute or relative to deviceDir, see overlayPath
+func overlayFiles(deviceDir string, doc interface{}) ([]string, error) {
+	var files []string
+	if root, ok := doc.(map[string]interface{}); ok {
+		if list, ok := root["overlays"].([]interface{}); ok {
+			for _, f := range list {
+				if s, ok := f.(string); ok {
+					files = append(files, s)
+				}
+			}
+			return files, nil
+		}
+	}
+
+	// no explicit list, all the HAL overlays
+	matches, err := filepath.Glob(filepath.Join(deviceDir, halOverlayPrefix+"*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		files = append(files, filepath.Base(m))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// apply applies an overlay file to the doc
+func (d *deviceDoc) apply(file string) error {
+	data, err := readSpecFile(file)
+	if err != nil {
+		return err
+	}
+	patch, err := decodeDoc(file, data)
+	if err != nil {
+		return err
+	}
+
+	before := flattenDoc(d.doc, "")
+	name := filepath.Base(file)
+
+	switch p := patch.(type) {
+	case map[string]interface{}:
+		if strings.HasPrefix(name, halOverlayPrefix) {
+			if err := checkStrict(file, data, reflect.TypeOf(spec.HAL{})); err != nil {
+				return err
+			}
+			d.doc = applyHalOverlay(d.doc, p)
+		} else {
+			if err := checkUnknown(file, data, reflect.TypeOf(spec.Spec{})); err != nil {
+				return err
+			}
+			d.doc = mergePatch(d.doc, p)
+		}
+	case []interface{}:
+		if d.doc, err = jsonPatch(d.doc, p); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+	default:
+		return fmt.Errorf("%s: overlay must be a json object or array", file)
+	}
+
+	// the changed fields come from this overlay now
+	updateSources(d.sources, before, flattenDoc(d.doc, ""), name)
+	return nil
+}
+
+// spec decodes the doc, checking it strictly since the overlays could break it
+func (d *deviceDoc) spec() (*spec.Spec, error) {
+	data, err := encodeDoc(d.doc, reflect.TypeOf(spec.Spec{}))
+	if err != nil {
+		return nil, err
+	}
+	name := effectiveSpecName
+	if len(d.overlays) == 0 && !d.extends {
+		name = d.file
+	}
+	var s *spec.Spec
+	if err := strictDecode(name, data, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadDeviceSpec loads the config.json in the deviceDir with the specs it extends and all the
+// overlays applied.
+func LoadDeviceSpec(deviceDir string) (*spec.Spec, error) {
+	d, err := loadDeviceDoc(deviceDir)
+	if err != nil {
+		return nil, err
+	}
+	return d.spec()
+}
+
+// EffectiveSpec return the spec of the device with all the overlays applied, in json, and
+// where each field of it comes from, sorted by path.
+func EffectiveSpec(deviceDir string) ([]byte, []FieldSource, error) {
+	d, err := loadDeviceDoc(deviceDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := encodeDoc(d.doc, reflect.TypeOf(spec.Spec{}))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fields []FieldSource
+	for p, v := range flattenDoc(d.doc, "") {
+		fields = append(fields, FieldSource{Path: p, Value: v, Source: d.sources[p]})
+	}
+	sort.Slice(fields, func(i, j int) bool { return pathLess(fields[i].Path, fields[j].Path) })
+	return data, fields, nil
+}
+
+// pathLess orders json paths, with the list indexes in numeric order
+func pathLess(a, b string) bool {
+	split := func(p string) []string {
+		return strings.FieldsFunc(p, func(r rune) bool { return r == '.' || r == '[' || r == ']' })
+	}
+	as, bs := split(a), split(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		x, errx := strconv.Atoi(as[i])
+		y, erry := strconv.Atoi(bs[i])
+		if errx == nil && erry == nil {
+			return x < y
+		}
+		return as[i] < bs[i]
+	}
+	return len(as) < len(bs)
+}
+
+// flattenDoc return all the leaf values of the doc, by json path, encoded in json
+func flattenDoc(doc interface{}, path string) map[string]string {
+	leaves := map[string]string{}
+	var walk func(v interface{}, path string)
+	walk = func(v interface{}, path string) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			if len(t) == 0 {
+				leaves[path] = "{}"
+			}
+			for k, e := range t {
+				p := k
+				if path != "" {
+					p = path + "." + k
+				}
+				walk(e, p)
+			}
+		case []interface{}:
+			if len(t) == 0 {
+				leaves[path] = "[]"
+			}
+			for i, e := range t {
+				walk(e, fmt.Sprintf("%s[%d]", path, i))
+			}
+		default:
+			data, _ := json.Marshal(t)
+			leaves[path] = string(data)
+		}
+	}
+	walk(doc, path)
+	return leaves
+}
+
+// mergePatch applies the JSON merge patch to target and return the result, target is modified.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// applyHalOverlay replaces the HAL of the same name in doc with hal, or adds it
+func applyHalOverlay(doc interface{}, hal map[string]interface{}) interface{} {
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		root = map[string]interface{}{}
+	}
+	hals, _ := root["hals"].([]interface{})
+	for i, h := range hals {
+		if m, ok := h.(map[string]interface{}); ok && m["name"] == hal["name"] {
+			hals[i] = hal
+			return root
+		}
+	}
+	root["hals"] = append(hals, hal)
+	return root
+}
+
+// parsePointer splits the JSON pointer [1] into its reference tokens
+// [1] https://tools.ietf.org/html/rfc6901
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if ptr[0] != '/' {
+		return nil, fmt.Errorf("invalid json pointer %q", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex return the index of token in an array of size n, "-" is n when allowed
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if token == "-" && end {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > n || (i == n && !end) || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+// docGet return the value at the pointer tokens
+func docGet(doc interface{}, tokens []string) (interface{}, error) {
+	cur := doc
+	for _, t := range tokens {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("no attribute %q", t)
+			}
+			cur = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			cur = c[i]
+		default:
+			return nil, fmt.Errorf("can't find %q in a json value", t)
+		}
+	}
+	return cur, nil
+}
+
+// docUpdate calls fn with the container of the last token and return the new doc, the
+// container is replaced by what fn return
+func docUpdate(doc interface{}, tokens []string,
+	fn func(parent interface{}, last string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("can't change the whole document")
+	}
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("no attribute %q", tokens[0])
+		}
+		v, err := docUpdate(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[tokens[0]] = v
+		return c, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		v, err := docUpdate(c[i], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+		return c, nil
+	}
+	return nil, fmt.Errorf("can't find %q in a json value", tokens[0])
+}
+
+func docAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return docUpdate(doc, tokens, func(parent interface{}, last string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			c[last] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(last, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("can't add %q to a json value", last)
+	})
+}
+
+func docRemove(doc interface{}, tokens []string) (interface{}, error) {
+	return docUpdate(doc, tokens, func(parent interface{}, last string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := c[last]; !ok {
+				return nil, fmt.Errorf("no attribute %q", last)
+			}
+			delete(c, last)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(last, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("can't remove %q from a json value", last)
+	})
+}
+
+// jsonPatch applies the JSON Patch operations to doc and return the result, doc is modified.
+func jsonPatch(doc interface{}, ops []interface{}) (interface{}, error) {
+	for i, o := range ops {
+		op, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operation %d: not a json object", i)
+		}
+		name, _ := op["op"].(string)
+		path, _ := op["path"].(string)
+		tokens, err := parsePointer(path)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+		value, hasValue := op["value"]
+		from, _ := op["from"].(string)
+
+		switch name {
+		case "add":
+			if !hasValue {
+				err = fmt.Errorf("missing value")
+				break
+			}
+			doc, err = docAdd(doc, tokens, value)
+		case "remove":
+			doc, err = docRemove(doc, tokens)
+		case "replace":
+			if !hasValue {
+				err = fmt.Errorf("missing value")
+				break
+			}
+			if _, err = docGet(doc, tokens); err != nil {
+				break
+			}
+			if doc, err = docRemove(doc, tokens); err == nil {
+				doc, err = docAdd(doc, tokens, value)
+			}
+		case "move", "copy":
+			var ft []string
+			var v interface{}
+			if ft, err = parsePointer(from); err != nil {
+				break
+			}
+			if v, err = docGet(doc, ft); err != nil {
+				break
+			}
+			if name == "move" {
+				if doc, err = docRemove(doc, ft); err != nil {
+					break
+				}
+			} else {
+				// the copy must not share the structure with the original
+				v = copyDoc(v)
+			}
+			doc, err = docAdd(doc, tokens, v)
+		case "test":
+			var v interface{}
+			if v, err = docGet(doc, tokens); err == nil && !docEqual(v, value) {
+				err = fmt.Errorf("test failed")
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %s", i, name, path, err)
+		}
+	}
+	return doc, nil
+}
+
+// docEqual return true if the docs are equal, the numbers are compared by value, e.g 1
+// equals 1.0, as JSON Patch test does
+func docEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		rx, okx := new(big.Rat).SetString(string(x))
+		ry, oky := new(big.Rat).SetString(string(y))
+		if !okx || !oky {
+			return x == y
+		}
+		return rx.Cmp(ry) == 0
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !docEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !docEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// copyDoc return a deep copy of the doc
+func copyDoc(doc interface{}) interface{} {
+	switch t := doc.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = copyDoc(v)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, v := range t {
+			s[i] = copyDoc(v)
+		}
+		return s
+	}
+	return doc
+}
@@ -0,0 +1,53 @@
+package specconv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pierrchen/avs/vdts"
+)
+
+// GeneratePartitionTable writes the partition table of the device in deviceDir to outDir:
+// the sparse image of the storage with the partition tables only (gpt.img or mbr.img) to
+// flash, partition.xml and the parted script partition.sh.
+func GeneratePartitionTable(deviceDir, outDir string) error {
+	s, err := LoadDeviceSpec(deviceDir)
+	if err != nil {
+		return err
+	}
+	if s.BoardConfig == nil {
+		return fmt.Errorf("no boardConfig.partition_table")
+	}
+	l, err := vdts.PartitionLayout(s)
+	if err != nil {
+		return err
+	}
+
+	img, err := l.Image()
+	if err != nil {
+		return err
+	}
+	x, err := l.PartitionXML()
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{l.Scheme + ".img", img.Bytes(), 0644},
+		{"partition.xml", x, 0644},
+		{"partition.sh", []byte(l.PartedScript()), 0755},
+	}
+	for _, f := range files {
+		path := filepath.Join(outDir, f.name)
+		if err := ioutil.WriteFile(path, f.data, f.mode); err != nil {
+			return err
+		}
+		fmt.Println("generated", path)
+	}
+	return nil
+}
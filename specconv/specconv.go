@@ -2,11 +2,13 @@
 package specconv
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 
@@ -43,12 +45,13 @@ func InitDeviceConfig(vendor, device string, config string) error {
 
 	var spec *spec.Spec
 	var err error
+	var parent string
 	if config == "" {
 		spec, err = loadTemplateSpec()
 
 	} else {
-		f, _ := filepath.Abs(config)
-		spec, err = LoadSpec(f)
+		parent, _ = filepath.Abs(config)
+		spec, err = LoadSpec(parent)
 	}
 
 	if err != nil {
@@ -59,13 +62,17 @@ func InitDeviceConfig(vendor, device string, config string) error {
 
 	deviceDir, _ := filepath.Abs(filepath.Join(vendor, device))
 	f := filepath.Join(deviceDir, defaultConfigJSONName)
-	SaveSpecToJSON(spec, f)
+	if parent == "" {
+		SaveSpecToJSON(spec, f)
+	} else if err := saveExtendingSpec(spec, parent, f); err != nil {
+		return err
+	}
 
 	avsstate.GenDir = deviceDir
 	// no need to validate the spec, the default one is always valid
-	generateAll(spec, deviceDir)
-
-	avsstate.Update()
+	if _, err := generateAll(spec, deviceDir, UpdateOptions{}, nil); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -85,40 +92,263 @@ func enrichTemplateSpec(spec *spec.Spec, vendor, device string) {
 	spec.BoardConfig.SELinux.PolicyDir = filepath.Join("device", vendor, device, "sepolicy")
 }
 
-func generateAll(spec *spec.Spec, genDir string) error {
-	addProductSpecificFileMapping(spec)
+// saveExtendingSpec saves a spec extending the parent spec to path, with only what
+// enrichTemplateSpec changes
+func saveExtendingSpec(spec *spec.Spec, parent string, path string) error {
+	ref, err := filepath.Rel(filepath.Dir(path), parent)
+	if err != nil {
+		ref = parent
+	}
+	doc := map[string]interface{}{
+		"version": map[string]interface{}{"schema": spec.Version.Schema},
+		"extends": ref,
+		"product": map[string]interface{}{
+			"name":        spec.Product.Name,
+			"device":      spec.Product.Device,
+			"brand":       spec.Product.Brand,
+			"model":       spec.Product.Model,
+			"manufacture": spec.Product.Manufacture,
+		},
+		"boardConfig": map[string]interface{}{
+			"selinux": map[string]interface{}{"policyDir": spec.BoardConfig.SELinux.PolicyDir},
+		},
+		"boot_image": map[string]interface{}{
+			"kernel": map[string]interface{}{
+				"local_kernel": spec.BootImage.Kernel.LocalKernel,
+				"local_dtb":    spec.BootImage.Kernel.LocalDTB,
+			},
+		},
+	}
+	data, err := encodeDoc(doc, reflect.TypeOf(*spec))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
 
+// generatedFile is a file rendered from the spec
+type generatedFile struct {
+	// absolute path
+	path string
+	data []byte
+}
+
+// renderAll renders all the files generated from the spec in memory, nothing is written.
+func renderAll(spec *spec.Spec, genDir string) ([]generatedFile, error) {
 	// before generating, sort the hal spec by name
 	sort.Slice(spec.Hals, func(i, j int) bool {
 		return spec.Hals[i].Name < spec.Hals[j].Name
 	})
 
-	for file, tmpl := range tmlMap {
-		path := filepath.Join(genDir, file)
-		// we might need to create subdirectory under the genDir
-		err := os.MkdirAll(filepath.Dir(path), 0775)
+	var files []generatedFile
+	for _, f := range generationPlan(spec) {
+		tmpString, err := getContentForTempate(f.template)
 		if err != nil {
-			log.Printf("err: %s when create dir %s\n", filepath.Dir(path), err)
-			return err
+			log.Printf("faild to get template content for %s\n", f.template)
+			return nil, err
 		}
-		outFile, err := os.Create(path)
-		if err != nil {
-			log.Printf("err: %s faild to create %s\n", path, err)
-			return err
+		var buf bytes.Buffer
+		if err := executeTemplate(&buf, f.template, tmpString, f.spec); err != nil {
+			return nil, fmt.Errorf("%s: %s", f.path, err)
 		}
-		defer outFile.Close()
+		files = append(files, generatedFile{filepath.Join(genDir, f.path), buf.Bytes()})
+	}
+
+	rcs, err := renderRcScripts(spec, genDir)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, rcs...)
+	return files, nil
+}
+
+// FileChange is the change avs update makes to a generated file.
+type FileChange struct {
+	Path string
+	// Status is FileNew, FileModified, FileRemoved or FileUnchanged
+	Status string
+	// Diff is the unified diff of the change, "" if unchanged
+	Diff string
+	// Edited is true if the file was edited by hand since it was generated
+	Edited bool
+}
 
-		tmpString, err := getContentForTempate(tmpl)
+// status of the generated files
+const (
+	FileNew       = "new"
+	FileModified  = "modified"
+	FileRemoved   = "removed"
+	FileUnchanged = "unchanged"
+)
+
+// writeGenerated writes the files whose content is different from the one on disk, so that
+// the timestamp of the others doesn't change and trigger a rebuild. Nothing is written if
+// opts.DryRun. The hashes of the files are recorded in the avsstate, written as well, which
+// is left as it was if the files are rolled back.
+// The files generated last time, as recorded in prev, but not anymore, e.g the makefile of a
+// renamed product, are removed.
+// Nothing is written either if some files were edited by hand since the last generation,
+// as recorded in prev, unless opts.Force.
+func writeGenerated(files []generatedFile, genDir string, prev *AvsState, opts UpdateOptions,
+	check func() error) ([]FileChange, error) {
+	var changes []FileChange
+	var edited []string
+	olds := map[string][]byte{}
+	for _, f := range files {
+		rel, _ := filepath.Rel(genDir, f.path)
+		change := FileChange{Path: f.path, Status: FileUnchanged}
+
+		old, err := ioutil.ReadFile(f.path)
+		switch {
+		case os.IsNotExist(err):
+			change.Status = FileNew
+			change.Diff = utils.UnifiedDiff("/dev/null", "b/"+rel, nil, f.data)
+		case err != nil:
+			return changes, err
+		case fileHash(old) != fileHash(f.data):
+			change.Status = FileModified
+			change.Diff = utils.UnifiedDiff("a/"+rel, "b/"+rel, old, f.data)
+			change.Edited = editedByHand(prev, f.path, old)
+		}
+		if change.Edited {
+			edited = append(edited, f.path)
+			if !opts.Force {
+				printEdits(f.path, f.data, old)
+			}
+		}
+		olds[f.path] = old
+		changes = append(changes, change)
+	}
+	stale, err := staleFiles(files, genDir, prev)
+	if err != nil {
+		return changes, err
+	}
+	for _, path := range stale {
+		rel, _ := filepath.Rel(genDir, path)
+		old, err := ioutil.ReadFile(path)
 		if err != nil {
-			log.Printf("faild to get template content for %s\n", tmpl)
-			return err
+			return changes, err
+		}
+		change := FileChange{Path: path, Status: FileRemoved,
+			Diff:   utils.UnifiedDiff("a/"+rel, "/dev/null", old, nil),
+			Edited: editedByHand(prev, path, old)}
+		if change.Edited {
+			edited = append(edited, path)
+			if !opts.Force {
+				fmt.Printf("%s was edited by hand, it is not generated anymore\n", path)
+			}
 		}
-		executeTemplate(outFile, tmpl, tmpString, spec)
-		avsstate.GenereatedFiles = append(avsstate.GenereatedFiles, outFile.Name())
+		olds[path] = old
+		changes = append(changes, change)
 	}
 
-	generateRcScripts(spec, genDir)
-	return nil
+	if opts.DryRun {
+		return changes, nil
+	}
+	if len(edited) != 0 && !opts.Force {
+		return changes, &EditedError{Files: edited}
+	}
+
+	tx, err := newGenTxn(genDir)
+	if err != nil {
+		return changes, err
+	}
+	defer tx.close()
+
+	state := AvsState{GenDir: genDir, FileHashes: map[string]string{}}
+	for i, f := range files {
+		if changes[i].Edited {
+			fmt.Printf("%s was edited by hand, saved as %s\n", f.path, f.path+editedSuffix)
+			if err := tx.stage(f.path+editedSuffix, olds[f.path]); err != nil {
+				return changes, err
+			}
+		}
+		if changes[i].Status != FileUnchanged {
+			fmt.Printf("generate file %s\n", f.path)
+			if err := tx.stage(f.path, f.data); err != nil {
+				return changes, err
+			}
+		}
+		state.GenereatedFiles = append(state.GenereatedFiles, f.path)
+		state.FileHashes[f.path] = fileHash(f.data)
+	}
+	for _, c := range changes[len(files):] {
+		if c.Edited {
+			fmt.Printf("%s was edited by hand, saved as %s\n", c.Path, c.Path+editedSuffix)
+			if err := tx.stage(c.Path+editedSuffix, olds[c.Path]); err != nil {
+				return changes, err
+			}
+		}
+		fmt.Printf("remove file %s\n", c.Path)
+		if err := tx.remove(c.Path); err != nil {
+			return changes, err
+		}
+	}
+	data, err := state.data()
+	if err != nil {
+		return changes, err
+	}
+	if err := tx.stage(filepath.Join(genDir, avsStateFile), data); err != nil {
+		return changes, err
+	}
+
+	if err := tx.commit(); err != nil {
+		return changes, err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			if rerr := tx.rollback(); rerr != nil {
+				log.Printf("failed to restore the previous generation: %s\n", rerr)
+			}
+			return changes, err
+		}
+	}
+	avsstate = state
+	return changes, nil
+}
+
+// staleFiles return the files generated last time, as recorded in prev, which still exist
+// but are not generated anymore
+func staleFiles(files []generatedFile, genDir string, prev *AvsState) ([]string, error) {
+	if prev == nil {
+		return nil, nil
+	}
+	current := map[string]bool{}
+	for _, f := range files {
+		current[f.path] = true
+	}
+	var stale []string
+	for _, path := range prev.GenereatedFiles {
+		// only remove what is in the genDir, the state might be tampered
+		rel, err := filepath.Rel(genDir, path)
+		if err != nil || current[path] || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		current[path] = true
+		stale = append(stale, path)
+	}
+	return stale, nil
+}
+
+// generateAll generates all the files from the spec and the avsstate, the unchanged files are
+// not written. The files are updated all together or not at all: if any of them fails, or
+// check, called once they are all updated, return error, the previous ones are restored.
+func generateAll(spec *spec.Spec, genDir string, opts UpdateOptions, check func() error) ([]FileChange, error) {
+	files, err := renderAll(spec, genDir)
+	if err != nil {
+		return nil, err
+	}
+	prev, err := LoadAvsState(genDir)
+	if err != nil {
+		return nil, err
+	}
+	return writeGenerated(files, genDir, prev, opts, check)
 }
 
 func getContentForTempate(template string) (string, error) {
@@ -133,6 +363,7 @@ func getContentForTempate(template string) (string, error) {
 		tplFstab:          tmpl.Fstab,
 		tplUsbRc:          tmpl.Usb,
 		tplInitRc:         tmpl.Initrc,
+		tplDtbo:           tmpl.Dtbo,
 	}
 
 	return m[template], nil
@@ -146,7 +377,7 @@ func getContentForTempate(template string) (string, error) {
 	// return string(tmpString), nil
 }
 
-func generateRcScripts(s *spec.Spec, genDir string) error {
+func renderRcScripts(s *spec.Spec, genDir string) ([]generatedFile, error) {
 
 	var scripts []spec.RcScripts
 
@@ -159,128 +390,129 @@ func generateRcScripts(s *spec.Spec, genDir string) error {
 		}
 	}
 
+	var files []generatedFile
 	for _, rc := range scripts {
 		// use rc.File directly, don't generate
 		// TODO: add validator
 		if rc.File == "" && rc.Name != "" {
-			path := filepath.Join(genDir, rc.Name)
-			outFile, err := os.Create(path)
-			if err != nil {
-				log.Printf("faild to create %s", path)
-				return err
+			var buf bytes.Buffer
+			if err := executeTemplateForRc(&buf, &rc); err != nil {
+				return nil, fmt.Errorf("%s: %s", rc.Name, err)
 			}
-			defer outFile.Close()
-			executeTemplateForRc(outFile, &rc)
-			avsstate.GenereatedFiles = append(avsstate.GenereatedFiles, outFile.Name())
+			files = append(files, generatedFile{filepath.Join(genDir, rc.Name), buf.Bytes()})
 		}
 	}
-	return nil
+	return files, nil
 }
 
-// ValdiateDeviceConfig validate the default config file in the path as specified by absGenDir
-func ValdiateDeviceConfig(absGenDir string) (err error) {
-	specFile := filepath.Join(absGenDir, defaultConfigJSONName)
-	spec, err := LoadSpec(specFile)
+// ValdiateDeviceConfig validate the default config file in the path as specified by absGenDir,
+// with the overlays applied.
+// The report lists all the problems found, error is non nil if any of them is an error.
+// The config file failing to load is reported as "schema" errors.
+func ValdiateDeviceConfig(absGenDir string) (*vdts.Report, error) {
+	spec, err := LoadDeviceSpec(absGenDir)
 	if err != nil {
-		log.Fatalln(err)
+		return loadErrorReport(filepath.Join(absGenDir, defaultConfigJSONName), err), err
 	}
 
-	pass := true
-
-	spec = override(spec, absGenDir)
-
-	if err = vdts.ValdiateSpec(spec, absGenDir); err != nil {
-		pass = false
-	}
-
-	if pass == false {
-		return fmt.Errorf("validation failed")
-	}
-	return nil
+	return vdts.ValdiateSpec(spec, absGenDir)
 }
 
-func hasHal(spec *spec.Spec, name string) (int, bool) {
-	for i, hal := range spec.Hals {
-		if hal.Name == name {
-			return i, true
-		}
-	}
-	return -1, false
-}
-
-// Find the overlay file in the dir and override it.
-// If there is already a corresponding feature spec in the spec passed in,
-// the new one will override it; otherwise, the new one will be added.
-// The overlay file follow the format of `ol.hal.[hw.halFeature].json`,
-// 1. "ol." is used to indicate it is an overlay file;
-// 2. "hal." indicates it is hal overlay, the only support overlay at the moment.
-// 3. [hw.halFeature] can be anything but a good practice is is hw for the device name,
-// halFeature for the exactly hal feature, say hikey.wifi. This enable us to do autoload
-// or/and validation.
-// 4. ".json" is to make the file easy to work with editor.
-func override(spec *spec.Spec, dir string) *spec.Spec {
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return spec
-	}
-
-	for _, f := range files {
-		if strings.HasPrefix(filepath.Base(f.Name()), "ol.hal.") {
-			halSpec, err := LoadHalSpec(f.Name())
-			if err != nil {
-				fmt.Printf("Fail to load hal override spec %s\n", f.Name())
-				break
-			}
-			fmt.Printf("Loading overlay spec %s\n", filepath.Base(f.Name()))
-			index, has := hasHal(spec, halSpec.Name)
-			if has {
-				spec.Hals[index] = *halSpec
-			} else {
-				spec.Hals = append(spec.Hals, *halSpec)
-			}
-
-		}
-	}
-
-	return spec
+// UpdateOptions are the options of UpdateDeviceConfigs.
+type UpdateOptions struct {
+	// DryRun prints the files that would change and the diff, nothing is written
+	DryRun bool
+	// Force overwrites the generated files even if they were edited by hand
+	Force bool
 }
 
 // UpdateDeviceConfigs updates the device configrations.
-// There must be already a config.json in path. Everthing will be regenerated at the moment.
-// TODO: rengerate only the things that changed for rebuild performance, especiall the stuff in
-// BoardConfig.mk
-func UpdateDeviceConfigs(deviceDir string) error {
-
-	specFile := filepath.Join(deviceDir, defaultConfigJSONName)
-	spec, err := LoadSpec(specFile)
+// There must be already a config.json in path. Everything is regenerated, but only the files
+// whose content changes are written, so that the build system doesn't rebuild what it
+// doesn't need to.
+func UpdateDeviceConfigs(deviceDir string, opts UpdateOptions) error {
 
+	spec, err := LoadDeviceSpec(deviceDir)
 	if err != nil {
-		fmt.Printf("err loading the spec file %s", specFile)
-		return fmt.Errorf("err loading the spec file %s", specFile)
+		fmt.Println(err)
+		return fmt.Errorf("err loading the spec file %s", filepath.Join(deviceDir, defaultConfigJSONName))
 	}
 
-	spec = override(spec, deviceDir)
-
-	err = vdts.ValdiateSpec(spec, deviceDir)
+	report, err := vdts.ValdiateSpec(spec, deviceDir, vdts.StagePreGen)
+	if werr := report.Write(os.Stdout, vdts.FormatText); werr != nil {
+		return fmt.Errorf("failed to write the validation report: %s", werr)
+	}
 
 	if err != nil {
 		fmt.Println("spec validation failed, please fix the errors first")
 		return fmt.Errorf("spec validation failed, please fix the errors first")
 	}
 
-	generateAll(spec, deviceDir)
+	// the generated files are rolled back if they fail the validation
+	validate := func() error {
+		report, err := vdts.ValdiateSpec(spec, deviceDir, vdts.StagePostGen)
+		if werr := report.Write(os.Stdout, vdts.FormatText); werr != nil {
+			return fmt.Errorf("failed to write the validation report: %s", werr)
+		}
+		if err != nil {
+			return fmt.Errorf("generated files validation failed, previous files restored")
+		}
+		return nil
+	}
+	changes, err := generateAll(spec, deviceDir, opts, validate)
+	if err != nil {
+		return err
+	}
 
-	avsstate.Update()
+	if opts.DryRun {
+		printChanges(changes)
+	}
 	return nil
 }
 
-// CleanDeviceConfigs clean up all the genereated files
-func CleanDeviceConfigs(deviceDir string) error {
+// printChanges prints the files that would change and how
+func printChanges(changes []FileChange) {
+	n := 0
+	for _, c := range changes {
+		if c.Edited {
+			fmt.Printf("%-9s %s (edited by hand)\n", c.Status, c.Path)
+			n++
+		} else if c.Status != FileUnchanged {
+			fmt.Printf("%-9s %s\n", c.Status, c.Path)
+			n++
+		}
+	}
+	fmt.Printf("%d file(s) would change, %d unchanged\n", n, len(changes)-n)
+	for _, c := range changes {
+		if c.Diff != "" {
+			fmt.Print("\n" + c.Diff)
+		}
+	}
+}
+
+// CleanDeviceConfigs clean up all the genereated files.
+// The files edited by hand since generated are not deleted unless force, see EditedError.
+func CleanDeviceConfigs(deviceDir string, force bool) error {
 	state, err := LoadAvsState(deviceDir)
-	if err != nil {
+	if err != nil || state == nil {
 		return err
 	}
 
+	var edited []string
+	for _, f := range state.GenereatedFiles {
+		if data, err := ioutil.ReadFile(f); err == nil && editedByHand(state, f, data) {
+			edited = append(edited, f)
+			if force {
+				if err := saveEdited(f, data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(edited) != 0 && !force {
+		return &EditedError{Files: edited}
+	}
+
 	for _, f := range state.GenereatedFiles {
 		os.Remove(f)
 	}
@@ -1,14 +1,18 @@
 package specconv
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/pierrchen/avs/images"
 	"github.com/pierrchen/avs/spec"
+	"github.com/pierrchen/avs/tmpl"
 	"github.com/pierrchen/avs/vdts"
 	"github.com/stretchr/testify/assert"
 )
@@ -258,3 +262,792 @@ func dirExists(path string) (bool, error) {
 	}
 	return true, err
 }
+
+func TestValidateReport(t *testing.T) {
+	spec, err := LoadSpec("../testFixtures/config.json")
+	assert.Nil(t, err)
+
+	// drop the cache partition
+	pt := &spec.BoardConfig.PartitionTable
+	pt.Partitions = pt.Partitions[:len(pt.Partitions)-1]
+
+	report, err := vdts.ValdiateSpec(spec, ".")
+	assert.NotNil(t, err, "missing partition should fail the validation")
+	assert.True(t, report.HasErrors())
+
+	var rules []string
+	for _, d := range report.Diagnostics {
+		rules = append(rules, d.Rule)
+	}
+	assert.Contains(t, rules, "partitions")
+	assert.Contains(t, rules, "fstab-mounts")
+}
+
+func TestValidateRuleConfig(t *testing.T) {
+	s, err := LoadSpec("../testFixtures/config.json")
+	assert.Nil(t, err)
+
+	pt := &s.BoardConfig.PartitionTable
+	pt.Partitions = pt.Partitions[:len(pt.Partitions)-1]
+	s.Validation = &spec.Validation{Rules: map[string]string{
+		"partitions":          "off",
+		"fstab-mounts":        "warning",
+		"hal-runtime-configs": "off",
+	}}
+
+	report, err := vdts.ValdiateSpec(s, ".", vdts.StagePreGen)
+	assert.Nil(t, err, "the failing rules are disabled or downgraded")
+	for _, d := range report.Diagnostics {
+		assert.NotEqual(t, "partitions", d.Rule)
+		if d.Rule == "fstab-mounts" {
+			assert.Equal(t, vdts.SeverityWarning, d.Severity)
+		}
+	}
+}
+
+func TestLoadSpecStrict(t *testing.T) {
+	f, _ := ioutil.TempFile("", "avs")
+	defer os.Remove(f.Name())
+
+	// a typo in version and the missing product
+	ioutil.WriteFile(f.Name(), []byte(`{
+    "version": {
+        "schema": "0.2",
+        "andriod": "Android O"
+    },
+    "boardConfig": null,
+    "boot_image": null,
+    "hals": null
+}`), 0644)
+
+	_, err := LoadSpec(f.Name())
+	assert.NotNil(t, err)
+	se, ok := err.(*StrictError)
+	assert.True(t, ok, "should be a StrictError")
+	assert.Equal(t, []string{
+		f.Name() + `:4:9: version: unknown field "andriod"`,
+		f.Name() + `:2:16: version: missing required field "android"`,
+		f.Name() + `:1:1: <root>: missing required field "product"`,
+	}, se.Problems)
+}
+
+func TestValidateLoadError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, defaultConfigJSONName)
+
+	ioutil.WriteFile(config, []byte(`{
+    "version": {
+        "schema": "0.2",
+        "andriod": "Android O"
+    },
+    "boardConfig": null,
+    "boot_image": null,
+    "hals": null
+}`), 0644)
+	report, err := ValdiateDeviceConfig(dir)
+	assert.NotNil(t, err)
+	assert.True(t, report.HasErrors())
+	assert.Equal(t, 3, len(report.Diagnostics))
+	assert.Equal(t, vdts.Diagnostic{Severity: vdts.SeverityError, Rule: "schema", Path: "version",
+		Message: `unknown field "andriod"`, File: config, Line: 4, Column: 9}, report.Diagnostics[0])
+	assert.Equal(t, "", report.Diagnostics[2].Path)
+
+	var buf bytes.Buffer
+	assert.Nil(t, report.Write(&buf, vdts.FormatText))
+	assert.True(t, strings.HasPrefix(buf.String(),
+		`config.json:4:9: error: version: unknown field "andriod" [schema]`+"\n"))
+	buf.Reset()
+	assert.Nil(t, report.Write(&buf, vdts.FormatSARIF))
+	assert.True(t, strings.Contains(buf.String(), `"startLine": 4`))
+
+	// a syntax error
+	ioutil.WriteFile(config, []byte("{\n    \"version\": }"), 0644)
+	report, err = ValdiateDeviceConfig(dir)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(report.Diagnostics))
+	assert.Equal(t, 2, report.Diagnostics[0].Line)
+}
+
+func TestMigrate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	s.Overlays = []string{"ol.eng.json", "ol.lda.json"}
+	data, _ := json.MarshalIndent(s, "", "    ")
+
+	// make it look like a 0.1 config
+	old := strings.Replace(string(data), `"schema": "0.2"`, `"schema": "0.1"`, 1)
+	old = strings.Replace(old, `"policyDir": "auto set when avs s"`,
+		`"policyDir": "auto set when avs s", "version": "26.0"`, 1)
+	old = strings.Replace(old, `"boot_image": {`, `"boot_image": {
+        "args": {"load_addresses": {"load_base": "0x0", "ramkdisk_offset": "0x2000000", "kernel_offset": "0x80000"}},`, 1)
+	config := filepath.Join(dir, defaultConfigJSONName)
+	ioutil.WriteFile(config, []byte(old), 0644)
+	// 0.1 overlays, a merge patch and a json patch
+	ioutil.WriteFile(filepath.Join(dir, "ol.eng.json"),
+		[]byte(`{"boardConfig": {"selinux": {"version": "27.0"}}}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "ol.lda.json"), []byte(`[
+		{"op": "replace", "path": "/boot_image/args/load_addresses/ramkdisk_offset", "value": "0x3000000"},
+		{"op": "add", "path": "/boot_image/args/load_addresses", "value": {"load_base": "0x0", "ramkdisk_offset": "0x4000000", "kernel_offset": "0x80000"}}
+	]`), 0644)
+
+	_, err = LoadSpec(config)
+	assert.NotNil(t, err, "old schema should be rejected")
+
+	results, err := MigrateDeviceConfigs(dir, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, 3, len(results[0].Changes))
+	assert.Equal(t, config+".0.1.bak", results[0].Backup)
+	assert.Equal(t, 1, len(results[1].Changes))
+	assert.Equal(t, 2, len(results[2].Changes))
+
+	migrated, err := LoadSpec(config)
+	assert.Nil(t, err)
+	assert.Equal(t, "0x2000000", migrated.BootImage.Args.Lda.RamdiskOffset)
+	assert.Equal(t, "26.0", migrated.Manifest.SEPolicyVersion)
+	migrated, err = LoadDeviceSpec(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "0x4000000", migrated.BootImage.Args.Lda.RamdiskOffset)
+	assert.Equal(t, "27.0", migrated.Manifest.SEPolicyVersion)
+
+	// nothing to do the 2nd time
+	results, err = MigrateDeviceConfigs(dir, false)
+	assert.Nil(t, err)
+	for _, r := range results {
+		assert.Equal(t, 0, len(r.Changes), r.File)
+	}
+
+	// a json patch value can't move a field out of it
+	var ops []interface{}
+	json.Unmarshal([]byte(`[{"op": "add", "path": "/boardConfig/selinux", "value": {"version": "27.0"}}]`), &ops)
+	_, err = migrateJSONPatchOps(ops, migrations[0].Renames)
+	assert.NotNil(t, err)
+}
+
+func TestMigrateExtends(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	// a 0.1 parent in the library
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	data, _ := json.MarshalIndent(s, "", "    ")
+	old := strings.Replace(string(data), `"schema": "0.2"`, `"schema": "0.1"`, 1)
+	old = strings.Replace(old, `"policyDir": "auto set when avs s"`,
+		`"policyDir": "auto set when avs s", "version": "26.0"`, 1)
+	parent := filepath.Join(dir, "library", "hi3798cv200.json")
+	os.MkdirAll(filepath.Dir(parent), 0755)
+	ioutil.WriteFile(parent, []byte(old), 0644)
+	os.Setenv("AVS_LIBRARY", filepath.Join(dir, "library"))
+	defer os.Unsetenv("AVS_LIBRARY")
+
+	// a 0.2 child
+	board := filepath.Join(dir, "poplar")
+	os.MkdirAll(board, 0755)
+	config := filepath.Join(board, defaultConfigJSONName)
+	ioutil.WriteFile(config, []byte(`{
+    "version": {"schema": "0.2"},
+    "extends": "hi3798cv200",
+    "product": {"name": "poplar"}
+}`), 0644)
+
+	_, err = LoadDeviceSpec(board)
+	assert.NotNil(t, err, "old parent schema should be rejected")
+
+	results, err := MigrateDeviceConfigs(board, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, config, results[0].File)
+	assert.Equal(t, 0, len(results[0].Changes))
+	assert.Equal(t, parent, results[1].File)
+	assert.Equal(t, "0.1", results[1].From)
+	assert.Equal(t, 2, len(results[1].Changes))
+	assert.Equal(t, parent+".0.1.bak", results[1].Backup)
+	assert.Equal(t, old, string(readFile(results[1].Backup)))
+
+	migrated, err := LoadDeviceSpec(board)
+	assert.Nil(t, err)
+	assert.Equal(t, "poplar", migrated.Product.Name)
+	assert.Equal(t, "26.0", migrated.Manifest.SEPolicyVersion)
+}
+
+func TestOverlay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	s.Overlays = []string{"ol.eng.json", "ol.size.json", "ol.hal.keymaster.json"}
+	SaveSpecToJSON(s, filepath.Join(dir, defaultConfigJSONName))
+
+	// merge patch, a json object
+	ioutil.WriteFile(filepath.Join(dir, "ol.eng.json"),
+		[]byte(`{"boot_image": {"kernel": {"cmd_line": "console=ttyAMA0 androidboot.selinux=permissive"}}}`), 0644)
+	// json patch, a json array
+	ioutil.WriteFile(filepath.Join(dir, "ol.size.json"), []byte(`[
+		{"op": "test", "path": "/boardConfig/partition_table/partitions/1/name", "value": "userdata"},
+		{"op": "replace", "path": "/boardConfig/partition_table/partitions/1/size", "value": "1024"}
+	]`), 0644)
+	// hal overlay
+	ioutil.WriteFile(filepath.Join(dir, "ol.hal.keymaster.json"),
+		[]byte(`{"name": "keymaster", "required_packages": {"build": ["keystore.poplar"]}}`), 0644)
+
+	spec, err := LoadDeviceSpec(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "console=ttyAMA0 androidboot.selinux=permissive", spec.BootImage.Kernel.CmdLine)
+	assert.Equal(t, "1024", string(spec.BoardConfig.PartitionTable.Partitions[1].Size))
+	assert.Equal(t, "5456789504", string(s.BoardConfig.PartitionTable.Partitions[1].Size))
+	assert.Equal(t, []string{"keystore.poplar"}, spec.Hals[0].Packages.Build)
+	assert.Equal(t, len(s.Hals), len(spec.Hals))
+
+	_, fields, err := EffectiveSpec(dir)
+	assert.Nil(t, err)
+	sources := map[string]string{}
+	for _, f := range fields {
+		sources[f.Path] = f.Source
+	}
+	assert.Equal(t, "ol.eng.json", sources["boot_image.kernel.cmd_line"])
+	assert.Equal(t, "ol.size.json", sources["boardConfig.partition_table.partitions[1].size"])
+	assert.Equal(t, "config.json", sources["boardConfig.partition_table.partitions[0].size"])
+	assert.Equal(t, "ol.hal.keymaster.json", sources["hals[0].required_packages.build[0]"])
+
+	// unknown attribute in an overlay
+	ioutil.WriteFile(filepath.Join(dir, "ol.eng.json"), []byte(`{"boot_image": {"kernal": {}}}`), 0644)
+	_, err = LoadDeviceSpec(dir)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), `boot_image: unknown field "kernal"`))
+
+	// a failed test op
+	ioutil.WriteFile(filepath.Join(dir, "ol.eng.json"), []byte(`{}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "ol.size.json"),
+		[]byte(`[{"op": "test", "path": "/boardConfig/partition_table/partitions/1/name", "value": "cache"}]`), 0644)
+	_, err = LoadDeviceSpec(dir)
+	assert.NotNil(t, err)
+
+	// an overlay outside the device dir
+	shared, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(shared)
+	ioutil.WriteFile(filepath.Join(shared, "ol.shared.json"),
+		[]byte(`{"product": {"brand": "shared"}}`), 0644)
+	s.Overlays = []string{filepath.Join(shared, "ol.shared.json")}
+	SaveSpecToJSON(s, filepath.Join(dir, defaultConfigJSONName))
+	spec, err = LoadDeviceSpec(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "shared", spec.Product.Brand)
+
+	// numbers are tested by value
+	doc, _ := decodeDoc("doc", []byte(`{"a": 1, "b": [1e2, {"c": 0.5}]}`))
+	for _, c := range []struct {
+		ops  string
+		fail bool
+	}{
+		{`[{"op": "test", "path": "/a", "value": 1.0}]`, false},
+		{`[{"op": "test", "path": "/b", "value": [100, {"c": 5e-1}]}]`, false},
+		{`[{"op": "test", "path": "/a", "value": 2}]`, true},
+		{`[{"op": "test", "path": "/a", "value": "1"}]`, true},
+	} {
+		ops, _ := decodeDoc("ops", []byte(c.ops))
+		_, err := jsonPatch(copyDoc(doc), ops.([]interface{}))
+		assert.Equal(t, c.fail, err != nil, c.ops)
+	}
+}
+
+func TestMultiProduct(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	s.Product.Name = "poplar"
+	s.Product.Packages = []string{"Launcher3"}
+	s.Products = []spec.ProductOverride{
+		{Name: "poplar", BuildVariants: []string{"eng", "userdebug"}},
+		{Name: "poplar_tv", Model: "poplar tv", Packages: []string{"TvSettings"},
+			Properties: []string{"ro.product.type=tv"}, BuildVariants: []string{"user"}},
+	}
+
+	_, err = generateAll(s, dir, UpdateOptions{}, nil)
+	assert.Nil(t, err)
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "AndroidProducts.mk"))
+	assert.Equal(t, `
+PRODUCT_MAKEFILES := \
+	$(LOCAL_DIR)/poplar.mk \
+	$(LOCAL_DIR)/poplar_tv.mk
+`, string(data))
+
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "vendorsetup.sh"))
+	assert.Equal(t, `
+
+add_lunch_combo poplar-eng
+add_lunch_combo poplar-userdebug
+add_lunch_combo poplar_tv-user
+`, string(data))
+
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "poplar_tv.mk"))
+	mk := string(data)
+	assert.True(t, strings.Contains(mk, "PRODUCT_NAME := poplar_tv\n"))
+	assert.True(t, strings.Contains(mk, "PRODUCT_MODEL := poplar tv\n"))
+	assert.True(t, strings.Contains(mk, "PRODUCT_PACKAGES += \\\n    Launcher3 \\\n    TvSettings \\\n"))
+	assert.True(t, strings.Contains(mk, "PRODUCT_PROPERTY_OVERRIDES += \\\n    ro.product.type=tv \\\n"))
+
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "poplar.mk"))
+	assert.False(t, strings.Contains(string(data), "TvSettings"))
+}
+
+func TestRemoveStale(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	s.Product.Name = "poplar"
+	_, err = generateAll(s, dir, UpdateOptions{}, nil)
+	assert.Nil(t, err)
+	old := filepath.Join(dir, "poplar.mk")
+	_, err = os.Stat(old)
+	assert.Nil(t, err)
+
+	s.Product.Name = "hikey"
+	changes, err := generateAll(s, dir, UpdateOptions{DryRun: true}, nil)
+	assert.Nil(t, err)
+	removed := 0
+	for _, c := range changes {
+		if c.Status == FileRemoved {
+			assert.Equal(t, old, c.Path)
+			removed++
+		}
+	}
+	assert.Equal(t, 1, removed)
+	_, err = os.Stat(old)
+	assert.Nil(t, err)
+
+	// edited by hand, kept unless forced
+	ioutil.WriteFile(old, []byte("edited"), 0644)
+	_, err = generateAll(s, dir, UpdateOptions{}, nil)
+	_, ok := err.(*EditedError)
+	assert.True(t, ok)
+	_, err = os.Stat(old)
+	assert.Nil(t, err)
+
+	// restored on rollback
+	_, err = generateAll(s, dir, UpdateOptions{Force: true}, func() error { return fmt.Errorf("check failed") })
+	assert.NotNil(t, err)
+	assert.Equal(t, "edited", string(readFile(old)))
+
+	_, err = generateAll(s, dir, UpdateOptions{Force: true}, nil)
+	assert.Nil(t, err)
+	_, err = os.Stat(old)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "edited", string(readFile(old+editedSuffix)))
+	_, err = os.Stat(filepath.Join(dir, "hikey.mk"))
+	assert.Nil(t, err)
+
+	state, err := LoadAvsState(dir)
+	assert.Nil(t, err)
+	for _, f := range state.GenereatedFiles {
+		assert.NotEqual(t, old, f)
+	}
+}
+
+func TestExtends(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	// the overlay of the parent isn't applied to the child
+	s.Overlays = []string{"ol.eng.json"}
+	os.MkdirAll(filepath.Join(dir, "library", "hi3798cv200"), 0755)
+	SaveSpecToJSON(s, filepath.Join(dir, "library", "hi3798cv200", defaultConfigJSONName))
+	ioutil.WriteFile(filepath.Join(dir, "library", "hi3798cv200", "ol.eng.json"),
+		[]byte(`{"product": {"brand": "eng"}}`), 0644)
+
+	board := filepath.Join(dir, "poplar")
+	os.MkdirAll(board, 0755)
+	ioutil.WriteFile(filepath.Join(board, defaultConfigJSONName), []byte(`{
+    "version": {"schema": "0.2"},
+    "extends": "hi3798cv200",
+    "product": {"name": "poplar"},
+    "boardConfig": {
+        "partition_table": {
+            "partitions": [
+                {"name": "userdata", "size": "1024"},
+                {"name": "vendor", "type": "ext4", "size": "2048"}
+            ]
+        }
+    },
+    "hals": [
+        {"name": "keymaster", "required_packages": null},
+        {"name": "wifi"}
+    ]
+}`), 0644)
+
+	os.Setenv("AVS_LIBRARY", filepath.Join(dir, "library"))
+	defer os.Unsetenv("AVS_LIBRARY")
+
+	spec, err := LoadSpec(filepath.Join(board, defaultConfigJSONName))
+	assert.Nil(t, err)
+	assert.Equal(t, "poplar", spec.Product.Name)
+	assert.Equal(t, s.Product.Brand, spec.Product.Brand)
+
+	pt := spec.BoardConfig.PartitionTable.Partitions
+	assert.Equal(t, len(s.BoardConfig.PartitionTable.Partitions)+1, len(pt))
+	assert.Equal(t, "1024", string(pt[1].Size))
+	assert.Equal(t, "ext4", string(pt[1].Type))
+	assert.Equal(t, "vendor", pt[len(pt)-1].Name)
+
+	assert.Equal(t, len(s.Hals)+1, len(spec.Hals))
+	assert.Nil(t, spec.Hals[0].Packages)
+	assert.Equal(t, "wifi", spec.Hals[len(spec.Hals)-1].Name)
+
+	_, fields, err := EffectiveSpec(board)
+	assert.Nil(t, err)
+	sources := map[string]string{}
+	for _, f := range fields {
+		sources[f.Path] = f.Source
+	}
+	assert.Equal(t, "config.json", sources["product.name"])
+	assert.Equal(t, "../library/hi3798cv200/config.json", sources["product.brand"])
+	assert.Equal(t, "", sources["overlays[0]"])
+	spec, err = LoadDeviceSpec(board)
+	assert.Nil(t, err)
+	assert.Equal(t, s.Product.Brand, spec.Product.Brand)
+	assert.Equal(t, 0, len(spec.Overlays))
+
+	// a cycle
+	ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"extends": "b.json"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte(`{"extends": "./a.json"}`), 0644)
+	_, err = LoadSpec(filepath.Join(dir, "a.json"))
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "extends cycle"))
+}
+
+func TestIncrementalGenerate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	changes, err := generateAll(s, dir, UpdateOptions{}, nil)
+	assert.Nil(t, err)
+	for _, c := range changes {
+		assert.Equal(t, FileNew, c.Status)
+		assert.Equal(t, avsstate.FileHashes[c.Path], fileHash(readFile(c.Path)))
+	}
+
+	changes, err = generateAll(s, dir, UpdateOptions{}, nil)
+	assert.Nil(t, err)
+	for _, c := range changes {
+		assert.Equal(t, FileUnchanged, c.Status, c.Path)
+	}
+
+	// only the product mk changes, and nothing is written in dry run
+	s.Product.Model = "poplar 2"
+	mk := filepath.Join(dir, s.Product.Name+".mk")
+	before := readFile(mk)
+	changes, err = generateAll(s, dir, UpdateOptions{DryRun: true}, nil)
+	assert.Nil(t, err)
+	for _, c := range changes {
+		if c.Path == mk {
+			assert.Equal(t, FileModified, c.Status)
+			assert.True(t, strings.Contains(c.Diff, "+PRODUCT_MODEL := poplar 2\n"))
+		} else {
+			assert.Equal(t, FileUnchanged, c.Status, c.Path)
+		}
+	}
+	assert.Equal(t, before, readFile(mk))
+}
+
+func readFile(path string) []byte {
+	data, _ := ioutil.ReadFile(path)
+	return data
+}
+
+func TestHandEdited(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	_, err = generateAll(s, dir, UpdateOptions{}, nil)
+	assert.Nil(t, err)
+
+	deviceMk := filepath.Join(dir, "device.mk")
+	edited := append(readFile(deviceMk), []byte("PRODUCT_PACKAGES += busybox\n")...)
+	ioutil.WriteFile(deviceMk, edited, 0644)
+
+	// unchanged spec, nothing to overwrite
+	_, err = generateAll(s, dir, UpdateOptions{}, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{deviceMk}, err.(*EditedError).Files)
+	assert.Equal(t, edited, readFile(deviceMk))
+
+	err = CleanDeviceConfigs(dir, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, edited, readFile(deviceMk))
+
+	changes, err := generateAll(s, dir, UpdateOptions{Force: true}, nil)
+	assert.Nil(t, err)
+	for _, c := range changes {
+		assert.Equal(t, c.Path == deviceMk, c.Edited)
+	}
+	assert.Equal(t, edited, readFile(deviceMk+editedSuffix))
+	assert.False(t, strings.Contains(string(readFile(deviceMk)), "busybox"))
+
+	assert.Nil(t, CleanDeviceConfigs(dir, false))
+	_, err = os.Stat(deviceMk)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGenerateRollback(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	_, err = generateAll(s, dir, UpdateOptions{}, nil)
+	assert.Nil(t, err)
+
+	mk := filepath.Join(dir, s.Product.Name+".mk")
+	before, state := readFile(mk), readFile(filepath.Join(dir, avsStateFile))
+	entries, _ := ioutil.ReadDir(dir)
+	hashes := map[string]string{}
+	for k, v := range avsstate.FileHashes {
+		hashes[k] = v
+	}
+
+	// a new file, one in a new directory and a changed one, all undone by the failed check
+	s.Product.Model = "poplar 2"
+	s.Products = []spec.ProductOverride{{Name: s.Product.Name}, {Name: "poplar_tv"}}
+	s.BoardConfig.USBGadget = &spec.USBGadget{}
+	_, err = generateAll(s, dir, UpdateOptions{}, func() error {
+		assert.True(t, strings.Contains(string(readFile(mk)), "poplar 2"))
+		return fmt.Errorf("validation failed")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, before, readFile(mk))
+	assert.Equal(t, state, readFile(filepath.Join(dir, avsStateFile)))
+	_, err = os.Stat(filepath.Join(dir, "poplar_tv.mk"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "rootfs"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, hashes, avsstate.FileHashes)
+
+	// no staging or backup left
+	after, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, len(entries), len(after))
+}
+
+func TestGenerateDtbo(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	s.BootImage.Dtbo = &spec.Dtbo{PageSize: "4K", Entries: []spec.DtboEntry{
+		{File: "$(LOCAL_PATH)/board.dtbo", ID: "1"},
+		{File: "out/board-b.dtbo", ID: "2", Rev: "0x10", Custom: []string{"3", "4"}},
+	}}
+	// the overlays are only read when building, not by avs update
+	_, err = generateAll(s, dir, UpdateOptions{}, nil)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "dtbo.img"))
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, strings.Contains(string(readFile(filepath.Join(dir, "BoardConfig.mk"))),
+		"BOARD_PREBUILT_DTBOIMAGE = $(TARGET_OUT_INTERMEDIATES)/DTBO_OBJ/dtbo.img\n"))
+	assert.Equal(t, `LOCAL_PATH := $(call my-dir)
+
+AVS_DTBO_FILES := \
+    $(LOCAL_PATH)/board.dtbo \
+    out/board-b.dtbo
+
+AVS_DTBO_ARGS := --page_size=4096 \
+    $(LOCAL_PATH)/board.dtbo --id=1 \
+    out/board-b.dtbo --id=2 --rev=0x10 --custom0=3 --custom1=4
+
+$(BOARD_PREBUILT_DTBOIMAGE): $(AVS_DTBO_FILES) $(MKDTIMG)
+	mkdir -p $(dir $@)
+	$(MKDTIMG) create $@ $(AVS_DTBO_ARGS)
+`, string(readFile(filepath.Join(dir, "AndroidBoard.mk"))))
+
+	// no dtbo, no rule
+	s.BootImage.Dtbo = nil
+	_, err = generateAll(s, dir, UpdateOptions{}, nil)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "AndroidBoard.mk"))
+	assert.True(t, os.IsNotExist(err))
+	assert.False(t, strings.Contains(string(readFile(filepath.Join(dir, "BoardConfig.mk"))), "DTBOIMAGE"))
+}
+
+// testExt4 return the head of an ext4 image of size bytes
+func testExt4(size int) []byte {
+	data := make([]byte, size)
+	data[1024+0x38], data[1024+0x39] = 0x53, 0xef
+	data[1024+0x60] = 0x40
+	return data
+}
+
+func TestCheckImages(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	os.Mkdir(out, 0755)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	s.BoardConfig.PartitionTable.Partitions[0].Size = "0x4000"
+	SaveSpecToJSON(s, filepath.Join(dir, defaultConfigJSONName))
+
+	// system is sparse
+	system, err := images.NewSparseImage(testExt4(0x4000), 4096)
+	assert.Nil(t, err)
+	ioutil.WriteFile(filepath.Join(out, "system.img"), system.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(out, "userdata.img"), testExt4(0x4000), 0644)
+	ioutil.WriteFile(filepath.Join(out, "cache.img"), testExt4(0x4000), 0644)
+	args := images.DefaultBootImgArgs()
+	args.Kernel = []byte("kernel")
+	args.CmdLine = getFullKernelCommand(s) + " buildvariant=eng"
+	boot, err := args.Build()
+	assert.Nil(t, err)
+	ioutil.WriteFile(filepath.Join(out, "boot.img"), boot, 0644)
+
+	report, err := CheckImages(dir, out)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(report.Diagnostics))
+
+	// too large, not ext4, and not built
+	s.BoardConfig.PartitionTable.Partitions[0].Size = "0x3000"
+	SaveSpecToJSON(s, filepath.Join(dir, defaultConfigJSONName))
+	ioutil.WriteFile(filepath.Join(out, "userdata.img"), []byte("hsqs"), 0644)
+	os.Remove(filepath.Join(out, "cache.img"))
+	// while the boot image is built with the default args and cmdline
+	s.BootImage.Args = &spec.MkBootImageArgs{PageSize: "4096",
+		Lda: &spec.MkBootImageLoadArgsLoadAddress{LoadBase: "0x0", KernelOffset: "0x80000", RamdiskOffset: "0x2000000"}}
+	s.BootImage.Kernel.CmdLine = "console=ttyAMA0,115200"
+	SaveSpecToJSON(s, filepath.Join(dir, defaultConfigJSONName))
+
+	report, err = CheckImages(dir, out)
+	assert.NotNil(t, err)
+	var rules []string
+	for _, d := range report.Diagnostics {
+		rules = append(rules, d.Rule+" "+d.Path)
+	}
+	assert.Equal(t, []string{
+		"bootimg-args boot_image.args.page_size",
+		"bootimg-args boot_image.args.load_addresses",
+		"bootimg-args boot_image.args.load_addresses",
+		"bootimg-args boot_image.kernel.cmd_line",
+		"image-fs-type boardConfig.partition_table.partitions[1].type",
+		"image-missing boardConfig.partition_table.partitions[2]",
+		"image-size boardConfig.partition_table.partitions[0].size",
+	}, rules)
+	assert.True(t, strings.Contains(report.Diagnostics[3].Message, "misses console=ttyAMA0,115200"))
+	assert.Equal(t, vdts.SeverityWarning, report.Diagnostics[5].Severity)
+
+	// the severities can be changed as the other rules
+	s.Validation = &spec.Validation{Rules: map[string]string{"bootimg-args": "off", "image-fs-type": "warning"}}
+	SaveSpecToJSON(s, filepath.Join(dir, defaultConfigJSONName))
+	ioutil.WriteFile(filepath.Join(dir, ".avsrc"), []byte(`{"rules": {"image-missing": "off"}}`), 0644)
+	report, err = CheckImages(dir, out)
+	assert.NotNil(t, err)
+	rules = nil
+	for _, d := range report.Diagnostics {
+		rules = append(rules, d.Severity.String()+" "+d.Rule)
+	}
+	assert.Equal(t, []string{"warning image-fs-type", "error image-size"}, rules)
+}
+
+func TestPartitionTable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "avs")
+	defer os.RemoveAll(dir)
+
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	pt := &s.BoardConfig.PartitionTable
+	pt.Scheme, pt.FlashBockSize, pt.StorageSize = spec.GPT, "0x100000", "0x200000000"
+	SaveSpecToJSON(s, filepath.Join(dir, defaultConfigJSONName))
+
+	assert.Nil(t, GeneratePartitionTable(dir, dir))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "gpt.img"))
+	assert.Nil(t, err)
+	img, err := images.ParseSparse(data)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0x200000000), img.Size())
+	x, err := ioutil.ReadFile(filepath.Join(dir, "partition.xml"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(x), `<partition label="userdata" start_lba="2099200" num_sectors="10657792"`))
+	sh, err := ioutil.ReadFile(filepath.Join(dir, "partition.sh"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(sh), "parted -s \"$1\" mklabel gpt\n"))
+
+	// doesn't fit in the storage
+	pt.StorageSize = "0x100000000"
+	report, err := vdts.ValdiateSpec(s, dir, vdts.StagePreGen)
+	assert.NotNil(t, err)
+	var found bool
+	for _, d := range report.Diagnostics {
+		if d.Rule == "partition-layout" {
+			found = true
+			assert.True(t, strings.Contains(d.Message, "larger than the storage of 4294967296 bytes"))
+		}
+	}
+	assert.True(t, found)
+
+	// gpt needs the storage size for the backup GPT
+	pt.StorageSize = ""
+	report, err = vdts.ValdiateSpec(s, dir, vdts.StagePreGen)
+	assert.NotNil(t, err)
+	found = false
+	for _, d := range report.Diagnostics {
+		if d.Rule == "partition-layout" {
+			found = true
+			assert.Equal(t, "boardConfig.partition_table.storage_size", d.Path)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestPartitionSizes(t *testing.T) {
+	s, err := LoadSpecFromString(DefaultSpec)
+	assert.Nil(t, err)
+	pt := &s.BoardConfig.PartitionTable
+	pt.FlashBockSize = "128K"
+	pt.Partitions[0].Size = "1G"
+	pt.Partitions[1].Size = "0x140000000"
+	pt.Partitions[2].Size = "256 MiB"
+
+	// always in bytes in BoardConfig.mk
+	var out bytes.Buffer
+	assert.Nil(t, executeTemplate(&out, "BoardConfig.mk", tmpl.Boardconfig, s))
+	for _, line := range []string{
+		"BOARD_FLASH_BLOCK_SIZE := 131072",
+		"BOARD_SYSTEMIMAGE_PARTITION_SIZE := 1073741824",
+		"BOARD_USERDATAIMAGE_PARTITION_SIZE := 5368709120",
+		"BOARD_CACHEIMAGE_PARTITION_SIZE := 268435456",
+	} {
+		assert.True(t, strings.Contains(out.String(), line), line)
+	}
+	report, err := vdts.ValdiateSpec(s, "", vdts.StagePreGen)
+	for _, d := range report.Diagnostics {
+		assert.False(t, strings.HasPrefix(d.Rule, "partition-"), d.String())
+	}
+
+	// invalid, unaligned and too small
+	pt.Partitions[0].Size = "1X"
+	pt.Partitions[1].Size = "1000000000"
+	pt.Partitions[2].Size = "1M"
+	report, err = vdts.ValdiateSpec(s, "", vdts.StagePreGen)
+	assert.NotNil(t, err)
+	rules := map[string]string{}
+	for _, d := range report.Diagnostics {
+		rules[d.Path] = d.Rule
+	}
+	assert.Equal(t, "partition-sizes", rules["boardConfig.partition_table.partitions[0].size"])
+	assert.Equal(t, "partition-sizes", rules["boardConfig.partition_table.partitions[1].size"])
+	assert.Equal(t, "partition-min-sizes", rules["boardConfig.partition_table.partitions[2].size"])
+}
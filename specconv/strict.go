@@ -0,0 +1,282 @@
+package specconv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pierrchen/avs/spec"
+	"github.com/pierrchen/avs/vdts"
+)
+
+// StrictError lists all the schema errors found in a config file.
+type StrictError struct {
+	File     string
+	Problems []string
+}
+
+func (e *StrictError) Error() string {
+	return fmt.Sprintf("%s has %d schema error(s):\n%s",
+		e.File, len(e.Problems), strings.Join(e.Problems, "\n"))
+}
+
+// strictChecker walks the json tokens alongside the go type they decode into, and
+// reports the unknown attributes and the missing required ones, with their position.
+type strictChecker struct {
+	file string
+	data []byte
+	dec  *json.Decoder
+	errs []string
+	// partial data, e.g an overlay, the required attributes aren't checked
+	partial bool
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkStrict checks the json data to be decoded into a value of type t.
+// file is only used in the error messages.
+func checkStrict(file string, data []byte, t reflect.Type) error {
+	return check(file, data, t, false)
+}
+
+// checkUnknown checks the json data to be merged into a value of type t, it is checkStrict
+// without the required attributes.
+func checkUnknown(file string, data []byte, t reflect.Type) error {
+	return check(file, data, t, true)
+}
+
+func check(file string, data []byte, t reflect.Type, partial bool) error {
+	c := &strictChecker{file: file, data: data, dec: json.NewDecoder(bytes.NewReader(data)), partial: partial}
+	if err := c.value(t, ""); err != nil {
+		return c.syntaxError(err)
+	}
+	if len(c.errs) != 0 {
+		return &StrictError{File: file, Problems: c.errs}
+	}
+	return nil
+}
+
+// strictDecode checks the data then decodes it into v, it is the strict version of json.Unmarshal
+func strictDecode(file string, data []byte, v interface{}) error {
+	if err := checkStrict(file, data, reflect.TypeOf(v)); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return decodeError(file, data, err)
+	}
+	return nil
+}
+
+// position return the line:column of the offset in data, both start with 1
+func position(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	col := offset - int64(bytes.LastIndexByte(data[:offset], '\n'))
+	return fmt.Sprintf("%d:%d", line, col)
+}
+
+// decodeError adds the position to the json decoding errors
+func decodeError(file string, data []byte, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("%s:%s: %s", file, position(data, e.Offset), e)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("%s:%s: %s: can't use json %s as %s",
+			file, position(data, e.Offset), e.Field, e.Value, e.Type)
+	}
+	return fmt.Errorf("%s: %s", file, err)
+}
+
+// positionRe matches the errors with a position, file:line:column: message
+var positionRe = regexp.MustCompile(`(?s)^(.+?):(\d+):(\d+): (.*)$`)
+
+// loadErrorReport return the report of the error loading the spec source, it has an error
+// diagnostic of rule "schema" for each problem, with the position of it if known
+func loadErrorReport(source string, err error) *vdts.Report {
+	r := vdts.NewReport(source)
+	problems := []string{err.Error()}
+	e, strict := err.(*StrictError)
+	if strict {
+		problems = e.Problems
+	}
+	for _, p := range problems {
+		d := vdts.Diagnostic{Severity: vdts.SeverityError, Rule: "schema", Message: p}
+		if m := positionRe.FindStringSubmatch(p); m != nil {
+			d.File, d.Message = m[1], m[4]
+			d.Line, _ = strconv.Atoi(m[2])
+			d.Column, _ = strconv.Atoi(m[3])
+			// the strict problems are path: message
+			if i := strings.Index(d.Message, ": "); strict && i > 0 {
+				if path := d.Message[:i]; path != "<root>" {
+					d.Path = path
+				}
+				d.Message = d.Message[i+2:]
+			}
+		}
+		r.Add(d)
+	}
+	return r
+}
+
+func (c *strictChecker) syntaxError(err error) error {
+	if _, ok := err.(*json.SyntaxError); ok {
+		return decodeError(c.file, c.data, err)
+	}
+	return fmt.Errorf("%s:%s: %s", c.file, position(c.data, c.dec.InputOffset()), err)
+}
+
+// next return the offset of the next token
+func (c *strictChecker) next() int64 {
+	off := c.dec.InputOffset()
+	for off < int64(len(c.data)) {
+		switch c.data[off] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			off++
+			continue
+		}
+		break
+	}
+	return off
+}
+
+func (c *strictChecker) errorf(offset int64, path, format string, args ...interface{}) {
+	if path == "" {
+		path = "<root>"
+	}
+	c.errs = append(c.errs, fmt.Sprintf("%s:%s: %s: %s",
+		c.file, position(c.data, offset), path, fmt.Sprintf(format, args...)))
+}
+
+// skip skips the rest of the value which begins with token tok
+func (c *strictChecker) skip(tok json.Token) error {
+	d, ok := tok.(json.Delim)
+	if !ok || d == '}' || d == ']' {
+		return nil
+	}
+	for depth := 1; depth > 0; {
+		t, err := c.dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := t.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+	}
+	return nil
+}
+
+func (c *strictChecker) value(t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	start := c.next()
+	tok, err := c.dec.Token()
+	if err != nil {
+		return err
+	}
+
+	// custom types and wrong types are left to json decoder
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return c.skip(tok)
+	}
+	d, isDelim := tok.(json.Delim)
+
+	switch {
+	case t.Kind() == reflect.Struct && isDelim && d == '{':
+		return c.object(t, path, start)
+	case t.Kind() == reflect.Map && isDelim && d == '{':
+		for c.dec.More() {
+			key, err := c.dec.Token()
+			if err != nil {
+				return err
+			}
+			if err := c.value(t.Elem(), fmt.Sprintf("%s.%s", path, key)); err != nil {
+				return err
+			}
+		}
+		_, err := c.dec.Token()
+		return err
+	case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && isDelim && d == '[':
+		for i := 0; c.dec.More(); i++ {
+			if err := c.value(t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		_, err := c.dec.Token()
+		return err
+	}
+	return c.skip(tok)
+}
+
+// object checks the attributes of a json object decoded into struct t, the '{' is consumed.
+func (c *strictChecker) object(t reflect.Type, path string, start int64) error {
+	type field struct {
+		t        reflect.Type
+		required bool
+		seen     bool
+	}
+	fields := map[string]*field{}
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		name, req, ok := spec.JSONField(t.Field(i))
+		if !ok {
+			continue
+		}
+		fields[name] = &field{t: t.Field(i).Type, required: req}
+		names = append(names, name)
+	}
+
+	join := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+
+	for c.dec.More() {
+		keyOff := c.next()
+		tok, err := c.dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		f, ok := fields[key]
+		if !ok {
+			c.errorf(keyOff, path, "unknown field %q", key)
+			vt, err := c.dec.Token()
+			if err != nil {
+				return err
+			}
+			if err := c.skip(vt); err != nil {
+				return err
+			}
+			continue
+		}
+		f.seen = true
+		if err := c.value(f.t, join(key)); err != nil {
+			return err
+		}
+	}
+	// the closing '}'
+	if _, err := c.dec.Token(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if f := fields[name]; f.required && !f.seen && !c.partial {
+			c.errorf(start, path, "missing required field %q", name)
+		}
+	}
+	return nil
+}
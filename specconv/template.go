@@ -2,8 +2,10 @@ package specconv
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/pierrchen/avs/utils"
 )
 
+// tmlMap is the device level files and their template, the same for all the products
 var tmlMap = map[string]string{
 	"vendorsetup.sh":     tplVendorSetup,
 	"AndroidProducts.mk": tplAndriodProduct,
@@ -32,6 +35,7 @@ const (
 	tplFstab          string = "fstab.tpl"
 	tplUsbRc          string = "usb.tpl"
 	tplInitRc         string = "initrc.tpl"
+	tplDtbo           string = "dtbo.tpl"
 )
 
 const (
@@ -59,34 +63,66 @@ func getGenFileName(name string) string {
 	return name + ".gen"
 }
 
-// called by GenerateScaffold to setup product specfic file and template mapping
-func addProductSpecificFileMapping(spec *spec.Spec) {
-	productMK := fmt.Sprintf("%s.mk", spec.Product.Name)
-	tmlMap[productMK] = tplProduct
+// genFile is a file to generate from the template with the spec
+type genFile struct {
+	path     string
+	template string
+	spec     *spec.Spec
+}
+
+// generationPlan return all the files to generate for the spec, sorted by path.
+// Each product has its own <product>.mk, generated with a copy of the spec whose Product
+// is that product, the other files are shared by all the products.
+func generationPlan(s *spec.Spec) []genFile {
+	files := map[string]string{}
+	for file, tmpl := range tmlMap {
+		files[file] = tmpl
+	}
 
 	// uevent.rc
-	rc := spec.BootImage.Rootfs.UeventRc
+	rc := s.BootImage.Rootfs.UeventRc
 	if rc.File == "" {
 		ueventRc := rc.Name
 		if ueventRc == "" {
 			ueventRc = getGenFileName("ueventd.rc")
 		}
-		tmlMap[ueventRc] = tplUevent
+		files[ueventRc] = tplUevent
 	}
 
 	// fstab.hw
-	fs := spec.BootImage.Rootfs.Fstab
-	fileName := "fstab." + spec.Product.Name
+	fs := s.BootImage.Rootfs.Fstab
+	fileName := "fstab." + s.Product.Name
 	if fs.Name != "" {
 		fileName = fs.Name
 	}
-	tmlMap[fileName] = tplFstab
+	files[fileName] = tplFstab
 
 	// init.hw.usb.rc
-	if spec.BoardConfig.USBGadget != nil {
-		usbRcFile := fmt.Sprintf("rootfs/init.%s.usb.rc", spec.Product.Name)
-		tmlMap[usbRcFile] = tplUsbRc
+	if s.BoardConfig.USBGadget != nil {
+		usbRcFile := fmt.Sprintf("rootfs/init.%s.usb.rc", s.Product.Name)
+		files[usbRcFile] = tplUsbRc
+	}
+
+	// AndroidBoard.mk, the rule building dtbo.img
+	if s.BootImage.Dtbo != nil {
+		files["AndroidBoard.mk"] = tplDtbo
 	}
+
+	var plan []genFile
+	for file, tmpl := range files {
+		plan = append(plan, genFile{path: file, template: tmpl, spec: s})
+	}
+
+	// <product>.mk
+	for _, p := range s.AllProducts() {
+		ps := *s
+		product := p
+		ps.Product = &product
+		plan = append(plan, genFile{path: p.Name + ".mk", template: tplProduct, spec: &ps})
+	}
+
+	sort.Slice(plan, func(i, j int) bool { return plan[i].path < plan[j].path })
+	return plan
 }
 
 // hardcoded by Android framework and used the Android Device configure files
@@ -207,10 +243,8 @@ func RuntimeConfigInstructions(config spec.RuntimeConfig) string {
 	return from + ":" + dst
 }
 
-func generate(tmpl *template.Template, f *os.File, data interface{}) error {
-	// TODO: remove the genDir from the f.Name()
-	fmt.Printf("generate file %s\n", f.Name())
-	return tmpl.Execute(f, data)
+func generate(tmpl *template.Template, w io.Writer, data interface{}) error {
+	return tmpl.Execute(w, data)
 }
 
 // UserImageExt4 return true if any of the user images (system, cache, userdata) is
@@ -272,7 +306,7 @@ func executeTemplate2(f *os.File, tmpName string, tmpContent string, spec *spec.
 	return nil
 }
 
-func executeTemplate(out *os.File, tmpName string, tmpContent string, spec *spec.Spec) (err error) {
+func executeTemplate(out io.Writer, tmpName string, tmpContent string, spec *spec.Spec) (err error) {
 	funcMap := template.FuncMap{
 		"ToUpper":                   strings.ToUpper,
 		"FeatureFileSrcDir":         getFeatureFileSrcDir,
@@ -302,7 +336,7 @@ func executeTemplate(out *os.File, tmpName string, tmpContent string, spec *spec
 }
 
 // executeTemplateForRc genereate Rcscript only
-func executeTemplateForRc(f *os.File, rc *spec.RcScripts) (err error) {
+func executeTemplateForRc(f io.Writer, rc *spec.RcScripts) (err error) {
 	funcMap := template.FuncMap{}
 
 	tmpl, err := template.New(tplInitRc).Funcs(funcMap).Parse(tmpl.Initrc)
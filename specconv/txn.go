@@ -0,0 +1,172 @@
+package specconv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// genTxn updates the generated files as a whole, or not at all.
+// The new files are written to a staging directory first, then renamed into the device
+// directory one by one, the files they replace are moved to a backup directory. If anything
+// goes wrong, the backup is moved back so the device directory is as before.
+// Both the staging and backup directory are in the device directory so that the renames
+// are atomic, i.e on the same file system.
+type genTxn struct {
+	genDir  string
+	staging string
+	backup  string
+	// the staged files, relative to genDir
+	staged []string
+	// the files to remove, relative to genDir
+	removed []string
+	// the files renamed into genDir, in order
+	swapped []swappedFile
+	// the directories created in genDir for them, the parents first
+	created []string
+}
+
+type swappedFile struct {
+	rel string
+	// there was a file replaced, moved to the backup dir
+	replaced bool
+}
+
+func newGenTxn(genDir string) (*genTxn, error) {
+	staging, err := ioutil.TempDir(genDir, ".avs-staging-")
+	if err != nil {
+		return nil, err
+	}
+	backup, err := ioutil.TempDir(genDir, ".avs-backup-")
+	if err != nil {
+		os.RemoveAll(staging)
+		return nil, err
+	}
+	return &genTxn{genDir: genDir, staging: staging, backup: backup}, nil
+}
+
+// stage writes the file to the staging directory, path is absolute and in the genDir
+func (t *genTxn) stage(path string, data []byte) error {
+	rel, err := filepath.Rel(t.genDir, path)
+	if err != nil {
+		return err
+	}
+	staged := filepath.Join(t.staging, rel)
+	if err := os.MkdirAll(filepath.Dir(staged), 0775); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(staged, data, 0644); err != nil {
+		return err
+	}
+	t.staged = append(t.staged, rel)
+	return nil
+}
+
+// remove records the file to remove on commit, path is absolute and in the genDir
+func (t *genTxn) remove(path string) error {
+	rel, err := filepath.Rel(t.genDir, path)
+	if err != nil {
+		return err
+	}
+	t.removed = append(t.removed, rel)
+	return nil
+}
+
+// commit moves the staged files into the genDir and the removed ones to the backup
+// directory, it rolls back on error
+func (t *genTxn) commit() error {
+	for _, rel := range t.staged {
+		if err := t.swap(rel); err != nil {
+			t.rollback()
+			return err
+		}
+	}
+	for _, rel := range t.removed {
+		if err := t.backupFile(rel); err != nil {
+			t.rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdirAll creates the directory and the missing parents, as os.MkdirAll does, and records
+// the ones created
+func (t *genTxn) mkdirAll(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		missing = append([]string{d}, missing...)
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	t.created = append(t.created, missing...)
+	return nil
+}
+
+func (t *genTxn) swap(rel string) error {
+	target := filepath.Join(t.genDir, rel)
+	// we might need to create subdirectory under the genDir
+	if err := t.mkdirAll(filepath.Dir(target)); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(target); err == nil {
+		if err := t.backupFile(rel); err != nil {
+			return err
+		}
+	} else {
+		t.swapped = append(t.swapped, swappedFile{rel: rel})
+	}
+	// recorded before the rename, so the backup is restored even if the rename fails
+	return os.Rename(filepath.Join(t.staging, rel), target)
+}
+
+// backupFile moves the file in the genDir to the backup directory, it is moved back on rollback
+func (t *genTxn) backupFile(rel string) error {
+	bak := filepath.Join(t.backup, rel)
+	if err := os.MkdirAll(filepath.Dir(bak), 0775); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(t.genDir, rel), bak); err != nil {
+		return err
+	}
+	t.swapped = append(t.swapped, swappedFile{rel: rel, replaced: true})
+	return nil
+}
+
+// rollback restores the files replaced, in reverse order, and removes the new ones and the
+// directories created for them
+func (t *genTxn) rollback() error {
+	var first error
+	for i := len(t.swapped) - 1; i >= 0; i-- {
+		s := t.swapped[i]
+		target := filepath.Join(t.genDir, s.rel)
+		var err error
+		if s.replaced {
+			err = os.Rename(filepath.Join(t.backup, s.rel), target)
+		} else if err = os.Remove(target); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	t.swapped = nil
+	for i := len(t.created) - 1; i >= 0; i-- {
+		if err := os.Remove(t.created[i]); err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+	t.created = nil
+	return first
+}
+
+// close removes the staging and backup directory, after commit or rollback
+func (t *genTxn) close() {
+	os.RemoveAll(t.staging)
+	os.RemoveAll(t.backup)
+}
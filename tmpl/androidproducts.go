@@ -2,8 +2,8 @@ package tmpl
 
 // Androidproducts is the template for AndroidProducts.mk
 const Androidproducts = `
-{{- with .Product}}
-PRODUCT_MAKEFILES := \
+PRODUCT_MAKEFILES :=
+{{- range .AllProducts}} \
 	$(LOCAL_DIR)/{{- .Name -}}.mk
 {{- end}}
 `
@@ -4,9 +4,9 @@ package tmpl
 const Boardconfig = `{{ $spec := .}}
 
 {{with .BoardConfig}}
-BOARD_FLASH_BLOCK_SIZE := {{.PartitionTable.FlashBockSize}}
+BOARD_FLASH_BLOCK_SIZE := {{.PartitionTable.FlashBockSize.Canonical}}
 {{range .PartitionTable.Partitions }}
-BOARD_{{.Name | ToUpper}}IMAGE_PARTITION_SIZE := {{.Size}}
+BOARD_{{.Name | ToUpper}}IMAGE_PARTITION_SIZE := {{.Size.Canonical}}
 BOARD_{{.Name | ToUpper}}IMAGE_FILE_SYSTEM_TYPE := {{.Type}}
 {{end }}
 
@@ -98,5 +98,10 @@ BOARD_MKBOOTIMG_ARGS = --base {{.Lda.LoadBase}} --kernel_offset {{.Lda.KernelOff
 {{- end}}
 {{- end}}
 
+{{- if $spec.BootImage.Dtbo}}
+# built by the rule in AndroidBoard.mk
+BOARD_PREBUILT_DTBOIMAGE = $(TARGET_OUT_INTERMEDIATES)/DTBO_OBJ/dtbo.img
+{{- end}}
+
 TARGET_COPY_OUT_VENDOR := {{ .BoardConfig.PartitionTable | getVendorOut }}
 `
@@ -0,0 +1,19 @@
+package tmpl
+
+// Dtbo is the template for AndroidBoard.mk, the rule building the BOARD_PREBUILT_DTBOIMAGE
+// with mkdtimg, so that it is rebuilt whenever the overlays are
+const Dtbo = `
+{{- with .BootImage.Dtbo -}}
+LOCAL_PATH := $(call my-dir)
+
+AVS_DTBO_FILES :={{range .Entries}} \
+    {{.File}}{{end}}
+
+AVS_DTBO_ARGS :={{with .PageSize}} --page_size={{.Canonical}}{{end}}{{range .Entries}} \
+    {{.File}}{{with .ID}} --id={{.}}{{end}}{{with .Rev}} --rev={{.}}{{end}}{{range $i, $c := .Custom}} --custom{{$i}}={{$c}}{{end}}{{end}}
+
+$(BOARD_PREBUILT_DTBOIMAGE): $(AVS_DTBO_FILES) $(MKDTIMG)
+	mkdir -p $(dir $@)
+	$(MKDTIMG) create $@ $(AVS_DTBO_ARGS)
+{{- end}}
+`
@@ -24,5 +24,12 @@ const Manifest = `<manifest version="1.0" type="device">
 {{- end}}
 {{- end}}
 {{- end}}
+{{- if .Manifest}}
+{{- if .Manifest.SEPolicyVersion}}
+    <sepolicy>
+        <version>{{ .Manifest.SEPolicyVersion }}</version>
+    </sepolicy>
+{{- end}}
+{{- end}}
 </manifest>
 `
@@ -15,6 +15,22 @@ PRODUCT_BRAND := {{.Brand}}
 PRODUCT_MODEL := {{.Model}}
 PRODUCT_MANUFACTURER := {{.Manufacture}}
 
+{{- if .Packages}}
+
+PRODUCT_PACKAGES += \
+{{- range .Packages}}
+    {{.}} \
+{{- end}}
+{{- end}}
+
+{{- if .Properties}}
+
+PRODUCT_PROPERTY_OVERRIDES += \
+{{- range .Properties}}
+    {{.}} \
+{{- end}}
+{{- end}}
+
 DEVICE_PACKAGE_OVERLAYS := device/{{- .Manufacture -}}/{{- .Device -}}/overlay
 
 # automatically called
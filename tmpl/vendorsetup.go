@@ -2,6 +2,10 @@ package tmpl
 
 // Vendorsetup is the template for vendorsetup.mk
 const Vendorsetup = `
-{{with .Product}}
-add_lunch_combo {{ .Name -}}-eng
-{{end}}`
+{{range .AllProducts}}
+{{- $name := .Name}}
+{{- range .ProductVariants}}
+add_lunch_combo {{ $name -}}-{{- .}}
+{{- end}}
+{{- end}}
+`
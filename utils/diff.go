@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around the changes in a hunk
+const diffContext = 3
+
+type diffOp struct {
+	// ' ' unchanged, '-' deleted from a, '+' added from b
+	kind byte
+	// the line in a and b, for '+' a is the line it's inserted before, same for '-' and b
+	a, b int
+}
+
+// splitLines splits text into lines, each keeps its "\n"
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines return the shortest edit script from a to b, using the longest common subsequence
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', i, j})
+			i++
+			j++
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', i, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', i, j})
+			j++
+		}
+	}
+	return ops
+}
+
+// hunkRange formats the start,count of a hunk header, the start is 1 based
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// UnifiedDiff return the diff from a to b in the unified format, as `diff -u` does, it is
+// "" if a and b are the same. aName and bName are the names in the header. Binary files,
+// with a NUL byte, are only said to differ.
+func UnifiedDiff(aName, bName string, a, b []byte) string {
+	if string(a) == string(b) {
+		return ""
+	}
+	if bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(b, 0) >= 0 {
+		return fmt.Sprintf("Binary files %s and %s differ\n", aName, bName)
+	}
+	al, bl := splitLines(string(a)), splitLines(string(b))
+	ops := diffLines(al, bl)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// a hunk begins with the context before the first change, and ends with the context
+		// after the last change not followed by another one within 2*diffContext lines
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		i = end
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		var aCount, bCount int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(ops[start].a, aCount), hunkRange(ops[start].b, bCount))
+
+		for _, op := range ops[start:end] {
+			line := ""
+			switch op.kind {
+			case '+':
+				line = bl[op.b]
+			default:
+				line = al[op.a]
+			}
+			out.WriteByte(op.kind)
+			out.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return out.String()
+}
+
+// AddedLines return the lines added in b by the diff from a to b, without the "\n"
+func AddedLines(a, b []byte) []string {
+	bl := splitLines(string(b))
+	var added []string
+	for _, op := range diffLines(splitLines(string(a)), bl) {
+		if op.kind == '+' {
+			added = append(added, strings.TrimSuffix(bl[op.b], "\n"))
+		}
+	}
+	return added
+}
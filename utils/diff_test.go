@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n"
+	b := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n17\n"
+
+	assert.Equal(t, "", UnifiedDiff("a", "b", []byte(a), []byte(a)))
+	assert.Equal(t, `--- a
++++ b
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+@@ -14,3 +14,4 @@
+ 14
+ 15
+ 16
++17
+`, UnifiedDiff("a", "b", []byte(a), []byte(b)))
+
+	assert.Equal(t, `--- a
++++ b
+@@ -0,0 +1 @@
++x
+\ No newline at end of file
+`, UnifiedDiff("a", "b", nil, []byte("x")))
+
+	assert.Equal(t, "Binary files a and b differ\n", UnifiedDiff("a", "b", []byte("x\x00"), []byte("y\x00")))
+}
@@ -0,0 +1,297 @@
+package vdts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Severity is how serious a Diagnostic is.
+type Severity int
+
+// valid severities, from the least to the most serious
+const (
+	// SeverityOff is only used to disable a rule, no diagnostic has it.
+	SeverityOff Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityError
+)
+
+var severityNames = map[Severity]string{
+	SeverityOff:     "off",
+	SeverityInfo:    "info",
+	SeverityWarning: "warning",
+	SeverityError:   "error",
+}
+
+func (s Severity) String() string {
+	if n, ok := severityNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// MarshalJSON encodes the severity as its name.
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// sarifLevel maps the severity to the SARIF result level
+func (s Severity) sarifLevel() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+	return "note"
+}
+
+// Diagnostic is a single problem found by a validator.
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	// Rule is the ID of the rule reporting it, e.g "partitions"
+	Rule string `json:"rule"`
+	// Path is the JSON path into the spec, e.g hals[3].init.rc[0].name
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+	// Hint tells how to fix it, optional
+	Hint string `json:"hint,omitempty"`
+	// File, Line and Column are where it is in the config files, for the problems found
+	// loading them, optional. File is the report Source if empty.
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+func (d Diagnostic) String() string {
+	s := d.Severity.String() + ": "
+	if d.Path != "" {
+		s += d.Path + ": "
+	}
+	s += d.Message + " [" + d.Rule + "]"
+	if d.Hint != "" {
+		s += "\n    hint: " + d.Hint
+	}
+	return s
+}
+
+// valid report output formats
+const (
+	FormatText  = "text"
+	FormatJSON  = "json"
+	FormatSARIF = "sarif"
+)
+
+// Report collects all the Diagnostics of a validation run.
+type Report struct {
+	// Source is the config file being validated
+	Source      string       `json:"source,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+
+	// rule and severity are used by Addf for the validator currently running
+	rule     string
+	severity Severity
+}
+
+// NewReport return an empty report for the config file source.
+func NewReport(source string) *Report {
+	return &Report{Source: source, Diagnostics: []Diagnostic{}}
+}
+
+// Addf adds a diagnostic at path for the running validator, hint can be empty.
+func (r *Report) Addf(path, hint, format string, args ...interface{}) {
+	r.Diagnostics = append(r.Diagnostics, Diagnostic{
+		Severity: r.severity,
+		Rule:     r.rule,
+		Path:     path,
+		Message:  fmt.Sprintf(format, args...),
+		Hint:     hint,
+	})
+}
+
+// Add adds the diagnostic d, for the problems not found by a validator, e.g loading the spec.
+func (r *Report) Add(d Diagnostic) {
+	r.Diagnostics = append(r.Diagnostics, d)
+}
+
+// Count return the number of diagnostics with severity s.
+func (r *Report) Count(s Severity) int {
+	n := 0
+	for _, d := range r.Diagnostics {
+		if d.Severity == s {
+			n++
+		}
+	}
+	return n
+}
+
+// HasErrors return true if there is any diagnostic with SeverityError.
+func (r *Report) HasErrors() bool {
+	return r.Count(SeverityError) != 0
+}
+
+// Write outputs the report to w in format, one of FormatText, FormatJSON and FormatSARIF.
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "", FormatText:
+		return r.writeText(w)
+	case FormatJSON:
+		return writeJSON(w, r)
+	case FormatSARIF:
+		return writeJSON(w, r.sarif())
+	}
+	return fmt.Errorf("unknown report format %s, use one of %s, %s, %s",
+		format, FormatText, FormatJSON, FormatSARIF)
+}
+
+// file return the file the diagnostic is in, "" if unknown
+func (r *Report) file(d Diagnostic) string {
+	if d.File != "" {
+		return d.File
+	}
+	return r.Source
+}
+
+func (r *Report) writeText(w io.Writer) error {
+	for _, d := range r.Diagnostics {
+		prefix := ""
+		if f := r.file(d); f != "" {
+			prefix = filepath.Base(f)
+			if d.Line != 0 {
+				prefix += fmt.Sprintf(":%d:%d", d.Line, d.Column)
+			}
+			prefix += ": "
+		}
+		if _, err := fmt.Fprintf(w, "%s%s\n", prefix, d); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d error(s), %d warning(s)\n",
+		r.Count(SeverityError), r.Count(SeverityWarning))
+	return err
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// The minimal subset of SARIF 2.1.0 [1] needed to be picked up by the CI.
+// [1] https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation *sarifPhysicalLocation `json:"physicalLocation,omitempty"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifLogicalLocation struct {
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+}
+
+func (r *Report) sarif() *sarifLog {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "avs",
+			InformationURI: "https://github.com/pierrchen/avs",
+			Rules:          []sarifRule{},
+		}},
+		Results: []sarifResult{},
+	}
+
+	seen := map[string]bool{}
+	for _, d := range r.Diagnostics {
+		if !seen[d.Rule] {
+			seen[d.Rule] = true
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: d.Rule})
+		}
+
+		msg := d.Message
+		if d.Hint != "" {
+			msg += " (hint: " + d.Hint + ")"
+		}
+		result := sarifResult{
+			RuleID:  d.Rule,
+			Level:   d.Severity.sarifLevel(),
+			Message: sarifMessage{Text: msg},
+		}
+
+		var loc sarifLocation
+		if f := r.file(d); f != "" {
+			loc.PhysicalLocation = &sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: filepath.Base(f)},
+			}
+			if d.Line != 0 {
+				loc.PhysicalLocation.Region = &sarifRegion{StartLine: d.Line, StartColumn: d.Column}
+			}
+		}
+		if d.Path != "" {
+			loc.LogicalLocations = []sarifLogicalLocation{{FullyQualifiedName: d.Path}}
+		}
+		if loc.PhysicalLocation != nil || loc.LogicalLocations != nil {
+			result.Locations = []sarifLocation{loc}
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	return &sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+}
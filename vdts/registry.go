@@ -0,0 +1,153 @@
+package vdts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pierrchen/avs/spec"
+	"github.com/pierrchen/avs/utils"
+)
+
+// Stage is when a rule runs, relative to the generation.
+type Stage int
+
+// valid stages
+const (
+	// StagePreGen rules check the spec and the files it refers to, before anything is generated.
+	StagePreGen Stage = iota
+	// StagePostGen rules check the files generated from the spec.
+	StagePostGen
+	// StageImages rules check the images built from the spec, they are run by ValidateImages
+	// only, with the product out dir in place of the device dir.
+	StageImages
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StagePostGen:
+		return "post-gen"
+	case StageImages:
+		return "images"
+	}
+	return "pre-gen"
+}
+
+// Rule is a validation rule. Rules are registered with Register and looked up by ID.
+type Rule struct {
+	// ID is the unique name of the rule, e.g "partitions"
+	ID          string
+	Description string
+	// Severity is the default severity of what the rule reports,
+	// SeverityOff disables the rule unless it is enabled by a RuleConfig.
+	Severity Severity
+	Stage    Stage
+	Check    IVal
+}
+
+var registry = map[string]Rule{}
+
+// Register makes a rule available to the validation. Vendors can compile in their own
+// rules by calling it from an init function. It panics if the rule is incomplete or
+// the ID is already registered.
+func Register(r Rule) {
+	if r.ID == "" || r.Check == nil {
+		panic("vdts: Register rule without ID or Check")
+	}
+	if _, dup := registry[r.ID]; dup {
+		panic("vdts: Register called twice for rule " + r.ID)
+	}
+	registry[r.ID] = r
+}
+
+// Rules return all the registered rules, sorted by stage and then ID.
+func Rules() []Rule {
+	var rules []Rule
+	for _, r := range registry {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Stage != rules[j].Stage {
+			return rules[i].Stage < rules[j].Stage
+		}
+		return rules[i].ID < rules[j].ID
+	})
+	return rules
+}
+
+// RuleConfig overrides the default severity of rules, by rule ID.
+// Setting a rule to SeverityOff disables it.
+type RuleConfig map[string]Severity
+
+// rcFileName is the per user ($HOME) or per device (device dir) rule config file.
+// It has the same format as spec.Validation, e.g {"rules": {"kernel-dtb": "warning"}}
+const rcFileName = ".avsrc"
+
+// LoadRuleConfig merges, in order, the rule configs from $HOME/.avsrc, deviceDir/.avsrc
+// and the validation section of the spec. The later wins.
+func LoadRuleConfig(deviceDir string, s *spec.Spec) (RuleConfig, error) {
+	cfg := RuleConfig{}
+
+	var rcFiles []string
+	if home := os.Getenv("HOME"); home != "" {
+		rcFiles = append(rcFiles, filepath.Join(home, rcFileName))
+	}
+	rcFiles = append(rcFiles, filepath.Join(deviceDir, rcFileName))
+
+	for _, f := range rcFiles {
+		if r, _ := utils.FileExists(f); r == false {
+			continue
+		}
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var v spec.Validation
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+		if err := cfg.merge(&v); err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+	}
+
+	if s != nil && s.Validation != nil {
+		if err := cfg.merge(s.Validation); err != nil {
+			return nil, fmt.Errorf("validation: %s", err)
+		}
+	}
+	return cfg, nil
+}
+
+func (c RuleConfig) merge(v *spec.Validation) error {
+	for id, name := range v.Rules {
+		sev, err := ParseSeverity(name)
+		if err != nil {
+			return fmt.Errorf("rule %s: %s", id, err)
+		}
+		c[id] = sev
+	}
+	return nil
+}
+
+// severity return the effective severity of rule r
+func (c RuleConfig) severity(r Rule) Severity {
+	if s, ok := c[r.ID]; ok {
+		return s
+	}
+	return r.Severity
+}
+
+// ParseSeverity return the Severity by its name, "off", "info", "warning" or "error".
+func ParseSeverity(name string) (Severity, error) {
+	for s, n := range severityNames {
+		if n == strings.ToLower(name) {
+			return s, nil
+		}
+	}
+	return SeverityOff, fmt.Errorf("unknown severity %q", name)
+}
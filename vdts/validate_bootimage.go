@@ -1,102 +1,386 @@
 package vdts
 
 import (
-	"errors"
 	"fmt"
 	"reflect"
 	"sort"
 
+	"github.com/pierrchen/avs/images"
 	"github.com/pierrchen/avs/spec"
 	"github.com/pierrchen/avs/utils"
 )
 
-func validateBootImage(spec *spec.Spec, absDeviceDir string) (err error) {
-	return validateAll(spec, absDeviceDir, []IVal{
-		//validatKernelDTB,
-		validateRootfs,
-		validateParititions,
-		validateMkBootImgArgs,
+func init() {
+	Register(Rule{
+		ID:          "kernel-dtb",
+		Description: "kernel command line is set, and the kernel Image and dtb exist",
+		Severity:    SeverityOff,
+		Stage:       StagePreGen,
+		Check:       validatKernelDTB,
+	})
+	Register(Rule{
+		ID:          "kernel-configs",
+		Description: "the kernel configs meet the requirements of the Android version, the HALs and the config_fragments",
+		Severity:    SeverityWarning,
+		Stage:       StagePreGen,
+		Check:       validateKernelConfigs,
+	})
+	Register(Rule{
+		ID:          "rootfs-initrc",
+		Description: "every rootfs init.rc has a file or a name",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateRootfs,
+	})
+	Register(Rule{
+		ID:          "rootfs-initrc-ignored",
+		Description: "rootfs init.rc with a file has no embedded attributes, they are ignored",
+		Severity:    SeverityWarning,
+		Stage:       StagePreGen,
+		Check:       validateRootfsIgnored,
+	})
+	Register(Rule{
+		ID:          "rootfs-initrc-files",
+		Description: "every rootfs init.rc exists in the device directory",
+		Severity:    SeverityWarning,
+		Stage:       StagePostGen,
+		Check:       validateRootfsFiles,
+	})
+	Register(Rule{
+		ID:          "partitions",
+		Description: "the partition table declares system, userdata and cache",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateParititions,
+	})
+	Register(Rule{
+		ID:          "partition-sizes",
+		Description: "the partition sizes are valid and multiples of the flash block size",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validatePartitionSizes,
+	})
+	Register(Rule{
+		ID:          "partition-layout",
+		Description: "the partitions, aligned to the flash block size, don't overlap and fit in the storage",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validatePartitionLayout,
+	})
+	Register(Rule{
+		ID:          "partition-min-sizes",
+		Description: "system, vendor, userdata and cache are large enough for Android",
+		Severity:    SeverityWarning,
+		Stage:       StagePreGen,
+		Check:       validatePartitionMinSizes,
+	})
+	Register(Rule{
+		ID:          "fstab-mounts",
+		Description: "fstab mounts exactly the partitions of the partition table",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateFstabMounts,
+	})
+	Register(Rule{
+		ID:          "mkbootimg-args",
+		Description: "mkbootimg load addresses are either all set or all default",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateMkBootImgArgs,
 	})
 }
 
-func validatKernelDTB(spec *spec.Spec, absDeviceDir string) error {
-	if spec.BootImage.Kernel == nil {
-		return errors.New("must have KernelConfig")
+func validatKernelDTB(spec *spec.Spec, absDeviceDir string, r *Report) {
+	k := spec.BootImage.Kernel
+	if k.CmdLine == "" {
+		r.Addf("boot_image.kernel.cmd_line", "", "must have kernel command line")
 	}
 
-	if spec.BootImage.Kernel.CmdLine == "" {
-		return errors.New("must have kernel command line")
+	// check if kernel and dtb exsit
+	if err := validateCopySrc(k.LocalKernel, absDeviceDir); err != nil {
+		r.Addf("boot_image.kernel.local_kernel", "", "can't find kernel Image %s", k.LocalKernel)
 	}
 
-	// check if kernel and dtb exsit, just print warning
-	if err := validateCopySrc(spec.BootImage.Kernel.LocalKernel, absDeviceDir); err != nil {
-		fmt.Printf("[avs v] can't find kernel Image %s\n", spec.BootImage.Kernel.LocalKernel)
+	if err := validateCopySrc(k.LocalDTB, absDeviceDir); err != nil {
+		r.Addf("boot_image.kernel.local_dtb", "", "can't find dtb Image %s", k.LocalDTB)
 	}
+}
+
+// validateKernelConfigs extracts the configs from the kernel, and checks them against the
+// requirements of the Android version, the HALs, the usb gadget and the config_fragments
+func validateKernelConfigs(s *spec.Spec, absDeviceDir string, r *Report) {
+	k := s.BootImage.Kernel
+	path := "boot_image.kernel.local_kernel"
 
-	if err := validateCopySrc(spec.BootImage.Kernel.LocalDTB, absDeviceDir); err != nil {
-		fmt.Printf("[avs v] can't find dtb Image %s\n", spec.BootImage.Kernel.LocalDTB)
+	var fragments []images.KconfigFragment
+	if s.Version != nil && s.Version.Android != "" {
+		f, err := images.AndroidKconfigFragment(s.Version.Android)
+		if err != nil {
+			r.Addf("version.android", "use the letter or the version, e.g Android O or 8.1", "%s", err)
+		} else {
+			fragments = append(fragments, f)
+		}
+	}
+	for _, h := range s.Hals {
+		if f, ok := images.FeatureKconfigFragment(h.Name); ok {
+			fragments = append(fragments, f)
+		}
+	}
+	if s.BoardConfig.USBGadget != nil {
+		f, _ := images.FeatureKconfigFragment("usb_gadget")
+		fragments = append(fragments, f)
+	}
+	for i, src := range k.ConfigFragments {
+		file, ok := copySrcPath(src, absDeviceDir)
+		if !ok {
+			continue
+		}
+		f, err := images.LoadKconfigFragment(file)
+		if err != nil {
+			r.Addf(fmt.Sprintf("boot_image.kernel.config_fragments[%d]", i), "", "%s", err)
+			continue
+		}
+		fragments = append(fragments, f)
 	}
 
-	return nil
+	kernel, ok := copySrcPath(k.LocalKernel, absDeviceDir)
+	if !ok || len(fragments) == 0 {
+		return
+	}
+	if exists, _ := utils.FileExists(kernel); !exists {
+		r.Addf(path, "build the kernel first", "%s doesn't exist, can't check the kernel configs", kernel)
+		return
+	}
+	ki := images.Kernel{ImagePath: kernel}
+	configs, err := ki.ConfigMap()
+	if err != nil {
+		r.Addf(path, "build the kernel with CONFIG_IKCONFIG=y", "can't get the kernel configs: %s", err)
+		return
+	}
+	for _, m := range images.CheckKconfig(configs, fragments...) {
+		r.Addf(path, "", "%s", m)
+	}
 }
 
-func validateRootfs(spec *spec.Spec, absDeviceDir string) error {
-	for _, rc := range spec.BootImage.Rootfs.InitRc {
+// rcName return the name of the rc script, or "" if it has none
+func rcName(rc *spec.RcScripts) string {
+	if rc.File != "" {
+		return rc.File
+	}
+	return rc.Name
+}
+
+func validateRootfs(spec *spec.Spec, absDeviceDir string, r *Report) {
+	for i, rc := range spec.BootImage.Rootfs.InitRc {
+		if rcName(&rc) == "" {
+			r.Addf(fmt.Sprintf("boot_image.rootfs_overlay.init.rc[%d]", i),
+				"set either file or name", "rc file don't have a name")
+		}
+	}
+}
+
+func validateRootfsIgnored(spec *spec.Spec, absDeviceDir string, r *Report) {
+	for i, rc := range spec.BootImage.Rootfs.InitRc {
 		if rc.File != "" &&
 			(rc.Name != "" || rc.Actions != nil || rc.Imports != nil || rc.Services != nil) {
-			fmt.Printf("rc.File (%s) is not empty, all other other attribute will be ignored\n", rc.File)
+			r.Addf(fmt.Sprintf("boot_image.rootfs_overlay.init.rc[%d].file", i),
+				"remove the other attributes, or the file to embed the script",
+				"rc.File (%s) is not empty, all other other attribute will be ignored", rc.File)
 		}
+	}
+}
 
-		rcName := rc.File
-		if rcName == "" {
-			rcName = rc.Name
+func validateRootfsFiles(spec *spec.Spec, absDeviceDir string, r *Report) {
+	for i, rc := range spec.BootImage.Rootfs.InitRc {
+		name := rcName(&rc)
+		if name == "" {
+			continue
 		}
-		if rcName == "" {
-			fmt.Printf("[avs v] rc file don't have a name")
-			break
+		if err := validateCopySrc("$(LOCAL_PATH)/"+name, absDeviceDir); err != nil {
+			r.Addf(fmt.Sprintf("boot_image.rootfs_overlay.init.rc[%d]", i),
+				"run avs update to generate it", "can't find rc file %s", name)
 		}
-		if err := validateCopySrc("$(LOCAL_PATH)/"+rcName, absDeviceDir); err != nil {
-			fmt.Printf("[avs v] can't find rc file %s\n", rcName)
+	}
+}
+
+// required partitions, with the name used in the partition table
+var requiredPartitions = []string{"system", "userdata", "cache"}
+
+// - BoardConfig.PartitionTable.Partitions
+// Must contain at least 3 partitions (system, userdata, cache)
+func validateParititions(spec *spec.Spec, absDeviceDir string, r *Report) {
+	var parts []string
+	for _, p := range spec.BoardConfig.PartitionTable.Partitions {
+		parts = append(parts, p.Name)
+	}
+
+	if utils.IncludedIn(requiredPartitions, parts) != true {
+		r.Addf("boardConfig.partition_table.partitions",
+			fmt.Sprintf("declare at least %v", requiredPartitions),
+			"missing partitions table declaration, has only %v", parts)
+	}
+}
+
+// the smallest partitions Android fits in
+var minPartitionSizes = map[string]int64{
+	spec.SYSTEM: 256 << 20,
+	spec.VENDOR: 32 << 20,
+	spec.DATA:   256 << 20,
+	spec.CACHE:  16 << 20,
+}
+
+const sizeHint = "e.g 1073741824, 0x40000000 or 1G"
+
+// - BoardConfig.PartitionTable
+// The flash block size is a multiple of the 512 bytes sector, the storage size, the partition
+// sizes and offsets are valid, and the partition sizes are multiples of the flash block size.
+func validatePartitionSizes(s *spec.Spec, absDeviceDir string, r *Report) {
+	pt := &s.BoardConfig.PartitionTable
+	block, err := pt.FlashBockSize.Bytes()
+	if err != nil {
+		r.Addf("boardConfig.partition_table.flash_block_size", sizeHint, "%s", err)
+	} else if block == 0 || block%512 != 0 {
+		r.Addf("boardConfig.partition_table.flash_block_size", "",
+			"flash block size %d is not a multiple of 512", block)
+		block = 0
+	}
+	if pt.StorageSize != "" {
+		if _, err := pt.StorageSize.Bytes(); err != nil {
+			r.Addf("boardConfig.partition_table.storage_size", sizeHint, "%s", err)
 		}
 	}
 
-	return nil
+	for i, p := range pt.Partitions {
+		path := fmt.Sprintf("boardConfig.partition_table.partitions[%d]", i)
+		if p.Offset != "" {
+			if _, err := p.Offset.Bytes(); err != nil {
+				r.Addf(path+".offset", sizeHint, "%s", err)
+			}
+		}
+		size, err := p.Size.Bytes()
+		if err != nil {
+			r.Addf(path+".size", sizeHint, "%s", err)
+			continue
+		}
+		if size == 0 {
+			r.Addf(path+".size", "", "partition %s is empty", p.Name)
+		} else if block != 0 && size%block != 0 {
+			r.Addf(path+".size", fmt.Sprintf("use %d or %d", size/block*block, (size/block+1)*block),
+				"partition %s size %d is not a multiple of the flash block size %d", p.Name, size, block)
+		}
+	}
 }
 
-// - BoardConfig.PartitionTable.Partitions
-// - BootImage.Rootfs.Fstab
-// Must contain at least 3 partitions (system, userdata, cache) and they must be in sync (e.g type)
-func validateParititions(spec *spec.Spec, absDeviceDir string) error {
+// partitionTableArgs return the args to create the partition table of the spec
+func partitionTableArgs(s *spec.Spec) (*images.PartitionTableArgs, error) {
+	pt := &s.BoardConfig.PartitionTable
+	a := images.PartitionTableArgs{Scheme: pt.Scheme}
+	if s.Product != nil {
+		a.Seed = s.Product.Device
+	}
+
+	var err error
+	if a.Alignment, err = pt.FlashBockSize.Bytes(); err != nil {
+		return nil, fmt.Errorf("flash_block_size: %s", err)
+	}
+	if pt.StorageSize != "" {
+		if a.DiskSize, err = pt.StorageSize.Bytes(); err != nil {
+			return nil, fmt.Errorf("storage_size: %s", err)
+		}
+	}
+	for _, p := range pt.Partitions {
+		args := images.PartitionArgs{Name: p.Name, TypeGUID: p.TypeGUID}
+		if args.Size, err = p.Size.Bytes(); err != nil {
+			return nil, fmt.Errorf("partition %s: %s", p.Name, err)
+		}
+		if p.Offset != "" {
+			if args.Offset, err = p.Offset.Bytes(); err != nil {
+				return nil, fmt.Errorf("partition %s: offset: %s", p.Name, err)
+			}
+		}
+		a.Partitions = append(a.Partitions, args)
+	}
+	return &a, nil
+}
+
+// PartitionLayout return where the partitions of the spec are on the storage
+func PartitionLayout(s *spec.Spec) (*images.PartitionLayout, error) {
+	a, err := partitionTableArgs(s)
+	if err != nil {
+		return nil, err
+	}
+	return a.Layout()
+}
 
-	P := []string{"system", "userdata", "cache"}
+// - BoardConfig.PartitionTable
+// The partitions can be laid out by the scheme, don't overlap, and fit in the storage if its
+// size is known. gpt needs the size for the backup GPT at the end of the storage.
+func validatePartitionLayout(s *spec.Spec, absDeviceDir string, r *Report) {
+	pt := &s.BoardConfig.PartitionTable
+	if pt.Scheme == "" {
+		return
+	}
+	if pt.Scheme == spec.GPT && pt.StorageSize == "" {
+		r.Addf("boardConfig.partition_table.storage_size", sizeHint,
+			"gpt needs the storage size, the backup GPT is at the end of the storage")
+		return
+	}
+	if _, err := PartitionLayout(s); err != nil {
+		r.Addf("boardConfig.partition_table", "see avs partition-table", "%s", err)
+	}
+}
+
+// - BoardConfig.PartitionTable.Partitions
+// system, vendor, userdata and cache are at least minPartitionSizes.
+func validatePartitionMinSizes(s *spec.Spec, absDeviceDir string, r *Report) {
+	for i, p := range s.BoardConfig.PartitionTable.Partitions {
+		least, ok := minPartitionSizes[p.Name]
+		if !ok {
+			continue
+		}
+		// invalid ones are reported by partition-sizes
+		if size, err := p.Size.Bytes(); err == nil && size < least {
+			r.Addf(fmt.Sprintf("boardConfig.partition_table.partitions[%d].size", i),
+				fmt.Sprintf("use at least %d", least),
+				"partition %s of %d bytes is too small, the minimum is %d", p.Name, size, least)
+		}
+	}
+}
 
+// - BoardConfig.PartitionTable.Partitions
+// - BootImage.Rootfs.Fstab
+// fstab must mount the required partitions and be in sync with the partition table.
+func validateFstabMounts(spec *spec.Spec, absDeviceDir string, r *Report) {
 	var parts []string
 	for _, p := range spec.BoardConfig.PartitionTable.Partitions {
 		parts = append(parts, p.Name)
 	}
 
-	if utils.IncludedIn(P, parts) != true {
-		fmt.Printf("missing partitions table declaration, has only %v, need at least %v\n", parts, P)
-	}
-
 	var mounts []string
-	for _, m := range spec.BootImage.Rootfs.Fstab.Mounts {
-
+	for i, m := range spec.BootImage.Rootfs.Fstab.Mounts {
 		// ignore the "auto", which are managed by volume managers
 		// usually for usb and sdcard
-		if m.Dst != "auto" {
-			// remove the leading '/' in Dst
-			p := m.Dst[1:]
-			// same partition
-			if p == "data" {
-				p = "userdata"
-			}
-			mounts = append(mounts, p)
+		if m.Dst == "auto" {
+			continue
+		}
+		if len(m.Dst) < 2 || m.Dst[0] != '/' {
+			r.Addf(fmt.Sprintf("boot_image.rootfs_overlay.fstab.mounts[%d].dst", i),
+				"use an absolute mount point, e.g /system", "invalid mount point %q", m.Dst)
+			continue
+		}
+		// remove the leading '/' in Dst
+		p := m.Dst[1:]
+		// same partition
+		if p == "data" {
+			p = "userdata"
 		}
+		mounts = append(mounts, p)
 	}
 
-	if utils.IncludedIn(P, mounts) != true {
-		fmt.Printf("missing partitions in fstab, has only %v, need at least %v\n", mounts, P)
+	if utils.IncludedIn(requiredPartitions, mounts) != true {
+		r.Addf("boot_image.rootfs_overlay.fstab.mounts",
+			fmt.Sprintf("mount at least %v", requiredPartitions),
+			"missing partitions in fstab, has only %v", mounts)
 	}
 
 	// very partition in the partition table must have correspoinding entry in fstab
@@ -104,22 +388,21 @@ func validateParititions(spec *spec.Spec, absDeviceDir string) error {
 	sort.Strings(mounts)
 
 	if !reflect.DeepEqual(parts, mounts) {
-		fmt.Printf("partitoins %v and mounts %s doesn't match.\n", parts, mounts)
+		r.Addf("boot_image.rootfs_overlay.fstab.mounts",
+			"every partition in boardConfig.partition_table needs a mount and vice versa",
+			"partitoins %v and mounts %v doesn't match", parts, mounts)
 	}
-
-	return nil
 }
 
-func validateMkBootImgArgs(spec *spec.Spec, absDeviceDir string) error {
+func validateMkBootImgArgs(spec *spec.Spec, absDeviceDir string, r *Report) {
 	args := spec.BootImage.Args
 	if args != nil && args.Lda != nil {
 		lda := args.Lda
 		if !((lda.LoadBase != "" && lda.KernelOffset != "" && lda.RamdiskOffset != "") ||
-			(lda.LoadBase == "" && lda.KernelOffset == "" && lda.RamdiskOffset == " ")) {
-			return fmt.Errorf("MkBootImageLoadArgsLoadAddress should either all default or has value")
+			(lda.LoadBase == "" && lda.KernelOffset == "" && lda.RamdiskOffset == "")) {
+			r.Addf("boot_image.args.load_addresses",
+				"set all of load_base, kernel_offset and ramdisk_offset, or remove load_addresses",
+				"MkBootImageLoadArgsLoadAddress should either all default or has value")
 		}
-		return nil
 	}
-
-	return nil
 }
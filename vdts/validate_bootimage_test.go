@@ -0,0 +1,162 @@
+package vdts
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pierrchen/avs/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeKernel writes an uncompressed kernel Image with the configs built in, none if configs
+// is ""
+func writeKernel(t *testing.T, path string, configs string) {
+	var buf bytes.Buffer
+	buf.WriteString("Linux version 4.19.157 (builder@build-host) #1 SMP PREEMPT\x00")
+	if configs != "" {
+		buf.WriteString("IKCFG_ST")
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(configs))
+		w.Close()
+		buf.WriteString("IKCFG_ED")
+	}
+	assert.Nil(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+}
+
+// androidOConfigs are the configs meet the android-base requirements of O
+const androidOConfigs = `
+# CONFIG_DEVKMEM is not set
+# CONFIG_DEVMEM is not set
+# CONFIG_FHANDLE is not set
+# CONFIG_NFSD is not set
+# CONFIG_NFS_FS is not set
+# CONFIG_SYSVIPC is not set
+# CONFIG_USELIB is not set
+CONFIG_ANDROID=y
+CONFIG_ANDROID_BINDER_IPC=y
+CONFIG_AUDIT=y
+CONFIG_BLK_DEV_INITRD=y
+CONFIG_CGROUPS=y
+CONFIG_CGROUP_CPUACCT=y
+CONFIG_CGROUP_FREEZER=y
+CONFIG_CGROUP_SCHED=y
+CONFIG_DEFAULT_SECURITY_SELINUX=y
+CONFIG_EMBEDDED=y
+CONFIG_HIGH_RES_TIMERS=y
+CONFIG_IKCONFIG=y
+CONFIG_IKCONFIG_PROC=y
+CONFIG_INOTIFY_USER=y
+CONFIG_IPV6=y
+CONFIG_MODULES=y
+CONFIG_NET=y
+CONFIG_NETFILTER=y
+CONFIG_PM_WAKELOCKS=y
+CONFIG_PREEMPT=y
+CONFIG_PROFILING=y
+CONFIG_QUOTA=y
+CONFIG_RTC_CLASS=y
+CONFIG_SECCOMP=y
+CONFIG_SECURITY=y
+CONFIG_SECURITY_NETWORK=y
+CONFIG_SECURITY_SELINUX=y
+CONFIG_STAGING=y
+CONFIG_TUN=y
+CONFIG_UNIX=y
+CONFIG_XFRM_USER=y
+CONFIG_ANDROID_LOW_MEMORY_KILLER=y
+CONFIG_ASHMEM=y
+CONFIG_ANDROID_BINDER_DEVICES="binder,hwbinder,vndbinder"
+CONFIG_HZ=100
+`
+
+func TestValidateKernelConfigs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vdts")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "hz.config"), []byte("CONFIG_HZ=250\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cfg80211.config"), []byte("CONFIG_CFG80211=y\n"), 0644)
+
+	for _, c := range []struct {
+		name      string
+		android   string
+		configs   string
+		hals      []string
+		usb       bool
+		fragments []string
+		want      []string
+	}{
+		{"android O", "O", androidOConfigs, nil, false, nil, nil},
+		{"nothing required", "", "", nil, false, nil, nil},
+		{"android 11", "11", androidOConfigs, nil, false, nil, []string{
+			"boot_image.kernel.local_kernel: CONFIG_BPF_SYSCALL is not set, android-base (r) requires y",
+			"boot_image.kernel.local_kernel: CONFIG_CGROUP_BPF is not set, android-base (r) requires y",
+			"boot_image.kernel.local_kernel: CONFIG_PSI is not set, android-base (r) requires y",
+			"boot_image.kernel.local_kernel: CONFIG_SECCOMP_FILTER is not set, android-base (r) requires y",
+		}},
+		{"unknown android", "Android Z", androidOConfigs, nil, false, nil, []string{
+			`version.android: unknown Android release "Android Z"`,
+		}},
+		{"hals", "O", androidOConfigs + "CONFIG_SND=y\n", []string{"audio", "wifi", "graphics"}, false, nil, []string{
+			"boot_image.kernel.local_kernel: CONFIG_CFG80211 is not set, wifi requires m",
+		}},
+		{"usb gadget", "O", androidOConfigs + "CONFIG_USB_GADGET=y\nCONFIG_USB_CONFIGFS=m\n", nil, true, nil, []string{
+			"boot_image.kernel.local_kernel: CONFIG_USB_CONFIGFS=m, usb_gadget requires y",
+			"boot_image.kernel.local_kernel: CONFIG_USB_CONFIGFS_F_FS is not set, usb_gadget requires y",
+		}},
+		{"config fragments", "", androidOConfigs, nil, false,
+			[]string{"$(LOCAL_PATH)/hz.config", "$(LOCAL_PATH)/missing.config"}, []string{
+				"boot_image.kernel.config_fragments[1]: open " + filepath.Join(dir, "missing.config") + ": no such file or directory",
+				"boot_image.kernel.local_kernel: CONFIG_HZ=100, " + filepath.Join(dir, "hz.config") + " requires 250",
+			}},
+		{"hal m doesn't relax the fragment y", "", androidOConfigs + "CONFIG_CFG80211=m\n", []string{"wifi"}, false,
+			[]string{"$(LOCAL_PATH)/cfg80211.config"}, []string{
+				"boot_image.kernel.local_kernel: CONFIG_CFG80211=m, " + filepath.Join(dir, "cfg80211.config") + " requires y",
+			}},
+		{"no IKCONFIG", "O", "", nil, false, nil, []string{
+			"boot_image.kernel.local_kernel: can't get the kernel configs: " + filepath.Join(dir, "Image") +
+				": no kernel config, is it built with CONFIG_IKCONFIG?",
+		}},
+	} {
+		writeKernel(t, filepath.Join(dir, "Image"), c.configs)
+		s := &spec.Spec{
+			BoardConfig: &spec.BoardConfig{},
+			BootImage: &spec.BootImage{Kernel: &spec.Kernel{
+				LocalKernel:     "$(LOCAL_PATH)/Image",
+				ConfigFragments: c.fragments,
+			}},
+		}
+		if c.android != "" {
+			s.Version = &spec.Version{Android: c.android}
+		}
+		for _, h := range c.hals {
+			s.Hals = append(s.Hals, spec.HAL{Name: h})
+		}
+		if c.usb {
+			s.BoardConfig.USBGadget = &spec.USBGadget{}
+		}
+
+		var got []string
+		for _, d := range runRule(func(r *Report) { validateKernelConfigs(s, dir, r) }) {
+			got = append(got, d.Path+": "+d.Message)
+		}
+		assert.Equal(t, c.want, got, c.name)
+		if len(c.want) != len(got) {
+			t.Log(strings.Join(got, "\n"))
+		}
+	}
+
+	// the kernel isn't built
+	s := &spec.Spec{
+		Version:     &spec.Version{Android: "O"},
+		BoardConfig: &spec.BoardConfig{},
+		BootImage:   &spec.BootImage{Kernel: &spec.Kernel{LocalKernel: "$(LOCAL_PATH)/missing"}},
+	}
+	got := runRule(func(r *Report) { validateKernelConfigs(s, dir, r) })
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, "boot_image.kernel.local_kernel", got[0].Path)
+	assert.Equal(t, filepath.Join(dir, "missing")+" doesn't exist, can't check the kernel configs", got[0].Message)
+}
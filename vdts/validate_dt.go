@@ -0,0 +1,434 @@
+package vdts
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pierrchen/avs/images"
+	"github.com/pierrchen/avs/spec"
+	"github.com/pierrchen/avs/utils"
+)
+
+func init() {
+	Register(Rule{
+		ID:          "dt-crosscheck",
+		Description: "the dtb agrees with the HAL drivers, the mkbootimg load addresses and the kernel command line",
+		Severity:    SeverityWarning,
+		Stage:       StagePreGen,
+		Check:       validateDtCrosscheck,
+	})
+	Register(Rule{
+		ID:          "dtbo",
+		Description: "the dtbo entries are device trees and their id, rev and custom are numbers",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateDtbo,
+	})
+}
+
+// validateDtCrosscheck parses the Kernel.LocalDTB and checks the spec against it
+func validateDtCrosscheck(s *spec.Spec, genDir string, r *Report) {
+	k := s.BootImage.Kernel
+	if k == nil || k.LocalDTB == "" {
+		return
+	}
+	path, ok := copySrcPath(k.LocalDTB, genDir)
+	if !ok {
+		return
+	}
+	if exists, _ := utils.FileExists(path); !exists {
+		// reported by kernel-dtb
+		return
+	}
+	dtb := images.Dtb{ImagePath: path}
+	fdt, err := dtb.Fdt()
+	if err != nil {
+		r.Addf("boot_image.kernel.local_dtb", "", "can't parse dtb: %s", err)
+		return
+	}
+
+	validateDtDrivers(s, fdt, genDir, r)
+	validateDtMemory(s, fdt, r)
+	validateDtBootargs(s, fdt, r)
+}
+
+// dtCompatibles return the compatible strings in the device tree, true for the ones of any
+// enabled node
+func dtCompatibles(fdt *images.Fdt) map[string]bool {
+	compatibles := map[string]bool{}
+	fdt.Root.Walk(func(n *images.FdtNode) {
+		p := n.Property("compatible")
+		if p == nil {
+			return
+		}
+		strs, _ := p.Strings()
+		enabled := true
+		if status := n.Property("status"); status != nil {
+			v, _ := status.StringValue()
+			enabled = v == "okay" || v == "ok"
+		}
+		for _, c := range strs {
+			compatibles[c] = compatibles[c] || enabled
+		}
+	})
+	return compatibles
+}
+
+// moduleCompatibles return the compatible strings the kernel module matches, from the
+// of aliases in the .modinfo, e.g alias=of:N*T*Cvendor,deviceC*
+func moduleCompatibles(ko string) ([]string, error) {
+	f, err := elf.Open(ko)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sec := f.Section(".modinfo")
+	if sec == nil {
+		return nil, fmt.Errorf("%s has no .modinfo", ko)
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	var compatibles []string
+	seen := map[string]bool{}
+	for _, info := range strings.Split(string(data), "\x00") {
+		// of:N<name>T<type>C<compatible>, the name and the type are usually *
+		if !strings.HasPrefix(info, "alias=of:N") {
+			continue
+		}
+		t := strings.Index(info, "T")
+		if t < 0 {
+			continue
+		}
+		i := strings.Index(info[t:], "C")
+		if i < 0 {
+			continue
+		}
+		c := strings.TrimSuffix(info[t+i+1:], "C*")
+		// the wildcard is in the name if the driver matches by type only
+		if c == "" || c == "*" || seen[c] {
+			continue
+		}
+		seen[c] = true
+		compatibles = append(compatibles, c)
+	}
+	return compatibles, nil
+}
+
+// validateDtDrivers makes sure the device tree has an enabled node for each HAL driver that
+// matches the devices by compatible
+func validateDtDrivers(s *spec.Spec, fdt *images.Fdt, genDir string, r *Report) {
+	compatibles := dtCompatibles(fdt)
+	for i, h := range s.Hals {
+		if h.Drivers == nil {
+			continue
+		}
+		for j, d := range *h.Drivers {
+			path, ok := copySrcPath(d, genDir)
+			if !ok {
+				continue
+			}
+			if exists, _ := utils.FileExists(path); !exists {
+				// reported by hal-packages-copy
+				continue
+			}
+			want, err := moduleCompatibles(path)
+			if err != nil || len(want) == 0 {
+				continue
+			}
+
+			found, disabled := false, false
+			for _, c := range want {
+				enabled, ok := compatibles[c]
+				found = found || (ok && enabled)
+				disabled = disabled || (ok && !enabled)
+			}
+			if found {
+				continue
+			}
+			sort.Strings(want)
+			if disabled {
+				r.Addf(fmt.Sprintf("hals[%d].drivers[%d]", i, j),
+					"set status = \"okay\" for the device in the dts",
+					"the device of driver %s is disabled in the dtb", filepath.Base(d))
+			} else {
+				r.Addf(fmt.Sprintf("hals[%d].drivers[%d]", i, j),
+					"add the device to the dts, or remove the driver",
+					"no device in the dtb for driver %s, it matches %s",
+					filepath.Base(d), strings.Join(want, ", "))
+			}
+		}
+	}
+}
+
+// dtRegion is a range of the physical memory
+type dtRegion struct {
+	start, size uint64
+}
+
+func (m dtRegion) contains(addr uint64) bool {
+	return addr >= m.start && addr-m.start < m.size
+}
+
+// dtCells return the #address-cells and #size-cells of the node, 2 and 1 by default
+func dtCells(n *images.FdtNode) (int, int) {
+	addr, size := 2, 1
+	if p := n.Property("#address-cells"); p != nil {
+		if v, err := p.U32(); err == nil {
+			addr = int(v)
+		}
+	}
+	if p := n.Property("#size-cells"); p != nil {
+		if v, err := p.U32(); err == nil {
+			size = int(v)
+		}
+	}
+	return addr, size
+}
+
+// dtReg return the regions in the reg property of the node, the cells are of the parent
+func dtReg(n *images.FdtNode) []dtRegion {
+	p := n.Property("reg")
+	if p == nil || n.Parent == nil {
+		return nil
+	}
+	cells, err := p.Cells()
+	if err != nil {
+		return nil
+	}
+	addrCells, sizeCells := dtCells(n.Parent)
+	if addrCells+sizeCells == 0 || addrCells > 2 || sizeCells > 2 {
+		return nil
+	}
+
+	num := func(c []uint32) uint64 {
+		var v uint64
+		for _, x := range c {
+			v = v<<32 | uint64(x)
+		}
+		return v
+	}
+	var regions []dtRegion
+	for i := 0; i+addrCells+sizeCells <= len(cells); i += addrCells + sizeCells {
+		regions = append(regions, dtRegion{
+			start: num(cells[i : i+addrCells]),
+			size:  num(cells[i+addrCells : i+addrCells+sizeCells]),
+		})
+	}
+	return regions
+}
+
+// validateDtMemory makes sure the kernel and the ramdisk are loaded to the memory in the
+// device tree, and not to the reserved memory
+func validateDtMemory(s *spec.Spec, fdt *images.Fdt, r *Report) {
+	path := "boot_image.args.load_addresses"
+	base := uint64(images.DefaultLoadBaseAddr)
+	kernelOffset := uint64(images.DefaultKernelOffset)
+	ramdiskOffset := uint64(images.DefaultRamdiskOffset)
+	if args := s.BootImage.Args; args != nil && args.Lda != nil && args.Lda.LoadBase != "" {
+		lda := args.Lda
+		for _, v := range []struct {
+			name, value string
+			n           *uint64
+		}{
+			{"load_base", lda.LoadBase, &base},
+			{"kernel_offset", lda.KernelOffset, &kernelOffset},
+			{"ramdisk_offset", lda.RamdiskOffset, &ramdiskOffset},
+		} {
+			if v.value == "" {
+				// reported by mkbootimg-args
+				return
+			}
+			n, err := strconv.ParseUint(v.value, 0, 64)
+			if err != nil {
+				r.Addf(path+"."+v.name, "use a number, hex is 0x prefixed", "invalid %s %q", v.name, v.value)
+				return
+			}
+			*v.n = n
+		}
+	}
+
+	var memory, reserved []dtRegion
+	for _, n := range fdt.Root.Children {
+		if dt := n.Property("device_type"); dt != nil {
+			if v, _ := dt.StringValue(); v != "memory" {
+				continue
+			}
+			// the size is 0 if the bootloader fills it
+			for _, m := range dtReg(n) {
+				if m.size != 0 {
+					memory = append(memory, m)
+				}
+			}
+		}
+	}
+	if len(memory) == 0 {
+		return
+	}
+	for _, rsv := range fdt.Reserved {
+		reserved = append(reserved, dtRegion{rsv.Address, rsv.Size})
+	}
+	if rm := fdt.Root.Child("reserved-memory"); rm != nil {
+		for _, n := range rm.Children {
+			reserved = append(reserved, dtReg(n)...)
+		}
+	}
+
+	for _, l := range []struct {
+		name string
+		addr uint64
+	}{
+		{"kernel", base + kernelOffset},
+		{"ramdisk", base + ramdiskOffset},
+	} {
+		inMemory := false
+		for _, m := range memory {
+			inMemory = inMemory || m.contains(l.addr)
+		}
+		if !inMemory {
+			r.Addf(path, "change load_base to an address in the memory node of the dts",
+				"%s load address 0x%x is not in the memory of the dtb", l.name, l.addr)
+			continue
+		}
+		for _, m := range reserved {
+			if m.contains(l.addr) {
+				r.Addf(path, "change load_base or the offsets to avoid the reserved memory",
+					"%s load address 0x%x is in the reserved memory 0x%x-0x%x of the dtb",
+					l.name, l.addr, m.start, m.start+m.size)
+				break
+			}
+		}
+	}
+}
+
+// cmdlineParams return the values of the parameters by name, the ones without value are
+// set to ""
+func cmdlineParams(cmdline string) map[string][]string {
+	params := map[string][]string{}
+	for _, p := range strings.Fields(cmdline) {
+		kv := strings.SplitN(p, "=", 2)
+		v := ""
+		if len(kv) == 2 {
+			v = kv[1]
+		}
+		params[kv[0]] = append(params[kv[0]], v)
+	}
+	return params
+}
+
+// validateDtBootargs makes sure the /chosen/bootargs and the Kernel.CmdLine don't set the
+// same parameter to different values
+func validateDtBootargs(s *spec.Spec, fdt *images.Fdt, r *Report) {
+	chosen := fdt.Find("/chosen")
+	if chosen == nil || chosen.Property("bootargs") == nil {
+		return
+	}
+	bootargs, _ := chosen.Property("bootargs").StringValue()
+	dt := cmdlineParams(bootargs)
+	cmdline := cmdlineParams(s.BootImage.Kernel.CmdLine)
+
+	var names []string
+	for name := range cmdline {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dv, ok := dt[name]
+		if !ok {
+			continue
+		}
+		sv := cmdline[name]
+		if strings.Join(dv, " ") != strings.Join(sv, " ") {
+			r.Addf("boot_image.kernel.cmd_line",
+				"remove "+name+" from one of them, or make them the same",
+				"%s is %q in the command line but %q in the chosen/bootargs of the dtb",
+				name, strings.Join(sv, " "), strings.Join(dv, " "))
+		}
+	}
+}
+
+// dtboNumber parses the id, rev or custom of the dtbo entry, "" is 0
+func dtboNumber(v string) (uint32, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(v, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", v)
+	}
+	return uint32(n), nil
+}
+
+// dtboFields return the dtbo entry with the id, rev and custom parsed, without the dt
+func dtboFields(e *spec.DtboEntry) (images.DtboDt, error) {
+	var dt images.DtboDt
+	var err error
+	if dt.ID, err = dtboNumber(e.ID); err != nil {
+		return dt, fmt.Errorf("id: %s", err)
+	}
+	if dt.Rev, err = dtboNumber(e.Rev); err != nil {
+		return dt, fmt.Errorf("rev: %s", err)
+	}
+	if len(e.Custom) > len(dt.Custom) {
+		return dt, fmt.Errorf("custom: %d values, at most %d", len(e.Custom), len(dt.Custom))
+	}
+	for i, c := range e.Custom {
+		if dt.Custom[i], err = dtboNumber(c); err != nil {
+			return dt, fmt.Errorf("custom[%d]: %s", i, err)
+		}
+	}
+	return dt, nil
+}
+
+// readDtbo return the device tree in the file of the dtbo entry
+func readDtbo(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := images.ParseFdt(data); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return data, nil
+}
+
+// - BootImage.Dtbo
+// The entries are device trees, with valid id, rev and custom, and the page size is valid.
+func validateDtbo(s *spec.Spec, genDir string, r *Report) {
+	d := s.BootImage.Dtbo
+	if d == nil {
+		return
+	}
+	if d.PageSize != "" {
+		if n, err := d.PageSize.Bytes(); err != nil || n == 0 || n > 1<<32-1 {
+			r.Addf("boot_image.dtbo.page_size", "e.g 2048 or 4K", "invalid page size %q", string(d.PageSize))
+		}
+	}
+	if len(d.Entries) == 0 {
+		r.Addf("boot_image.dtbo.entries", "", "dtbo has no entries")
+	}
+	for i := range d.Entries {
+		e := &d.Entries[i]
+		path := fmt.Sprintf("boot_image.dtbo.entries[%d]", i)
+		if _, err := dtboFields(e); err != nil {
+			r.Addf(path, "e.g 1 or 0x10", "%s", err)
+		}
+		if e.File == "" {
+			r.Addf(path+".file", "", "no dtbo file")
+			continue
+		}
+		// an unknown ANDROID_BUILD_TOP is reported once by ValdiateSpec
+		if p, ok := copySrcPath(e.File, genDir); ok {
+			if _, err := readDtbo(p); err != nil {
+				r.Addf(path+".file", "", "%s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package vdts
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pierrchen/avs/images"
+	"github.com/pierrchen/avs/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeKo writes a kernel module, an ELF with only the .modinfo section of the infos
+func writeKo(t *testing.T, path string, infos ...string) {
+	modinfo := []byte(strings.Join(infos, "\x00") + "\x00")
+	shstrtab := []byte("\x00.modinfo\x00.shstrtab\x00")
+
+	hdrSize := binary.Size(elf.Header64{})
+	shoff := hdrSize + len(modinfo) + len(shstrtab)
+	shoff = (shoff + 7) / 8 * 8
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_AARCH64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(shoff),
+		Ehsize:    uint16(hdrSize),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     3,
+		Shstrndx:  2,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	buf.Write(modinfo)
+	buf.Write(shstrtab)
+	buf.Write(make([]byte, shoff-buf.Len()))
+	for _, s := range []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC), Off: uint64(hdrSize),
+			Size: uint64(len(modinfo)), Addralign: 1},
+		{Name: 10, Type: uint32(elf.SHT_STRTAB), Off: uint64(hdrSize + len(modinfo)),
+			Size: uint64(len(shstrtab)), Addralign: 1},
+	} {
+		binary.Write(&buf, binary.LittleEndian, s)
+	}
+	assert.Nil(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+}
+
+// testFdt return a device tree like the poplar one, with 2G of memory and an ethernet
+// device of the status
+func testFdt(ethernetStatus string) *images.Fdt {
+	root := &images.FdtNode{Properties: []images.FdtProperty{
+		{Name: "compatible", Value: []byte("hisilicon,hi3798cv200-poplar\x00")},
+		{Name: "#address-cells", Value: images.CellsValue(2)},
+		{Name: "#size-cells", Value: images.CellsValue(2)},
+	}}
+	root.AddChild("chosen", images.FdtProperty{Name: "bootargs", Value: []byte("console=ttyAMA0,115200 quiet\x00")})
+	root.AddChild("memory", images.FdtProperty{Name: "device_type", Value: []byte("memory\x00")},
+		images.FdtProperty{Name: "reg", Value: images.CellsValue(0, 0, 0, 0x80000000)})
+	rm := root.AddChild("reserved-memory",
+		images.FdtProperty{Name: "#address-cells", Value: images.CellsValue(1)},
+		images.FdtProperty{Name: "#size-cells", Value: images.CellsValue(1)})
+	rm.AddChild("tee@7000000", images.FdtProperty{Name: "reg", Value: images.CellsValue(0x7000000, 0x1000000)})
+	soc := root.AddChild("soc")
+	soc.AddChild("ethernet@f9840000",
+		images.FdtProperty{Name: "compatible", Value: []byte("hisilicon,hi3798cv200-gmac\x00hisilicon,hisi-gmac-v2\x00")},
+		images.FdtProperty{Name: "status", Value: []byte(ethernetStatus + "\x00")})
+	return &images.Fdt{Root: root, Reserved: []images.FdtReserve{{Address: 0x30000000, Size: 0x100000}}}
+}
+
+// runRule runs the check of the spec as the rule, and return the diagnostics
+func runRule(check func(*Report)) []Diagnostic {
+	r := NewReport("config.json")
+	r.rule, r.severity = "test", SeverityWarning
+	check(r)
+	return r.Diagnostics
+}
+
+func TestModuleCompatibles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vdts")
+	defer os.RemoveAll(dir)
+
+	ko := filepath.Join(dir, "gmac.ko")
+	writeKo(t, ko,
+		"license=GPL",
+		"alias=of:N*T*Chisilicon,hisi-gmac-v2C*",
+		"alias=of:N*T*Chisilicon,hisi-gmac-v2",
+		"alias=of:N*T*Chisilicon,hi3798cv200-gmac",
+		"alias=of:NethernetT*C*",
+		"alias=platform:hisi-gmac",
+		"depends=")
+	got, err := moduleCompatibles(ko)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hisilicon,hisi-gmac-v2", "hisilicon,hi3798cv200-gmac"}, got)
+
+	notElf := filepath.Join(dir, "not.ko")
+	ioutil.WriteFile(notElf, []byte("not an elf"), 0644)
+	_, err = moduleCompatibles(notElf)
+	assert.NotNil(t, err)
+}
+
+func TestDtReg(t *testing.T) {
+	for _, c := range []struct {
+		addrCells, sizeCells uint32
+		reg                  []uint32
+		want                 []dtRegion
+	}{
+		{2, 2, []uint32{0, 0x80000000, 0, 0x1000, 1, 0, 0, 0x2000},
+			[]dtRegion{{0x80000000, 0x1000}, {0x100000000, 0x2000}}},
+		{1, 1, []uint32{0x7000000, 0x1000000}, []dtRegion{{0x7000000, 0x1000000}}},
+		{2, 1, []uint32{0, 0x1000, 0x100}, []dtRegion{{0x1000, 0x100}}},
+		// a partial one is ignored
+		{1, 1, []uint32{0x1000, 0x100, 0x2000}, []dtRegion{{0x1000, 0x100}}},
+		{1, 0, []uint32{0x1000}, []dtRegion{{0x1000, 0}}},
+		{0, 0, []uint32{0x1000}, nil},
+		{3, 2, []uint32{0, 0, 0x1000, 0, 0x100}, nil},
+	} {
+		parent := &images.FdtNode{Properties: []images.FdtProperty{
+			{Name: "#address-cells", Value: images.CellsValue(c.addrCells)},
+			{Name: "#size-cells", Value: images.CellsValue(c.sizeCells)},
+		}}
+		n := parent.AddChild("node", images.FdtProperty{Name: "reg", Value: images.CellsValue(c.reg...)})
+		assert.Equal(t, c.want, dtReg(n), "%d %d %x", c.addrCells, c.sizeCells, c.reg)
+	}
+
+	// the default cells of the parent are 2 and 1
+	n := (&images.FdtNode{}).AddChild("node", images.FdtProperty{Name: "reg", Value: images.CellsValue(0, 0x1000, 0x100)})
+	assert.Equal(t, []dtRegion{{0x1000, 0x100}}, dtReg(n))
+	assert.Nil(t, dtReg(&images.FdtNode{Name: "root"}))
+}
+
+func TestValidateDtMemory(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		lda  *spec.MkBootImageLoadArgsLoadAddress
+		fdt  func(*images.Fdt)
+		want []string
+	}{
+		{"default", nil, nil, nil},
+		{"in memory", &spec.MkBootImageLoadArgsLoadAddress{LoadBase: "0x1000000", KernelOffset: "0x80000", RamdiskOffset: "0x2000000"}, nil, nil},
+		{"kernel reserved", &spec.MkBootImageLoadArgsLoadAddress{LoadBase: "0x7000000", KernelOffset: "0x80000", RamdiskOffset: "0x2000000"}, nil,
+			[]string{"kernel load address 0x7080000 is in the reserved memory 0x7000000-0x8000000 of the dtb"}},
+		{"memreserve", &spec.MkBootImageLoadArgsLoadAddress{LoadBase: "0x2f000000", KernelOffset: "0x80000", RamdiskOffset: "0x1000000"}, nil,
+			[]string{"ramdisk load address 0x30000000 is in the reserved memory 0x30000000-0x30100000 of the dtb"}},
+		{"out of memory", &spec.MkBootImageLoadArgsLoadAddress{LoadBase: "0x7ff00000", KernelOffset: "0x80000", RamdiskOffset: "0x1000000"}, nil,
+			[]string{"ramdisk load address 0x80f00000 is not in the memory of the dtb"}},
+		{"invalid", &spec.MkBootImageLoadArgsLoadAddress{LoadBase: "base", KernelOffset: "0x80000", RamdiskOffset: "0x1000000"}, nil,
+			[]string{`invalid load_base "base"`}},
+		{"partial, reported by mkbootimg-args", &spec.MkBootImageLoadArgsLoadAddress{LoadBase: "0x7000000"}, nil, nil},
+		{"no memory size", &spec.MkBootImageLoadArgsLoadAddress{LoadBase: "0x7ff00000", KernelOffset: "0x80000", RamdiskOffset: "0x1000000"},
+			func(f *images.Fdt) { f.Find("/memory").Properties[1].Value = images.CellsValue(0, 0, 0, 0) }, nil},
+	} {
+		s := &spec.Spec{BootImage: &spec.BootImage{Args: &spec.MkBootImageArgs{Lda: c.lda}}}
+		fdt := testFdt("okay")
+		if c.fdt != nil {
+			c.fdt(fdt)
+		}
+		var got []string
+		for _, d := range runRule(func(r *Report) { validateDtMemory(s, fdt, r) }) {
+			got = append(got, d.Message)
+		}
+		assert.Equal(t, c.want, got, c.name)
+	}
+}
+
+func TestValidateDtBootargs(t *testing.T) {
+	for _, c := range []struct {
+		cmdline string
+		want    []string
+	}{
+		{"", nil},
+		{"console=ttyAMA0,115200 quiet androidboot.hardware=poplar", nil},
+		{"console=ttyS0 quiet loglevel=7",
+			[]string{`console is "ttyS0" in the command line but "ttyAMA0,115200" in the chosen/bootargs of the dtb`}},
+		{"console=ttyAMA0,115200 console=tty0",
+			[]string{`console is "ttyAMA0,115200 tty0" in the command line but "ttyAMA0,115200" in the chosen/bootargs of the dtb`}},
+		{"quiet=1", []string{`quiet is "1" in the command line but "" in the chosen/bootargs of the dtb`}},
+	} {
+		s := &spec.Spec{BootImage: &spec.BootImage{Kernel: &spec.Kernel{CmdLine: c.cmdline}}}
+		var got []string
+		for _, d := range runRule(func(r *Report) { validateDtBootargs(s, testFdt("okay"), r) }) {
+			got = append(got, d.Message)
+		}
+		assert.Equal(t, c.want, got, c.cmdline)
+	}
+}
+
+func TestValidateDtCrosscheck(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vdts")
+	defer os.RemoveAll(dir)
+	writeKo(t, filepath.Join(dir, "gmac.ko"), "alias=of:N*T*Chisilicon,hisi-gmac-v2C*")
+	writeKo(t, filepath.Join(dir, "wifi.ko"), "alias=of:N*T*Cbrcm,bcm4329-fmacC*")
+	writeKo(t, filepath.Join(dir, "usb.ko"), "alias=usb:v0BDAp8179d*")
+
+	for _, c := range []struct {
+		status  string
+		drivers spec.Drivers
+		want    []string
+	}{
+		{"okay", spec.Drivers{"$(LOCAL_PATH)/gmac.ko", "$(LOCAL_PATH)/usb.ko", "$(LOCAL_PATH)/missing.ko"}, nil},
+		{"disabled", spec.Drivers{"$(LOCAL_PATH)/gmac.ko"},
+			[]string{"hals[0].drivers[0]: the device of driver gmac.ko is disabled in the dtb"}},
+		{"okay", spec.Drivers{"$(LOCAL_PATH)/usb.ko", "$(LOCAL_PATH)/wifi.ko"},
+			[]string{"hals[0].drivers[1]: no device in the dtb for driver wifi.ko, it matches brcm,bcm4329-fmac"}},
+	} {
+		dtb := filepath.Join(dir, "poplar.dtb")
+		assert.Nil(t, ioutil.WriteFile(dtb, testFdt(c.status).Bytes(), 0644))
+		drivers := c.drivers
+		s := &spec.Spec{
+			BootImage: &spec.BootImage{Kernel: &spec.Kernel{CmdLine: "quiet", LocalDTB: "$(LOCAL_PATH)/poplar.dtb"}},
+			Hals:      []spec.HAL{{Name: "ethernet", Drivers: &drivers}},
+		}
+		var got []string
+		for _, d := range runRule(func(r *Report) { validateDtCrosscheck(s, dir, r) }) {
+			got = append(got, d.Path+": "+d.Message)
+		}
+		assert.Equal(t, c.want, got, "%v", c.drivers)
+	}
+
+	// not a dtb
+	ioutil.WriteFile(filepath.Join(dir, "poplar.dtb"), []byte("not a dtb"), 0644)
+	s := &spec.Spec{BootImage: &spec.BootImage{Kernel: &spec.Kernel{LocalDTB: "$(LOCAL_PATH)/poplar.dtb"}}}
+	got := runRule(func(r *Report) { validateDtCrosscheck(s, dir, r) })
+	assert.Equal(t, 1, len(got))
+}
+
+func TestValidateDtbo(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vdts")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.dtbo"), testFdt("okay").Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.dtbo"), testFdt("disabled").Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "bad.dtbo"), []byte("not a dtb"), 0644)
+
+	for _, c := range []struct {
+		name string
+		dtbo spec.Dtbo
+		want []string
+	}{
+		{"valid", spec.Dtbo{Entries: []spec.DtboEntry{
+			{File: "$(LOCAL_PATH)/a.dtbo", ID: "0x10"},
+			{File: "$(LOCAL_PATH)/b.dtbo", ID: "0x10", Rev: "1", Custom: []string{"2", "0x3"}},
+		}}, nil},
+		{"no entries", spec.Dtbo{PageSize: "4K"}, []string{"boot_image.dtbo.entries: dtbo has no entries"}},
+		{"invalid", spec.Dtbo{PageSize: "page", Entries: []spec.DtboEntry{
+			{File: "$(LOCAL_PATH)/a.dtbo", ID: "board a"},
+			{File: "$(LOCAL_PATH)/a.dtbo", Custom: []string{"1", "2", "3", "4", "5"}},
+			{ID: "1"},
+		}}, []string{
+			`boot_image.dtbo.page_size: invalid page size "page"`,
+			`boot_image.dtbo.entries[0]: id: invalid number "board a"`,
+			"boot_image.dtbo.entries[1]: custom: 5 values, at most 4",
+			"boot_image.dtbo.entries[2].file: no dtbo file",
+		}},
+		{"not a dtb", spec.Dtbo{Entries: []spec.DtboEntry{{File: "$(LOCAL_PATH)/bad.dtbo"}}}, []string{
+			"boot_image.dtbo.entries[0].file: " + filepath.Join(dir, "bad.dtbo") + ": ",
+		}},
+	} {
+		dtbo := c.dtbo
+		s := &spec.Spec{BootImage: &spec.BootImage{Dtbo: &dtbo}}
+		var got []string
+		for _, d := range runRule(func(r *Report) { validateDtbo(s, dir, r) }) {
+			got = append(got, d.Path+": "+d.Message)
+		}
+		// the parse error follows the file
+		assert.Equal(t, len(c.want), len(got), c.name)
+		for i := 0; i < len(c.want) && i < len(got); i++ {
+			assert.True(t, strings.HasPrefix(got[i], c.want[i]), got[i])
+		}
+	}
+
+}
@@ -0,0 +1,47 @@
+package vdts
+
+import (
+	"fmt"
+
+	"github.com/pierrchen/avs/spec"
+)
+
+func init() {
+	Register(Rule{
+		ID:          "products",
+		Description: "product names are unique and build variants are eng, userdebug or user",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateProducts,
+	})
+}
+
+func validateBuildVariants(path string, variants []string, r *Report) {
+	for i, v := range variants {
+		switch v {
+		case spec.VariantEng, spec.VariantUserdebug, spec.VariantUser:
+		default:
+			r.Addf(fmt.Sprintf("%s.build_variants[%d]", path, i),
+				"use eng, userdebug or user", "unknown build variant %q", v)
+		}
+	}
+}
+
+// validateProducts validates the products generated from the device, the product makefiles
+// and lunch combos are named after them
+func validateProducts(s *spec.Spec, genDir string, r *Report) {
+	validateBuildVariants("product", s.Product.BuildVariants, r)
+
+	names := map[string]int{}
+	for i, p := range s.Products {
+		path := fmt.Sprintf("products[%d]", i)
+		if p.Name == "" {
+			r.Addf(path+".name", "", "product name is empty")
+		} else if j, ok := names[p.Name]; ok {
+			r.Addf(path+".name", fmt.Sprintf("products[%d] has the same name", j),
+				"duplicated product %q", p.Name)
+		}
+		names[p.Name] = i
+		validateBuildVariants(path, p.BuildVariants, r)
+	}
+}
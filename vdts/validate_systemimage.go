@@ -12,185 +12,201 @@ import (
 	"github.com/pierrchen/avs/utils"
 )
 
-// ValidateSystemImage valdiate if the HAL OK
-func ValidateSystemImage(spec *spec.Spec, genDir string) error {
-	return validateAll(spec, genDir, []IVal{
-		validateFeatureFiles,
-		validateHalRuntimeConfigs,
-		//validateHalPackagesBuild,
-		validateHalPackagesCopy,
-		validateHalInitRc,
+func init() {
+	Register(Rule{
+		ID:          "feature-files",
+		Description: "every board and HAL feature file exists in frameworks/native/data/etc",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateFeatureFiles,
+	})
+	Register(Rule{
+		ID:          "hal-runtime-configs",
+		Description: "every HAL runtime config file exists",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateHalRuntimeConfigs,
+	})
+	Register(Rule{
+		ID:          "hal-packages-build",
+		Description: "vendor packages (tagged :v) are modules of the HAL Android.mk",
+		Severity:    SeverityOff,
+		Stage:       StagePreGen,
+		Check:       validateHalPackagesBuild,
+	})
+	Register(Rule{
+		ID:          "hal-packages-copy",
+		Description: "every HAL copy package, firmware and driver exists",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateHalPackagesCopy,
+	})
+	Register(Rule{
+		ID:          "hal-initrc",
+		Description: "every HAL init.rc has either a file or a name",
+		Severity:    SeverityError,
+		Stage:       StagePreGen,
+		Check:       validateHalInitRc,
+	})
+	Register(Rule{
+		ID:          "hal-initrc-files",
+		Description: "every HAL init.rc exists in the device directory",
+		Severity:    SeverityWarning,
+		Stage:       StagePostGen,
+		Check:       validateHalInitRcFiles,
 	})
 }
 
 // validateHalInitRc validate the hal initrc
-func validateHalInitRc(s *spec.Spec, genDir string) error {
-	// pre-generation validation
-
-	var rcs []spec.RcScripts
-
-	for _, hal := range s.Hals {
-		if hal.InitRc != nil {
-			rcs = append(rcs, hal.InitRc...)
-		}
-	}
-
-	for _, rc := range rcs {
-		if (rc.File != "" && rc.Name != "") ||
-			(rc.File == "" && rc.Name == "") {
-			fmt.Printf("rc.File %v and rc.Name %s can't both empty or non-empty", rc.File, rc.Name)
+func validateHalInitRc(s *spec.Spec, genDir string, r *Report) {
+	for i, hal := range s.Hals {
+		for j, rc := range hal.InitRc {
+			if (rc.File != "" && rc.Name != "") ||
+				(rc.File == "" && rc.Name == "") {
+				r.Addf(fmt.Sprintf("hals[%d].init.rc[%d]", i, j),
+					"set file for an external script, or name for the generated one",
+					"rc.File %q and rc.Name %q can't both empty or non-empty", rc.File, rc.Name)
+			}
 		}
 	}
-	// post-generattion validation
+}
 
-	// making sure all the init.rc are generated
-	for _, rc := range rcs {
-		srcFile := rc.Name
-		if rc.File != "" {
-			srcFile = rc.File
-		}
-		srcFile = "$(LOCAL_PATH)/" + srcFile
-		err := validateCopySrc(srcFile, genDir)
-		if err != nil {
-			fmt.Printf("[avs v] can't find copy sources: %s\n", srcFile)
+// validateHalInitRcFiles makes sure all the init.rc are generated
+func validateHalInitRcFiles(s *spec.Spec, genDir string, r *Report) {
+	for i, hal := range s.Hals {
+		for j, rc := range hal.InitRc {
+			srcFile := "$(LOCAL_PATH)/" + rcName(&rc)
+			if err := validateCopySrc(srcFile, genDir); err != nil {
+				r.Addf(fmt.Sprintf("hals[%d].init.rc[%d]", i, j),
+					"run avs update to generate it", "can't find copy sources: %s", srcFile)
+			}
 		}
 	}
-
-	return nil
 }
 
 // validateHalPackagesCopy vaildiate the binary blob copy, including
 // the share libary, the firmware and the kernel drivers
-func validateHalPackagesCopy(spec *spec.Spec, genDir string) error {
-	var allCopyPkgs []string
-
-	for _, h := range spec.Hals {
-		if h.Packages != nil && h.Packages.Copy != nil {
-			for _, cp := range h.Packages.Copy {
-				allCopyPkgs = append(allCopyPkgs, cp.Src)
+func validateHalPackagesCopy(spec *spec.Spec, genDir string, r *Report) {
+	for i, h := range spec.Hals {
+		if h.Packages != nil {
+			for j, cp := range h.Packages.Copy {
+				if err := validateCopySrc(cp.Src, genDir); err != nil {
+					r.Addf(fmt.Sprintf("hals[%d].required_packages.copy[%d].src", i, j), "",
+						"can't find copy source %s", cp.Src)
+				}
 			}
 		}
 
 		if h.Firmwares != nil {
-			for _, f := range []string(*(h.Firmwares)) {
-				allCopyPkgs = append(allCopyPkgs, f)
+			for j, f := range *h.Firmwares {
+				if err := validateCopySrc(f, genDir); err != nil {
+					r.Addf(fmt.Sprintf("hals[%d].firmwares[%d]", i, j), "",
+						"can't find firmware %s", f)
+				}
 			}
 		}
 
 		if h.Drivers != nil {
-			for _, d := range []string(*(h.Drivers)) {
-				allCopyPkgs = append(allCopyPkgs, d)
+			for j, d := range *h.Drivers {
+				if err := validateCopySrc(d, genDir); err != nil {
+					r.Addf(fmt.Sprintf("hals[%d].drivers[%d]", i, j), "",
+						"can't find driver %s", d)
+				}
 			}
 		}
 	}
-
-	var invalid []string
-	for _, p := range allCopyPkgs {
-		if err := validateCopySrc(p, genDir); err != nil {
-			invalid = append(invalid, p)
-		}
-	}
-
-	if len(invalid) != 0 {
-		return fmt.Errorf("can't find copy sources: %v", invalid)
-	}
-	return nil
 }
 
-func validateHalRuntimeConfigs(spec *spec.Spec, genDir string) error {
-	var invalid []string
-	for _, h := range spec.Hals {
-		for _, c := range h.RuntimeConfigs {
+func validateHalRuntimeConfigs(spec *spec.Spec, genDir string, r *Report) {
+	for i, h := range spec.Hals {
+		for j, c := range h.RuntimeConfigs {
 			if err := validateCopySrc(c.Src, genDir); err != nil {
-				invalid = append(invalid, c.Src)
+				r.Addf(fmt.Sprintf("hals[%d].runtime_configs[%d].src", i, j), "",
+					"can't find copy source %s", c.Src)
 			}
 		}
 	}
-
-	if len(invalid) != 0 {
-		return fmt.Errorf("can't find copy sources: %v", invalid)
-	}
-	return nil
 }
 
 // validateFeatureFiles validate all the feautres files, it can be found in
 // either HAL declaration or BoardConfigs
-func validateFeatureFiles(sp *spec.Spec, genDir string) error {
-	var invalid []string
-
-	var allFeatures []spec.Feature
+func validateFeatureFiles(sp *spec.Spec, genDir string, r *Report) {
+	featureFileDir := "frameworks/native/data/etc/"
+	hint := "see " + featureFileDir + " for the valid features"
 
 	// fixed Board Features
-	for _, f := range sp.BoardConfig.BoardFeatures {
-		allFeatures = append(allFeatures, f)
-	}
-
-	// HAL features
-	for _, h := range sp.Hals {
-		for _, f := range h.Features {
-			allFeatures = append(allFeatures, f)
-		}
-	}
-
-	// validate all the feature files
-	featureFileDir := "frameworks/native/data/etc/"
-	for _, f := range allFeatures {
+	for i, f := range sp.BoardConfig.BoardFeatures {
 		if err := validateCopySrc(featureFileDir+string(f), genDir); err != nil {
-			invalid = append(invalid, featureFileDir+string(f))
+			r.Addf(fmt.Sprintf("boardConfig.board_features[%d]", i), hint,
+				"can't find features file %s", featureFileDir+string(f))
 		}
 	}
 
-	if len(invalid) != 0 {
-		return fmt.Errorf("can't find features files: %v", invalid)
+	// HAL features
+	for i, h := range sp.Hals {
+		for j, f := range h.Features {
+			if err := validateCopySrc(featureFileDir+string(f), genDir); err != nil {
+				r.Addf(fmt.Sprintf("hals[%d].features[%d]", i, j), hint,
+					"can't find features file %s", featureFileDir+string(f))
+			}
+		}
 	}
-	return nil
 }
 
+// copySrcPath return the file path of the copy source, and false if it is relative to
+// ${ANDROID_BUILD_TOP} which is not set.
 // path start with "$(LOCAL_PATH)" must in $genDir
 // all the other paths are relative the to ${ANDROID_BUILD_TOP}
-func validateCopySrc(src string, genDir string) error {
-	//	fmt.Printf("validate src copy %s\n", src)
+func copySrcPath(src string, genDir string) (string, bool) {
 	L := "$(LOCAL_PATH)"
 	if strings.HasPrefix(src, L) {
-		p := filepath.Join(genDir, src[len(L):])
-		if r, _ := utils.FileExists(p); r == false {
-			return fmt.Errorf("%s(:%s)dont't exsits", src, p)
-		}
-	} else {
-		androiTop := os.Getenv("ANDROID_BUILD_TOP")
-		if androiTop == "" {
-			fmt.Println("warning: ignore feature file validating, since ${ANDROID_BUILD_TOP} was not set")
-			return nil
-		}
+		return filepath.Join(genDir, src[len(L):]), true
+	}
+	androidTop := os.Getenv("ANDROID_BUILD_TOP")
+	if androidTop == "" {
+		return "", false
+	}
+	return filepath.Join(androidTop, src), true
+}
 
-		p := filepath.Join(androiTop, src)
-		if r, _ := utils.FileExists(p); r == false {
-			return fmt.Errorf("%s dont't exsits", p)
+// validateCopySrc return error if the copy source doesn't exist, see copySrcPath
+func validateCopySrc(src string, genDir string) error {
+	p, ok := copySrcPath(src, genDir)
+	if !ok {
+		// reported once by ValdiateSpec
+		return nil
+	}
+	if r, _ := utils.FileExists(p); r == false {
+		if strings.HasPrefix(src, "$(LOCAL_PATH)") {
+			return fmt.Errorf("%s(:%s)dont't exsits", src, p)
 		}
-
+		return fmt.Errorf("%s dont't exsits", p)
 	}
 	return nil
 }
 
-func validateHalPackagesBuild(spec *spec.Spec, genDir string) error {
-	for feature, vendorPackges := range GetVendorPackges(spec) {
+func validateHalPackagesBuild(spec *spec.Spec, genDir string, r *Report) {
+	for i, h := range spec.Hals {
+		vendorPackges := GetVendorPackges(spec)[h.Name]
+		if len(vendorPackges) == 0 {
+			continue
+		}
 		// TODO: What if there are multiply Android.mk for this feature HAL
 		// Or it is not in the location we assume
-		mk := filepath.Join(genDir, feature, "Android.mk")
-		if r, _ := utils.FileExists(mk); r == false {
-			return fmt.Errorf("can't find %s", mk)
+		mk := filepath.Join(genDir, h.Name, "Android.mk")
+		if exists, _ := utils.FileExists(mk); !exists {
+			r.Addf(fmt.Sprintf("hals[%d].required_packages.build", i), "", "can't find %s", mk)
+			continue
 		}
 
 		for _, module := range vendorPackges {
 			// make sure the Android.mk has a Model called with the name in check
-			if r, _ := HasModulesInFile(mk, module); r == true {
-				return nil
+			if has, _ := HasModulesInFile(mk, module); has != true {
+				r.Addf(fmt.Sprintf("hals[%d].required_packages.build", i), "",
+					"no moduel %s in %s", module, mk)
 			}
-			return fmt.Errorf("no moduel %s in %s", module, mk)
 		}
-
 	}
-	return nil
 }
 
 // HasModulesInFile test if there is a module in file
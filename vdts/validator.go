@@ -1,43 +1,132 @@
 // Package vdts validates the device config files.
+//
+// Validation is plugin based: every check is a Rule registered by ID, see Register.
+// The severity of each rule can be changed, or the rule disabled, per user or device
+// with a .avsrc file, or per device with the validation section of the config.json,
+// see LoadRuleConfig.
 package vdts
 
 import (
 	"errors"
-	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/pierrchen/avs/spec"
 )
 
-// IVal is the validator interface,
-type IVal func(spec *spec.Spec, genDir string) error
+// IVal is the validator interface, problems found are added to the Report r.
+type IVal func(spec *spec.Spec, genDir string, r *Report)
 
 // ValdiateSpec validates the spec, and it is the entry validator.
-// It validator not only the spec but also the artifact geneated from the spec
-// TODO: add validate stage1 and stage2, stage1 won't validate anything depend on
-// the generation
-func ValdiateSpec(spec *spec.Spec, absDeviceDir string) (err error) {
+// It validator not only the spec but also the artifact geneated from the spec, the
+// rules to run are selected by the stages, StagePreGen and StagePostGen when none is given.
+// The returned report is never nil, and error is non nil if the report has any error.
+func ValdiateSpec(spec *spec.Spec, absDeviceDir string, stages ...Stage) (*Report, error) {
+	r := NewReport(filepath.Join(absDeviceDir, "config.json"))
 	if spec == nil {
-		return errors.New("nil spec")
+		return r, errors.New("nil spec")
 	}
 
-	validateAll(spec, absDeviceDir, []IVal{
-		validateBootImage,
-		ValidateSystemImage})
-	return nil
-}
+	cfg, err := LoadRuleConfig(absDeviceDir, spec)
+	if err != nil {
+		return r, err
+	}
+
+	if len(stages) == 0 {
+		stages = []Stage{StagePreGen, StagePostGen}
+	}
 
-// validateAll is a helper function that will call all the validators pass in
-func validateAll(spec *spec.Spec, genDir string, validators []IVal) error {
-	var hasError bool
-	for _, v := range validators {
-		if err := v(spec, genDir); err != nil {
-			fmt.Println("[avs v]", err)
-			hasError = true
+	if os.Getenv("ANDROID_BUILD_TOP") == "" {
+		r.rule, r.severity = "env", SeverityInfo
+		r.Addf("", "source build/envsetup.sh in the Android tree first",
+			"${ANDROID_BUILD_TOP} was not set, files relative to it are not checked")
+	}
+
+	r.rule, r.severity = "rule-config", SeverityWarning
+	for id := range cfg {
+		if _, ok := registry[id]; !ok {
+			r.Addf("validation.rules", "run avs rules for all the rule IDs", "unknown rule %s", id)
 		}
 	}
-	if hasError {
-		return fmt.Errorf("validation failed")
+
+	// the rules assume the required parts are there, so it can't be disabled
+	r.rule, r.severity = "spec-required", SeverityError
+	validateRequired(spec, absDeviceDir, r)
+	if r.HasErrors() {
+		return r, errors.New("validation failed")
+	}
+
+	for _, stage := range stages {
+		validateAll(spec, absDeviceDir, r, cfg, stage)
+	}
+
+	if r.HasErrors() {
+		return r, errors.New("validation failed")
+	}
+	return r, nil
+}
+
+// ValidateImages checks the images built from the spec in outDir, the product out dir, e.g
+// out/target/product/poplar, with the rules of StageImages.
+// The returned report is never nil, and error is non nil if the report has any error.
+func ValidateImages(spec *spec.Spec, absDeviceDir string, outDir string) (*Report, error) {
+	r := NewReport(filepath.Join(absDeviceDir, "config.json"))
+	if spec == nil {
+		return r, errors.New("nil spec")
+	}
+	cfg, err := LoadRuleConfig(absDeviceDir, spec)
+	if err != nil {
+		return r, err
 	}
 
-	return nil
+	r.rule, r.severity = "spec-required", SeverityError
+	validateRequired(spec, absDeviceDir, r)
+	if !r.HasErrors() {
+		validateAll(spec, outDir, r, cfg, StageImages)
+	}
+	if r.HasErrors() {
+		return r, errors.New("images check failed")
+	}
+	return r, nil
+}
+
+// validateAll is a helper function that will call all the enabled rules of the stage
+func validateAll(spec *spec.Spec, genDir string, r *Report, cfg RuleConfig, stage Stage) {
+	for _, rule := range Rules() {
+		if rule.Stage != stage {
+			continue
+		}
+		r.rule, r.severity = rule.ID, cfg.severity(rule)
+		if r.severity == SeverityOff {
+			continue
+		}
+		rule.Check(spec, genDir, r)
+	}
+}
+
+// validateRequired makes sure the parts the generation can't live without are there
+func validateRequired(s *spec.Spec, genDir string, r *Report) {
+	if s.Product == nil {
+		r.Addf("product", "", "missing product")
+	}
+	if s.BoardConfig == nil {
+		r.Addf("boardConfig", "", "missing boardConfig")
+	}
+	if s.BootImage == nil {
+		r.Addf("boot_image", "", "missing boot_image")
+		return
+	}
+	if s.BootImage.Kernel == nil {
+		r.Addf("boot_image.kernel", "", "missing kernel")
+	}
+	if s.BootImage.Rootfs == nil {
+		r.Addf("boot_image.rootfs_overlay", "", "missing rootfs_overlay")
+		return
+	}
+	if s.BootImage.Rootfs.Fstab == nil {
+		r.Addf("boot_image.rootfs_overlay.fstab", "", "missing fstab")
+	}
+	if s.BootImage.Rootfs.UeventRc == nil {
+		r.Addf("boot_image.rootfs_overlay.uevent.rc", "", "missing uevent.rc")
+	}
 }